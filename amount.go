@@ -0,0 +1,642 @@
+/*
+Copyright 2022 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/milochristiansen/ledger/parse/lex"
+)
+
+// DefaultCommodity is the commodity used when writing an amount that does not have one.
+const DefaultCommodity = "$"
+
+// AmountStyle records how an amount was written so that it can be written back out the same way.
+// The zero value matches the classic output of this package: a leading commodity with no space and
+// two decimal places.
+type AmountStyle struct {
+	Suffix       bool // The commodity follows the number.
+	Spaced       bool // There is white space between the commodity and the number.
+	DecimalComma bool // A comma is the decimal mark and periods are used for digit grouping.
+	Thousands    bool // Digits are grouped by thousands.
+	SignFirst    bool // The minus sign of a negative amount comes before a leading commodity (-$5.00, not $-5.00).
+
+	// The number of decimal places to write. Zero means the default of two places and a negative number means
+	// no decimal places at all. There are never more than four decimal places.
+	Precision int
+}
+
+// Places returns the number of decimal places this style writes.
+func (s AmountStyle) Places() int {
+	switch {
+	case s.Precision == 0:
+		return 2
+	case s.Precision < 0:
+		return 0
+	case s.Precision > 4:
+		return 4
+	}
+	return s.Precision
+}
+
+// IsCommodityRune returns true if the given rune may appear in an unquoted commodity name. Any rune that isn't a
+// digit, white space, or one of a handful of punctuation marks with special meaning in a posting is allowed, so
+// multi-byte currency symbols like € work just as well as $.
+func IsCommodityRune(r rune) bool {
+	if unicode.IsDigit(r) || unicode.IsSpace(r) {
+		return false
+	}
+	return !strings.ContainsRune(".,;:?!-+*/^&|=<>[](){}@\"'#", r)
+}
+
+// IsCurrencyRune returns true if the rune is a currency symbol. Currency symbols are allowed to directly follow
+// a number as a commodity (like 5€), other commodities need a space (5 EUR).
+func IsCurrencyRune(r rune) bool {
+	return unicode.Is(unicode.Sc, r)
+}
+
+// ErrBadAmount is returned by SplitAmount for anything that isn't an amount.
+var ErrBadAmount = errors.New("Malformed amount.")
+
+// SplitAmount splits an amount into its number and commodity without converting the number, following the same
+// rules as the parser (see ScanAmount):
+//
+//   - The commodity may come before the number ($5.00, EUR 5.00) or after it (5.00 EUR, 5€), in which case prefix is
+//     false. Only a currency symbol may directly follow the number, anything else needs white space first.
+//   - A commodity is either a run of characters allowed by IsCommodityRune or a string in double quotes, the quotes
+//     are not included in the result.
+//   - A minus sign may be before or after a leading commodity (-$5.00 or $-5.00), but not both. It is kept at the
+//     front of numeric.
+//   - The number is any run of digits, periods, and commas. It is not checked beyond that, see ParseNumber.
+//
+// The commodity is empty if there isn't one. White space around the amount is ignored, anything else left over is
+// an ErrBadAmount.
+func SplitAmount(s string) (numeric, commodity string, prefix bool, err error) {
+	tok, ok := scanAll(strings.TrimSpace(s))
+	if !ok {
+		return "", "", false, ErrBadAmount
+	}
+	numeric = tok.Numeric
+	if tok.Negative {
+		numeric = "-" + numeric
+	}
+	return numeric, tok.Commodity, tok.Commodity != "" && !tok.Style.Suffix, nil
+}
+
+// ParseAmount reads an amount written the same way as in a posting ($1,000.00, -5 EUR, 20,00 €, etc), see
+// SplitAmount and ParseNumber for the rules. The style records how the amount was written. Returns ErrBadAmount if
+// the string is not a single valid amount.
+func ParseAmount(s string) (Amount, error) {
+	tok, ok := scanAll(strings.TrimSpace(s))
+	if !ok {
+		return Amount{}, ErrBadAmount
+	}
+	a := Amount{Commodity: tok.Commodity, Style: tok.Style}
+	v, ok := ParseNumber(tok.Numeric, &a.Style)
+	if !ok {
+		return Amount{}, ErrBadAmount
+	}
+	if tok.Negative {
+		v = -v
+	}
+	a.Value = v
+	return a, nil
+}
+
+// scanAll reads an amount with ScanAmount, returning false if there isn't one or if there is anything after it.
+func scanAll(s string) (AmountToken, bool) {
+	cr := lex.NewCharReader(s, 1)
+	tok, err := ScanAmount(cr, false)
+	if err != nil || tok.Numeric == "" {
+		return AmountToken{}, false
+	}
+	return tok, cr.EOF || cr.C == '\n' && cr.NEOF
+}
+
+// AmountToken is an amount read by ScanAmount, split into its parts but with the number not yet converted.
+type AmountToken struct {
+	Numeric   string       // The digits and marks of the number, without the sign. Empty if there was no amount.
+	Negative  bool         // There was a minus sign.
+	Commodity string       // Empty if there wasn't one.
+	Style     AmountStyle  // Only SignFirst, Spaced, and Suffix are filled in, the rest depends on the number.
+	L         lex.Location // Where the number starts.
+}
+
+// AmountSyntaxError is returned by ScanAmount and ScanCommodity if the amount is not written correctly. End is true
+// if the input ran out before the amount did.
+type AmountSyntaxError struct {
+	L   lex.Location
+	End bool
+}
+
+func (err AmountSyntaxError) Error() string {
+	if err.End {
+		return fmt.Sprintf("Unexpected end of input in amount on line: %v", err.L)
+	}
+	return fmt.Sprintf("Malformed amount on line: %v", err.L)
+}
+
+// ScanAmount reads an amount from the CharReader, stopping at the first character that isn't part of it. This is
+// the tokenizer used by the parser as well as SplitAmount, see SplitAmount for the rules. If unitSuffix is true any
+// commodity may directly follow the number (10AAPL), not just a currency symbol.
+//
+// If there is no amount at all (no sign, commodity, or number) the token has an empty Numeric and the error is nil,
+// this is how the parser finds null postings.
+func ScanAmount(cr *lex.CharReader, unitSuffix bool) (tok AmountToken, err error) {
+	// The minus sign may come before a leading commodity (-$5.00) as well as after it ($-5.00).
+	if cr.C == '-' && (cr.NC == '"' || IsCommodityRune(cr.NC)) {
+		cr.Next()
+		tok.Negative = true
+		tok.Style.SignFirst = true
+	}
+
+	// The optional leading commodity.
+	if cr.C == '"' || (!cr.EOF && IsCommodityRune(cr.C)) {
+		tok.Commodity, err = ScanCommodity(cr)
+		if err != nil {
+			return AmountToken{}, err
+		}
+		if cr.Match(" \t") {
+			tok.Style.Spaced = true
+			cr.Eat(" \t")
+		}
+		if cr.EOF {
+			return AmountToken{}, AmountSyntaxError{cr.L, true}
+		}
+	}
+
+	if cr.C == '-' {
+		if tok.Negative {
+			return AmountToken{}, AmountSyntaxError{cr.L, false}
+		}
+		cr.Next()
+		tok.Negative = true
+	}
+
+	tok.L = cr.L
+	num := []rune{}
+	for cr.MatchNumeric() || cr.C == '.' || cr.C == ',' {
+		num = append(num, cr.C)
+		cr.Next()
+		if cr.EOF {
+			return AmountToken{}, AmountSyntaxError{cr.L, true}
+		}
+	}
+	if len(num) == 0 {
+		if tok.Commodity != "" || tok.Negative {
+			return AmountToken{}, AmountSyntaxError{tok.L, false}
+		}
+		return AmountToken{}, nil
+	}
+	tok.Numeric = string(num)
+
+	// And the optional trailing commodity.
+	if tok.Commodity == "" {
+		if cr.C == '"' || IsCurrencyRune(cr.C) || (unitSuffix && !cr.EOF && IsCommodityRune(cr.C)) {
+			tok.Style.Suffix = true
+			tok.Commodity, err = ScanCommodity(cr)
+			if err != nil {
+				return AmountToken{}, err
+			}
+		} else if cr.Match(" \t") {
+			cr.Eat(" \t")
+			if cr.EOF {
+				return AmountToken{}, AmountSyntaxError{cr.L, true}
+			}
+			if cr.C == '"' || IsCommodityRune(cr.C) {
+				tok.Style.Suffix = true
+				tok.Style.Spaced = true
+				tok.Commodity, err = ScanCommodity(cr)
+				if err != nil {
+					return AmountToken{}, err
+				}
+			}
+		}
+	}
+	return tok, nil
+}
+
+// ScanCommodity reads a commodity name from the CharReader, either a run of characters allowed by IsCommodityRune
+// or a string wrapped in double quotes. The quotes are not included in the result.
+func ScanCommodity(cr *lex.CharReader) (string, error) {
+	c := []rune{}
+	if cr.C == '"' {
+		l := cr.L
+		cr.Next()
+		c = cr.ReadUntil("\"\n", c)
+		if cr.EOF {
+			return "", AmountSyntaxError{cr.L, true}
+		}
+		if cr.C != '"' || len(c) == 0 {
+			return "", AmountSyntaxError{l, false}
+		}
+		cr.Next()
+		return string(c), nil
+	}
+
+	for !cr.EOF && IsCommodityRune(cr.C) {
+		c = append(c, cr.C)
+		cr.Next()
+		if cr.EOF {
+			return "", AmountSyntaxError{cr.L, true}
+		}
+	}
+	return string(c), nil
+}
+
+// ParseNumber converts an unsigned number (digits along with periods and commas) into a value, filling in the
+// number related parts of the style (DecimalComma, Thousands, and Precision) as it goes. Returns false if the
+// number is not valid, including if it has more than four decimal places or is too large to hold (more than
+// math.MaxInt64/10000).
+//
+// If the number contains both periods and commas, whichever comes last is the decimal mark. If only commas are
+// present they are treated as digit grouping, unless there is a single comma that is not followed by exactly three
+// digits. Several periods and nothing else can only be grouping.
+func ParseNumber(s string, style *AmountStyle) (int64, bool) {
+	num := []rune(s)
+	if len(num) == 0 {
+		return 0, false
+	}
+	dots, commas := 0, 0
+	for _, c := range num {
+		switch c {
+		case '.':
+			dots++
+		case ',':
+			commas++
+		}
+	}
+
+	// Figure out which mark is the decimal mark. Commas are normally grouping, but a single comma that isn't
+	// followed by exactly three digits can't be. Several periods and nothing else can only be grouping.
+	mark := '.'
+	switch {
+	case dots > 0 && commas > 0:
+		for i := len(num) - 1; i >= 0; i-- {
+			if num[i] == '.' || num[i] == ',' {
+				mark = num[i]
+				break
+			}
+		}
+	case dots > 1:
+		mark = ','
+	case commas == 1:
+		if i := strings.IndexRune(string(num), ','); len(num)-i-1 != 3 {
+			mark = ','
+		}
+	}
+	if mark == ',' {
+		style.DecimalComma = true
+	}
+
+	whole, part, places := int64(0), int64(0), -1
+	for _, c := range num {
+		switch {
+		case c == mark:
+			if places != -1 {
+				return 0, false
+			}
+			places = 0
+		case c == '.' || c == ',':
+			if places != -1 {
+				return 0, false
+			}
+			style.Thousands = true
+		case c < '0' || c > '9':
+			return 0, false
+		case places == -1:
+			whole = whole*10 + int64(c-'0')
+			if whole > math.MaxInt64/10000 {
+				return 0, false
+			}
+		default:
+			places++
+			if places > 4 {
+				return 0, false
+			}
+			part = part*10 + int64(c-'0')
+		}
+	}
+	if num[0] == mark {
+		return 0, false
+	}
+
+	style.Precision = places
+	if places == 0 {
+		style.Precision = -1
+	}
+	for i := places; i < 4; i++ {
+		part *= 10
+	}
+	if whole > (math.MaxInt64-part)/10000 {
+		return 0, false
+	}
+	return whole*10000 + part, true
+}
+
+// FormatAmount formats a value (in ten-thousandths of a unit) with its commodity using the given style.
+// Rounding is done via the round to even method.
+func FormatAmount(v int64, commodity string, style AmountStyle) string {
+	s, _ := formatAmount(v, commodity, style)
+	return s
+}
+
+// formatAmount does the work for FormatAmount, additionally returning the number of runes that come before the
+// decimal mark (or the end of the number if there is no decimal mark) so that callers may align on it.
+func formatAmount(v int64, commodity string, style AmountStyle) (string, int) {
+	whole, frac := formatNumber(v, style)
+	return withCommodity(whole, frac, commodity, style)
+}
+
+// withCommodity adds the commodity to a number split at its decimal mark (see formatNumber) as set by the style,
+// returning the result and the number of runes before the decimal mark.
+func withCommodity(whole, frac, commodity string, style AmountStyle) (string, int) {
+	if commodity == "" {
+		commodity = DefaultCommodity
+	}
+	if strings.IndexFunc(commodity, func(r rune) bool { return !IsCommodityRune(r) }) != -1 {
+		commodity = "\"" + commodity + "\""
+	}
+
+	buf := new(strings.Builder)
+	if !style.Suffix && style.SignFirst && strings.HasPrefix(whole, "-") {
+		buf.WriteRune('-')
+		whole = whole[1:]
+	}
+	if !style.Suffix {
+		buf.WriteString(commodity)
+		if style.Spaced {
+			buf.WriteRune(' ')
+		}
+	}
+
+	buf.WriteString(whole)
+	point := utf8.RuneCountInString(buf.String())
+	buf.WriteString(frac)
+
+	if style.Suffix {
+		if style.Spaced {
+			buf.WriteRune(' ')
+		}
+		buf.WriteString(commodity)
+	}
+	return buf.String(), point
+}
+
+// splitRaw splits a number as written (with an optional sign) at its decimal mark, the same way formatNumber does.
+// A number that is not valid is returned whole.
+func splitRaw(raw string) (string, string) {
+	style := AmountStyle{}
+	if _, ok := ParseNumber(strings.TrimPrefix(raw, "-"), &style); !ok || style.Precision <= 0 {
+		return raw, ""
+	}
+	mark := "."
+	if style.DecimalComma {
+		mark = ","
+	}
+	i := strings.LastIndex(raw, mark)
+	return raw[:i], raw[i:]
+}
+
+// formatNumber returns the signed whole part of a value and the fractional part (including the decimal mark).
+func formatNumber(v int64, style AmountStyle) (string, string) {
+	places := style.Places()
+
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+
+	// Round to the requested number of places.
+	div := int64(1)
+	for i := places; i < 4; i++ {
+		div *= 10
+	}
+	q, r := v/div, v%div
+	if r*2 > div || (r*2 == div && q%2 != 0) {
+		q++
+	}
+
+	mul := int64(1)
+	for i := 0; i < places; i++ {
+		mul *= 10
+	}
+	ip, fp := q/mul, q%mul
+
+	mark, group := ".", ","
+	if style.DecimalComma {
+		mark, group = ",", "."
+	}
+
+	digits := []byte(strconv.FormatInt(ip, 10))
+	if style.Thousands {
+		grouped := []byte{}
+		for i, d := range digits {
+			if i != 0 && (len(digits)-i)%3 == 0 {
+				grouped = append(grouped, group...)
+			}
+			grouped = append(grouped, d)
+		}
+		digits = grouped
+	}
+
+	whole := string(digits)
+	if neg && q != 0 {
+		whole = "-" + whole
+	}
+	if places == 0 {
+		return whole, ""
+	}
+
+	frac := strconv.FormatInt(fp, 10)
+	for len(frac) < places {
+		frac = "0" + frac
+	}
+	return whole, mark + frac
+}
+
+// Amount is a value along with its commodity and formatting information.
+type Amount struct {
+	Value     int64  // In ten-thousandths of a unit.
+	Commodity string // Empty means DefaultCommodity.
+	Style     AmountStyle
+}
+
+func (a Amount) String() string {
+	return FormatAmount(a.Value, a.Commodity, a.Style)
+}
+
+// FormatPrec formats the amount like String, but with the given number of decimal places in place of the number
+// from its style. Rounding is to even. Places beyond the four that are stored are filled with zeros, zero or less
+// gives a whole number.
+func (a Amount) FormatPrec(places int) string {
+	style := a.Style
+	style.Precision = places
+	if places <= 0 {
+		style.Precision = -1
+	}
+
+	s, point := formatAmount(a.Value, a.Commodity, style)
+	if places <= 4 {
+		return s
+	}
+	rs := []rune(s)
+	at := point + 1 + 4
+	return string(rs[:at]) + strings.Repeat("0", places-4) + string(rs[at:])
+}
+
+// Equal returns true if both amounts have the same value in the same commodity. An amount without a commodity is
+// in DefaultCommodity, and how the amounts are written (the style) doesn't matter. Amounts in different commodities
+// are never equal, no matter their values.
+func (a Amount) Equal(other Amount) bool {
+	return a.Value == other.Value && commodityName(a.Commodity) == commodityName(other.Commodity)
+}
+
+// Cmp compares the values of the amounts, returning -1 if a is less than other, 0 if they are equal, and 1 if a is
+// greater. Like Equal, an amount without a commodity is in DefaultCommodity and the style doesn't matter. Returns a
+// CommodityMismatchError if the amounts are in different commodities, as there is no way to compare them.
+func (a Amount) Cmp(other Amount) (int, error) {
+	if commodityName(a.Commodity) != commodityName(other.Commodity) {
+		return 0, CommodityMismatchError{commodityName(a.Commodity), commodityName(other.Commodity)}
+	}
+	switch {
+	case a.Value < other.Value:
+		return -1, nil
+	case a.Value > other.Value:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// CommodityMismatchError is returned by Amount.Add and Amount.Cmp when the amounts are in different commodities.
+type CommodityMismatchError struct {
+	A, B string
+}
+
+func (err CommodityMismatchError) Error() string {
+	return fmt.Sprintf("Amounts are in different commodities: %v and %v", err.A, err.B)
+}
+
+// ErrAmountOverflow is returned by Amount.Add when the sum is too large to store.
+var ErrAmountOverflow = errors.New("Amount is too large.")
+
+// Add returns the sum of the amounts, keeping a's commodity and style (or b's, if a has no commodity and b is in
+// DefaultCommodity). Returns a CommodityMismatchError if the amounts are in different commodities, or
+// ErrAmountOverflow if the sum does not fit.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if commodityName(a.Commodity) != commodityName(b.Commodity) {
+		return a, CommodityMismatchError{commodityName(a.Commodity), commodityName(b.Commodity)}
+	}
+	v := a.Value + b.Value
+	if (b.Value > 0 && v < a.Value) || (b.Value < 0 && v > a.Value) {
+		return a, ErrAmountOverflow
+	}
+	if a.Commodity == "" && b.Commodity != "" {
+		a.Commodity, a.Style = b.Commodity, b.Style
+	}
+	a.Value = v
+	return a, nil
+}
+
+// AmountSum adds up the amounts in each commodity, keyed by commodity name (amounts with no commodity are under
+// DefaultCommodity). Each sum keeps the commodity and style of the first amount in it, preferring one with the
+// commodity written out. An empty list gives an empty map. The only possible error is ErrAmountOverflow.
+func AmountSum(amounts []Amount) (map[string]Amount, error) {
+	sums := map[string]Amount{}
+	for _, a := range amounts {
+		c := commodityName(a.Commodity)
+		sum, ok := sums[c]
+		if !ok {
+			sums[c] = a
+			continue
+		}
+		sum, err := sum.Add(a)
+		if err != nil {
+			return nil, err
+		}
+		sums[c] = sum
+	}
+	return sums, nil
+}
+
+// ConvertTo returns the amount converted to the given commodity using rate, which is the number of units of the
+// target commodity per unit of a's commodity. The rate's commodity is not checked, but if it matches the target its
+// style is used for the result. The math is done exactly, with the result rounded to the nearest ten-thousandth (to
+// even, see ConvertToWith for other modes).
+func (a Amount) ConvertTo(commodity string, rate Amount) Amount {
+	return a.ConvertToWith(commodity, rate, RoundHalfEven)
+}
+
+// ConvertToWith is exactly like ConvertTo, but with the given rounding mode.
+func (a Amount) ConvertToWith(commodity string, rate Amount, mode RoundingMode) Amount {
+	out := Amount{Commodity: commodity, Style: a.Style}
+	if commodityName(rate.Commodity) == commodityName(commodity) {
+		out.Style = rate.Style
+	}
+
+	r := new(big.Rat).SetFrac(big.NewInt(a.Value), big.NewInt(10000))
+	r.Mul(r, big.NewRat(rate.Value, 10000))
+	out.Value = roundRat(r, mode)
+	return out
+}
+
+// ratValue converts r to ten-thousandths of a unit, rounding to even.
+func ratValue(r *big.Rat) int64 {
+	return roundRat(r, RoundHalfEven)
+}
+
+// roundRat converts r to ten-thousandths of a unit, rounding with the given mode.
+func roundRat(r *big.Rat, mode RoundingMode) int64 {
+	r = new(big.Rat).Mul(r, big.NewRat(10000, 1))
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if mode == RoundDown {
+		return q.Int64()
+	}
+
+	// Compare twice the remainder to the denominator to see which way to round.
+	m.Abs(m).Lsh(m, 1)
+	c := m.Cmp(r.Denom())
+	if c > 0 || c == 0 && (mode == RoundHalfUp || q.Bit(0) == 1) {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// Amount returns the amount of the posting. For a null posting this will not be meaningful unless the transaction
+// has been canonicalized. A raw number (see Posting.Raw) is converted, if it isn't valid the value is zero (use
+// ParseRaw to find out why).
+func (p *Posting) Amount() Amount {
+	v, style, _ := p.number()
+	return Amount{Value: v, Commodity: p.Commodity, Style: style}
+}
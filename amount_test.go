@@ -0,0 +1,380 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestUnicodeCommodityInput = `
+2022/01/02 * Bakery
+    Expenses:Food       €1.234,56
+    Expenses:Tea        £3.50
+    Expenses:Sushi      ¥1,200
+    Expenses:Wine       12,50 €
+    Assets:Cash
+`
+
+func TestUnicodeCommodity(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestUnicodeCommodityInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.T) != 1 || len(f.T[0].Postings) != 5 {
+		t.Fatalf("Incorrect parse result: %#v", f.T)
+	}
+
+	expected := []struct {
+		commodity string
+		value     int64
+		out       string
+	}{
+		{"€", 12345600, "€1.234,56"},
+		{"£", 35000, "£3.50"},
+		{"¥", 12000000, "¥1,200"},
+		{"€", 125000, "12,50 €"},
+	}
+	for i, e := range expected {
+		p := f.T[0].Postings[i]
+		if p.Commodity != e.commodity {
+			t.Errorf("Incorrect posting %v commodity: %q", i, p.Commodity)
+		}
+		if p.Value != e.value {
+			t.Errorf("Incorrect posting %v value: %v", i, p.Value)
+		}
+		if v := ledger.FormatAmount(p.Value, p.Commodity, p.Style); v != e.out {
+			t.Errorf("Incorrect posting %v formatted value: %v", i, v)
+		}
+	}
+
+	// Write it out and read it back in, everything should survive.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "€1.234,56") {
+		t.Errorf("Round trip lost formatting:\n%v", buf.String())
+	}
+
+	f2, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range f2.T[0].Postings {
+		p1 := f.T[0].Postings[i]
+		if p.Value != p1.Value || p.Commodity != p1.Commodity || p.Style != p1.Style {
+			t.Errorf("Posting %v changed in round trip: %#v", i, p)
+		}
+	}
+}
+
+// Alignment is done on the decimal mark, measured in runes. A multi-byte commodity must not push things around.
+func TestUnicodeCommodityAlignment(t *testing.T) {
+	posts := []ledger.Posting{
+		{Account: "Expenses:Food", Value: 100000, Commodity: "$"},
+		{Account: "Expenses:Food", Value: 100000, Commodity: "€"},
+		{Account: "Expenses:Food", Value: 100000, Commodity: "€", Style: ledger.AmountStyle{DecimalComma: true}},
+	}
+
+	column := -1
+	for i, p := range posts {
+		s := p.String()
+		mark := strings.LastIndexAny(s, ".,")
+		if mark == -1 {
+			t.Fatalf("No decimal mark in posting %v: %v", i, s)
+		}
+		c := utf8.RuneCountInString(s[:mark])
+		if column == -1 {
+			column = c
+		}
+		if c != column {
+			t.Errorf("Posting %v is misaligned (column %v, expected %v): %v", i, c, column, s)
+		}
+	}
+}
+
+func TestAmountConvertTo(t *testing.T) {
+	usd := ledger.Amount{Value: 1000000, Commodity: "$"}
+	eurPerUSD := ledger.Amount{Value: 9000, Commodity: "€", Style: ledger.AmountStyle{DecimalComma: true}}
+	gbpPerEUR := ledger.Amount{Value: 8500, Commodity: "£"}
+
+	eur := usd.ConvertTo("€", eurPerUSD)
+	if eur.Value != 900000 || eur.Commodity != "€" || eur.String() != "€90,00" {
+		t.Errorf("Incorrect conversion to €: %#v (%v)", eur, eur)
+	}
+
+	// Converting through a cross rate should match converting with the product of the rates.
+	gbp := eur.ConvertTo("£", gbpPerEUR)
+	direct := usd.ConvertTo("£", ledger.Amount{Value: 7650, Commodity: "£"})
+	if gbp.Value != 765000 || gbp.Value != direct.Value {
+		t.Errorf("Incorrect cross rate conversion: %v, direct: %v", gbp, direct)
+	}
+
+	// Rounding is to even on the last place.
+	odd := ledger.Amount{Value: 1, Commodity: "$"}.ConvertTo("€", ledger.Amount{Value: 15000})
+	even := ledger.Amount{Value: 1, Commodity: "$"}.ConvertTo("€", ledger.Amount{Value: 25000})
+	neg := ledger.Amount{Value: -1, Commodity: "$"}.ConvertTo("€", ledger.Amount{Value: 15000})
+	if odd.Value != 2 || even.Value != 2 || neg.Value != -2 {
+		t.Errorf("Incorrect rounding: %v %v %v", odd.Value, even.Value, neg.Value)
+	}
+
+	// Zero amounts and zero rates both give zero.
+	if v := (ledger.Amount{Commodity: "$"}).ConvertTo("€", eurPerUSD); v.Value != 0 || v.Commodity != "€" {
+		t.Errorf("Incorrect conversion of zero: %#v", v)
+	}
+	if v := usd.ConvertTo("€", ledger.Amount{}); v.Value != 0 {
+		t.Errorf("Incorrect conversion with zero rate: %#v", v)
+	}
+}
+
+func TestAmountFormatPrec(t *testing.T) {
+	a := ledger.Amount{Value: 12345, Commodity: "$"}
+	e := ledger.Amount{Value: -12345678, Commodity: "€", Style: ledger.AmountStyle{Suffix: true, Spaced: true, DecimalComma: true, Thousands: true}}
+
+	cases := []struct {
+		a      ledger.Amount
+		places int
+		out    string
+	}{
+		{a, 2, "$1.23"},
+		{a, 3, "$1.234"}, // Half rounds to even.
+		{ledger.Amount{Value: 12355}, 3, "$1.236"},
+		{a, 1, "$1.2"},
+		{a, 0, "$1"},
+		{a, -1, "$1"},
+		{ledger.Amount{Value: 15000}, 0, "$2"},
+		{a, 4, "$1.2345"},
+		{a, 6, "$1.234500"},
+		{e, 1, "-1.234,6 €"},
+		{e, 6, "-1.234,567800 €"},
+		{e, 0, "-1.235 €"},
+	}
+	for i, c := range cases {
+		if out := c.a.FormatPrec(c.places); out != c.out {
+			t.Errorf("Case %v: incorrect output %q, expected %q", i, out, c.out)
+		}
+	}
+
+	// The amount itself is not changed.
+	if a.String() != "$1.23" || a.Style != (ledger.AmountStyle{}) {
+		t.Errorf("Amount was modified: %#v", a)
+	}
+}
+
+func TestAmountEqual(t *testing.T) {
+	cases := []struct {
+		a, b  ledger.Amount
+		equal bool
+	}{
+		{ledger.Amount{Value: 50000, Commodity: "$"}, ledger.Amount{Value: 50000, Commodity: "$"}, true},
+		{ledger.Amount{Value: 50000, Commodity: "$"}, ledger.Amount{Value: 50000, Commodity: "EUR"}, false},
+		{ledger.Amount{Value: 50000, Commodity: "$"}, ledger.Amount{Value: 50001, Commodity: "$"}, false},
+		{ledger.Amount{Value: 50000}, ledger.Amount{Value: 50000, Commodity: ledger.DefaultCommodity}, true},
+		{ledger.Amount{Value: 0, Commodity: "$"}, ledger.Amount{Value: 0, Commodity: "EUR"}, false},
+		{
+			ledger.Amount{Value: 50000, Commodity: "EUR"},
+			ledger.Amount{Value: 50000, Commodity: "EUR", Style: ledger.AmountStyle{Suffix: true, Precision: 4}},
+			true,
+		},
+	}
+	for i, c := range cases {
+		if c.a.Equal(c.b) != c.equal || c.b.Equal(c.a) != c.equal {
+			t.Errorf("Case %v: expected %v", i, c.equal)
+		}
+	}
+}
+
+func TestAmountCmp(t *testing.T) {
+	cases := []struct {
+		a, b ledger.Amount
+		cmp  int
+	}{
+		{ledger.Amount{Value: 50000, Commodity: "$"}, ledger.Amount{Value: 50000, Commodity: "$"}, 0},
+		{ledger.Amount{Value: 50000, Commodity: "$"}, ledger.Amount{Value: 50001, Commodity: "$"}, -1},
+		{ledger.Amount{Value: -50000}, ledger.Amount{Value: -50001, Commodity: ledger.DefaultCommodity}, 1},
+		{
+			ledger.Amount{Value: 50000, Commodity: "EUR"},
+			ledger.Amount{Value: 50000, Commodity: "EUR", Style: ledger.AmountStyle{Suffix: true, Precision: 4}},
+			0,
+		},
+	}
+	for i, c := range cases {
+		cmp, err := c.a.Cmp(c.b)
+		rcmp, rerr := c.b.Cmp(c.a)
+		if err != nil || rerr != nil || cmp != c.cmp || rcmp != -c.cmp {
+			t.Errorf("Case %v: incorrect result: %v %v %v %v", i, cmp, rcmp, err, rerr)
+		}
+	}
+
+	_, err := ledger.Amount{Value: 0, Commodity: "$"}.Cmp(ledger.Amount{Value: 0, Commodity: "EUR"})
+	if merr, ok := err.(ledger.CommodityMismatchError); !ok || merr.A != "$" || merr.B != "EUR" {
+		t.Errorf("Incorrect error for mismatched commodities: %v", err)
+	}
+}
+
+func TestAmountSum(t *testing.T) {
+	sums, err := ledger.AmountSum(nil)
+	if err != nil || sums == nil || len(sums) != 0 {
+		t.Errorf("Incorrect sum of nothing: %v %v", sums, err)
+	}
+
+	sums, err = ledger.AmountSum([]ledger.Amount{
+		{Value: 50000},
+		{Value: 120000, Commodity: "€", Style: ledger.AmountStyle{Suffix: true}},
+		{Value: 25000, Commodity: "$"},
+		{Value: -20000, Commodity: "€"},
+		{Value: 10, Commodity: "AAPL", Style: ledger.AmountStyle{Suffix: true, Spaced: true, Precision: 4}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"$": "$7.50", "€": "10.00€", "AAPL": "0.0010 AAPL"}
+	if len(sums) != len(expected) {
+		t.Errorf("Incorrect sums: %v", sums)
+	}
+	for c, e := range expected {
+		if s := sums[c].String(); s != e {
+			t.Errorf("Incorrect sum for %v: %v", c, s)
+		}
+	}
+
+	if _, err := ledger.AmountSum([]ledger.Amount{{Value: 1 << 62}, {Value: 1 << 62}}); err != ledger.ErrAmountOverflow {
+		t.Errorf("Incorrect error for overflow: %v", err)
+	}
+
+	_, err = ledger.Amount{Commodity: "$"}.Add(ledger.Amount{Commodity: "€"})
+	if merr, ok := err.(ledger.CommodityMismatchError); !ok || merr.A != "$" || merr.B != "€" {
+		t.Errorf("Incorrect error for mismatched commodities: %v", err)
+	}
+}
+
+func TestSplitAmount(t *testing.T) {
+	cases := []struct {
+		in        string
+		numeric   string
+		commodity string
+		prefix    bool
+		ok        bool
+	}{
+		{"$5.00", "5.00", "$", true, true},
+		{"$-5.00", "-5.00", "$", true, true},
+		{"-$5.00", "-5.00", "$", true, true},
+		{"EUR 1.000,50", "1.000,50", "EUR", true, true},
+		{"-EUR -5", "", "", false, false},
+		{"1,000.00 EUR", "1,000.00", "EUR", false, true},
+		{"-20,00 €", "-20,00", "€", false, true},
+		{"20€", "20", "€", false, true},
+		{"10 AAPL", "10", "AAPL", false, true},
+		{"10 \"S&P 500\"", "10", "S&P 500", false, true},
+		{"\"S&P 500\" 10", "10", "S&P 500", true, true},
+		{"  42  ", "42", "", false, true},
+		{"-42", "-42", "", false, true},
+		{"10AAPL", "", "", false, false},
+		{"$", "", "", false, false},
+		{"$5.00 EUR", "", "", false, false},
+		{"\"Unclosed 5", "", "", false, false},
+		{"", "", "", false, false},
+	}
+	for _, c := range cases {
+		numeric, commodity, prefix, err := ledger.SplitAmount(c.in)
+		if (err == nil) != c.ok || numeric != c.numeric || commodity != c.commodity || prefix != c.prefix {
+			t.Errorf("Incorrect result for %q: %q %q %v %v", c.in, numeric, commodity, prefix, err)
+		}
+
+		// The parser must agree.
+		if !c.ok {
+			continue
+		}
+		f, err := parse.ParseLedgerWith(parse.NewCharReader("2023/01/01 Test\n    Expenses:Food    "+c.in+"\n    Assets:Cash\n", 1), parse.Options{LazyAmounts: true})
+		if err != nil {
+			t.Errorf("Parser error for %q: %v", c.in, err)
+			continue
+		}
+		p := f.T[0].Postings[0]
+		if p.Raw != numeric || p.Commodity != commodity || (commodity != "" && p.Style.Suffix == prefix) {
+			t.Errorf("Parser disagrees for %q: %q %q %v", c.in, p.Raw, p.Commodity, p.Style.Suffix)
+		}
+	}
+}
+
+func TestScanAmount(t *testing.T) {
+	// The amount ends at the first character that can't be part of it.
+	cr := parse.NewCharReader("-EUR 5,00 ; note", 1)
+	tok, err := ledger.ScanAmount(cr, false)
+	if err != nil || tok.Numeric != "5,00" || !tok.Negative || tok.Commodity != "EUR" || !tok.Style.SignFirst ||
+		!tok.Style.Spaced || tok.Style.Suffix || cr.C != ' ' {
+		t.Errorf("Incorrect token: %#v %v %q", tok, err, cr.C)
+	}
+
+	// Units only directly follow the number if asked for.
+	tok, err = ledger.ScanAmount(parse.NewCharReader("10AAPL", 1), false)
+	if err != nil || tok.Commodity != "" {
+		t.Errorf("Incorrect token without unit suffixes: %#v %v", tok, err)
+	}
+	tok, err = ledger.ScanAmount(parse.NewCharReader("10AAPL", 1), true)
+	if err != nil || tok.Commodity != "AAPL" || !tok.Style.Suffix || tok.Style.Spaced {
+		t.Errorf("Incorrect token with unit suffixes: %#v %v", tok, err)
+	}
+
+	// Nothing at all is not an error, but a lone commodity is.
+	tok, err = ledger.ScanAmount(parse.NewCharReader("; note", 1), false)
+	if err != nil || tok.Numeric != "" {
+		t.Errorf("Incorrect token for no amount: %#v %v", tok, err)
+	}
+	_, err = ledger.ScanAmount(parse.NewCharReader("$ ; note", 1), false)
+	if serr, ok := err.(ledger.AmountSyntaxError); !ok || serr.End {
+		t.Errorf("Incorrect error for a lone commodity: %v", err)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected ledger.Amount
+		ok       bool
+	}{
+		{"$1,000.00", ledger.Amount{Value: 10000000, Commodity: "$", Style: ledger.AmountStyle{Thousands: true, Precision: 2}}, true},
+		{"-20,00 €", ledger.Amount{Value: -200000, Commodity: "€", Style: ledger.AmountStyle{Suffix: true, Spaced: true, DecimalComma: true, Precision: 2}}, true},
+		{"-$5", ledger.Amount{Value: -50000, Commodity: "$", Style: ledger.AmountStyle{SignFirst: true, Precision: -1}}, true},
+		{"42", ledger.Amount{Value: 420000, Style: ledger.AmountStyle{Precision: -1}}, true},
+		{"$1,2.3.4", ledger.Amount{}, false},
+		{"$ten", ledger.Amount{}, false},
+		{"5 $ 5", ledger.Amount{}, false},
+		{"$922337203685477", ledger.Amount{Value: 9223372036854770000, Commodity: "$", Style: ledger.AmountStyle{Precision: -1}}, true},
+		{"$922337203685477.9999", ledger.Amount{}, false},
+		{"$99999999999999999999", ledger.Amount{}, false},
+	}
+	for _, c := range cases {
+		a, err := ledger.ParseAmount(c.in)
+		if (err == nil) != c.ok || a != c.expected {
+			t.Errorf("Incorrect result for %q: %#v %v", c.in, a, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// Kinds of change recorded in a ChangeLogEntry.
+const (
+	ChangeAdd    = "add"
+	ChangeRemove = "remove"
+	ChangeModify = "modify"
+)
+
+// ChangeLogEntry records a single change to a transaction, identified by its "ID" KV. Entries are meant to be
+// persisted (for example as JSON lines) to make an append only audit log.
+type ChangeLogEntry struct {
+	Time   time.Time     `json:"time"` // When the change was recorded.
+	Kind   string        `json:"kind"` // One of ChangeAdd, ChangeRemove, or ChangeModify.
+	ID     string        `json:"id"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// FieldChange is the before and after value of one field of a transaction, as text. For an added transaction
+// Before is always empty, for a removed one After is.
+//
+// Field is one of "Date", "ClearDate", "Status", "Code", "Description", "Comments", "Tags", "Postings", or "KV:"
+// followed by the key of a KV pair. Multi line values (comments and postings) have one item per line.
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// DiffToChangeLog compares two versions of a list of transactions and returns a change log entry for each
+// transaction that was added, removed, or modified, all stamped with the current time. Removals and modifications
+// come first, in the order of old, followed by additions in the order of new.
+//
+// Transactions are matched up by ID, transactions without one are ignored. If an ID is used more than once
+// (revision history) only the last transaction with that ID is considered.
+func DiffToChangeLog(old, new []Transaction) []ChangeLogEntry {
+	now := time.Now()
+
+	last := func(trs []Transaction) ([]string, map[string]map[string]string) {
+		order := []string{}
+		fields := map[string]map[string]string{}
+		for i := range trs {
+			id, ok := trs[i].KVPairs["ID"]
+			if !ok {
+				continue
+			}
+			if _, ok := fields[id]; !ok {
+				order = append(order, id)
+			}
+			fields[id] = trs[i].changeFields()
+		}
+		return order, fields
+	}
+	oldOrder, oldFields := last(old)
+	newOrder, newFields := last(new)
+
+	entries := []ChangeLogEntry{}
+	for _, id := range oldOrder {
+		before := oldFields[id]
+		after, ok := newFields[id]
+		if !ok {
+			entries = append(entries, ChangeLogEntry{now, ChangeRemove, id, diffFields(before, nil)})
+			continue
+		}
+		if changes := diffFields(before, after); len(changes) > 0 {
+			entries = append(entries, ChangeLogEntry{now, ChangeModify, id, changes})
+		}
+	}
+	for _, id := range newOrder {
+		if _, ok := oldFields[id]; !ok {
+			entries = append(entries, ChangeLogEntry{now, ChangeAdd, id, diffFields(nil, newFields[id])})
+		}
+	}
+	return entries
+}
+
+// changeFields returns the fields of the transaction as used by DiffToChangeLog. Empty fields are left out.
+func (t *Transaction) changeFields() map[string]string {
+	fields := map[string]string{}
+	set := func(k, v string) {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+
+	set("Date", t.Date.Format("2006/01/02"))
+	if !t.ClearDate.IsZero() {
+		set("ClearDate", t.ClearDate.Format("2006/01/02"))
+	}
+	switch t.Status {
+	case StatusClear:
+		set("Status", "*")
+	case StatusPending:
+		set("Status", "!")
+	}
+	set("Code", t.Code)
+	set("Description", t.Description)
+	set("Comments", strings.Join(t.Comments, "\n"))
+
+	tags := []string{}
+	for tag, ok := range t.Tags {
+		if ok {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		sort.Strings(tags)
+		set("Tags", ":"+strings.Join(tags, ":")+":")
+	}
+	for k, v := range t.KVPairs {
+		set("KV:"+k, v)
+	}
+
+	posts := []string{}
+	for i := range t.Postings {
+		posts = append(posts, t.Postings[i].String())
+		for _, line := range t.Postings[i].Comments {
+			posts = append(posts, "    ; "+line)
+		}
+	}
+	set("Postings", strings.Join(posts, "\n"))
+	return fields
+}
+
+// diffFields returns the changes between two sets of fields, sorted by field name.
+func diffFields(before, after map[string]string) []FieldChange {
+	keys := maps.Keys(before)
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []FieldChange{}
+	for _, k := range keys {
+		if before[k] != after[k] {
+			changes = append(changes, FieldChange{k, before[k], after[k]})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestChangeLogInput = `
+2022/07/01 * Groceries
+	; ID: a
+    Expenses:Food       $20.00
+    Assets:Cash
+
+2022/07/02 * Rent
+	; ID: b
+    Expenses:Rent       $500.00
+    Assets:Checking
+
+2022/07/03 * No ID
+    Expenses:Misc       $1.00
+    Assets:Cash
+`
+
+func TestDiffToChangeLog(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestChangeLogInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Edit a, remove b, add c, and change the transaction without an ID (which is ignored).
+	a := *f.T[0].CleanCopy()
+	a.Description = "Grocery Store"
+	a.KVPairs["Receipt"] = "123"
+	c := *f.T[0].CleanCopy()
+	c.KVPairs["ID"] = "c"
+	x := *f.T[2].CleanCopy()
+	x.Description = "Still no ID"
+
+	log := ledger.DiffToChangeLog(f.T, []ledger.Transaction{a, x, c})
+	if len(log) != 3 {
+		t.Fatalf("Incorrect number of entries: %#v", log)
+	}
+
+	if log[0].Kind != ledger.ChangeModify || log[0].ID != "a" || log[0].Time.IsZero() {
+		t.Errorf("Incorrect first entry: %#v", log[0])
+	}
+	expected := []ledger.FieldChange{
+		{Field: "Description", Before: "Groceries", After: "Grocery Store"},
+		{Field: "KV:Receipt", After: "123"},
+	}
+	if !reflect.DeepEqual(log[0].Fields, expected) {
+		t.Errorf("Incorrect modified fields: %#v", log[0].Fields)
+	}
+
+	if log[1].Kind != ledger.ChangeRemove || log[1].ID != "b" {
+		t.Errorf("Incorrect second entry: %#v", log[1])
+	}
+	for _, fc := range log[1].Fields {
+		if fc.Before == "" || fc.After != "" {
+			t.Errorf("Incorrect removed field: %#v", fc)
+		}
+	}
+
+	if log[2].Kind != ledger.ChangeAdd || log[2].ID != "c" {
+		t.Errorf("Incorrect third entry: %#v", log[2])
+	}
+	for _, fc := range log[2].Fields {
+		if fc.Before != "" || fc.After == "" {
+			t.Errorf("Incorrect added field: %#v", fc)
+		}
+	}
+
+	// Must survive a trip through JSON.
+	data, err := json.Marshal(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log2 := []ledger.ChangeLogEntry{}
+	err = json.Unmarshal(data, &log2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range log {
+		if !log[i].Time.Equal(log2[i].Time) || log[i].Kind != log2[i].Kind || log[i].ID != log2[i].ID ||
+			!reflect.DeepEqual(log[i].Fields, log2[i].Fields) {
+			t.Errorf("Entry %v changed in JSON round trip: %#v", i, log2[i])
+		}
+	}
+
+	// No changes, no entries.
+	if log := ledger.DiffToChangeLog(f.T, f.T); len(log) != 0 {
+		t.Errorf("Entries for unchanged transactions: %#v", log)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/milochristiansen/ledger/parse/lex"
+)
+
+// RunChecks goes through the transactions in order, making sure that each one balances and that every balance
+// assertion holds. The first failure is returned as an error (a BalanceError, MultipleNullError, or AssertionError),
+// anything that could not be checked is reported as a warning.
+//
+// There are two kinds of balance assertion. The first is the usual posting assertion (`Assets:Cash  $5 = $20`),
+// which checks the balance of the posting's account (not including its children) after the posting.
+//
+// The second is an "assert" KV on the transaction, which is checked after all of the transaction's postings. Only
+// simple comparisons of an account balance against an amount are supported:
+//
+//	; assert: Assets:Cash >= $0
+//	; assert: Expenses:Food == 20.00 EUR
+//
+// The operator may be any of ==, =, !=, <, <=, >, or >=. The amount is written the same way as in a posting (see
+// ParseAmount), the default commodity is used if it has none. It is compared against the account's balance in that
+// commodity, not including its children.
+// An assert KV in any other form is kept as is but skipped with a warning.
+func RunChecks(trs []Transaction) (warnings []string, err error) {
+	warnings, errs := RunChecksSeq(SliceSeq(trs), CheckOptions{})
+	if len(errs) > 0 {
+		return warnings, errs[0]
+	}
+	return warnings, nil
+}
+
+// CheckOptions controls the optional behavior of RunChecksSeq.
+type CheckOptions struct {
+	// Keep going after a failure, returning all of them. A transaction that does not balance is left out of the
+	// balances entirely, a failed assertion has no effect on them.
+	CollectErrors bool
+
+	// Options used when balancing each transaction.
+	Balance BalanceOptions
+}
+
+// RunChecksSeq is like RunChecks, but it reads the transactions from a sequence and returns the failures as a list
+// (with only the first one unless CollectErrors is set). Nothing is kept but the running balance of each account, so
+// a huge journal can be checked as it is read without ever having all of it in memory. The index in each error is
+// the position of the transaction in the sequence.
+func RunChecksSeq(trs Seq[Transaction], opts CheckOptions) (warnings []string, errs []error) {
+	type key struct {
+		account   string
+		commodity string
+	}
+	sums := map[key]int64{}
+
+	i := -1
+	trs(func(tr Transaction) bool {
+		i++
+		fail := func(err error) bool {
+			errs = append(errs, err)
+			return opts.CollectErrors
+		}
+
+		ps, err := tr.resolve(opts.Balance)
+		if err != nil {
+			switch err.(type) {
+			case BalanceError:
+				return fail(BalanceError{i, tr.Location})
+			case MultipleNullError:
+				return fail(MultipleNullError{i, tr.Location})
+			}
+			return fail(err)
+		}
+
+		for _, p := range ps {
+			k := key{p.Account, commodityName(p.Commodity)}
+			sums[k] += p.Value
+			if p.HasAssert && sums[k] != p.Assert {
+				expr := fmt.Sprintf("%v = %v", p.Account, FormatAmount(p.Assert, p.Commodity, p.Style))
+				if !fail(AssertionError{i, tr.Location, expr, FormatAmount(sums[k], p.Commodity, p.Style)}) {
+					return false
+				}
+			}
+		}
+
+		expr, ok := tr.KVPairs["assert"]
+		if !ok {
+			return true
+		}
+		account, op, amount, ok := parseAssertion(expr)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("Transaction %v (defined on line %v) has an assertion that is not understood: %v", i, tr.Location, expr))
+			return true
+		}
+		v := sums[key{account, commodityName(amount.Commodity)}]
+		if !compareAssertion(v, op, amount.Value) {
+			// The assertion may be written with fewer decimal places than the balance needs ($35 for $35.50).
+			style := amount.Style
+			for style.Places() < 4 && roundValue(v, style.Places(), RoundDown) != v {
+				style.Precision = style.Places() + 1
+				if style.Precision < 2 {
+					style.Precision = 2
+				}
+			}
+			return fail(AssertionError{i, tr.Location, expr, FormatAmount(v, amount.Commodity, style)})
+		}
+		return true
+	})
+	return warnings, errs
+}
+
+// assertionOps are the operators supported in an assert KV. Longer operators come first so that they are found
+// before their prefixes.
+var assertionOps = []string{"==", "!=", "<=", ">=", "=", "<", ">"}
+
+// parseAssertion splits an assert KV into its parts, returning false if it is not in the supported form.
+func parseAssertion(expr string) (account, op string, amount Amount, ok bool) {
+	at := -1
+	for _, o := range assertionOps {
+		if i := strings.Index(expr, o); i != -1 && (at == -1 || i < at || (i == at && len(o) > len(op))) {
+			at, op = i, o
+		}
+	}
+	if at == -1 {
+		return "", "", amount, false
+	}
+
+	account = strings.TrimSpace(expr[:at])
+	rest := strings.TrimSpace(expr[at+len(op):])
+	if account == "" || rest == "" {
+		return "", "", amount, false
+	}
+
+	amount, err := ParseAmount(rest)
+	if err != nil {
+		return "", "", amount, false
+	}
+	return account, op, amount, true
+}
+
+// compareAssertion applies an assertion operator.
+func compareAssertion(v int64, op string, to int64) bool {
+	switch op {
+	case "==", "=":
+		return v == to
+	case "!=":
+		return v != to
+	case "<":
+		return v < to
+	case "<=":
+		return v <= to
+	case ">":
+		return v > to
+	case ">=":
+		return v >= to
+	}
+	return false
+}
+
+// AssertionError is returned by RunChecks when a balance assertion does not hold.
+type AssertionError struct {
+	T      int
+	L      lex.Location
+	Expr   string // The assertion, as written.
+	Actual string // The actual balance.
+}
+
+func (err AssertionError) Error() string {
+	return fmt.Sprintf("Transaction %v (defined on line %v) failed balance assertion \"%v\", the balance is %v.", err.T, err.L, err.Expr, err.Actual)
+}
+
+// CheckCurrencyConsistency looks for postings in a commodity other than the home commodity of their account, which
+// usually means an import forgot to convert a foreign currency amount. accountCommodity maps account names to their
+// home commodities, accounts that aren't in it are skipped. Virtual accounts are looked up by their bare names, but
+// not their parents, so "Expenses" does not cover "Expenses:Food". Postings with a cost in the home commodity are
+// fine, as are null postings (which are always in the commodity they balance).
+//
+// Returns a CurrencyError for each posting that does not fit, or nil if there are none.
+func CheckCurrencyConsistency(trs []Transaction, accountCommodity map[string]string) []error {
+	var errs []error
+	for i, tr := range trs {
+		for j, p := range tr.Postings {
+			home, ok := accountCommodity[BareAccount(p.Account)]
+			if !ok || p.Null {
+				continue
+			}
+
+			home = commodityName(home)
+			if commodityName(p.Commodity) == home || (p.HasCost && commodityName(p.CostCommodity) == home) {
+				continue
+			}
+			errs = append(errs, CurrencyError{i, j, tr.Location, p.Account, commodityName(p.Commodity), home})
+		}
+	}
+	return errs
+}
+
+// CurrencyError is returned by CheckCurrencyConsistency for a posting (P) that is not in the home commodity of its
+// account, and has no cost in it either.
+type CurrencyError struct {
+	T         int
+	P         int
+	L         lex.Location
+	Account   string
+	Commodity string
+	Home      string
+}
+
+func (err CurrencyError) Error() string {
+	return fmt.Sprintf("Transaction %v (defined on line %v) has a posting to %v in %v, which is not the account's commodity (%v).", err.T, err.L, err.Account, err.Commodity, err.Home)
+}
+
+// CheckRequiredKeys makes sure that every transaction has each of the required KV keys. If accountFilter is not
+// empty only transactions with a posting to that account (or one of its children) are checked, so
+// "Expenses" checks every expense.
+//
+// A key on the transaction covers all of its postings. Failing that, a key is also found if every posting that is
+// checked has it in its own comments (see Posting.OrderedKV). Those are all of the postings, or just the ones that
+// match the filter if there is one.
+//
+// Returns a MissingKeyError for each key missing from each transaction, or nil if there are none.
+func CheckRequiredKeys(trs []Transaction, required []string, accountFilter string) []error {
+	var errs []error
+	for i := range trs {
+		tr := &trs[i]
+
+		postings := []*Posting{}
+		for j := range tr.Postings {
+			if accountFilter == "" || accountMatches(tr.Postings[j].Account, accountFilter, true) {
+				postings = append(postings, &tr.Postings[j])
+			}
+		}
+		if len(postings) == 0 {
+			continue
+		}
+
+	outer:
+		for _, key := range required {
+			if _, ok := tr.KVPairs[key]; ok {
+				continue
+			}
+		posting:
+			for _, p := range postings {
+				for _, kv := range p.OrderedKV() {
+					if kv.Key == key {
+						continue posting
+					}
+				}
+				errs = append(errs, MissingKeyError{i, tr.Location, key})
+				continue outer
+			}
+		}
+	}
+	return errs
+}
+
+// MissingKeyError is returned by CheckRequiredKeys for a transaction that doesn't have a required KV key.
+type MissingKeyError struct {
+	T   int
+	L   lex.Location
+	Key string
+}
+
+func (err MissingKeyError) Error() string {
+	return fmt.Sprintf("Transaction %v (defined on line %v) is missing the required key %q.", err.T, err.L, err.Key)
+}
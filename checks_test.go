@@ -0,0 +1,302 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestRunChecksInput = `
+2022/09/01 * Paycheck
+	; assert: Assets:Checking == $1,000.00
+    Assets:Checking     $1000.00
+    Income:Salary
+
+2022/09/02 * Groceries
+	; assert: Assets:Checking >= $ten
+    Expenses:Food       $25.50
+    Assets:Checking                = $974.50
+
+2022/09/03 * Souvenirs
+	; assert: Expenses:Travel == 20 EUR
+    Expenses:Travel     20.00 EUR
+    Assets:Checking     $-22.00
+    Liabilities:Card
+
+2022/09/04 * Lunch
+	; assert: the food budget is not blown
+    Expenses:Food       $10.00
+    Assets:Checking
+`
+
+func TestRunChecks(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRunChecksInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second assertion has no number, so it is not understood and there are two warnings.
+	warnings, err := ledger.RunChecks(f.T)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 2 {
+		t.Errorf("Incorrect warnings: %q", warnings)
+	}
+	if f.T[3].KVPairs["assert"] != "the food budget is not blown" {
+		t.Errorf("Unknown assertion was not kept: %v", f.T[3].KVPairs)
+	}
+
+	cases := []struct {
+		tr     int
+		assert string
+		ok     bool
+	}{
+		{0, "Assets:Checking == $1000", true},
+		{0, "Assets:Checking = $1000.00", true},
+		{0, "Assets:Checking != $1000", false},
+		{0, "Assets:Checking == $1,000.01", false},
+		{0, "Assets:Checking == 1.000,00 $", true},
+		{0, "Assets:Checking > $999.99", true},
+		{0, "Assets:Checking < $1000", false},
+		{0, "Assets:Checking <= 1000", true},
+		{1, "Assets:Checking >= $974.51", false},
+		{2, "Liabilities:Card == $-22.00", false},
+		{2, "Liabilities:Card == $22.00", true},
+		{2, "Expenses:Travel == 20€", false},
+		{2, "Expenses:Travel >= EUR 19.9999", true},
+	}
+	for i, c := range cases {
+		trs := make([]ledger.Transaction, len(f.T))
+		for j := range f.T {
+			trs[j] = *f.T[j].CleanCopy()
+		}
+		trs[c.tr].KVPairs["assert"] = c.assert
+
+		_, err := ledger.RunChecks(trs)
+		if c.ok && err != nil {
+			t.Errorf("Case %v: unexpected error: %v", i, err)
+		}
+		if aerr, ok := err.(ledger.AssertionError); !c.ok && (!ok || aerr.T != c.tr) {
+			t.Errorf("Case %v: incorrect error: %v", i, err)
+		}
+	}
+
+	// Posting assertions are checked too.
+	f.T[1].Postings[1].Assert = 9745100
+	_, err = ledger.RunChecks(f.T)
+	if aerr, ok := err.(ledger.AssertionError); !ok || aerr.T != 1 {
+		t.Errorf("Incorrect error for failed posting assertion: %v", err)
+	}
+
+	// As is balance.
+	f.T[1].Postings[1].HasAssert = false
+	f.T[2].Postings[2].Null = false
+	_, err = ledger.RunChecks(f.T)
+	if berr, ok := err.(ledger.BalanceError); !ok || berr.T != 2 {
+		t.Errorf("Incorrect error for unbalanced transaction: %v", err)
+	}
+}
+
+func TestRunChecksSeq(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRunChecksInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Break an assertion, then a transaction, then another assertion.
+	f.T[0].KVPairs["assert"] = "Assets:Checking == $999"
+	f.T[1].Postings[1].Assert = 9745100
+	f.T[2].Postings[2].Null = false
+	f.T[3].KVPairs["assert"] = "Expenses:Food == $35"
+
+	_, errs := ledger.RunChecksSeq(ledger.SliceSeq(f.T), ledger.CheckOptions{})
+	if len(errs) != 1 {
+		t.Fatalf("Incorrect errors: %v", errs)
+	}
+	if aerr, ok := errs[0].(ledger.AssertionError); !ok || aerr.T != 0 {
+		t.Errorf("Incorrect error: %v", errs[0])
+	}
+
+	// Food is at $35.50 as the failed assertions change nothing, and the unbalanced transaction is left out. The
+	// assertion that is not understood is still a warning.
+	warnings, errs := ledger.RunChecksSeq(ledger.SliceSeq(f.T), ledger.CheckOptions{CollectErrors: true})
+	if len(errs) != 4 || len(warnings) != 1 {
+		t.Fatalf("Incorrect errors: %v %q", errs, warnings)
+	}
+	if _, ok := errs[2].(ledger.BalanceError); !ok {
+		t.Errorf("Incorrect error: %v", errs[2])
+	}
+	if aerr, ok := errs[3].(ledger.AssertionError); !ok || aerr.T != 3 || aerr.Actual != "$35.50" {
+		t.Errorf("Incorrect error: %v", errs[3])
+	}
+}
+
+// checksBenchSeq returns a sequence of n made up transactions, each with a balance assertion. The transactions
+// are made as they are needed, so none of them are kept.
+func checksBenchSeq(n int) ledger.Seq[ledger.Transaction] {
+	return func(yield func(ledger.Transaction) bool) {
+		date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < n; i++ {
+			tr := ledger.Transaction{
+				Date:        date.AddDate(0, 0, i/10),
+				Description: "Groceries",
+				Postings: []ledger.Posting{
+					{Account: fmt.Sprintf("Expenses:Food:%v", i%50), Value: 10000},
+					{Account: "Assets:Cash", Value: -10000, Assert: -10000 * int64(i+1), HasAssert: true},
+				},
+			}
+			if !yield(tr) {
+				return
+			}
+		}
+	}
+}
+
+func BenchmarkRunChecksSeq(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, errs := ledger.RunChecksSeq(checksBenchSeq(100000), ledger.CheckOptions{})
+		if len(errs) != 0 {
+			b.Fatal(errs[0])
+		}
+	}
+}
+
+var TestCurrencyConsistencyInput = `
+2023/04/01 * Hotel
+    Expenses:Travel     120.00 EUR
+    Liabilities:Card
+
+2023/04/02 * Dinner
+    Expenses:Food       50.00 EUR @ $1.10
+    Liabilities:Card
+
+2023/04/03 * Museum
+    Expenses:Travel     $15.00
+    (Budget:Travel)     20.00 EUR
+    Liabilities:Card
+`
+
+func TestCheckCurrencyConsistency(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCurrencyConsistencyInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := ledger.CheckCurrencyConsistency(f.T, map[string]string{
+		"Expenses:Travel":  "$",
+		"Expenses:Food":    "$",
+		"Liabilities:Card": "",
+		"Budget:Travel":    "$",
+	})
+	expected := []ledger.CurrencyError{
+		{T: 0, P: 0, Account: "Expenses:Travel", Commodity: "EUR", Home: "$"},
+		{T: 2, P: 1, Account: "(Budget:Travel)", Commodity: "EUR", Home: "$"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Incorrect errors: %v", errs)
+	}
+	for i, e := range expected {
+		cerr, ok := errs[i].(ledger.CurrencyError)
+		cerr.L = 0
+		if !ok || cerr != e {
+			t.Errorf("Incorrect error %v: %v", i, errs[i])
+		}
+	}
+
+	// Accounts without a commodity are skipped.
+	if errs := ledger.CheckCurrencyConsistency(f.T, nil); len(errs) != 0 {
+		t.Errorf("Incorrect errors: %v", errs)
+	}
+}
+
+var TestRequiredKeysInput = `
+2022/10/01 * Lumber
+    ; Project: Deck
+    ; Vendor: Yard
+    Expenses:Materials      $200.00
+    Assets:Checking
+
+2022/10/02 * Split order
+    ; Vendor: Hardware
+    Expenses:Materials      $50.00
+    ; Project: Deck
+    Expenses:Tools          $80.00
+    ; Project: Shed
+    Assets:Checking
+
+2022/10/03 * Split order
+    ; Vendor: Hardware
+    Expenses:Materials      $50.00
+    ; Project: Deck
+    Expenses:Tools          $80.00
+    Assets:Checking
+
+2022/10/04 * Transfer
+    Assets:Savings          $500.00
+    Assets:Checking
+`
+
+func TestCheckRequiredKeys(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRequiredKeysInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		filter   string
+		expected []ledger.MissingKeyError
+	}{
+		// The transfer has no expenses, and the last split is missing a project on one posting.
+		{"Expenses", []ledger.MissingKeyError{{T: 2, Key: "Project"}}},
+		{"Expenses:Materials", nil},
+		// Without a filter the postings to Assets:Checking need a project too.
+		{"", []ledger.MissingKeyError{
+			{T: 1, Key: "Project"},
+			{T: 2, Key: "Project"},
+			{T: 3, Key: "Project"},
+			{T: 3, Key: "Vendor"},
+		}},
+	}
+	for _, c := range cases {
+		errs := ledger.CheckRequiredKeys(f.T, []string{"Project", "Vendor"}, c.filter)
+		if len(errs) != len(c.expected) {
+			t.Errorf("Incorrect errors for %q: %v", c.filter, errs)
+			continue
+		}
+		for i, e := range c.expected {
+			kerr, ok := errs[i].(ledger.MissingKeyError)
+			kerr.L = 0
+			if !ok || kerr != e {
+				t.Errorf("Incorrect error %v for %q: %v", i, c.filter, errs[i])
+			}
+		}
+	}
+}
@@ -169,7 +169,7 @@ func (client *Client) AddTransaction(tr ledger.Transaction) error {
 	for _, ok := client.simpleid[id]; ok; {
 		id = <-transactionIDService
 	}
-	tr.KVPairs["ID"] = id
+	tr.SetKV("ID", id)
 
 	// Next, write the new transaction to the log file. This is the most likely step to fail somehow.
 	_, err = fmt.Fprintf(client.ledger, "\n%v", tr)
@@ -210,7 +210,7 @@ func (client *Client) AddTransactionEdit(tr ledger.Transaction) error {
 	}
 
 	// Generate a revision ID.
-	tr.KVPairs["RID"] = <-transactionIDService
+	tr.SetKV("RID", <-transactionIDService)
 
 	// Next, write the new transaction to the log file.
 	_, err = fmt.Fprintf(client.ledger, "\n%v", tr)
@@ -434,7 +434,7 @@ func (client *Client) AddAttachment(id string, path string) error {
 	if err != nil {
 		return err
 	}
-	tr.KVPairs["Attachments"] = string(rawats)
+	tr.SetKV("Attachments", string(rawats))
 
 	// Submit the transaction as an edit.
 	client.AddTransactionEdit(tr)
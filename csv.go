@@ -0,0 +1,264 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVMapping describes how the columns of a CSV file map to a transaction for StreamCSV.
+type CSVMapping struct {
+	// If set, the first row is a header and the fields below are column names. Otherwise they are column indexes.
+	Header bool
+
+	Date        string   // The date column.
+	DateFormat  string   // The format of the dates, as for time.Parse. Defaults to "01/02/2006".
+	Amount      string   // The amount column.
+	Description []string // The description columns, their values are joined with spaces in the given order.
+
+	To   string // Positive amounts are added to this account.
+	From string // Positive amounts are taken from this account (via a null posting).
+}
+
+// CSVError is returned by StreamCSV when a row cannot be imported or the callback fails for it. Row is the
+// number of the row in the file, counting from one (including the header, if any).
+type CSVError struct {
+	Row int
+	Err error
+}
+
+func (err CSVError) Error() string {
+	return fmt.Sprintf("CSV row %v: %v", err.Row, err.Err)
+}
+
+func (err CSVError) Unwrap() error {
+	return err.Err
+}
+
+// StreamCSV reads a CSV file one row at a time, calling fn with a transaction for each row. Nothing is kept
+// between rows, so this works on files of any size. Each transaction gets a new ID and RID, the same as the import
+// tools.
+//
+// Amounts may include dollar signs and commas for grouping, and parenthesis mark a negative amount. If fn returns
+// an error the import stops and the error is returned wrapped in a CSVError. Problems with the file itself are
+// reported the same way (except for a missing column in the mapping, which is a plain error).
+func StreamCSV(r io.Reader, mapping CSVMapping, fn func(Transaction) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	row := 0
+
+	names := map[string]int{}
+	if mapping.Header {
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		row++
+		if err != nil {
+			return CSVError{row, err}
+		}
+		for i, field := range header {
+			if _, ok := names[field]; !ok {
+				names[field] = i
+			}
+		}
+	}
+	column := func(name string) (int, error) {
+		if mapping.Header {
+			i, ok := names[name]
+			if !ok {
+				return -1, fmt.Errorf("Column %q not found in CSV header.", name)
+			}
+			return i, nil
+		}
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 {
+			return -1, fmt.Errorf("Invalid CSV column index: %q", name)
+		}
+		return i, nil
+	}
+
+	dateIx, err := column(mapping.Date)
+	if err != nil {
+		return err
+	}
+	amountIx, err := column(mapping.Amount)
+	if err != nil {
+		return err
+	}
+	if len(mapping.Description) == 0 {
+		return errors.New("No description columns given.")
+	}
+	descIxs := []int{}
+	for _, name := range mapping.Description {
+		i, err := column(name)
+		if err != nil {
+			return err
+		}
+		descIxs = append(descIxs, i)
+	}
+
+	minLen := dateIx
+	if amountIx > minLen {
+		minLen = amountIx
+	}
+	for _, i := range descIxs {
+		if i > minLen {
+			minLen = i
+		}
+	}
+	minLen++
+
+	format := mapping.DateFormat
+	if format == "" {
+		format = "01/02/2006"
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		row++
+		if err != nil {
+			return CSVError{row, err}
+		}
+		if len(record) < minLen {
+			return CSVError{row, errors.New("Too few fields.")}
+		}
+
+		date, err := time.Parse(format, record[dateIx])
+		if err != nil {
+			return CSVError{row, err}
+		}
+
+		amount, err := parseCSVAmount(record[amountIx])
+		if err != nil {
+			return CSVError{row, err}
+		}
+
+		desc := make([]string, 0, len(descIxs))
+		for _, i := range descIxs {
+			desc = append(desc, record[i])
+		}
+
+		tr := Transaction{
+			Description: strings.Join(desc, " "),
+			Date:        date,
+			Status:      StatusClear,
+			KVPairs: map[string]string{
+				"ID":  <-IDService,
+				"RID": <-IDService,
+			},
+			Postings: []Posting{
+				{
+					Account: mapping.To,
+					Value:   amount,
+				},
+				{
+					Account: mapping.From,
+					Null:    true,
+				},
+			},
+		}
+
+		err = fn(tr)
+		if err != nil {
+			return CSVError{row, err}
+		}
+	}
+}
+
+// parseCSVAmount parses an amount as it is found in bank exports.
+func parseCSVAmount(s string) (int64, error) {
+	clean := strings.Builder{}
+	negate := false
+	for _, chr := range strings.TrimSpace(s) {
+		switch chr {
+		case '$', ')', ',':
+			// Eat these.
+		case '(':
+			negate = true
+		default:
+			clean.WriteRune(chr)
+		}
+	}
+
+	r, ok := new(big.Rat).SetString(clean.String())
+	if !ok || strings.ContainsAny(clean.String(), "/eE") {
+		return 0, fmt.Errorf("Invalid amount: %q", s)
+	}
+	v := ratValue(r)
+	if negate {
+		v = -v
+	}
+	return v, nil
+}
+
+// WriteRegisterCSV writes a register of the given account (and its children) as CSV, the way a bank statement
+// lists an account. There is a header row, then a row for each posting to the account with the date, the payee
+// (see Posting.EffectivePayee), the amount and its commodity, and the balance of the account in that commodity after
+// the posting. Amounts are plain decimal numbers, as for ToRows. Null postings are filled in with the value needed
+// to balance their transaction.
+func WriteRegisterCSV(w io.Writer, trs []Transaction, account string) error {
+	out := csv.NewWriter(w)
+	err := out.Write([]string{"Date", "Payee", "Amount", "Commodity", "Balance"})
+	if err != nil {
+		return err
+	}
+
+	sums := map[string]int64{}
+	for i := range trs {
+		tr := &trs[i]
+		ps, _ := tr.resolve(BalanceOptions{})
+		for j := range ps {
+			p := &ps[j]
+			if !accountMatches(p.Account, account, true) {
+				continue
+			}
+
+			c := commodityName(p.Commodity)
+			sums[c] += p.Value
+			err := out.Write([]string{
+				p.DateIn(tr, PrimaryDate).Format("2006/01/02"),
+				p.EffectivePayee(tr),
+				plainNumber(p.Value, p.Style.Places()),
+				c,
+				plainNumber(sums[c], p.Style.Places()),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
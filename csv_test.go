@@ -0,0 +1,157 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestStreamCSVInput = `Date,Payee,Memo,Amount
+01/02/2022,Coffee Shop,Latte,$4.50
+01/03/2022,Bookstore,,"($1,234.56)"
+01/04/2022,Grocery Store,Weekly,-20
+01/05/2022,Hardware Store,Nails,3.25
+`
+
+func TestStreamCSV(t *testing.T) {
+	mapping := ledger.CSVMapping{
+		Header:      true,
+		Date:        "Date",
+		Amount:      "Amount",
+		Description: []string{"Payee", "Memo"},
+		To:          "Expenses:Unknown",
+		From:        "Assets:Checking",
+	}
+
+	trs := []ledger.Transaction{}
+	err := ledger.StreamCSV(strings.NewReader(TestStreamCSVInput), mapping, func(tr ledger.Transaction) error {
+		trs = append(trs, tr)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		date  string
+		desc  string
+		value int64
+	}{
+		{"2022/01/02", "Coffee Shop Latte", 45000},
+		{"2022/01/03", "Bookstore ", -12345600},
+		{"2022/01/04", "Grocery Store Weekly", -200000},
+		{"2022/01/05", "Hardware Store Nails", 32500},
+	}
+	if len(trs) != len(expected) {
+		t.Fatalf("Incorrect transaction count: %v", len(trs))
+	}
+	for i, e := range expected {
+		tr := trs[i]
+		if tr.Date.Format("2006/01/02") != e.date || tr.Description != e.desc || tr.Postings[0].Value != e.value {
+			t.Errorf("Incorrect transaction %v: %v %q %v", i, tr.Date, tr.Description, tr.Postings[0].Value)
+		}
+		if ok, _ := tr.Balance(); !ok || tr.Postings[0].Account != "Expenses:Unknown" || tr.KVPairs["ID"] == "" {
+			t.Errorf("Incorrect transaction %v: %#v", i, tr)
+		}
+	}
+
+	// Stop half way.
+	stop := errors.New("stop")
+	n := 0
+	err = ledger.StreamCSV(strings.NewReader(TestStreamCSVInput), mapping, func(tr ledger.Transaction) error {
+		n++
+		if n == 2 {
+			return stop
+		}
+		return nil
+	})
+	var cerr ledger.CSVError
+	if !errors.As(err, &cerr) || cerr.Row != 3 || !errors.Is(err, stop) || n != 2 {
+		t.Errorf("Incorrect error from aborted import: %v (%v calls)", err, n)
+	}
+
+	// Columns by index, with a bad row.
+	mapping = ledger.CSVMapping{Date: "0", Amount: "3", Description: []string{"1"}}
+	err = ledger.StreamCSV(strings.NewReader(TestStreamCSVInput), mapping, func(tr ledger.Transaction) error {
+		return nil
+	})
+	if !errors.As(err, &cerr) || cerr.Row != 1 {
+		t.Errorf("Incorrect error for header read as data: %v", err)
+	}
+	n = 0
+	err = ledger.StreamCSV(strings.NewReader(TestStreamCSVInput[strings.Index(TestStreamCSVInput, "\n")+1:]), mapping, func(tr ledger.Transaction) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 4 {
+		t.Errorf("Incorrect result for import by index: %v (%v calls)", err, n)
+	}
+}
+
+var TestRegisterCSVInput = `
+2023/10/01 * Paycheck
+    Assets:Checking     $1,000.00
+    Income:Salary
+
+2023/10/02 * Rent
+    Expenses:Rent       $800.00
+    Assets:Checking
+
+2023/10/03 * Groceries
+    Expenses:Food       $50.00
+    Assets:Cash
+
+2023/10/04 * Exchange
+    Assets:Checking:Euro    €100.00
+    Assets:Checking         $-110.00
+        ; Payee: Bank of Euros
+`
+
+var TestRegisterCSVOutput = `Date,Payee,Amount,Commodity,Balance
+2023/10/01,Paycheck,1000.00,$,1000.00
+2023/10/02,Rent,-800.00,$,200.00
+2023/10/04,Exchange,100.00,€,100.00
+2023/10/04,Bank of Euros,-110.00,$,90.00
+`
+
+func TestWriteRegisterCSV(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRegisterCSVInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(strings.Builder)
+	err = ledger.WriteRegisterCSV(buf, f.T, "Assets:Checking")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != TestRegisterCSVOutput {
+		t.Errorf("Incorrect output:\n%v\nExpected:\n%v", buf.String(), TestRegisterCSVOutput)
+	}
+}
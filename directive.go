@@ -24,6 +24,7 @@ package ledger
 
 import (
 	"bytes"
+	"strings"
 
 	"github.com/milochristiansen/ledger/parse/lex"
 )
@@ -32,21 +33,130 @@ import (
 type Directive struct {
 	Type        string       // The keyword that starts the directive.
 	Argument    string       // Any remaining content that was on the first line of the directive.
+	Comment     string       // ; Stuff (optional, at the end of the first line)
 	Lines       []string     // Subsequent indented lines. Stored here unparsed.
 	FoundBefore int          // The transaction index this directive precedes.
 	Location    lex.Location // Line number this directive begins at.
+	BlankLines  int          // The number of blank lines before the directive, see WriteOptions.PreserveBlankLines.
+}
+
+// DirectiveKind identifies what a directive does. Several keywords may have the same kind (ledger-cli accepts both
+// "Y" and "year", for example), see Directive.Kind.
+type DirectiveKind int
+
+const (
+	DirectiveOther            DirectiveKind = iota // Anything not listed below.
+	DirectiveAccount                               // account
+	DirectiveCommodity                             // commodity
+	DirectivePayee                                 // payee
+	DirectiveTag                                   // tag
+	DirectivePrice                                 // P
+	DirectiveDefaultCommodity                      // D
+	DirectiveYear                                  // Y, year
+	DirectiveComment                               // comment, test (block comments)
+	DirectiveInclude                               // include
+	DirectiveAlias                                 // alias
+	DirectiveApply                                 // apply, end
+	DirectiveSection                               // ---, \f (see parse.Options.KeepSections)
+)
+
+// directiveKeywords maps directive keywords to their kinds.
+var directiveKeywords = map[string]DirectiveKind{
+	"account":   DirectiveAccount,
+	"commodity": DirectiveCommodity,
+	"payee":     DirectivePayee,
+	"tag":       DirectiveTag,
+	"P":         DirectivePrice,
+	"D":         DirectiveDefaultCommodity,
+	"Y":         DirectiveYear,
+	"year":      DirectiveYear,
+	"comment":   DirectiveComment,
+	"test":      DirectiveComment,
+	"include":   DirectiveInclude,
+	"alias":     DirectiveAlias,
+	"apply":     DirectiveApply,
+	"end":       DirectiveApply,
+	"---":       DirectiveSection,
+	"\f":        DirectiveSection,
+}
+
+// Kind returns the kind of the directive, from its keyword. Unknown keywords are DirectiveOther.
+func (d *Directive) Kind() DirectiveKind {
+	return directiveKeywords[d.Type]
+}
+
+// DirectivesOfKind returns the directives of the given kind, in the order they are found in drs.
+func DirectivesOfKind(drs []Directive, kind DirectiveKind) []Directive {
+	rdrs := []Directive{}
+	for i := range drs {
+		if drs[i].Kind() == kind {
+			rdrs = append(rdrs, drs[i])
+		}
+	}
+	return rdrs
+}
+
+// ParseApplyTag reads an `apply tag` directive, returning the tags or KV pair it applies to the transactions in its
+// block. Both `apply tag :tag1:tag2:` and `apply tag tag1` give tags, `apply tag Key: Value` gives a KV pair. Returns
+// false if the directive is not an apply tag directive.
+func ParseApplyTag(d *Directive) ([]string, []KV, bool) {
+	if d.Type != "apply" {
+		return nil, nil, false
+	}
+	if !strings.HasPrefix(d.Argument, "tag ") {
+		return nil, nil, false
+	}
+	arg := strings.TrimSpace(d.Argument[len("tag "):])
+
+	if kv, ok := commentKV(arg); ok {
+		return nil, []KV{kv}, true
+	}
+	tags := []string{}
+	for _, tag := range strings.Split(arg, ":") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil, true
+}
+
+// EndsApply returns true if the directive closes an apply block (`end apply tag`, `end tag`, `end apply`, or a bare
+// `end`).
+func (d *Directive) EndsApply() bool {
+	if d.Type != "end" {
+		return false
+	}
+	switch d.Argument {
+	case "", "apply", "tag", "apply tag", "apply account", "apply year":
+		return true
+	}
+	return false
 }
 
 func (d *Directive) String() string {
+	return d.StringWith(WriteOptions{})
+}
+
+// StringWith is exactly like String, but with options. Only the indent style applies to directives.
+func (d *Directive) StringWith(opts WriteOptions) string {
 	buf := new(bytes.Buffer)
+	indent, _ := opts.indent()
 
 	buf.WriteString(d.Type)
-	buf.WriteRune(' ')
-	buf.WriteString(d.Argument)
+	// A section marker is often just the marker, don't leave a space after it.
+	if d.Argument != "" || d.Kind() != DirectiveSection {
+		buf.WriteRune(' ')
+		buf.WriteString(d.Argument)
+	}
+	if d.Comment != "" {
+		buf.WriteString(" ; ")
+		buf.WriteString(d.Comment)
+	}
 	buf.WriteRune('\n')
 
 	for _, line := range d.Lines {
-		buf.WriteRune('\t')
+		buf.WriteString(indent)
 		buf.WriteString(line)
 		buf.WriteRune('\n')
 	}
@@ -56,7 +166,7 @@ func (d *Directive) String() string {
 
 // Compare two directives to see if they are identical.
 func (d *Directive) Compare(d2 Directive) bool {
-	ok := d.Type == d2.Type && d.Argument == d2.Argument && len(d.Lines) == len(d2.Lines)
+	ok := d.Type == d2.Type && d.Argument == d2.Argument && d.Comment == d2.Comment && len(d.Lines) == len(d2.Lines)
 	if !ok {
 		return false
 	}
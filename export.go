@@ -0,0 +1,117 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// PostingRow is a single posting flattened together with the important parts of its transaction. A slice of
+// these is a simple table that is easy to hand off to other tools (dataframes, Parquet, Arrow, etc).
+type PostingRow struct {
+	Date      time.Time
+	Payee     string // The effective payee of the posting, see Posting.EffectivePayee.
+	Account   string
+	Amount    string // The value as a plain decimal number (no commodity or digit grouping), so nothing is lost to floats.
+	Commodity string // Only empty if Amount is, amounts without a commodity get DefaultCommodity.
+	Tags      []string
+	ID        string // The "ID" KV of the transaction, if any.
+}
+
+// ToRows flattens transactions into exactly one row per posting, in order. Null postings are filled in with the
+// value needed to balance the transaction. A null posting that balances more than one commodity (see
+// Transaction.SplitByCommodity) or that can't be filled in (the transaction doesn't balance) has no single value, so
+// its row has an empty Amount and Commodity. Tags are sorted so the output is deterministic, and each row has its own
+// copy.
+func ToRows(trs []Transaction) []PostingRow {
+	rows := []PostingRow{}
+	for _, tr := range trs {
+		tags := make([]string, 0, len(tr.Tags))
+		for tag, ok := range tr.Tags {
+			if ok {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+
+		// Only use the resolved postings if they line up with the originals.
+		resolved, err := tr.resolve(BalanceOptions{})
+		if err != nil || len(resolved) != len(tr.Postings) {
+			resolved = nil
+		}
+		for i := range tr.Postings {
+			p := &tr.Postings[i]
+			row := PostingRow{
+				Date:    tr.Date,
+				Payee:   p.EffectivePayee(&tr),
+				Account: p.Account,
+				Tags:    slices.Clone(tags),
+				ID:      tr.KVPairs["ID"],
+			}
+			a, ok := p.Amount(), !p.Null
+			if resolved != nil {
+				a, ok = resolved[i].Amount(), true
+			}
+			if ok {
+				row.Amount, row.Commodity = plainNumber(a.Value, a.Style.Places()), commodityName(a.Commodity)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// EffectivePayee returns the payee of the posting, for reports that list postings on their own. Postings don't
+// keep a reference to their transaction, so it must be passed in. This is the transaction's description unless the
+// posting overrides it with a "Payee:" comment (the same as ledger), which is useful when one transaction pays
+// several parties.
+func (p *Posting) EffectivePayee(t *Transaction) string {
+	for _, c := range append([]string{p.Note}, p.Comments...) {
+		if !strings.HasPrefix(c, "Payee:") {
+			continue
+		}
+		if payee := strings.TrimSpace(c[len("Payee:"):]); payee != "" {
+			return payee
+		}
+	}
+	return t.Description
+}
+
+// plainNumber formats a value as a plain decimal number with at least the given number of decimal places. More
+// places are used if needed to represent the value exactly.
+func plainNumber(v int64, places int) string {
+	whole, frac := formatNumber(v, AmountStyle{Precision: 4})
+	frac = strings.TrimRight(frac, "0")
+	for len(frac) < places+1 {
+		frac += "0"
+	}
+	if frac == "." {
+		frac = ""
+	}
+	return whole + frac
+}
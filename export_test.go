@@ -0,0 +1,98 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"testing"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestToRowsInput = `
+2022/05/01 * Market
+	; ID: abc
+	; :food:weekly:
+    Expenses:Food       $12.34
+    Expenses:Flowers    $0.0125
+    Assets:Cash
+
+2022/05/02 * Exchange
+    Assets:Euros        €1.000,00
+    Assets:Checking     $-1,100
+    Equity:Conversion
+
+2022/05/03 * Roommates
+    Assets:Checking     $40.00 ; Payee: Alice
+    Assets:Checking     $35.00
+        ; Payee: Bob
+    Expenses:Rent
+`
+
+func TestToRows(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestToRowsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := ledger.ToRows(f.T)
+
+	expected := []struct {
+		payee, account, amount, commodity, id string
+		tags                                  int
+	}{
+		{"Market", "Expenses:Food", "12.34", "$", "abc", 2},
+		{"Market", "Expenses:Flowers", "0.0125", "$", "abc", 2},
+		{"Market", "Assets:Cash", "-12.3525", "$", "abc", 2},
+		{"Exchange", "Assets:Euros", "1000.00", "€", "", 0},
+		{"Exchange", "Assets:Checking", "-1100", "$", "", 0},
+		// The null posting balances two commodities, so it has no single amount.
+		{"Exchange", "Equity:Conversion", "", "", "", 0},
+		{"Alice", "Assets:Checking", "40.00", "$", "", 0},
+		{"Bob", "Assets:Checking", "35.00", "$", "", 0},
+		{"Roommates", "Expenses:Rent", "-75.00", "$", "", 0},
+	}
+	postings := 0
+	for _, tr := range f.T {
+		postings += len(tr.Postings)
+	}
+	if len(rows) != len(expected) || len(rows) != postings {
+		t.Fatalf("Incorrect number of rows: %v", len(rows))
+	}
+	for i, e := range expected {
+		r := rows[i]
+		if r.Payee != e.payee || r.Account != e.account || r.Amount != e.amount || r.Commodity != e.commodity || r.ID != e.id || len(r.Tags) != e.tags {
+			t.Errorf("Incorrect row %v: %#v", i, r)
+		}
+	}
+	if rows[0].Tags[0] != "food" || rows[0].Tags[1] != "weekly" {
+		t.Errorf("Incorrect tags: %v", rows[0].Tags)
+	}
+
+	// Changing the tags of one row must not change the others.
+	rows[0].Tags[0] = "lunch"
+	if rows[1].Tags[0] != "food" {
+		t.Errorf("Rows share their tags: %v", rows[1].Tags)
+	}
+}
@@ -29,11 +29,14 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/milochristiansen/ledger/parse/lex"
 )
 
 // File hold a parsed ledger file stored as lists of Directives and Transactions.
+// Both lists are kept in the order they appear in the source, so directives that share a FoundBefore value
+// keep their relative order when written.
 type File struct {
 	T []Transaction
 	D []Directive
@@ -47,16 +50,146 @@ var ErrImproperInterleave = errors.New("Ledger file transaction and directive li
 // "FoundBefore" values in the directives. The directive list is sorted on the FoundBefore values as
 // part of this operation.
 func (f *File) Format(w io.Writer) error {
+	return f.FormatWith(w, WriteOptions{})
+}
+
+// DirectiveSort selects the order File.FormatWith writes directives in.
+type DirectiveSort int
+
+const (
+	// Directives are written before the transaction they were found before, in the order they are in the list.
+	DirectivesPreserve DirectiveSort = iota
+
+	// Like DirectivesPreserve, but directives found before the same transaction are written in the order of their
+	// locations, for when the list has been put out of order (by appending directives from another file, say).
+	DirectivesByPosition
+
+	// Price, commodity, account, payee, and tag directives are all moved to the top of the file and grouped by
+	// kind, in that order. Prices are sorted by date, the others by their argument. Every other directive stays
+	// where it is. Directives that change the meaning of what follows them (year, apply and end, alias, D, include,
+	// and unknown directives) are never crossed: anything after one of those only moves up to just after it.
+	DirectivesByKind
+)
+
+// directiveKinds is the order of the directive groups written first by DirectivesByKind.
+var directiveKinds = map[DirectiveKind]int{
+	DirectivePrice:     1,
+	DirectiveCommodity: 2,
+	DirectiveAccount:   3,
+	DirectivePayee:     4,
+	DirectiveTag:       5,
+}
+
+// changesScope returns true if a directive of the given kind may change the meaning of what follows it, so that
+// nothing may be moved across it.
+func changesScope(kind DirectiveKind) bool {
+	switch kind {
+	case DirectiveYear, DirectiveApply, DirectiveAlias, DirectiveDefaultCommodity, DirectiveInclude, DirectiveOther:
+		return true
+	}
+	return false
+}
+
+// sortDirectives returns the directives in the order they should be written for the given mode. The list in the
+// file is only sorted on FoundBefore, anything else is done to a copy.
+func (f *File) sortDirectives(mode DirectiveSort) []Directive {
 	// Use a stable sort to be minimally disruptive.
 	sort.SliceStable(f.D, func(i, j int) bool {
 		return f.D[i].FoundBefore < f.D[j].FoundBefore
 	})
 
+	switch mode {
+	case DirectivesByPosition:
+		ds := append([]Directive(nil), f.D...)
+		sort.SliceStable(ds, func(i, j int) bool {
+			if ds[i].FoundBefore != ds[j].FoundBefore {
+				return ds[i].FoundBefore < ds[j].FoundBefore
+			}
+			if ds[i].Location.Line() != ds[j].Location.Line() {
+				return ds[i].Location.Line() < ds[j].Location.Line()
+			}
+			return ds[i].Location.Column() < ds[j].Location.Column()
+		})
+		return ds
+	case DirectivesByKind:
+		// Each directive that changes the scope starts a new group, which is written right after it.
+		ds := []Directive{}
+		top, rest, at := []Directive{}, []Directive{}, 0
+		flush := func() {
+			sort.SliceStable(top, func(i, j int) bool {
+				ki, kj := directiveKinds[top[i].Kind()], directiveKinds[top[j].Kind()]
+				if ki != kj {
+					return ki < kj
+				}
+				if top[i].Kind() == DirectivePrice {
+					di, dj := priceDate(top[i].Argument), priceDate(top[j].Argument)
+					if !di.Equal(dj) {
+						return di.Before(dj)
+					}
+				}
+				return top[i].Argument < top[j].Argument
+			})
+			ds = append(append(ds, top...), rest...)
+			top, rest = []Directive{}, []Directive{}
+		}
+		for _, d := range f.D {
+			switch {
+			case changesScope(d.Kind()):
+				flush()
+				ds = append(ds, d)
+				at = d.FoundBefore
+			case directiveKinds[d.Kind()] != 0:
+				d.FoundBefore = at
+				top = append(top, d)
+			default:
+				rest = append(rest, d)
+			}
+		}
+		flush()
+		return ds
+	}
+	return f.D
+}
+
+// priceDate returns the date a price directive's argument starts with, or the zero time if it does not start with
+// a date.
+func priceDate(arg string) time.Time {
+	field, _, _ := strings.Cut(arg, " ")
+	field = strings.NewReplacer("-", "/", ".", "/").Replace(field)
+	date, err := time.Parse("2006/1/2", field)
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// FormatWith is exactly like Format, but with options.
+func (f *File) FormatWith(w io.Writer, opts WriteOptions) error {
+	opts = opts.preserved()
+	ds := f.sortDirectives(opts.DirectiveSort)
+	opts = opts.withDecimalColumn(f.T)
+
+	// The applied tags are written on the transactions unless KeepApplyBlocks is set, so the apply tag directives
+	// must go, along with the ends of their blocks. Other apply blocks are kept, so track which end is which.
+	applies := []bool{}
+
 	ctr, cdr := 0, 0
-	for ctr < len(f.T) || cdr < len(f.D) {
+	for ctr < len(f.T) || cdr < len(ds) {
 		// If we have remaining directives and the next directive goes before the current transaction
-		if cdr < len(f.D) && f.D[cdr].FoundBefore == ctr {
-			fmt.Fprintf(w, "\n%v", f.D[cdr].String())
+		if cdr < len(ds) && ds[cdr].FoundBefore == ctr {
+			skip := false
+			if !opts.KeepApplyBlocks {
+				if ds[cdr].Type == "apply" {
+					_, _, skip = ParseApplyTag(&ds[cdr])
+					applies = append(applies, skip)
+				} else if ds[cdr].EndsApply() && len(applies) > 0 {
+					skip = applies[len(applies)-1]
+					applies = applies[:len(applies)-1]
+				}
+			}
+			if !skip {
+				fmt.Fprintf(w, "%v%v", opts.blankLines(ds[cdr].BlankLines), ds[cdr].StringWith(opts))
+			}
 			cdr++
 			continue
 		}
@@ -67,12 +200,231 @@ func (f *File) Format(w io.Writer) error {
 		}
 
 		// Write next transaction
-		fmt.Fprintf(w, "\n%v", f.T[ctr].String())
+		fmt.Fprintf(w, "%v%v", opts.blankLines(f.T[ctr].BlankLines), f.T[ctr].StringWith(opts))
 		ctr++
 	}
 	return nil
 }
 
+// blankLines returns the blank lines written before a transaction or directive that was parsed with n before it.
+func (opts WriteOptions) blankLines(n int) string {
+	if !opts.PreserveBlankLines {
+		return "\n"
+	}
+	return strings.Repeat("\n", n)
+}
+
+// Append adds a transaction to the file, giving it an ID first (via AssignIDs) if it does not have one. The
+// transaction is inserted after every transaction that does not sort after it (see CompareTransactions), so a sorted
+// file stays sorted, and each directive stays with the transaction it was found before. Returns the transaction's ID.
+//
+// Any IDIndex built for f.T is not valid after this, use AppendIndexed to keep one up to date.
+func (f *File) Append(t Transaction) string {
+	return f.AppendIndexed(t, nil)
+}
+
+// AppendIndexed is exactly like Append, but it also updates idx (which must have been built for f.T) so it stays
+// valid. idx may be nil.
+func (f *File) AppendIndexed(t Transaction, idx *IDIndex) string {
+	ts := []Transaction{*t.CleanCopy()}
+	AssignIDs(ts)
+	t = ts[0]
+
+	at := sort.Search(len(f.T), func(i int) bool {
+		return CompareTransactions(&f.T[i], &t) > 0
+	})
+	f.T = append(f.T, Transaction{})
+	copy(f.T[at+1:], f.T[at:])
+	f.T[at] = t
+
+	for i := range f.D {
+		if f.D[i].FoundBefore >= at {
+			f.D[i].FoundBefore++
+		}
+	}
+	if idx != nil {
+		idx.inserted(f.T, at)
+	}
+	return t.KVPairs["ID"]
+}
+
+// Sort sorts the transactions with CompareTransactions and moves every directive to the top of the file, keeping
+// their order. This is the same layout the zipper writes.
+//
+// Any IDIndex built for f.T is not valid after this.
+func (f *File) Sort() {
+	f.SortWith(SortOptions{})
+}
+
+// SortOptions controls File.SortWith.
+type SortOptions struct {
+	// The order of the transactions, CompareTransactions if nil.
+	Compare Comparator
+
+	// If set, comment directives (comment blocks) right before a transaction are taken to document it, and move
+	// with it instead of going to the top of the file. Only comments directly before the transaction count, if any
+	// other directive comes between them and the transaction they go to the top like everything else.
+	KeepComments bool
+}
+
+// SortWith is exactly like Sort, but with options.
+func (f *File) SortWith(opts SortOptions) {
+	cmp := opts.Compare
+	if cmp == nil {
+		cmp = CompareTransactions
+	}
+
+	sort.SliceStable(f.D, func(i, j int) bool {
+		return f.D[i].FoundBefore < f.D[j].FoundBefore
+	})
+
+	// Find the comments attached to each transaction, the run of comment directives at the end of its group.
+	attached := map[int][]Directive{}
+	top := []Directive{}
+	for i := 0; i < len(f.D); {
+		j := i
+		for j < len(f.D) && f.D[j].FoundBefore == f.D[i].FoundBefore {
+			j++
+		}
+		k := j
+		if opts.KeepComments && f.D[i].FoundBefore < len(f.T) {
+			for k > i && f.D[k-1].Kind() == DirectiveComment {
+				k--
+			}
+		}
+		top = append(top, f.D[i:k]...)
+		if k < j {
+			attached[f.D[i].FoundBefore] = f.D[k:j]
+		}
+		i = j
+	}
+
+	order := make([]int, len(f.T))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return cmp(&f.T[order[i]], &f.T[order[j]]) < 0
+	})
+
+	trs := make([]Transaction, 0, len(f.T))
+	for i := range top {
+		top[i].FoundBefore = 0
+	}
+	drs := top
+	for at, i := range order {
+		for _, d := range attached[i] {
+			d.FoundBefore = at
+			drs = append(drs, d)
+		}
+		trs = append(trs, f.T[i])
+	}
+	f.T, f.D = trs, drs
+}
+
+// ErrMissingID is returned by File.WriteChanges if a transaction does not have an "ID" KV.
+var ErrMissingID = errors.New("Transaction does not have an ID.")
+
+// ErrSourceMismatch is returned by File.WriteChanges if the file was not parsed from the given source.
+var ErrSourceMismatch = errors.New("Ledger file does not match the source it was parsed from.")
+
+// WriteChanges writes out src (the source f was parsed from) with the changes from trs applied, touching as
+// little as possible so that diffs stay small. Transactions are matched up by their "ID" KV:
+//
+//   - Transactions in f that have a match in trs are replaced with it, unless the match writes out identically
+//     to the original (in which case the original text is kept exactly as it was).
+//   - Transactions in f with an ID that is not in trs are removed, along with the blank lines before them.
+//   - Transactions in trs with an ID that is not in f are added to the end of the file, in order.
+//   - Transactions in f without an ID are left alone, as is everything that isn't a transaction.
+//
+// If an ID is used more than once in f (revision history), only the last transaction with that ID is matched and
+// the others are left alone. Every transaction in trs must have an ID.
+func (f *File) WriteChanges(w io.Writer, src []byte, trs []Transaction) error {
+	byid := map[string]int{}
+	for i, tr := range trs {
+		id, ok := tr.KVPairs["ID"]
+		if !ok {
+			return ErrMissingID
+		}
+		byid[id] = i
+	}
+
+	last := map[string]int{}
+	for i, tr := range f.T {
+		if id, ok := tr.KVPairs["ID"]; ok {
+			last[id] = i
+		}
+		if tr.Start > tr.End || tr.End > int64(len(src)) || (i > 0 && tr.Start < f.T[i-1].End) {
+			return ErrSourceMismatch
+		}
+	}
+
+	used := map[string]bool{}
+	cursor := int64(0)
+	for i, tr := range f.T {
+		id, ok := tr.KVPairs["ID"]
+		if !ok || last[id] != i {
+			continue
+		}
+
+		j, ok := byid[id]
+		if !ok {
+			// Removed, along with the blank lines that separate it from what comes before it (or after it, if it is
+			// the first thing in the file).
+			start, end := tr.Start, tr.End
+			for start > cursor && start >= 2 && src[start-1] == '\n' && src[start-2] == '\n' {
+				start--
+			}
+			for start == tr.Start && end < int64(len(src)) && src[end] == '\n' && (end == 0 || src[end-1] == '\n') {
+				end++
+			}
+			_, err := w.Write(src[cursor:start])
+			if err != nil {
+				return err
+			}
+			cursor = end
+			continue
+		}
+
+		_, err := w.Write(src[cursor:tr.Start])
+		if err != nil {
+			return err
+		}
+		cursor = tr.End
+		used[id] = true
+
+		if trs[j].String() == tr.String() {
+			_, err = w.Write(src[tr.Start:tr.End])
+		} else {
+			_, err = io.WriteString(w, trs[j].String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(src[cursor:])
+	if err != nil {
+		return err
+	}
+	newline := len(src) == 0 || src[len(src)-1] == '\n'
+
+	for _, tr := range trs {
+		if used[tr.KVPairs["ID"]] {
+			continue
+		}
+		if !newline {
+			fmt.Fprint(w, "\n")
+			newline = true
+		}
+		_, err = fmt.Fprintf(w, "\n%v", tr.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ErrMalformedAccountName is returned by File.Accounts if an account name is malformed.
 type ErrMalformedAccountName struct {
 	Name     string
@@ -137,7 +489,7 @@ func (f *File) Accounts() ([]Account, error) {
 func (f *File) Payees() ([]Payee, error) {
 	payees := []Payee{}
 	for dIx, d := range f.D {
-		if d.Type != "account" {
+		if d.Type != "payee" {
 			continue
 		}
 
@@ -163,6 +515,248 @@ func (f *File) Payees() ([]Payee, error) {
 	return payees, nil
 }
 
+// Tags returns a slice of all tag directives, in the order they are found in D. See ParseTagDirective.
+func (f *File) Tags() []TagDirective {
+	tags := []TagDirective{}
+	for dIx, d := range f.D {
+		if d.Kind() != DirectiveTag {
+			continue
+		}
+		tag := ParseTagDirective(&d)
+		tag.DirectiveIndex = dIx
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// ParseTagDirective reads a tag directive. The DirectiveIndex is left as zero.
+func ParseTagDirective(d *Directive) TagDirective {
+	tag := TagDirective{
+		Name:        d.Argument,
+		FoundBefore: d.FoundBefore,
+		Location:    d.Location,
+	}
+	for _, sd := range d.Lines {
+		if strings.HasPrefix(sd, "check") {
+			tag.Checks = append(tag.Checks, strings.TrimSpace(sd[len("check"):]))
+		} else if strings.HasPrefix(sd, "assert") {
+			tag.Checks = append(tag.Checks, strings.TrimSpace(sd[len("assert"):]))
+		}
+	}
+	return tag
+}
+
+// Check returns true if the value passes all of the tag's value constraints, otherwise it returns false along with
+// the first constraint that failed.
+//
+// Only simple constraints on the value are supported: `value == "text"`, `value != "text"`, `value =~ /regex/`,
+// and `value !~ /regex/` (single quotes work as well). Anything else is skipped, as is a regex that doesn't
+// compile.
+func (tag *TagDirective) Check(value string) (string, bool) {
+	for _, expr := range tag.Checks {
+		rest := strings.TrimSpace(strings.TrimPrefix(expr, "value"))
+		if len(rest) == len(expr) || len(rest) < 4 {
+			continue
+		}
+		op, arg := rest[:2], strings.TrimSpace(rest[2:])
+		if len(arg) < 2 {
+			continue
+		}
+
+		pass := true
+		switch {
+		case (op == "==" || op == "!=") && (arg[0] == '"' || arg[0] == '\'') && arg[len(arg)-1] == arg[0]:
+			pass = (value == arg[1:len(arg)-1]) == (op == "==")
+		case (op == "=~" || op == "!~") && arg[0] == '/' && arg[len(arg)-1] == '/':
+			re, err := regexp.Compile(arg[1 : len(arg)-1])
+			if err != nil {
+				continue
+			}
+			pass = re.MatchString(value) == (op == "=~")
+		}
+		if !pass {
+			return expr, false
+		}
+	}
+	return "", true
+}
+
+// Commodities returns a slice of all commodity directives, in the order they are found in D.
+// If any commodity directives fail to parse, Commodities returns an error.
+func (f *File) Commodities() ([]Commodity, error) {
+	cs := []Commodity{}
+	for dIx, d := range f.D {
+		if d.Type != "commodity" {
+			continue
+		}
+
+		c := Commodity{
+			Name:           d.Argument,
+			FoundBefore:    d.FoundBefore,
+			Location:       d.Location,
+			DirectiveIndex: dIx,
+		}
+		if c.Name == "" || strings.ContainsAny(c.Name, " \t;") && !strings.HasPrefix(c.Name, "\"") {
+			return nil, ErrMalformedCommodityName{c.Name, c.Location}
+		}
+		c.Name = strings.Trim(c.Name, "\"")
+
+		for sdIx, sd := range d.Lines {
+			if strings.HasPrefix(sd, "nomarket") {
+				c.NoMarket = true
+			} else if strings.HasPrefix(sd, "alias") {
+				alias := strings.Trim(strings.TrimSpace(sd[len("alias"):]), "\"")
+				if alias == "" {
+					return nil, ErrMalformedCommodityName{
+						Name:     alias,
+						Location: c.Location.L(c.Location.Line() + uint64(sdIx) + 1),
+					}
+				}
+				c.Aliases = append(c.Aliases, alias)
+			} else if strings.HasPrefix(sd, "note") {
+				c.Note = strings.TrimSpace(sd[len("note"):])
+			}
+		}
+
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// ErrMalformedCommodityName is returned by File.Commodities if a commodity name is malformed.
+type ErrMalformedCommodityName struct {
+	Name     string
+	Location lex.Location
+}
+
+func (err ErrMalformedCommodityName) Error() string {
+	return fmt.Sprintf("Malformed commodity name (%s) at %s", err.Name, err.Location)
+}
+
+// CommodityAliases returns a map of every alias declared by the given commodities to the commodity it is an alias
+// of, so that (for example) "USD" and "$" can be treated as the same commodity. Every commodity maps to itself as
+// well, so the map can be used to look up the canonical name of any declared commodity. Set BalanceOptions.Aliases
+// to this to have balancing and reports treat the aliases as the same commodity.
+func CommodityAliases(cs []Commodity) map[string]string {
+	aliases := map[string]string{}
+	for _, c := range cs {
+		aliases[c.Name] = c.Name
+		for _, a := range c.Aliases {
+			aliases[a] = c.Name
+		}
+	}
+	return aliases
+}
+
+// Price is a simple type representing a price directive (P 2023/01/02 AAPL $150.00), which gives the price of one
+// unit of a commodity on a date.
+type Price struct {
+	Date      time.Time // Including the time of day, if one was given.
+	Commodity string    // The commodity being priced, without any quotes.
+	Price     Amount
+
+	FoundBefore    int          // The transaction index this directive precedes.
+	DirectiveIndex int          // The index of this directive in the list of all directives. Calling File.Format may ruin this relationship.
+	Location       lex.Location // Line number where this directive starts.
+}
+
+// Prices returns a slice of all price directives, in the order they are found in D. Prices for a commodity that is
+// declared nomarket (see Commodity) are left out. The commodities are written as they
+// are in the directives, aliases are only resolved by PriceAt.
+//
+// The date is read with ParseDateIn, short dates are not allowed. If any price or commodity directives fail to parse,
+// Prices returns an error.
+func (f *File) Prices() ([]Price, error) {
+	cs, err := f.Commodities()
+	if err != nil {
+		return nil, err
+	}
+	nomarket := map[string]bool{}
+	for _, c := range cs {
+		if !c.NoMarket {
+			continue
+		}
+		nomarket[c.Name] = true
+		for _, a := range c.Aliases {
+			nomarket[a] = true
+		}
+	}
+
+	prices := []Price{}
+	for dIx, d := range f.D {
+		if d.Kind() != DirectivePrice {
+			continue
+		}
+
+		p, ok := parsePrice(d.Argument)
+		if !ok {
+			return nil, ErrMalformedPrice{d.Argument, d.Location}
+		}
+		if nomarket[p.Commodity] {
+			continue
+		}
+		p.FoundBefore, p.DirectiveIndex, p.Location = d.FoundBefore, dIx, d.Location
+		prices = append(prices, p)
+	}
+	return prices, nil
+}
+
+// parsePrice reads the argument of a price directive: a date, an optional time of day, the commodity, and the price.
+func parsePrice(arg string) (Price, bool) {
+	fields := strings.Fields(arg)
+	if len(fields) < 3 {
+		return Price{}, false
+	}
+	date, rest := fields[0], strings.TrimSpace(arg[len(fields[0]):])
+	if _, ok := ParseTimeOfDay(fields[1]); ok {
+		date += " " + fields[1]
+		rest = strings.TrimSpace(rest[len(fields[1]):])
+	}
+
+	p := Price{}
+	var err error
+	p.Date, err = ParseDateIn(date, 0)
+	if err != nil {
+		return Price{}, false
+	}
+	cr := lex.NewCharReader(rest, 1)
+	p.Commodity, err = ScanCommodity(cr)
+	if err != nil || p.Commodity == "" || !cr.Match(" \t") {
+		return Price{}, false
+	}
+	p.Price, err = ParseAmount(string(cr.ReadUntil("\n", nil)))
+	if err != nil {
+		return Price{}, false
+	}
+	return p, true
+}
+
+// ErrMalformedPrice is returned by File.Prices if a price directive is malformed.
+type ErrMalformedPrice struct {
+	Argument string
+	Location lex.Location
+}
+
+func (err ErrMalformedPrice) Error() string {
+	return fmt.Sprintf("Malformed price (%s) at %s", err.Argument, err.Location)
+}
+
+// PriceAt returns the price of one unit of the commodity from the last of the prices dated no later than at, or
+// false if there is no such price. Commodities are compared by name with the given aliases (as from CommodityAliases,
+// may be nil) resolved, and prices with the same date are taken in order, so the last one wins.
+func PriceAt(prices []Price, commodity string, at time.Time, aliases map[string]string) (Amount, bool) {
+	opts := BalanceOptions{Aliases: aliases}
+	c := opts.commodity(commodity)
+	found, ok := Price{}, false
+	for _, p := range prices {
+		if opts.commodity(p.Commodity) != c || p.Date.After(at) || (ok && p.Date.Before(found.Date)) {
+			continue
+		}
+		found, ok = p, true
+	}
+	return found.Price, ok
+}
+
 // Account is a simple type representing an account directive. Subdirectives containing value expressions
 // are not included.
 type Account struct {
@@ -188,6 +782,30 @@ type Payee struct {
 	Location       lex.Location // Line number where this directive starts.
 }
 
+// TagDirective is a simple type representing a tag directive, which declares a tag (`:tag:`) or the key of a KV
+// pair (`key: value`).
+type TagDirective struct {
+	Name   string   // The tag or key.
+	Checks []string // The expression of each check or assert subdirective, see TagDirective.Check.
+
+	FoundBefore    int          // The transaction index this directive precedes.
+	DirectiveIndex int          // The index of this directive in the list of all directives. Calling File.Format may ruin this relationship.
+	Location       lex.Location // Line number where this directive starts.
+}
+
+// Commodity is a simple type representing a commodity directive. Subdirectives other than note, alias, and
+// nomarket are not included.
+type Commodity struct {
+	Name     string   // The commodity, without any quotes.
+	Note     string   // The contents of the note subdirective.
+	Aliases  []string // One string for each alias subdirective. See CommodityAliases.
+	NoMarket bool     // True if the nomarket subdirective is present, meaning the commodity is never valued. See File.Prices.
+
+	FoundBefore    int          // The transaction index this directive precedes.
+	DirectiveIndex int          // The index of this directive in the list of all directives. Calling File.Format may ruin this relationship.
+	Location       lex.Location // Line number where this directive starts.
+}
+
 // Matched finds transactions by regexp on the description, and returns a slice of found transactions
 // with postings and description modified by the first successful match from matchers. Only transactions
 // with a posting containing the given account will be modified.
@@ -196,14 +814,16 @@ func (f *File) Matched(account string, matchers []Matcher) []Transaction {
 	for _, ftr := range f.T {
 		tr := *ftr.CleanCopy()
 		if tr.Match(account, matchers) {
-			tr.KVPairs["RID"] = <-IDService
+			tr.SetKV("RID", <-IDService)
 			outTrs = append(outTrs, tr)
 		}
 	}
 	return outTrs
 }
 
-// ParseMatchers parses matchers from the directives of this ledger file.
+// ParseMatchers parses matchers from the directives of this ledger file. Each payee subdirective of an account
+// directive is a regexp that books matching transactions to that account. If one of those also matches the name
+// of a payee directive, the payee's aliases (also regexps) book to the account as well, and rename the payee.
 func (f *File) ParseMatchers() ([]Matcher, error) {
 	accounts, err := f.Accounts()
 	if err != nil {
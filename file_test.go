@@ -0,0 +1,861 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestWriteChangesInput = `; A hand maintained file.
+
+account Expenses:Food
+
+2022/06/01 * Groceries
+  ; ID: a
+  Expenses:Food    $20.00   ; odd spacing that must survive
+  Assets:Cash
+
+2022/06/02 * Rent
+  ; ID: b
+  Expenses:Rent    $500.00
+  Assets:Checking
+
+2022/06/03 * Untracked
+  Expenses:Misc    $1.00
+  Assets:Cash
+
+2022/06/04 * Mistake
+  ; ID: c
+  Expenses:Misc    $1,000.00
+  Assets:Cash
+`
+
+func TestWriteChanges(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestWriteChangesInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a untouched, edit b, drop c, and add d.
+	a := *f.T[0].CleanCopy()
+	b := *f.T[1].CleanCopy()
+	b.Postings[0].Value = 5500000
+	d := *f.T[0].CleanCopy()
+	d.KVPairs["ID"] = "d"
+	d.Description = "More Groceries"
+
+	buf := new(strings.Builder)
+	err = f.WriteChanges(buf, []byte(TestWriteChangesInput), []ledger.Transaction{a, b, d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	expected := TestWriteChangesInput[:strings.Index(TestWriteChangesInput, "2022/06/02")] +
+		b.String() +
+		TestWriteChangesInput[strings.Index(TestWriteChangesInput, "\n2022/06/03"):strings.Index(TestWriteChangesInput, "\n\n2022/06/04")+1] +
+		"\n" + d.String()
+	if out != expected {
+		t.Errorf("Incorrect output:\n%v\nExpected:\n%v", out, expected)
+	}
+
+	// Removing a transaction takes its separator with it.
+	buf.Reset()
+	err = f.WriteChanges(buf, []byte(TestWriteChangesInput), []ledger.Transaction{a, f.T[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = TestWriteChangesInput[:strings.Index(TestWriteChangesInput, "\n2022/06/02")] +
+		TestWriteChangesInput[strings.Index(TestWriteChangesInput, "\n2022/06/03"):]
+	if buf.String() != expected {
+		t.Errorf("Incorrect output:\n%v\nExpected:\n%v", buf.String(), expected)
+	}
+
+	// Nothing changed, nothing written differently.
+	buf.Reset()
+	err = f.WriteChanges(buf, []byte(TestWriteChangesInput), []ledger.Transaction{a, f.T[1], f.T[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != TestWriteChangesInput {
+		t.Errorf("Unchanged file was modified:\n%v", buf.String())
+	}
+
+	// Everything needs an ID.
+	err = f.WriteChanges(buf, []byte(TestWriteChangesInput), []ledger.Transaction{f.T[2]})
+	if err != ledger.ErrMissingID {
+		t.Errorf("Incorrect error for transaction without an ID: %v", err)
+	}
+}
+
+var TestAppendInput = `account Assets:Cash
+
+2022/06/01 * One
+  ; ID: a
+  Expenses:Food    $1.00
+  Assets:Cash
+
+account Expenses:Rent
+
+2022/06/03 * Three
+  ; ID: c
+  Expenses:Rent    $3.00
+  Assets:Cash
+`
+
+func TestAppend(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestAppendInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mk := func(day int, desc string) ledger.Transaction {
+		return ledger.Transaction{
+			Date:        time.Date(2022, 6, day, 0, 0, 0, 0, time.UTC),
+			Description: desc,
+			Postings: []ledger.Posting{
+				{Account: "Expenses:Misc", Value: 10000},
+				{Account: "Assets:Cash", Null: true},
+			},
+		}
+	}
+
+	ids := []string{}
+	ids = append(ids, f.Append(mk(2, "Two")))
+	ids = append(ids, f.Append(mk(4, "Four")))
+	// Same date as "One", so the ID decides.
+	half := mk(1, "One and a half")
+	half.KVPairs = map[string]string{"ID": "b"}
+	ids = append(ids, f.Append(half))
+	kept := mk(3, "Three and a half")
+	kept.KVPairs = map[string]string{"ID": "keep"}
+	ids = append(ids, f.Append(kept))
+	if ids[3] != "keep" {
+		t.Errorf("Existing ID was replaced: %v", ids[3])
+	}
+
+	order := []string{"One", "One and a half", "Two", "Three", "Three and a half", "Four"}
+	if len(f.T) != len(order) {
+		t.Fatalf("Incorrect transaction count: %v", len(f.T))
+	}
+	for i, tr := range f.T {
+		if tr.Description != order[i] {
+			t.Errorf("Incorrect transaction %v: %v", i, tr.Description)
+		}
+	}
+	if len(ledger.DuplicateIDs(f.T)) != 0 {
+		t.Errorf("Duplicate IDs: %v", ledger.DuplicateIDs(f.T))
+	}
+	for _, id := range ids {
+		if tr, _ := ledger.FindByID(f.T, id); tr == nil {
+			t.Errorf("Returned ID %q not found", id)
+		}
+	}
+
+	// The second directive must still come right before "Three".
+	if f.D[1].FoundBefore != 3 {
+		t.Errorf("Directive was not moved: %v", f.D[1].FoundBefore)
+	}
+
+	// On the same date the time and then the ID decide, the same as Sort.
+	early := mk(3, "Three, early")
+	early.KVPairs = map[string]string{"ID": "z", "time": "08:00"}
+	late := mk(3, "Three, late")
+	late.KVPairs = map[string]string{"ID": "y", "time": "20:00"}
+	f.Append(late)
+	f.Append(early)
+	order = []string{"One", "One and a half", "Two", "Three", "Three and a half", "Three, early", "Three, late", "Four"}
+	for i, tr := range f.T {
+		if tr.Description != order[i] {
+			t.Errorf("Incorrect transaction %v: %v", i, tr.Description)
+		}
+	}
+}
+
+func TestAppendIndexed(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestAppendInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := ledger.NewIDIndex(f.T)
+
+	mk := func(day int, id string) ledger.Transaction {
+		return ledger.Transaction{
+			Date:    time.Date(2022, 6, day, 0, 0, 0, 0, time.UTC),
+			KVPairs: map[string]string{"ID": id},
+			Postings: []ledger.Posting{
+				{Account: "Expenses:Misc", Value: 10000},
+				{Account: "Assets:Cash", Null: true},
+			},
+		}
+	}
+	f.AppendIndexed(mk(2, "b"), idx)
+	f.AppendIndexed(mk(4, "d"), idx)
+	f.AppendIndexed(mk(1, "z"), idx)
+	f.AppendIndexed(ledger.Transaction{Date: time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)}, idx)
+
+	// Every ID must be found where it is now, the same as a fresh index.
+	fresh := ledger.NewIDIndex(f.T)
+	for _, id := range []string{"a", "b", "c", "d", "z"} {
+		tr, i := idx.Find(id)
+		if tr == nil || tr.KVPairs["ID"] != id {
+			t.Errorf("Incorrect transaction for %q: %v", id, i)
+		}
+		if _, fi := fresh.Find(id); fi != i {
+			t.Errorf("Incorrect index for %q: %v, expected %v", id, i, fi)
+		}
+	}
+
+	// Including duplicates.
+	f.AppendIndexed(mk(5, "b"), idx)
+	if !reflect.DeepEqual(idx.Duplicates(), ledger.NewIDIndex(f.T).Duplicates()) {
+		t.Errorf("Incorrect duplicates: %v", idx.Duplicates())
+	}
+}
+
+var TestIndentStyleInput = `account Expenses:Food
+	note Groceries and the like
+
+2022/06/01 * Groceries
+	; A comment
+	; :food:
+	; ID: a
+    Expenses:Food    $20.00
+        ; On the posting
+    Assets:Cash          = $-20.00
+`
+
+func TestIndentStyle(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestIndentStyleInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tabs, spaces := new(strings.Builder), new(strings.Builder)
+	err = f.Format(tabs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.FormatWith(spaces, ledger.WriteOptions{IndentStyle: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(spaces.String(), "\t") {
+		t.Errorf("Tabs in space indented output:\n%v", spaces.String())
+	}
+
+	// Everything must be in the same column, with a tab being 8 columns.
+	tl := strings.Split(strings.Replace(tabs.String(), "\t", "        ", -1), "\n")
+	sl := strings.Split(spaces.String(), "\n")
+	if len(tl) != len(sl) {
+		t.Fatalf("Incorrect line count: %v != %v", len(sl), len(tl))
+	}
+	for i := range tl {
+		if strings.Contains(tl[i], "$") && strings.Index(tl[i], "$") != strings.Index(sl[i], "$") {
+			t.Errorf("Misaligned line %v:\n%q\n%q", i, sl[i], tl[i])
+		}
+	}
+
+	f2, err := parse.ParseLedgerString(spaces.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(strings.Builder)
+	err = f2.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != tabs.String() {
+		t.Errorf("Space indented output did not reparse the same:\n%v\nExpected:\n%v", buf.String(), tabs.String())
+	}
+}
+
+var TestCommoditiesInput = `commodity $
+	note US dollars
+	alias USD
+	alias "US Dollar"
+
+commodity "VANGUARD 500"
+	nomarket
+
+P 2022/05/01 AAPL $150.00
+P 2022/05/20 10:30 AAPL USD 155.50
+P 2022/05/20 "VANGUARD 500" $400.00
+P 2022/06/01 AAPL $160.00
+
+2022/06/01 * Groceries
+	Expenses:Food    $20.00
+	Assets:Cash
+`
+
+func TestCommodities(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCommoditiesInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := f.Commodities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 {
+		t.Fatalf("Incorrect commodity count: %v", len(cs))
+	}
+	if cs[0].Name != "$" || cs[0].Note != "US dollars" || len(cs[0].Aliases) != 2 || cs[0].NoMarket {
+		t.Errorf("Incorrect commodity: %#v", cs[0])
+	}
+	if cs[1].Name != "VANGUARD 500" || !cs[1].NoMarket || cs[1].DirectiveIndex != 1 {
+		t.Errorf("Incorrect commodity: %#v", cs[1])
+	}
+
+	aliases := ledger.CommodityAliases(cs)
+	for _, a := range []string{"$", "USD", "US Dollar"} {
+		if aliases[a] != "$" {
+			t.Errorf("Incorrect alias for %q: %q", a, aliases[a])
+		}
+	}
+
+	// Once the aliases are in use an alias is the same commodity.
+	tr := f.T[0].CleanCopy()
+	tr.Postings[1].Value, tr.Postings[1].Commodity, tr.Postings[1].Null = -200000, "USD", false
+	if ok, _ := tr.Balance(); ok {
+		t.Errorf("Transaction with an alias balances without the aliases.")
+	}
+	if ok, _ := tr.BalanceWith(ledger.BalanceOptions{Aliases: aliases}); !ok {
+		t.Errorf("Transaction with an alias does not balance.")
+	}
+	lines := ledger.TrialBalanceWith([]ledger.Transaction{*tr}, time.Now(), ledger.ReportOptions{Balance: ledger.BalanceOptions{Aliases: aliases}})
+	for _, l := range lines {
+		if l.Commodity != "$" {
+			t.Errorf("Alias not resolved in a report: %#v", l)
+		}
+	}
+
+	// Prices, without the nomarket commodity.
+	prices, err := f.Prices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 3 || prices[1].Date != time.Date(2022, 5, 20, 10, 30, 0, 0, time.UTC) || prices[1].Price.Value != 1555000 {
+		t.Fatalf("Incorrect prices: %#v", prices)
+	}
+	cases := []struct {
+		commodity string
+		at        time.Time
+		price     int64
+		ok        bool
+	}{
+		{"AAPL", time.Date(2022, 4, 30, 0, 0, 0, 0, time.UTC), 0, false},
+		{"AAPL", time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC), 1500000, true},
+		{"AAPL", time.Date(2022, 5, 31, 0, 0, 0, 0, time.UTC), 1555000, true},
+		{"AAPL", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), 1600000, true},
+		{"VANGUARD 500", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), 0, false},
+	}
+	for _, c := range cases {
+		price, ok := ledger.PriceAt(prices, c.commodity, c.at, aliases)
+		if ok != c.ok || price.Value != c.price {
+			t.Errorf("Incorrect price for %v at %v: %v %v", c.commodity, c.at, price, ok)
+		}
+	}
+
+	// Bad prices are an error.
+	arg := f.D[2].Argument
+	f.D[2].Argument = "2022/05/01 AAPL"
+	if _, err := f.Prices(); err == nil {
+		t.Errorf("No error for malformed price.")
+	}
+	f.D[2].Argument = arg
+
+	// The subdirectives must survive a write.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs2, err := f2.Commodities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range cs {
+		cs2[i].Location = cs[i].Location
+		if !reflect.DeepEqual(cs[i], cs2[i]) {
+			t.Errorf("Commodity %v changed in round trip: %#v", i, cs2[i])
+		}
+	}
+
+	// Bad names are an error.
+	f.D[0].Argument = "US Dollars"
+	if _, err := f.Commodities(); err == nil {
+		t.Errorf("No error for malformed commodity name.")
+	}
+}
+
+var TestBareCommodityInput = `D $1,000.00
+
+2022/10/07 * Groceries
+    Expenses:Food       $12.50
+    Expenses:Imported   EUR 3.00 @ $1.10
+    Assets:Checking     $-15.80 = $984.20
+`
+
+func TestBareCommodity(t *testing.T) {
+	opts := parse.Options{DefaultCommodity: true}
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(TestBareCommodityInput, 1), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(strings.Builder)
+	err = f.FormatWith(buf, ledger.WriteOptions{BareCommodity: "$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out[strings.Index(out, "2022"):], "$") || !strings.Contains(out, "EUR 3.00 @ 1.10") {
+		t.Errorf("Incorrect output:\n%v", out)
+	}
+
+	f2, err := parse.ParseLedgerWith(parse.NewCharReader(out, 1), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f2.T[0].Postings, f.T[0].Postings) {
+		t.Errorf("Incorrect round trip:\n%#v\n%#v", f2.T[0].Postings, f.T[0].Postings)
+	}
+
+	// Explicit by default.
+	buf.Reset()
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "$12.50") {
+		t.Errorf("Incorrect output:\n%v", buf.String())
+	}
+}
+
+var TestParseMatchersInput = `account Expenses:Food
+    note Eating
+    payee ^(Grocer|Market)
+account Expenses:Coffee
+    payee Coffee Shop
+payee Coffee Shop
+    alias ^SQ \*BEANS
+
+2022/10/08 * Grocer Downtown
+    Expenses:Unknown    $30.00
+    Assets:Checking
+
+2022/10/09 * SQ *BEANS 1234
+    Expenses:Unknown    $4.00
+    Assets:Checking
+
+2022/10/10 * Hardware
+    Expenses:Unknown    $8.00
+    Assets:Checking
+`
+
+func TestParseMatchers(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestParseMatchersInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchers, err := f.ParseMatchers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		matched       bool
+		account, desc string
+	}{
+		{true, "Expenses:Food", "Grocer Downtown"},
+		{true, "Expenses:Coffee", "Coffee Shop"},
+		{false, "Expenses:Unknown", "Hardware"},
+	}
+	for i, e := range expected {
+		tr := f.T[i].CleanCopy()
+		if tr.Match("Expenses:Unknown", matchers) != e.matched || tr.Postings[0].Account != e.account || tr.Description != e.desc {
+			t.Errorf("Incorrect match %v: %q %q", i, tr.Postings[0].Account, tr.Description)
+		}
+	}
+
+	// The subdirectives survive a round trip.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accts, err := f2.Accounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accts) != 2 || !reflect.DeepEqual(accts[0].Payees, []string{"^(Grocer|Market)"}) || accts[0].Note != "Eating" {
+		t.Errorf("Incorrect accounts: %#v", accts)
+	}
+}
+
+var TestDirectiveSortInput = `account Expenses:Food
+P 2023/02/01 EUR $1.10
+commodity EUR
+
+2023/01/05 * Groceries
+	Expenses:Food    $20.00
+	Assets:Cash
+
+year 2023
+P 2023/01/01 EUR $1.05
+account Assets:Cash
+
+01/10 * Lunch
+	Expenses:Food    $10.00
+	Assets:Cash
+`
+
+var TestDirectiveSortPreserve = `
+commodity EUR
+
+P 2023/02/01 EUR $1.10
+
+account Expenses:Food
+
+2023/01/05 * Groceries
+	Expenses:Food                                                $20.00
+	Assets:Cash
+
+year 2023
+
+P 2023/01/01 EUR $1.05
+
+account Assets:Cash
+
+01/10 * Lunch
+	Expenses:Food                                                $10.00
+	Assets:Cash
+`
+
+var TestDirectiveSortByKind = `
+P 2023/02/01 EUR $1.10
+
+commodity EUR
+
+account Expenses:Food
+
+2023/01/05 * Groceries
+	Expenses:Food                                                $20.00
+	Assets:Cash
+
+year 2023
+
+P 2023/01/01 EUR $1.05
+
+account Assets:Cash
+
+01/10 * Lunch
+	Expenses:Food                                                $10.00
+	Assets:Cash
+`
+
+func TestDirectiveSort(t *testing.T) {
+	format := func(f *ledger.File, mode ledger.DirectiveSort) string {
+		buf := new(strings.Builder)
+		err := f.FormatWith(buf, ledger.WriteOptions{DirectiveSort: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	f, err := parse.ParseLedgerString(TestDirectiveSortInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preserve := format(f, ledger.DirectivesPreserve)
+	if s := format(f, ledger.DirectivesByPosition); s != preserve {
+		t.Errorf("Incorrect output for ByPosition:\n%v\nExpected:\n%v", s, preserve)
+	}
+
+	// Swapping directives in the list only changes the output when it is not sorted by position.
+	f.D[0], f.D[2] = f.D[2], f.D[0]
+	if s := format(f, ledger.DirectivesByPosition); s != preserve {
+		t.Errorf("Incorrect output for ByPosition:\n%v\nExpected:\n%v", s, preserve)
+	}
+	if s := format(f, ledger.DirectivesPreserve); s != TestDirectiveSortPreserve {
+		t.Errorf("Incorrect output for Preserve:\n%v\nExpected:\n%v", s, TestDirectiveSortPreserve)
+	}
+	if s := format(f, ledger.DirectivesByKind); s != TestDirectiveSortByKind {
+		t.Errorf("Incorrect output for ByKind:\n%v\nExpected:\n%v", s, TestDirectiveSortByKind)
+	}
+}
+
+var TestSortCommentsInput = `account Assets:Cash
+
+2023/02/01 * Rent
+	Expenses:Rent    $500.00
+	Assets:Cash
+
+comment
+	Paid back in March, see the receipt.
+
+2023/01/15 * Loan
+	Assets:Cash    $100.00
+	Liabilities:Loan
+`
+
+var TestSortCommentsOutput = `
+account Assets:Cash
+
+comment 
+	Paid back in March, see the receipt.
+
+2023/01/15 * Loan
+	Assets:Cash                                                 $100.00
+	Liabilities:Loan
+
+2023/02/01 * Rent
+	Expenses:Rent                                               $500.00
+	Assets:Cash
+`
+
+func TestSortComments(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestSortCommentsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SortWith(ledger.SortOptions{KeepComments: true})
+
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != TestSortCommentsOutput {
+		t.Errorf("Incorrect output:\n%v\nExpected:\n%v", buf.String(), TestSortCommentsOutput)
+	}
+
+	// By default everything goes to the top.
+	f, err = parse.ParseLedgerString(TestSortCommentsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Sort()
+	if f.T[0].Description != "Loan" || len(f.D) != 2 || f.D[1].Type != "comment" || f.D[1].FoundBefore != 0 {
+		t.Errorf("Incorrect sort: %v %v", f.T, f.D)
+	}
+}
+
+var TestDirectivesOfKindInput = `P 2023/01/01 EUR $1.05
+account Assets:Cash
+Y 2023
+P 2023/02/01 EUR $1.10
+year 2024
+bucket Assets:Cash
+
+01/10 * Lunch
+	Expenses:Food    $10.00
+	Assets:Cash
+`
+
+func TestDirectivesOfKind(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestDirectivesOfKindInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		kind ledger.DirectiveKind
+		args []string
+	}{
+		{ledger.DirectivePrice, []string{"2023/01/01 EUR $1.05", "2023/02/01 EUR $1.10"}},
+		{ledger.DirectiveAccount, []string{"Assets:Cash"}},
+		{ledger.DirectiveYear, []string{"2023", "2024"}},
+		{ledger.DirectiveOther, []string{"Assets:Cash"}},
+		{ledger.DirectiveCommodity, []string{}},
+	}
+	for i, c := range cases {
+		args := []string{}
+		for _, d := range ledger.DirectivesOfKind(f.D, c.kind) {
+			args = append(args, d.Argument)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("Case %v: incorrect directives: %q", i, args)
+		}
+	}
+}
+
+var TestGlobalAlignInput = `2023/01/01 * Short
+    Expenses:Food    $5.00
+    Assets:Cash
+
+2023/01/02 * Long
+    Expenses:Household:Furniture:Living Room:Sofas and Chairs:Recliners    $1,250.00
+    * Liabilities:Card    $-1,250.00
+
+2023/01/03 * Mixed
+    Expenses:Travel    20,00 €
+    Assets:Cash    = $0.00
+    Assets:Checking
+`
+
+func TestGlobalAlign(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestGlobalAlignInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, indent := range []int{0, 4} {
+		buf := new(strings.Builder)
+		err = f.FormatWith(buf, ledger.WriteOptions{GlobalAlign: true, IndentStyle: indent})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every decimal mark must be in the same column, two spaces after the longest account.
+		column := -1
+		for _, line := range strings.Split(buf.String(), "\n") {
+			line = strings.ReplaceAll(line, "\t", "        ")
+			if !strings.HasPrefix(line, " ") || !strings.ContainsAny(line, ".,") || strings.Contains(line, "=") {
+				continue
+			}
+			runes := []rune(line)
+			mark := len(runes) - 1
+			for runes[mark] != '.' && runes[mark] != ',' {
+				mark--
+			}
+			if column == -1 {
+				column = mark
+			}
+			if mark != column {
+				t.Errorf("Misaligned line with indent %v:\n%v", indent, buf.String())
+				break
+			}
+		}
+		if width := map[int]int{0: 8, 4: 4}[indent]; column != width+len("Expenses:Household:Furniture:Living Room:Sofas and Chairs:Recliners  $1,250") {
+			t.Errorf("Incorrect column with indent %v: %v\n%v", indent, column, buf.String())
+		}
+
+		// Nothing is lost.
+		out, err := parse.ParseLedgerString(buf.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.T[1].Postings[1].Value != f.T[1].Postings[1].Value || out.T[2].Postings[1].Assert != 0 || !out.T[2].Postings[1].HasAssert {
+			t.Errorf("Incorrect output:\n%v", buf.String())
+		}
+	}
+}
+
+func TestDirectiveSortApply(t *testing.T) {
+	input := "account Assets:Cash\n\napply tag trip\naccount Expenses:Travel\n\n2023/01/01 * Taxi\n\tExpenses:Travel    $20.00\n\tAssets:Cash\n\nend apply tag\n"
+	f, err := parse.ParseLedgerString(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(strings.Builder)
+	err = f.FormatWith(buf, ledger.WriteOptions{DirectiveSort: ledger.DirectivesByKind, KeepApplyBlocks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The account declared in the apply block stays in it.
+	f2, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	for _, d := range f2.D {
+		types = append(types, d.Type+" "+d.Argument)
+	}
+	expected := []string{"account Assets:Cash", "apply tag trip", "account Expenses:Travel", "end apply tag"}
+	if !reflect.DeepEqual(types, expected) || !f2.T[0].Tags["trip"] {
+		t.Errorf("Incorrect output:\n%v", buf.String())
+	}
+}
+
+var TestPreserveInput = `apply tag trip
+
+
+2023/01/01 (12) * Taxi
+      ; Late at night.
+	Expenses:Travel    $20.00
+	Assets:Cash        -$20.00
+
+end apply tag
+`
+
+func TestPreserve(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestPreserveInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format := func(opts ledger.WriteOptions) string {
+		buf := new(strings.Builder)
+		err := f.FormatWith(buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	preserve := format(ledger.WriteOptions{Preserve: true})
+	all := format(ledger.WriteOptions{
+		Sign:                  ledger.SignPreserve,
+		PreserveCodeOrder:     true,
+		PreserveCommentIndent: true,
+		PreserveBlankLines:    true,
+		KeepApplyBlocks:       true,
+	})
+	if preserve != all {
+		t.Errorf("Incorrect output:\n%v\nExpected:\n%v", preserve, all)
+	}
+	for _, s := range []string{"apply tag trip\n\n\n", "(12) * Taxi", "      ; Late at night.", "-$20.00"} {
+		if !strings.Contains(preserve, s) {
+			t.Errorf("Output is missing %q:\n%v", s, preserve)
+		}
+	}
+
+	// The transaction on its own too.
+	if s := f.T[0].StringWith(ledger.WriteOptions{Preserve: true}); !strings.Contains(s, "(12) * Taxi") || !strings.Contains(s, "-$20.00") {
+		t.Errorf("Incorrect transaction output:\n%v", s)
+	}
+}
@@ -23,8 +23,11 @@ misrepresented as being the original software.
 package ledger
 
 import (
+	"fmt"
+	"sort"
 	"time"
 
+	"github.com/milochristiansen/ledger/parse/lex"
 	"github.com/teris-io/shortid"
 )
 
@@ -32,10 +35,10 @@ import (
 var IDService <-chan string
 
 func init() {
-	go func() {
-		c := make(chan string)
-		IDService = c
+	c := make(chan string)
+	IDService = c
 
+	go func() {
 		idsource := shortid.MustNew(1, shortid.DefaultABC, uint64(time.Now().UnixNano()))
 
 		for {
@@ -43,3 +46,220 @@ func init() {
 		}
 	}()
 }
+
+// RIDService is a read only channel that will return a revision ID every time you read it. Unlike the IDs from
+// IDService these are based on the time, and each one sorts (as a string) after every earlier one, even across runs
+// as long as the clock does not go backwards. See BumpRID.
+var RIDService <-chan string
+
+func init() {
+	c := make(chan string)
+	RIDService = c
+
+	// The IDs are the time in hex, fixed width so that they sort as numbers.
+	go func() {
+		last := int64(0)
+		for {
+			now := time.Now().UnixNano()
+			if now <= last {
+				now = last + 1
+			}
+			last = now
+			c <- fmt.Sprintf("%016x", now)
+		}
+	}()
+}
+
+// BumpRID gives the transaction a new "RID" KV from RIDService, returning it. Call this whenever a transaction is
+// edited, so that the zipper (which orders revisions of a transaction by RID) puts the edit after the original.
+// RIDs from anywhere else (File.Matched uses IDService, for example) do not sort in any particular order, so the
+// new RID is only guaranteed to sort after RIDs that also came from RIDService.
+func BumpRID(t *Transaction) string {
+	rid := <-RIDService
+	t.SetKV("RID", rid)
+	return rid
+}
+
+// AssignIDs gives every transaction that does not have an "ID" KV a new ID from IDService, returning the number
+// of transactions that got one.
+func AssignIDs(trs []Transaction) int {
+	n := 0
+	for i := range trs {
+		if _, ok := trs[i].KVPairs["ID"]; ok {
+			continue
+		}
+		if trs[i].KVPairs == nil {
+			trs[i].KVPairs = map[string]string{}
+		}
+		trs[i].KVPairs["ID"] = <-IDService
+		n++
+	}
+	return n
+}
+
+// FindByID returns a pointer to the first transaction with the given "ID" KV along with its index, or nil, -1 if
+// there is no such transaction. The pointer is into trs, so changes made through it are visible in the slice.
+// Use DuplicateIDs to find out if an ID is used more than once.
+func FindByID(trs []Transaction, id string) (*Transaction, int) {
+	for i := range trs {
+		if tid, ok := trs[i].KVPairs["ID"]; ok && tid == id {
+			return &trs[i], i
+		}
+	}
+	return nil, -1
+}
+
+// DuplicateIDs returns a map of every "ID" KV that is used by more than one transaction to the indexes of all the
+// transactions that use it, in order. Transactions without an ID are ignored.
+func DuplicateIDs(trs []Transaction) map[string][]int {
+	all := map[string][]int{}
+	for i, tr := range trs {
+		if id, ok := tr.KVPairs["ID"]; ok {
+			all[id] = append(all[id], i)
+		}
+	}
+
+	dups := map[string][]int{}
+	for id, ixs := range all {
+		if len(ixs) > 1 {
+			dups[id] = ixs
+		}
+	}
+	return dups
+}
+
+// IDIndex is an index of transactions by their "ID" KV, for when you need to do a lot of lookups. The index is
+// only valid until the underlying slice is changed (editing transactions in place is fine, as long as their IDs
+// do not change), except by File.AppendIndexed.
+type IDIndex struct {
+	trs   []Transaction
+	index map[string]int
+	dups  map[string][]int
+}
+
+// NewIDIndex builds an IDIndex for the given transactions.
+func NewIDIndex(trs []Transaction) *IDIndex {
+	idx := &IDIndex{
+		trs:   trs,
+		index: map[string]int{},
+		dups:  map[string][]int{},
+	}
+	for i, tr := range trs {
+		id, ok := tr.KVPairs["ID"]
+		if !ok {
+			continue
+		}
+		if first, ok := idx.index[id]; ok {
+			if len(idx.dups[id]) == 0 {
+				idx.dups[id] = []int{first}
+			}
+			idx.dups[id] = append(idx.dups[id], i)
+			continue
+		}
+		idx.index[id] = i
+	}
+	return idx
+}
+
+// inserted updates the index after a transaction was inserted at the given index of trs, which is the slice the
+// index was built for with the new transaction added.
+func (idx *IDIndex) inserted(trs []Transaction, at int) {
+	idx.trs = trs
+	for id, i := range idx.index {
+		if i >= at {
+			idx.index[id] = i + 1
+		}
+	}
+	for _, is := range idx.dups {
+		for j := range is {
+			if is[j] >= at {
+				is[j]++
+			}
+		}
+	}
+
+	id, ok := trs[at].KVPairs["ID"]
+	if !ok {
+		return
+	}
+	first, ok := idx.index[id]
+	if !ok {
+		idx.index[id] = at
+		return
+	}
+	if len(idx.dups[id]) == 0 {
+		idx.dups[id] = []int{first}
+	}
+	idx.dups[id] = append(idx.dups[id], at)
+	sort.Ints(idx.dups[id])
+	idx.index[id] = idx.dups[id][0]
+}
+
+// Find works exactly like FindByID.
+func (idx *IDIndex) Find(id string) (*Transaction, int) {
+	i, ok := idx.index[id]
+	if !ok {
+		return nil, -1
+	}
+	return &idx.trs[i], i
+}
+
+// Duplicates works exactly like DuplicateIDs. The returned map must not be modified.
+func (idx *IDIndex) Duplicates() map[string][]int {
+	return idx.dups
+}
+
+// CheckSyncReady makes sure that the transactions can be synced with the zipper, returning an error for each
+// problem found (or nil if there are none). Every transaction needs an "ID" KV, and no two transactions may share an
+// ID unless they are revisions of the same transaction with different "RID" KVs (the original may have no RID at
+// all). This also guarantees that the zipper can always order transactions on the same date.
+//
+// The errors are MissingIDError and DuplicateIDError values.
+func CheckSyncReady(trs []Transaction) []error {
+	var errs []error
+
+	// The first transaction seen for each ID/RID pair, the RID is empty if missing.
+	type key struct {
+		id, rid string
+	}
+	seen := map[key]int{}
+
+	for i, tr := range trs {
+		id, ok := tr.KVPairs["ID"]
+		if !ok {
+			errs = append(errs, MissingIDError{i, tr.Location})
+			continue
+		}
+
+		k := key{id, tr.KVPairs["RID"]}
+		if first, ok := seen[k]; ok {
+			errs = append(errs, DuplicateIDError{i, tr.Location, id, first})
+			continue
+		}
+		seen[k] = i
+	}
+	return errs
+}
+
+// MissingIDError is returned by CheckSyncReady for a transaction without an ID.
+type MissingIDError struct {
+	T int
+	L lex.Location
+}
+
+func (err MissingIDError) Error() string {
+	return fmt.Sprintf("Transaction %v (defined on line %v) does not have an ID.", err.T, err.L)
+}
+
+// DuplicateIDError is returned by CheckSyncReady for a transaction that can't be told apart from an earlier
+// transaction (First) with the same ID.
+type DuplicateIDError struct {
+	T     int
+	L     lex.Location
+	ID    string
+	First int
+}
+
+func (err DuplicateIDError) Error() string {
+	return fmt.Sprintf("Transaction %v (defined on line %v) has the same ID (%v) as transaction %v.", err.T, err.L, err.ID, err.First)
+}
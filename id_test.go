@@ -0,0 +1,156 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"testing"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestFindByIDInput = `
+2022/01/01 * One
+	; ID: a
+    Expenses:Food       $1.00
+    Assets:Cash
+
+2022/01/02 * Two
+	; ID: b
+    Expenses:Food       $2.00
+    Assets:Cash
+
+2022/01/03 * No ID
+    Expenses:Food       $3.00
+    Assets:Cash
+
+2022/01/04 * Two (edited)
+	; ID: b
+	; RID: x
+    Expenses:Food       $2.50
+    Assets:Cash
+`
+
+func TestFindByID(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestFindByIDInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := ledger.NewIDIndex(f.T)
+	cases := []struct {
+		id   string
+		ix   int
+		desc string
+	}{
+		{"a", 0, "One"},
+		{"b", 1, "Two"},
+		{"c", -1, ""},
+	}
+	for _, c := range cases {
+		for _, find := range []func(string) (*ledger.Transaction, int){
+			func(id string) (*ledger.Transaction, int) { return ledger.FindByID(f.T, id) },
+			idx.Find,
+		} {
+			tr, ix := find(c.id)
+			if ix != c.ix {
+				t.Errorf("Incorrect index for %v: %v", c.id, ix)
+			}
+			if c.ix == -1 {
+				if tr != nil {
+					t.Errorf("Non-nil result for missing ID %v", c.id)
+				}
+				continue
+			}
+			if tr == nil || tr.Description != c.desc {
+				t.Errorf("Incorrect transaction for %v: %#v", c.id, tr)
+			}
+		}
+	}
+
+	// The pointer must point into the slice.
+	tr, ix := ledger.FindByID(f.T, "a")
+	tr.Description = "Changed"
+	if f.T[ix].Description != "Changed" {
+		t.Errorf("FindByID result does not point into the slice.")
+	}
+
+	for _, dups := range []map[string][]int{ledger.DuplicateIDs(f.T), idx.Duplicates()} {
+		if len(dups) != 1 || len(dups["b"]) != 2 || dups["b"][0] != 1 || dups["b"][1] != 3 {
+			t.Errorf("Incorrect duplicates: %v", dups)
+		}
+	}
+}
+
+func TestCheckSyncReady(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestFindByIDInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction without an ID is the only problem, the revision of b is fine.
+	errs := ledger.CheckSyncReady(f.T)
+	if len(errs) != 1 {
+		t.Fatalf("Incorrect errors: %v", errs)
+	}
+	if merr, ok := errs[0].(ledger.MissingIDError); !ok || merr.T != 2 {
+		t.Errorf("Incorrect error: %v", errs[0])
+	}
+
+	// All good.
+	trs := append([]ledger.Transaction{}, f.T[:2]...)
+	trs = append(trs, f.T[3])
+	if errs := ledger.CheckSyncReady(trs); errs != nil {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	// A plain duplicate, and a duplicate revision.
+	trs = append(trs, *f.T[0].CleanCopy(), *f.T[3].CleanCopy())
+	errs = ledger.CheckSyncReady(trs)
+	if len(errs) != 2 {
+		t.Fatalf("Incorrect errors: %v", errs)
+	}
+	for i, e := range []ledger.DuplicateIDError{{T: 3, ID: "a", First: 0}, {T: 4, ID: "b", First: 2}} {
+		derr, ok := errs[i].(ledger.DuplicateIDError)
+		if !ok || derr.T != e.T || derr.ID != e.ID || derr.First != e.First {
+			t.Errorf("Incorrect error %v: %v", i, errs[i])
+		}
+	}
+}
+
+func TestBumpRID(t *testing.T) {
+	tr := ledger.Transaction{Description: "Edited"}
+	first := ledger.BumpRID(&tr)
+	if tr.KVPairs["RID"] != first {
+		t.Fatalf("RID was not set: %v", tr.KVPairs)
+	}
+
+	for i := 0; i < 100; i++ {
+		old := tr.KVPairs["RID"]
+		rid := ledger.BumpRID(&tr)
+		if rid <= old || tr.KVPairs["RID"] != rid {
+			t.Fatalf("Bumped RID %q does not sort after %q", rid, old)
+		}
+	}
+}
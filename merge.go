@@ -0,0 +1,100 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import "container/heap"
+
+// Merge combines any number of lists of transactions, each already sorted as by SortTransactions, into a single
+// sorted list. Transactions that compare equal are taken from the earlier source first, so the result is always
+// the same for the same input. The sources are not modified.
+//
+// This is a k-way merge, which is much faster than merging the sources two at a time when there are many of them.
+func Merge(sources ...[]Transaction) []Transaction {
+	return MergeFunc(CompareTransactions, sources...)
+}
+
+// MergeFunc is exactly like Merge, but the sources are sorted as by SortTransactionsFunc with the given order.
+func MergeFunc(cmp Comparator, sources ...[]Transaction) []Transaction {
+	total := 0
+	h := &mergeHeap{cmp: cmp}
+	for i, src := range sources {
+		total += len(src)
+		if len(src) > 0 {
+			h.cs = append(h.cs, mergeCursor{src: i, trs: src})
+		}
+	}
+	heap.Init(h)
+
+	out := make([]Transaction, 0, total)
+	for h.Len() > 0 {
+		c := &h.cs[0]
+		out = append(out, c.trs[c.at])
+		c.at++
+		if c.at == len(c.trs) {
+			heap.Pop(h)
+			continue
+		}
+		heap.Fix(h, 0)
+	}
+	return out
+}
+
+// mergeCursor is the position in one of the sources given to Merge.
+type mergeCursor struct {
+	src int
+	trs []Transaction
+	at  int
+}
+
+// mergeHeap implements heap.Interface, ordering the cursors by their next transaction.
+type mergeHeap struct {
+	cs  []mergeCursor
+	cmp Comparator
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.cs)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	c := h.cmp(&h.cs[i].trs[h.cs[i].at], &h.cs[j].trs[h.cs[j].at])
+	if c != 0 {
+		return c < 0
+	}
+	return h.cs[i].src < h.cs[j].src
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.cs[i], h.cs[j] = h.cs[j], h.cs[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.cs = append(h.cs, x.(mergeCursor))
+}
+
+func (h *mergeHeap) Pop() any {
+	x := h.cs[len(h.cs)-1]
+	h.cs = h.cs[:len(h.cs)-1]
+	return x
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+)
+
+// mergeSources makes n sorted sources of size transactions each, with plenty of shared dates.
+func mergeSources(n, size int) [][]ledger.Transaction {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	sources := [][]ledger.Transaction{}
+	for i := 0; i < n; i++ {
+		src := []ledger.Transaction{}
+		for j := 0; j < size; j++ {
+			src = append(src, ledger.Transaction{
+				Date:        start.AddDate(0, 0, (j*n+i*7)%size),
+				Description: fmt.Sprintf("%v/%v", i, j),
+				KVPairs:     map[string]string{"ID": fmt.Sprintf("%04d-%04d", j, i)},
+			})
+		}
+		ledger.SortTransactions(src)
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+func TestMerge(t *testing.T) {
+	sources := mergeSources(5, 40)
+	sources = append(sources, nil)
+
+	// Ties are taken from the earlier source.
+	tie := ledger.Transaction{Date: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), Description: "first"}
+	tie2 := tie
+	tie2.Description = "second"
+	sources = append(sources, []ledger.Transaction{tie}, []ledger.Transaction{tie2})
+
+	out := ledger.Merge(sources...)
+	if len(out) != 5*40+2 {
+		t.Fatalf("Incorrect transaction count: %v", len(out))
+	}
+	for i := 1; i < len(out); i++ {
+		if ledger.CompareTransactions(&out[i-1], &out[i]) > 0 {
+			t.Errorf("Transactions %v and %v are out of order: %v %v", i-1, i, out[i-1].Description, out[i].Description)
+		}
+	}
+	first, second := -1, -1
+	for i, tr := range out {
+		switch tr.Description {
+		case "first":
+			first = i
+		case "second":
+			second = i
+		}
+	}
+	if first == -1 || second != first+1 {
+		t.Errorf("Ties were not taken in source order: %v %v", first, second)
+	}
+
+	// The result must be the same as sorting everything at once.
+	all := []ledger.Transaction{}
+	for _, src := range sources {
+		all = append(all, src...)
+	}
+	ledger.SortTransactions(all)
+	for i := range all {
+		if all[i].Description != out[i].Description {
+			t.Errorf("Transaction %v does not match sorted: %v %v", i, out[i].Description, all[i].Description)
+		}
+	}
+
+	if len(ledger.Merge()) != 0 {
+		t.Errorf("Merge of nothing is not empty.")
+	}
+}
+
+// mergePairwise is the simple approach Merge replaces, merging sources two at a time.
+func mergePairwise(sources [][]ledger.Transaction) []ledger.Transaction {
+	out := []ledger.Transaction{}
+	for _, src := range sources {
+		merged := make([]ledger.Transaction, 0, len(out)+len(src))
+		i, j := 0, 0
+		for i < len(out) && j < len(src) {
+			if ledger.CompareTransactions(&src[j], &out[i]) < 0 {
+				merged = append(merged, src[j])
+				j++
+				continue
+			}
+			merged = append(merged, out[i])
+			i++
+		}
+		merged = append(merged, out[i:]...)
+		out = append(merged, src[j:]...)
+	}
+	return out
+}
+
+func BenchmarkMerge(b *testing.B) {
+	sources := mergeSources(64, 500)
+	for i := 0; i < b.N; i++ {
+		if len(ledger.Merge(sources...)) != 64*500 {
+			b.Fatal("Incorrect merge result.")
+		}
+	}
+}
+
+func BenchmarkMergePairwise(b *testing.B) {
+	sources := mergeSources(64, 500)
+	for i := 0; i < b.N; i++ {
+		if len(mergePairwise(sources)) != 64*500 {
+			b.Fatal("Incorrect merge result.")
+		}
+	}
+}
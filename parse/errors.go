@@ -24,6 +24,7 @@ package parse
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/milochristiansen/ledger/parse/lex"
 )
@@ -62,3 +63,70 @@ type ErrMalformedTagLine lex.Location
 func (err ErrMalformedTagLine) Error() string {
 	return fmt.Sprintf("Malformed tags in transaction on line: %v", lex.Location(err))
 }
+
+// ErrStrayPosting is returned by the parser when it finds an indented line that reads as a posting (an account and an
+// amount, usually left behind by a bad edit) but isn't part of a transaction or directive.
+type ErrStrayPosting lex.Location
+
+func (err ErrStrayPosting) Error() string {
+	return fmt.Sprintf("Posting without a transaction on line: %v", lex.Location(err))
+}
+
+// ErrMissingAccount is returned when a posting is only an amount, most likely because the account name was left out.
+type ErrMissingAccount lex.Location
+
+func (err ErrMissingAccount) Error() string {
+	return fmt.Sprintf("Posting missing account name on line: %v", lex.Location(err))
+}
+
+// ErrIncludeNotFound is returned by ResolveInclude when the included file is not in any of the directories.
+type ErrIncludeNotFound string
+
+func (err ErrIncludeNotFound) Error() string {
+	return fmt.Sprintf("Included file not found: %q", string(err))
+}
+
+// ErrTabInAccount is returned by the parser when a posting's account name appears to contain a tab. Tabs are
+// never allowed in account names, a tab always ends the name.
+type ErrTabInAccount lex.Location
+
+func (err ErrTabInAccount) Error() string {
+	return fmt.Sprintf("Tab in account name on line: %v", lex.Location(err))
+}
+
+// ErrUndeclared is returned by the parser in pedantic mode when it finds an account, commodity, or tag that has
+// not been declared yet.
+type ErrUndeclared struct {
+	Kind     string // "account", "commodity", or "tag"
+	Name     string
+	Location lex.Location
+}
+
+func (err ErrUndeclared) Error() string {
+	return fmt.Sprintf("Undeclared %v %q on line: %v", err.Kind, err.Name, err.Location)
+}
+
+// ErrTagValue is returned by the parser in pedantic mode when the value of a KV pair fails one of the constraints
+// declared for its key (see ledger.TagDirective.Check).
+type ErrTagValue struct {
+	Tag        string
+	Value      string
+	Constraint string
+	Location   lex.Location
+}
+
+func (err ErrTagValue) Error() string {
+	return fmt.Sprintf("Value %q of tag %q fails \"%v\" on line: %v", err.Value, err.Tag, err.Constraint, err.Location)
+}
+
+// Errors is returned by the parser when it collects errors instead of stopping at the first one (see
+// Options.CollectErrors). The errors are in the order they were found.
+type Errors []error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
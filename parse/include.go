@@ -0,0 +1,65 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package parse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ResolveInclude finds the file named by the argument of an include directive. The parser does not follow includes
+// itself (they are kept as directives, see ledger.DirectiveInclude), so this is for tools that do.
+//
+// The name may be wrapped in double quotes (for names with spaces), and a leading "~/" is the user's home directory.
+// An absolute name is returned as is, without looking in any of the directories. A relative name is looked for in
+// each of the given directories in order, and the first one that has it wins. Normally the first directory is the
+// one holding the file with the directive, but a tool working on a journal that was moved away from its includes
+// can pass the journal's original root instead, followed by any other places to look. Glob patterns are not
+// expanded, the name must be a single file.
+//
+// Returns ErrIncludeNotFound if none of the directories have the file.
+func ResolveInclude(name string, dirs ...string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		name = name[1 : len(name)-1]
+	}
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		name = filepath.Join(home, name[1:])
+	}
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", ErrIncludeNotFound(name)
+}
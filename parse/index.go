@@ -0,0 +1,147 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package parse
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/milochristiansen/ledger/parse/lex"
+)
+
+// TxnIndex is the little bit of a transaction that ScanIndex reads.
+type TxnIndex struct {
+	Date time.Time
+
+	// The values of the ID, RID, and FITID KVs of the transaction, empty if it doesn't have them.
+	ID    string
+	RID   string
+	FITID string
+
+	Location lex.Location // The line number where the transaction starts.
+
+	// The byte range [Start, End) of the transaction, the same as ledger.Transaction.Start and End would be.
+	Start, End int64
+}
+
+// ScanIndex quickly reads the date, IDs, and position of every transaction in a file, without parsing anything else.
+// This is much faster than a full parse for tools that only need to order or find transactions (such as the
+// zipper), and with the byte ranges a file can be spliced without writing it back out.
+//
+// Only the dates are checked, so a file that ScanIndex reads without error may still fail to parse. Year
+// directives are followed for dates without a year. The KVs are read from the transaction's own comments (as
+// opposed to those of its postings) the same way the parser does with the default options. If a KV is given more
+// than once the last one wins, again the same as the parser.
+func ScanIndex(cr *lex.CharReader) ([]TxnIndex, error) {
+	idx := []TxnIndex{}
+	year := 0
+	for !cr.EOF {
+		cr.Eat(" \t\f")
+		if cr.C == '\n' {
+			cr.Next()
+			continue
+		}
+
+		// Anything that isn't a transaction is skipped, the directives this cares about are all a single line. The
+		// indented lines after a directive belong to it (a comment block, say), the same as for the parser, so
+		// they are skipped as well.
+		if !(cr.Match("0123456789") && cr.NMatch("0123456789")) {
+			l := cr.L
+			line, err := ReadUntilTrimmed(cr, "\n")
+			if err != nil {
+				return nil, err
+			}
+			cr.Next()
+			if line[0] != ';' && line[0] != '-' {
+				for cr.Match(" \t") {
+					cr.EatUntil("\n")
+					cr.Next()
+				}
+			}
+
+			typ, arg, _ := strings.Cut(line, " ")
+			if typ == "Y" || typ == "year" {
+				y, err := strconv.Atoi(strings.TrimSpace(arg))
+				if err != nil || y < 1 || y > 9999 {
+					return nil, ErrBadDate(l)
+				}
+				year = y
+			}
+			continue
+		}
+
+		current := TxnIndex{
+			Location: cr.L,
+			Start:    cr.Offset(),
+		}
+		date, _, err := ParseDateIn(cr, year)
+		if err != nil {
+			return nil, err
+		}
+		current.Date = date
+		cr.EatUntil("\n")
+		cr.Next()
+
+		postings, postIndent := 0, 0
+		for cr.Match(" \t") {
+			indent := ReadIndent(cr)
+			if cr.C != ';' || (postings > 0 && indent >= postIndent) {
+				// A posting, or a comment that belongs to one.
+				if cr.C != ';' {
+					postings++
+					postIndent = indent
+				}
+				cr.EatUntil("\n")
+				cr.Next()
+				continue
+			}
+
+			cr.Next()
+			line, err := ReadUntilTrimmed(cr, "\n")
+			if err != nil {
+				return nil, err
+			}
+			cr.Next()
+
+			// A key can't have white space or another colon in it, and there must be white space after the colon.
+			i := strings.IndexAny(line, " \t")
+			if i < 1 || line[i-1] != ':' || strings.Contains(line[:i-1], ":") {
+				continue
+			}
+			value := strings.TrimSpace(line[i:])
+			switch line[:i-1] {
+			case "ID":
+				current.ID = value
+			case "RID":
+				current.RID = value
+			case "FITID":
+				current.FITID = value
+			}
+		}
+
+		current.End = cr.Offset()
+		idx = append(idx, current)
+	}
+	return idx, nil
+}
@@ -38,12 +38,17 @@ type CharReader struct {
 	// The current character
 	L   Location  // Line
 	C   rune // Character
+	P   int64 // Byte offset of C in the source
 	EOF bool // true if current C and L are invalid, at end of input
 
 	// The lookahead (next) character
 	NL   Location
 	NC   rune
+	NP   int64
 	NEOF bool // true if current NC and NL are invalid, will be at end of input with next advance
+
+	read  int64 // Number of bytes read from the source so far.
+	ended bool  // A newline has been added to the end of the source.
 }
 
 // NewCharReader returns a new CharReader with the input preadvanced so that all fields are valid.
@@ -127,16 +132,29 @@ func (cr *CharReader) Next() {
 	}
 
 	var err error
+	var size int
 
 	cr.C = cr.NC
 	cr.L = cr.NL
+	cr.P = cr.NP
 
 again:
-	cr.NC, _, err = cr.source.ReadRune() // err should only ever be io.EOF
+	cr.NP = cr.read
+	cr.NC, size, err = cr.source.ReadRune() // err should only ever be io.EOF
 	if err != nil {
+		// Hand edited files often end without a newline, but everything that reads a line expects one. So if the
+		// source doesn't end with one, add it. It doesn't take up any space in the source, so offsets are not
+		// affected.
+		if !cr.ended && cr.read > 0 && cr.C != '\n' {
+			cr.ended = true
+			cr.NC = '\n'
+			cr.NL = cr.NL.CPlus()
+			return
+		}
 		cr.NEOF = true
 		return
 	}
+	cr.read += int64(size)
 	cr.NL = cr.NL.CPlus()
 
 	// We simply strip carriage returns.
@@ -152,6 +170,14 @@ again:
 	}
 }
 
+// Offset returns the byte offset of C in the source, or the length of the source if at EOF.
+func (cr *CharReader) Offset() int64 {
+	if cr.EOF {
+		return cr.read
+	}
+	return cr.P
+}
+
 // Eat the given characters until something else is found or EOF.
 func (cr *CharReader) Eat(chars string) {
 	for cr.Match(chars) {
@@ -254,11 +280,11 @@ func (l Location) C(i uint16) Location {
 // LPlus increments the line portion of a Location and returns the result.
 func (l Location) LPlus() Location {
 	i := l.Line()
-	return l.L(i)
+	return l.L(i + 1)
 }
 
 // CPlus increments the column portion of a Location and returns the result.
 func (l Location) CPlus() Location {
 	i := l.Column()
-	return l.C(i)
+	return l.C(i + 1)
 }
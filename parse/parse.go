@@ -23,12 +23,17 @@ misrepresented as being the original software.
 package parse
 
 import (
+	"bytes"
 	"io"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/milochristiansen/ledger"
 	"github.com/milochristiansen/ledger/parse/lex"
+	"golang.org/x/exp/slices"
 )
 
 /*
@@ -41,19 +46,182 @@ The entire file is made up of these four types of entry.
 
 */
 
+// Options controls the optional behavior of the parser. The zero value is the default behavior.
+type Options struct {
+	// Normally a comment line that comes after a posting belongs to that posting if it is indented at least as far
+	// as the posting itself (more indented is clearly a posting comment, the same indentation is ambiguous and goes
+	// to the posting, the same as ledger does). Comment lines before the first posting or indented less than the
+	// posting before them belong to the transaction.
+	//
+	// If this is set all comment lines belong to the transaction, no matter where they are.
+	CommentsToTransaction bool
+
+	// Some tools write long descriptions (payees) over several lines, ending each line but the last with a
+	// backslash. If this is set, such lines are joined with a single space (and the backslashes dropped) to make
+	// the description. Otherwise a trailing backslash is just part of the description and the next line is
+	// parsed normally (which probably means an error).
+	PayeeContinuation bool
+
+	// Allow any commodity to directly follow the number, not just currency symbols. This is for non-financial
+	// ledgers with amounts like `10%` or `2kg`. It is off by default to keep parsing of financial data strict.
+	//
+	// Note that scientific notation is not supported either way: `1e3` is the number 1 with the commodity "e"
+	// followed by garbage, which is an error.
+	UnitSuffix bool
+
+	// Require every account and commodity to be declared (with an account or commodity directive) before it is
+	// used, like ledger's --pedantic. Anything undeclared is an ErrUndeclared, reported as soon as it is found.
+	// Aliases declared on an account or commodity count as declared as well. Amounts written without a commodity
+	// are fine.
+	//
+	// Tags and the keys of KV pairs must be declared with a tag directive as well, except for the keys this library
+	// writes itself (ID, RID, FITID, time, TransferID, and Attachments). The values of KV pairs must also pass any
+	// check or assert constraints on their tag directive (both are treated the same), a failure is an ErrTagValue. Constraints that aren't understood are skipped, see
+	// ledger.TagDirective.Check.
+	Pedantic bool
+
+	// Add the time of day from the "time" KV (see Transaction.TimeOfDay) to the transaction's date. Normally the
+	// KV is just kept as is, it is used to order transactions on the same date either way. A time of day written
+	// after the date (2022/10/02 12:15 Lunch) takes precedence, the KV is not added to it.
+	MergeTime bool
+
+	// Use the precision of the amount in a `D` directive (`D $1,000.00`) as the default precision for that
+	// commodity, so that a later `$5` is written back out as `$5.00`. A `format` line on a commodity directive
+	// (`commodity $` followed by `format $1,000.00`) does the same, and takes precedence over any `D` directive for
+	// the same commodity no matter which comes first. Only amounts after the directive are affected.
+	//
+	// The declared precision is a minimum: an amount written with more decimal places than declared keeps them, so
+	// nothing is lost when the file is written back out. Amounts written without a commodity count as
+	// ledger.DefaultCommodity.
+	DefaultPrecision bool
+
+	// Give amounts written without a commodity the commodity of the last `D` directive before them (`D EUR 1.000,00`
+	// makes `5` into `EUR 5`), placed before or after the number the same as in the directive. Without this they
+	// are left without a commodity, which means ledger.DefaultCommodity. This is what ledger does, and what a file
+	// written with ledger.WriteOptions.BareCommodity needs to read back the same.
+	DefaultCommodity bool
+
+	// Keep going after errors that can be recovered from, returning the file along with all of the errors found as
+	// an Errors. Only stray postings (ErrStrayPosting) and postings without an account (ErrMissingAccount) can be
+	// recovered from so far: the stray lines, or the rest of the transaction, are skipped up to the next line that
+	// isn't indented. Any other error still stops the parser right away.
+	CollectErrors bool
+
+	// Leave the numbers of posting amounts as they were written (in ledger.Posting.Raw) instead of converting them,
+	// for tools that only move transactions around and never look at the values. The commodity is still read, but
+	// the number is not checked at all until it is converted (by ledger.Posting.ParseRaw, Posting.Amount, or
+	// balancing the transaction), and DefaultPrecision does not apply to it. Costs and balance assertions are always
+	// converted, as is the amount of a posting with an assertion.
+	LazyAmounts bool
+
+	// Keep section markers as directives instead of dropping them. Some generated files separate groups of
+	// transactions with a form feed (page break) or a line starting with three or more dashes (`---`, or
+	// `--- Section name ---`). Either way they are never part of a transaction. A form feed is kept as a directive
+	// with the type "\f", and a dashed line as one with the type "---" and the text after the dashes as the argument.
+	// Together with ledger.WriteOptions.Preserve this writes a file back out the way it came in.
+	KeepSections bool
+}
+
 // ParseLedgerString parses a ledger File from a string.
 func ParseLedgerString(input string) (*ledger.File, error) {
 	return ParseLedger(lex.NewCharReader(input, 1))
 }
 
+// ParseLedgerBytes parses a ledger File from a byte slice, such as the contents of a file from os.ReadFile. The
+// slice is read in place, without being copied to a string.
+func ParseLedgerBytes(input []byte) (*ledger.File, error) {
+	return ParseLedger(lex.NewRawCharReader(bytes.NewReader(input), 1))
+}
+
 // ParseLedger parses a ledger from a CharReader into a File.
 func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
+	return ParseLedgerWith(cr, Options{})
+}
+
+// ParseLedgerWith parses a ledger from a CharReader into a File using the given options.
+func ParseLedgerWith(cr *lex.CharReader, opts Options) (*ledger.File, error) {
 	transactions := []ledger.Transaction{}
 	directives := []ledger.Directive{}
+	accounts, commodities := map[string]bool{}, map[string]bool{}
+	tags := map[string]ledger.TagDirective{}
+	used := map[string]bool{} // Commodities used by postings so far.
+	year := 0 // From the last Y directive, zero if there hasn't been one.
+
+	// The tags and KV pairs of the enclosing apply blocks, innermost last. Other kinds of apply blocks get an empty
+	// entry so their ends pop the right one.
+	type applied struct {
+		tags []string
+		kvs  []ledger.KV
+	}
+	applies := []applied{}
+
+	// The declared precision of each commodity for DefaultPrecision, and which of those came from a commodity
+	// directive (so a D directive doesn't override them).
+	precisions, formatted := map[string]ledger.AmountStyle{}, map[string]bool{}
+	directiveAmount := func(amount string, l lex.Location) (string, ledger.AmountStyle, error) {
+		_, c, style, null, err := ReadCommodityAmountWith(lex.NewCharReader(amount+"\n", uint(l.Line())), opts)
+		if err != nil {
+			return "", style, err
+		}
+		if null {
+			return "", style, ErrBadAmount(l)
+		}
+		if c == "" {
+			c = ledger.DefaultCommodity
+		}
+		return c, style, nil
+	}
+	declare := func(amount string, l lex.Location, format bool) error {
+		c, style, err := directiveAmount(amount, l)
+		if err != nil {
+			return err
+		}
+		if format || !formatted[c] {
+			precisions[c] = style
+			formatted[c] = formatted[c] || format
+		}
+		return nil
+	}
+
+	// The commodity from the last D directive for DefaultCommodity, along with how it was written.
+	dflt, dfltStyle := "", ledger.AmountStyle{}
+	bare := func(c *string, style *ledger.AmountStyle) {
+		if *c == "" && dflt != "" {
+			*c = dflt
+			style.Suffix, style.Spaced = dfltStyle.Suffix, dfltStyle.Spaced
+		}
+	}
+	precision := func(c string, style *ledger.AmountStyle) {
+		if c == "" {
+			c = ledger.DefaultCommodity
+		}
+		if d, ok := precisions[c]; ok && d.Places() > style.Places() {
+			style.Precision = d.Precision
+		}
+	}
+	errs := Errors{}
+	blank := 0 // Blank lines since the last directive or transaction.
 	for !cr.EOF {
+		// Form feeds (page breaks) are used to separate sections in some generated files.
+		if cr.C == '\f' {
+			if opts.KeepSections {
+				directives = append(directives, ledger.Directive{
+					Type:        "\f",
+					FoundBefore: len(transactions),
+					Location:    cr.L,
+					BlankLines:  blank,
+				})
+				blank = 0
+			}
+			cr.Eat("\f")
+			continue
+		}
+
 		// Eat any leading white space, also lines that are blank.
+		indented := cr.Match(" \t")
 		cr.Eat(" \t")
 		if cr.C == '\n' {
+			blank++
 			cr.Next()
 			continue
 		}
@@ -65,12 +233,40 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 			continue
 		}
 
+		// Lines starting with three or more dashes separate sections as well.
+		if cr.C == '-' {
+			l := cr.L
+			line, err := ReadUntilTrimmed(cr, "\n")
+			if err != nil {
+				return nil, err
+			}
+			cr.Next()
+
+			arg := strings.TrimLeft(line, "-")
+			if len(line)-len(arg) < 3 {
+				return nil, ErrMalformed(l)
+			}
+			if opts.KeepSections {
+				directives = append(directives, ledger.Directive{
+					Type:        "---",
+					Argument:    strings.TrimLeft(arg, " \t"),
+					FoundBefore: len(transactions),
+					Location:    l,
+					BlankLines:  blank,
+				})
+				blank = 0
+			}
+			continue
+		}
+
 		if !(cr.Match("0123456789") && cr.NMatch("0123456789")) {
 			// The start of this line doesn't look like a date, so it must be a directive.
 			current := ledger.Directive{
 				FoundBefore: len(transactions),
 				Location:    cr.L,
+				BlankLines:  blank,
 			}
+			blank = 0
 
 			typ, err := ReadUntilTrimmed(cr, " \n")
 			if err != nil {
@@ -78,13 +274,28 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 			}
 			current.Type = typ
 
+			// Postings are always read along with their transaction, so an indented line that reads as an account
+			// and an amount is a leftover from a bad edit. Anything else indented (directives, comments) is read as
+			// usual, and so are indented transactions.
+			stray := false
 			if cr.NC != '\n' {
+				sep := " "
+				if cr.NC == ' ' || cr.NC == '\t' {
+					sep = "  "
+				}
 				arg, err := ReadUntilTrimmed(cr, "\n")
 				if err != nil {
 					return nil, err
 				}
 				cr.Next()
-				current.Argument = arg
+				stray = indented && current.Kind() == ledger.DirectiveOther && looksLikePosting(typ+sep+arg)
+
+				// Comment lines (# % | *) and comment blocks are comments already, keep them exactly as written.
+				if strings.ContainsAny(typ[:1], "#%|*") || current.Kind() == ledger.DirectiveComment {
+					current.Argument = arg
+				} else {
+					current.Argument, current.Comment = splitComment(arg)
+				}
 			}
 
 			for cr.Match(" \t") {
@@ -102,6 +313,65 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 				current.Lines = append(current.Lines, line)
 			}
 
+			if stray {
+				if !opts.CollectErrors {
+					return nil, ErrStrayPosting(current.Location)
+				}
+				errs = append(errs, ErrStrayPosting(current.Location))
+				continue
+			}
+
+			switch current.Type {
+			case "account":
+				accounts[current.Argument] = true
+				for _, line := range current.Lines {
+					if strings.HasPrefix(line, "alias") {
+						accounts[strings.TrimSpace(line[len("alias"):])] = true
+					}
+				}
+			case "commodity":
+				commodities[strings.Trim(current.Argument, "\"")] = true
+				for _, line := range current.Lines {
+					if strings.HasPrefix(line, "alias") {
+						commodities[strings.Trim(strings.TrimSpace(line[len("alias"):]), "\"")] = true
+					}
+					if opts.DefaultPrecision && strings.HasPrefix(line, "format") {
+						err := declare(strings.TrimSpace(line[len("format"):]), current.Location, true)
+						if err != nil {
+							return nil, err
+						}
+					}
+				}
+			case "tag":
+				tags[current.Argument] = ledger.ParseTagDirective(&current)
+			case "apply":
+				atags, akvs, _ := ledger.ParseApplyTag(&current)
+				applies = append(applies, applied{atags, akvs})
+			case "end":
+				if current.EndsApply() && len(applies) > 0 {
+					applies = applies[:len(applies)-1]
+				}
+			case "Y", "year":
+				y, err := strconv.Atoi(current.Argument)
+				if err != nil || y < 1 || y > 9999 {
+					return nil, ErrBadDate(current.Location)
+				}
+				year = y
+			case "D":
+				if opts.DefaultPrecision {
+					err := declare(current.Argument, current.Location, false)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if opts.DefaultCommodity {
+					dflt, dfltStyle, err = directiveAmount(current.Argument, current.Location)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+
 			directives = append(directives, current)
 			continue
 		}
@@ -109,20 +379,24 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 		// Anything that is left must be a transaction. We will treat transactions and directives
 		// we don't support (yet) as an error.
 		current := ledger.Transaction{
-			Tags:     map[string]bool{},
-			KVPairs:  map[string]string{},
-			Location: cr.L,
+			Tags:       map[string]bool{},
+			KVPairs:    map[string]string{},
+			Location:   cr.L,
+			Start:      cr.Offset(),
+			BlankLines: blank,
 		}
+		blank = 0
 
-		// Parse the leading dates(s)
-		date, err := ParseDate(cr)
+		// Parse the leading dates(s). Both may leave off the year if there was a Y directive.
+		date, short, err := ParseDateIn(cr, year)
 		if err != nil {
 			return nil, err
 		}
 		current.Date = date
+		current.ShortDate = short
 		if cr.C == '=' {
 			cr.Next()
-			date, err := ParseDate(cr)
+			date, _, err := ParseDateIn(cr, year)
 			if err != nil {
 				return nil, err
 			}
@@ -135,60 +409,137 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 			return nil, ErrUnexpectedEnd(cr.L)
 		}
 
-		// The optional cleared indicator
-		if cr.C == '*' {
-			current.Status = ledger.StatusClear
-			cr.Next()
-		} else if cr.C == '!' {
-			current.Status = ledger.StatusPending
-			cr.Next()
-		} else {
-			current.Status = ledger.StatusUndefined
+		// An optional time of day. Descriptions can start with digits too ("7-Eleven", or even "12:30 Lunch"), so a
+		// time only counts if a status or code follows it. If this turns out not to be a time it is the start of the
+		// description instead, and there is no status or code.
+		desc := ""
+		if cr.MatchNumeric() {
+			tm := cr.ReadMatch("0123456789:", nil)
+			if cr.EOF {
+				return nil, ErrUnexpectedEnd(cr.L)
+			}
+			tod, ok := ledger.ParseTimeOfDay(string(tm))
+			if ok = ok && cr.Match(" \t"); ok {
+				tm = cr.ReadMatch(" \t", tm)
+				if cr.EOF {
+					return nil, ErrUnexpectedEnd(cr.L)
+				}
+				ok = cr.C == '*' || cr.C == '!' || cr.C == '('
+			}
+			if ok {
+				current.Date = current.Date.Add(tod)
+				current.HasTime = true
+			} else {
+				tm = cr.ReadUntil("\n", tm)
+				if cr.EOF {
+					return nil, ErrUnexpectedEnd(cr.L)
+				}
+				desc = strings.TrimRight(string(tm), " \t")
+			}
 		}
 
-		// Maybe more whitespace (only if there was a cleared indicator)
-		cr.Eat(" \t")
-		if cr.EOF {
-			return nil, ErrUnexpectedEnd(cr.L)
-		}
+		if desc == "" {
+			// The optional cleared indicator
+			if cr.C == '*' {
+				current.Status = ledger.StatusClear
+				cr.Next()
+			} else if cr.C == '!' {
+				current.Status = ledger.StatusPending
+				cr.Next()
+			} else {
+				current.Status = ledger.StatusUndefined
+			}
 
-		// An optional "code"
-		if cr.C == '(' {
-			cr.Next()
+			// Maybe more whitespace (only if there was a cleared indicator). Some files leave it out (`*Payee`), so
+			// none is required here or after the code.
 			cr.Eat(" \t")
-			desc, err := ReadUntilTrimmed(cr, ")\n")
+			if cr.EOF {
+				return nil, ErrUnexpectedEnd(cr.L)
+			}
+
+			// An optional "code"
+			if cr.C == '(' {
+				cr.Next()
+				cr.Eat(" \t")
+				code, err := ReadUntilTrimmed(cr, ")\n")
+				if err != nil {
+					return nil, err
+				}
+				if cr.C == '\n' {
+					return nil, ErrMalformed(cr.L)
+				}
+				current.Code = code
+				cr.Next()
+
+				// Some files put the status after the code. The status needs white space after it here, so that a
+				// description starting with one of the status characters isn't mistaken for one.
+				cr.Eat(" \t")
+				if current.Status == ledger.StatusUndefined && (cr.C == '*' || cr.C == '!') && strings.ContainsRune(" \t\n", cr.NC) {
+					current.Status = ledger.StatusClear
+					if cr.C == '!' {
+						current.Status = ledger.StatusPending
+					}
+					current.CodeFirst = true
+					cr.Next()
+				}
+			}
+
+			// Even more ws
+			cr.Eat(" \t")
+			if cr.EOF {
+				return nil, ErrUnexpectedEnd(cr.L)
+			}
+
+			// And, to cap the first line off, the description.
+			desc, err = ReadUntilTrimmed(cr, "\n")
 			if err != nil {
 				return nil, err
 			}
-			if cr.C == '\n' {
-				return nil, ErrMalformed(cr.L)
-			}
-			current.Code = desc
-			cr.Next()
 		}
+		cr.Next()
 
-		// Even more ws
-		cr.Eat(" \t")
-		if cr.EOF {
-			return nil, ErrUnexpectedEnd(cr.L)
-		}
+		// Some tools split long descriptions over several lines.
+		for opts.PayeeContinuation && strings.HasSuffix(desc, "\\") {
+			cr.Eat(" \t")
+			if cr.EOF {
+				return nil, ErrUnexpectedEnd(cr.L)
+			}
+			more, err := ReadUntilTrimmed(cr, "\n")
+			if err != nil {
+				return nil, err
+			}
+			cr.Next()
 
-		// And, to cap the first line off, the description.
-		desc, err := ReadUntilTrimmed(cr, "\n")
-		if err != nil {
-			return nil, err
+			desc = strings.TrimRight(strings.TrimSuffix(desc, "\\"), " \t") + " " + more
 		}
 		current.Description = desc
-		cr.Next()
 
 		// Now parse the individual postings or comment lines.
+		postIndent := 0
+		dropped := false
 		for cr.Match(" \t") {
-			cr.Eat(" \t")
+			indent, ws := readIndent(cr)
 			if cr.EOF {
 				return nil, ErrUnexpectedEnd(cr.L)
 			}
 
-			// Is a comment that is attached to the transaction
+			// Is a comment that is attached to the previous posting
+			if cr.C == ';' && !opts.CommentsToTransaction && len(current.Postings) > 0 && indent >= postIndent {
+				cr.Next()
+				line, err := ReadUntilTrimmed(cr, "\n")
+				if err != nil {
+					return nil, err
+				}
+				cr.Next()
+
+				post := &current.Postings[len(current.Postings)-1]
+				post.Comments = append(post.Comments, line)
+				post.CommentIndent = append(post.CommentIndent, ws)
+				continue
+			}
+
+			// Is a comment that is attached to the transaction. Comments before the first posting always end up here,
+			// no matter how far they are indented.
 			if cr.C == ';' {
 				cr.Next()
 
@@ -333,18 +684,23 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 				}
 
 				if state == 3 {
+					if old, ok := current.KVPairs[key]; ok {
+						current.DuplicateKV = append(current.DuplicateKV, ledger.KV{Key: key, Value: old})
+					}
 					current.KVPairs[key] = strings.TrimSpace(string(ln))
 					continue
 				}
 
 				if state == 2 || state == 4 {
 					current.Comments = append(current.Comments, strings.TrimSpace(string(ln)))
+					current.CommentIndent = append(current.CommentIndent, ws)
 				}
 				continue
 			}
 
 			// Otherwise must be a actual posting
 			post := ledger.Posting{}
+			postIndent = indent
 
 			// The optional cleared indicator, TBH I didn't even know this was a thing until I looked at the spec.
 			if cr.C == '*' {
@@ -366,8 +722,9 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 			// Parsing the account name.
 			// The spec doesn't seem to tell you the rules for account names, but they *can* include spaces.
 			// I am going to allow spaces in account names, but only one in a row. Two or more spaces or a tab
-			// ends the name.
+			// ends the name. Tabs are never part of an account name.
 
+			l := cr.L
 			buf := []rune{}
 			for {
 				if cr.C == '\t' || cr.C == '\n' || (cr.C == ' ' && cr.NC == ' ') {
@@ -380,26 +737,115 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 					return nil, ErrUnexpectedEnd(cr.L)
 				}
 			}
-			if len(buf) == 0 {
+			// A single space right before a tab or the end of the line is not part of the name either.
+			post.Account = strings.TrimRight(string(buf), " ")
+			if post.Account == "" {
 				return nil, ErrMalformed(cr.L)
 			}
-			post.Account = string(buf)
 
+			// A tab ends the account name, so if the name looks cut off (or what comes after doesn't read as an
+			// amount, see below) the tab was most likely meant to be part of the name. Writing the name back out
+			// would then produce garbage, so refuse it. Anything after the tab that does read as an amount is taken
+			// as one, "Expenses:Fo<tab>od 5" is 5 "od" to Expenses:Fo.
+			tab := lex.Location(0)
+			if cr.C == '\t' {
+				tab = cr.L
+				if strings.HasSuffix(post.Account, ":") {
+					return nil, ErrTabInAccount(tab)
+				}
+			}
 			cr.Eat(" \t")
 			if cr.EOF {
 				return nil, ErrUnexpectedEnd(cr.L)
 			}
 
-			post.Value, post.Null, err = ReadAmount(cr)
+			// A posting that is only an amount is missing its account, treating the amount as the name would just
+			// give a confusing error later (or worse, none at all). Numbered accounts ("1200 Receivables") are
+			// common, so this is only done if nothing follows the name. A bare number ("4000") may be a numbered
+			// account used as the null posting, so that is only an error if it isn't declared and the transaction
+			// already has its null posting.
+			if (cr.C == '\n' || cr.C == ';') && looksLikeAmount(post.Account) &&
+				(hasNull(current.Postings) || !accounts[post.Account] && strings.Trim(post.Account, "0123456789") != "") {
+				if !opts.CollectErrors {
+					return nil, ErrMissingAccount(l)
+				}
+				errs = append(errs, ErrMissingAccount(l))
+				skipIndented(cr)
+				dropped = true
+				break
+			}
+			if opts.Pedantic && !accounts[ledger.BareAccount(post.Account)] {
+				return nil, ErrUndeclared{"account", post.Account, l}
+			}
+
+			l = cr.L
+			letter := unicode.IsLetter(cr.C)
+			post.Value, post.Commodity, post.Style, post.Raw, post.Null, err = readAmount(cr, opts, opts.LazyAmounts)
 			if err != nil {
+				if tab != 0 && letter {
+					return nil, ErrTabInAccount(tab)
+				}
 				return nil, err
 			}
+			if post.Commodity != "" {
+				used[post.Commodity] = true
+			}
+			if opts.Pedantic && post.Commodity != "" && !commodities[post.Commodity] {
+				return nil, ErrUndeclared{"commodity", post.Commodity, l}
+			}
+			if !post.Null {
+				bare(&post.Commodity, &post.Style)
+			}
+			if post.Raw == "" {
+				precision(post.Commodity, &post.Style)
+			}
+			al := l
 
 			cr.Eat(" \t")
 			if cr.EOF {
 				return nil, ErrUnexpectedEnd(cr.L)
 			}
 
+			// Parse cost, either per unit (@) or for the whole posting (@@). Any amount of white space is allowed
+			// around the markers.
+			if cr.C == '@' {
+				l := cr.L
+
+				cr.Next()
+				if cr.C == '@' {
+					post.TotalCost = true
+					cr.Next()
+				}
+
+				cr.Eat(" \t")
+				if cr.EOF {
+					return nil, ErrUnexpectedEnd(cr.L)
+				}
+				if post.Null {
+					return nil, ErrMalformed(l)
+				}
+
+				post.HasCost = true
+				null := false
+				post.Cost, post.CostCommodity, post.CostStyle, null, err = ReadCommodityAmountWith(cr, opts)
+				if err != nil {
+					return nil, err
+				}
+				if null {
+					return nil, ErrMalformed(l)
+				}
+				if opts.Pedantic && post.CostCommodity != "" && !commodities[post.CostCommodity] {
+					return nil, ErrUndeclared{"commodity", post.CostCommodity, l}
+				}
+				bare(&post.CostCommodity, &post.CostStyle)
+				precision(post.CostCommodity, &post.CostStyle)
+
+				cr.Eat(" \t")
+				if cr.EOF {
+					return nil, ErrUnexpectedEnd(cr.L)
+				}
+			}
+
 			// Parse balance assertion.
 			if cr.C == '=' {
 				l := cr.L
@@ -413,7 +859,8 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 
 				post.HasAssert = true
 				null := false
-				post.Assert, null, err = ReadAmount(cr)
+				commodity, style := "", ledger.AmountStyle{}
+				post.Assert, commodity, style, null, err = ReadCommodityAmountWith(cr, opts)
 				if err != nil {
 					return nil, err
 				}
@@ -421,6 +868,27 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 					return nil, ErrMalformed(l)
 				}
 
+				// The assertion shares the commodity of the posting, so for a null posting it supplies it.
+				if opts.Pedantic && commodity != "" && !commodities[commodity] {
+					return nil, ErrUndeclared{"commodity", commodity, l}
+				}
+				bare(&commodity, &style)
+
+				// The assertion is written in the style of the posting's amount, so a lazy amount can't stay that way.
+				if post.Raw != "" {
+					if post.ParseRaw() != nil {
+						return nil, ErrBadAmount(al)
+					}
+					precision(post.Commodity, &post.Style)
+				}
+
+				if post.Null {
+					precision(commodity, &style)
+					post.Commodity, post.Style = commodity, style
+				} else if commodity != post.Commodity {
+					return nil, ErrMalformed(l)
+				}
+
 				cr.Eat(" \t")
 				if cr.EOF {
 					return nil, ErrUnexpectedEnd(cr.L)
@@ -452,77 +920,307 @@ func ParseLedger(cr *lex.CharReader) (*ledger.File, error) {
 
 			current.Postings = append(current.Postings, post)
 		}
+		if dropped {
+			continue
+		}
+
+		for i := range current.Postings {
+			postingDates(&current.Postings[i], current.Date.Year())
+		}
+
+		if opts.MergeTime && !current.HasTime {
+			if tod, ok := current.TimeOfDay(); ok {
+				current.Date = current.Date.Add(tod)
+			}
+		}
+
+		// Tags written on the transaction win over applied ones, and inner blocks win over outer ones.
+		for _, a := range applies {
+			for _, tag := range a.tags {
+				if !current.Tags[tag] {
+					current.Tags[tag] = true
+					current.AppliedTags = append(current.AppliedTags, tag)
+				}
+			}
+			for _, kv := range a.kvs {
+				if _, ok := current.KVPairs[kv.Key]; !ok {
+					current.AppliedKV = append(current.AppliedKV, kv.Key)
+				} else if !slices.Contains(current.AppliedKV, kv.Key) {
+					continue
+				}
+				current.KVPairs[kv.Key] = kv.Value
+			}
+		}
+
+		if opts.Pedantic {
+			err := checkTags(&current, tags)
+			if err != nil {
+				return nil, err
+			}
+		}
 
+		current.End = cr.Offset()
 		transactions = append(transactions, current)
 	}
 
+	if len(errs) > 0 {
+		return &ledger.File{T: transactions, D: directives}, errs
+	}
 	return &ledger.File{T: transactions, D: directives}, nil
 }
 
-func ReadAmount(cr *lex.CharReader) (v int64, null bool, err error) {
-	// Read the amount. Currently only supporting USD with or without the leading $
-	if cr.C == '$' {
+// skipIndented skips the rest of the current line, along with any indented lines after it. This is used to get past
+// something broken when collecting errors.
+func skipIndented(cr *lex.CharReader) {
+	for !cr.EOF {
+		cr.EatUntil("\n")
 		cr.Next()
+		if !cr.Match(" \t") {
+			break
+		}
+	}
+}
 
-		// Just in case...
-		cr.Eat(" \t")
-		if cr.EOF {
-			return 0, false, ErrUnexpectedEnd(cr.L)
+// hasNull returns true if one of the postings has no amount.
+func hasNull(ps []ledger.Posting) bool {
+	for _, p := range ps {
+		if p.Null {
+			return true
 		}
 	}
+	return false
+}
 
-	neg := false
-	if cr.C == '-' {
-		cr.Next()
-		neg = true
+// looksLikePosting returns true if the line reads as an account name followed by an amount (with an optional cost,
+// assertion, or comment after it). The account ends at a tab or at two or more spaces, the same as in a posting.
+func looksLikePosting(line string) bool {
+	end := strings.IndexAny(line, "\t")
+	if i := strings.Index(line, "  "); i != -1 && (end == -1 || i < end) {
+		end = i
+	}
+	if end <= 0 || strings.ContainsAny(line[:end], ";") {
+		return false
+	}
+	amount := line[end:]
+	if i := strings.IndexAny(amount, ";@="); i != -1 {
+		amount = amount[:i]
+	}
+	_, err := ledger.ParseAmount(strings.TrimSpace(amount))
+	return err == nil
+}
+
+// looksLikeAmount returns true if what was read as an account name is actually an amount: a number with an optional
+// currency symbol ($-5.00, 20,00 €, or a bare 1200). Anything with some other commodity could just as well be an
+// account name ("-10 AAPL", "1200 Receivables").
+func looksLikeAmount(name string) bool {
+	numeric, commodity, _, err := ledger.SplitAmount(name)
+	if err != nil {
+		return false
 	}
+	if _, ok := ledger.ParseNumber(strings.TrimPrefix(numeric, "-"), &ledger.AmountStyle{}); !ok {
+		return false
+	}
+	for _, r := range commodity {
+		if !ledger.IsCurrencyRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// libraryKeys are the KV keys written by this library (and the tools built on it), which pedantic mode does not
+// require a tag directive for. If one is declared anyway its constraints are still checked.
+var libraryKeys = map[string]bool{
+	"ID":          true,
+	"RID":         true,
+	"FITID":       true,
+	"time":        true,
+	"TransferID":  true,
+	"Attachments": true,
+}
+
+// checkTags makes sure that every tag and KV key used by the transaction has been declared, and that the KV values
+// pass the constraints declared for them. Tags and keys are checked in sorted order so the error is always the same.
+func checkTags(tr *ledger.Transaction, tags map[string]ledger.TagDirective) error {
+	names := []string{}
+	for name := range tr.Tags {
+		names = append(names, name)
+	}
+	for key := range tr.KVPairs {
+		if _, ok := tags[key]; ok || !libraryKeys[key] {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
 
-	// Read the numeric part of the amount
-	// This is probably shitty, and maybe wrong, but I hope not. I 1000% need to write tests for this.
-	whole := int64(0)
-	part := int64(0)
-	cur := &whole
-	null = true
-	for cr.MatchNumeric() || cr.C == '.' || cr.C == ',' {
-		if cr.C == '.' {
-			if cur == &part || null == true {
-				return 0, false, ErrBadAmount(cr.L)
+	for _, name := range names {
+		tag, ok := tags[name]
+		if !ok {
+			return ErrUndeclared{"tag", name, tr.Location}
+		}
+		for _, value := range tr.GetAll(name) {
+			if constraint, ok := tag.Check(value); !ok {
+				return ErrTagValue{name, value, constraint, tr.Location}
 			}
-			cr.Next()
-			cur = &part
-			continue
 		}
-		if cr.C == ',' {
-			cr.Next()
-			continue
+	}
+	return nil
+}
+
+// ReadAmount reads an amount, ignoring the commodity. See ReadCommodityAmount.
+func ReadAmount(cr *lex.CharReader) (v int64, null bool, err error) {
+	v, _, _, null, err = ReadCommodityAmount(cr)
+	return v, null, err
+}
+
+// ReadCommodityAmount reads an amount along with its (optional) commodity and a description of how it was written.
+//
+// The commodity may come before or after the number. A leading commodity may or may not be separated from the
+// number by white space, a trailing commodity must be separated by white space unless it is a currency symbol
+// (so both `5 EUR` and `5€` are fine). Commodities containing characters that are not allowed in a bare commodity
+// name may be wrapped in double quotes. The minus sign may be before or after a leading commodity (`-$5` or `$-5`).
+//
+// If the number contains both periods and commas, whichever comes last is the decimal mark, so `€1.234,56` and
+// `$1,234.56` both work as expected. If only commas are present they are treated as digit grouping, unless there
+// is a single comma that is not followed by exactly three digits (`12,50 €`).
+//
+// If there is no amount at all null is true. An empty commodity means the amount was written without one.
+func ReadCommodityAmount(cr *lex.CharReader) (v int64, commodity string, style ledger.AmountStyle, null bool, err error) {
+	return ReadCommodityAmountWith(cr, Options{})
+}
+
+// ReadCommodityAmountWith is like ReadCommodityAmount, but it honors the amount related parser options.
+func ReadCommodityAmountWith(cr *lex.CharReader, opts Options) (v int64, commodity string, style ledger.AmountStyle, null bool, err error) {
+	v, commodity, style, _, null, err = readAmount(cr, opts, false)
+	return v, commodity, style, null, err
+}
+
+// readAmount does the work for ReadCommodityAmountWith. If lazy is set the number is returned as it was written
+// (with its sign) in raw instead of being converted, and v is always zero.
+func readAmount(cr *lex.CharReader, opts Options, lazy bool) (v int64, commodity string, style ledger.AmountStyle, raw string, null bool, err error) {
+	tok, err := ledger.ScanAmount(cr, opts.UnitSuffix)
+	if err != nil {
+		return 0, "", style, "", false, amountError(err)
+	}
+	if tok.Numeric == "" {
+		return 0, "", style, "", true, nil
+	}
+
+	// The number is only checked and converted if it is needed now.
+	style = tok.Style
+	if lazy {
+		raw = tok.Numeric
+		if tok.Negative {
+			raw = "-" + raw
 		}
+		return 0, tok.Commodity, style, raw, false, nil
+	}
+	v, ok := ledger.ParseNumber(tok.Numeric, &style)
+	if !ok {
+		return 0, "", style, "", false, ErrBadAmount(tok.L)
+	}
+	if tok.Negative {
+		v = -v
+	}
+	return v, tok.Commodity, style, "", false, nil
+}
 
-		*cur = *cur*10 + int64(cr.C-'0')
-		null = false
-		cr.Next()
-		if cr.EOF {
-			return 0, false, ErrUnexpectedEnd(cr.L)
+// amountError converts an error from ledger.ScanAmount or ledger.ScanCommodity into the matching parser error.
+func amountError(err error) error {
+	if serr, ok := err.(ledger.AmountSyntaxError); ok {
+		if serr.End {
+			return ErrUnexpectedEnd(serr.L)
 		}
+		return ErrBadAmount(serr.L)
 	}
-	if !null {
-		whole = whole * 10000
-		if part > 9999 {
-			return 0, false, ErrBadAmount(cr.L)
+	return err
+}
+
+// ReadCommodity reads a commodity name, either a run of characters allowed by ledger.IsCommodityRune or a string
+// wrapped in double quotes. The quotes are not included in the result.
+func ReadCommodity(cr *lex.CharReader) (string, error) {
+	c, err := ledger.ScanCommodity(cr)
+	if err != nil {
+		return "", amountError(err)
+	}
+	return c, nil
+}
+
+// ReadIndent eats white space, returning the width of what was eaten. Tabs advance to the next multiple of 8.
+func ReadIndent(cr *lex.CharReader) int {
+	indent, _ := readIndent(cr)
+	return indent
+}
+
+// readIndent is like ReadIndent, but it also returns the white space that was eaten.
+func readIndent(cr *lex.CharReader) (int, string) {
+	indent := 0
+	ws := []rune{}
+	for cr.Match(" \t") {
+		if cr.C == '\t' {
+			indent += 8 - indent%8
+		} else {
+			indent++
 		}
-		switch {
-		case part < 9:
-			part = part * 1000
-		case part < 99:
-			part = part * 100
-		case part < 9999:
-			part = part * 10
+		ws = append(ws, cr.C)
+		cr.Next()
+	}
+	return indent, string(ws)
+}
+
+// postingDates sets the dates of a posting from its note and comments. Like ledger, a posting may have its own date
+// and effective date written in brackets: `[2023/01/05]`, `[=2023/02/01]`, or `[2023/01/05=2023/02/01]`. The year
+// may be left off, in which case the year of the transaction is used. Anything in brackets that isn't dates is
+// left alone, and the text itself is never changed so the dates are written back out exactly as they were.
+func postingDates(p *ledger.Posting, year int) {
+	date := func(s string) (time.Time, bool) {
+		cr := lex.NewCharReader(s+"\n", 1)
+		t, _, err := ParseDateIn(cr, year)
+		return t, err == nil && cr.C == '\n'
+	}
+
+	for _, text := range append([]string{p.Note}, p.Comments...) {
+		for {
+			i := strings.IndexRune(text, '[')
+			j := strings.IndexRune(text, ']')
+			if i == -1 || j == -1 {
+				break
+			}
+			if j < i {
+				text = text[j+1:]
+				continue
+			}
+			inner := text[i+1 : j]
+			text = text[j+1:]
+
+			primary, effective, _ := strings.Cut(inner, "=")
+			d1, ok1 := date(primary)
+			d2, ok2 := date(effective)
+			switch {
+			case primary == "" && ok2:
+				p.ClearDate = d2
+			case ok1 && !strings.Contains(inner, "="):
+				p.Date = d1
+			case ok1 && ok2:
+				p.Date, p.ClearDate = d1, d2
+			}
 		}
-		v = whole + part
-		if neg {
-			v = -v
+	}
+}
+
+// splitComment splits a trailing comment (a semicolon after white space, outside of double quotes) off of a
+// directive argument. Both parts are trimmed, and the comment does not include the semicolon.
+func splitComment(arg string) (string, string) {
+	quoted := false
+	for i, r := range arg {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted && (i == 0 || arg[i-1] == ' ' || arg[i-1] == '\t'):
+			return strings.TrimRight(arg[:i], " \t"), strings.TrimSpace(arg[i+1:])
 		}
 	}
-	return v, null, nil
+	return arg, ""
 }
 
 // ReadUntilTrimmed reads characters from the CharReader until one of the characters in `chars` is found.
@@ -552,47 +1250,27 @@ func ReadUntilTrimmed(cr *lex.CharReader, chars string) (string, error) {
 
 // ParseDate reads a date (in yyyy/mm/dd format) from the CharReader.
 func ParseDate(cr *lex.CharReader) (time.Time, error) {
-	date := []rune{}
-	ok := false
-	var t time.Time
-
-	ok, date = cr.ReadMatchLimit("0123456789", date, 4)
-	if !ok {
-		return t, ErrBadDate(cr.L)
-	}
-	if cr.EOF {
-		return t, ErrUnexpectedEnd(cr.L)
-	}
-
-	if !cr.Match("/-.") {
-		return t, ErrBadDate(cr.L)
-	}
-	date = append(date, '/')
-	cr.Next()
+	t, _, err := ParseDateIn(cr, 0)
+	return t, err
+}
 
-	ok, date = cr.ReadMatchLimit("0123456789", date, 2)
-	if !ok {
-		return t, ErrBadDate(cr.L)
-	}
+// ParseDateIn is like ParseDate, but if year is not zero the date may also be in mm/dd format, in which case the
+// given year is used and short is true. The date itself is checked by ledger.ParseDateIn.
+func ParseDateIn(cr *lex.CharReader, year int) (t time.Time, short bool, err error) {
+	l := cr.L
+	date := string(cr.ReadMatch("0123456789/-.", nil))
 	if cr.EOF {
-		return t, ErrUnexpectedEnd(cr.L)
+		return t, false, ErrUnexpectedEnd(cr.L)
 	}
 
-	if !cr.Match("/-.") {
-		return t, ErrBadDate(cr.L)
+	t, err = ledger.ParseDateIn(date, year)
+	if err == ledger.ErrBadDate {
+		return t, false, ErrBadDate(l)
 	}
-	date = append(date, '/')
-	cr.Next()
-
-	ok, date = cr.ReadMatchLimit("0123456789", date, 2)
-	if !ok {
-		return t, ErrBadDate(cr.L)
-	}
-	if cr.EOF {
-		return t, ErrUnexpectedEnd(cr.L)
+	if err != nil {
+		return t, false, err
 	}
-
-	return time.Parse("2006/01/02", string(date))
+	return t, strings.IndexAny(date, "/-.") == strings.LastIndexAny(date, "/-."), nil
 }
 
 // NewCharReader returns a new lex.CharReader with the input preadvanced so that all fields are valid.
@@ -0,0 +1,1534 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package parse_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+	"github.com/milochristiansen/ledger/parse/lex"
+)
+
+var TestCommentAttributionInput = `
+2022/04/01 * Hardware Store
+    ; Transaction comment
+    Expenses:Tools      $20.00
+        ; Clearly about the tools
+    Expenses:Paint      $10.00
+    ; Ambiguous, goes to the paint
+  ; Less indented, goes to the transaction
+    Assets:Checking
+`
+
+func TestCommentAttribution(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCommentAttributionInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.T[0]
+
+	if len(tr.Comments) != 2 || tr.Comments[0] != "Transaction comment" || tr.Comments[1] != "Less indented, goes to the transaction" {
+		t.Errorf("Incorrect transaction comments: %#v", tr.Comments)
+	}
+	if len(tr.Postings[0].Comments) != 1 || tr.Postings[0].Comments[0] != "Clearly about the tools" {
+		t.Errorf("Incorrect posting 0 comments: %#v", tr.Postings[0].Comments)
+	}
+	if len(tr.Postings[1].Comments) != 1 || tr.Postings[1].Comments[0] != "Ambiguous, goes to the paint" {
+		t.Errorf("Incorrect posting 1 comments: %#v", tr.Postings[1].Comments)
+	}
+	if len(tr.Postings[2].Comments) != 0 {
+		t.Errorf("Incorrect posting 2 comments: %#v", tr.Postings[2].Comments)
+	}
+
+	// Round trip, everything must stay where it was.
+	f2, err := parse.ParseLedgerString(tr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2 := f2.T[0]
+	if strings.Join(tr2.Comments, "|") != strings.Join(tr.Comments, "|") {
+		t.Errorf("Transaction comments changed in round trip: %#v", tr2.Comments)
+	}
+	for i := range tr.Postings {
+		if strings.Join(tr2.Postings[i].Comments, "|") != strings.Join(tr.Postings[i].Comments, "|") {
+			t.Errorf("Posting %v comments changed in round trip: %#v", i, tr2.Postings[i].Comments)
+		}
+	}
+
+	// With the option set, everything goes to the transaction.
+	f, err = parse.ParseLedgerWith(parse.NewCharReader(TestCommentAttributionInput, 1), parse.Options{CommentsToTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr = f.T[0]
+	if len(tr.Comments) != 4 {
+		t.Errorf("Incorrect transaction comments: %#v", tr.Comments)
+	}
+	for i, p := range tr.Postings {
+		if len(p.Comments) != 0 {
+			t.Errorf("Incorrect posting %v comments: %#v", i, p.Comments)
+		}
+	}
+}
+
+var TestPayeeContinuationInput = `
+2022/04/02 * Some Very Long \
+    Payee Name \
+    Continued
+    Expenses:Misc       $20.00
+    Assets:Checking
+`
+
+func TestPayeeContinuation(t *testing.T) {
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(TestPayeeContinuationInput, 1), parse.Options{PayeeContinuation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.T) != 1 {
+		t.Fatalf("Incorrect number of transactions: %v", len(f.T))
+	}
+	if f.T[0].Description != "Some Very Long Payee Name Continued" {
+		t.Errorf("Incorrect description: %q", f.T[0].Description)
+	}
+	if len(f.T[0].Postings) != 2 {
+		t.Errorf("Incorrect number of postings: %v", len(f.T[0].Postings))
+	}
+
+	// Without the option the backslash is literal.
+	f, err = parse.ParseLedgerString("2022/04/02 * Back\\slash \\\n    Expenses:Misc       $20.00\n    Assets:Checking\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.T[0].Description != "Back\\slash \\" {
+		t.Errorf("Incorrect description: %q", f.T[0].Description)
+	}
+}
+
+var TestUnitSuffixInput = `
+2022/04/03 * Harvest
+    Assets:Potatoes     2kg
+    Assets:Share        10%
+    Assets:Apples       1.5 kg
+    Income:Garden       -3.5kg
+    Income:Garden       -10%
+`
+
+func TestUnitSuffix(t *testing.T) {
+	// Strict by default.
+	_, err := parse.ParseLedgerString(TestUnitSuffixInput)
+	if err == nil {
+		t.Errorf("Adjacent unit suffix parsed without the option.")
+	}
+
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(TestUnitSuffixInput, 1), parse.Options{UnitSuffix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		commodity string
+		value     int64
+	}{
+		{"kg", 20000},
+		{"%", 100000},
+		{"kg", 15000},
+		{"kg", -35000},
+		{"%", -100000},
+	}
+	for i, e := range expected {
+		p := f.T[0].Postings[i]
+		if p.Commodity != e.commodity || p.Value != e.value {
+			t.Errorf("Incorrect posting %v: %v %q", i, p.Value, p.Commodity)
+		}
+	}
+	if ok, _ := f.T[0].Balance(); !ok {
+		t.Errorf("Transaction does not balance.")
+	}
+
+	out := f.T[0].String()
+	for _, s := range []string{"  2kg\n", "  10%\n", "  1.5 kg\n", "  -3.5kg\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Output does not contain %q:\n%v", s, out)
+		}
+	}
+
+	// Scientific notation is not a thing.
+	_, err = parse.ParseLedgerWith(parse.NewCharReader("2022/04/03 Bad\n    Assets:Potatoes     1e3\n    Income:Garden\n", 1), parse.Options{UnitSuffix: true})
+	if err == nil {
+		t.Errorf("Scientific notation parsed without error.")
+	}
+}
+
+var TestPedanticInput = `
+account Assets:Cash
+account Expenses:Food
+	alias Food
+commodity €
+	alias EUR
+
+2022/05/01 * Lunch
+    Expenses:Food       €12.00
+    Assets:Cash         -12.00 EUR
+
+2022/05/02 * Dinner
+    Food                $20.00
+    (Assets:Cash)       20.00
+    Assets:Cash
+`
+
+func TestPedantic(t *testing.T) {
+	// Lenient by default.
+	_, err := parse.ParseLedgerString(strings.Replace(TestPedanticInput, "Assets:Cash         -12", "Asets:Cash         -12", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is declared once $ is, the aliases count as declared as well.
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(strings.Replace(TestPedanticInput, "commodity €", "commodity $\ncommodity €", 1), 1), parse.Options{Pedantic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lunch only balances once the aliases are in use.
+	cs, err := f.Commodities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := f.T[0].Balance(); ok {
+		t.Error("Transaction balanced without the aliases.")
+	}
+	if ok, _ := f.T[0].BalanceWith(ledger.BalanceOptions{Aliases: ledger.CommodityAliases(cs)}); !ok {
+		t.Error("Transaction did not balance with the aliases.")
+	}
+
+	cases := []struct {
+		input string
+		err   parse.ErrUndeclared
+	}{
+		{
+			strings.Replace(TestPedanticInput, "Assets:Cash         -12", "Asets:Cash         -12", 1),
+			parse.ErrUndeclared{Kind: "account", Name: "Asets:Cash"},
+		},
+		{
+			TestPedanticInput,
+			parse.ErrUndeclared{Kind: "commodity", Name: "$"},
+		},
+	}
+	for i, c := range cases {
+		_, err := parse.ParseLedgerWith(parse.NewCharReader(c.input, 1), parse.Options{Pedantic: true})
+		uerr, ok := err.(parse.ErrUndeclared)
+		if !ok {
+			t.Errorf("Case %v: incorrect error: %v", i, err)
+			continue
+		}
+		if uerr.Kind != c.err.Kind || uerr.Name != c.err.Name {
+			t.Errorf("Case %v: incorrect error: %v", i, err)
+		}
+		if uerr.Location.Line() == 0 {
+			t.Errorf("Case %v: error does not have a line: %v", i, err)
+		}
+	}
+}
+
+func TestTabInAccount(t *testing.T) {
+	bad := []string{
+		"2022/05/03 * Store\n    Expenses:\tFood  $5.00\n    Assets:Cash\n",
+		"2022/05/03 * Store\n    Expenses:Fo\tod  $5.00\n    Assets:Cash\n",
+		"2022/05/03 * Store\n    Expenses:Food  $5.00\n    Assets:Ca\tsh\n",
+		"2022/05/03 * Store\n    Expenses:Fo\tod\n    Assets:Cash\n",
+	}
+	for i, input := range bad {
+		_, err := parse.ParseLedgerString(input)
+		terr, ok := err.(parse.ErrTabInAccount)
+		if !ok {
+			t.Errorf("Case %v: incorrect error: %v", i, err)
+			continue
+		}
+		if line := lex.Location(terr).Line(); line != 2 && line != 3 {
+			t.Errorf("Case %v: incorrect line: %v", i, line)
+		}
+	}
+
+	// A tab is a perfectly good delimiter after the account name.
+	good := []string{
+		"2022/05/03 * Store\n    Expenses:Food\t$5.00\n    Assets:Cash\n",
+		"2022/05/03 * Store\n    Expenses:Food\tEUR 5.00\n    Assets:Cash\tEUR -5.00\n",
+		"2022/05/03 * Store\n    Expenses:Food\t$5.00\n    Assets:Cash\t\n",
+		"commodity gold\n\n2022/05/03 * Store\n    Expenses:Food\tgold 5\n    Assets:Cash\n",
+		"2022/05/03 * Store\n    Expenses:Food  ounces 5\n    Expenses:Food\tounces 5\n    Assets:Cash\n",
+		"2022/05/03 * Store\n    Expenses:Food\tgold 5\n    Assets:Cash\n",
+	}
+	for i, input := range good {
+		f, err := parse.ParseLedgerString(input)
+		if err != nil {
+			t.Errorf("Case %v: %v", i, err)
+			continue
+		}
+		if f.T[0].Postings[0].Account != "Expenses:Food" {
+			t.Errorf("Case %v: incorrect account: %q", i, f.T[0].Postings[0].Account)
+		}
+	}
+}
+
+func TestMergeTime(t *testing.T) {
+	input := "2022/10/02 * Lunch\n    ; time: 12:15\n    Expenses:Food  $12.00\n    Assets:Cash\n"
+
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(input, 1), parse.Options{MergeTime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.T[0].Date != time.Date(2022, 10, 2, 12, 15, 0, 0, time.UTC) {
+		t.Errorf("Incorrect date: %v", f.T[0].Date)
+	}
+	if f.T[0].KVPairs["time"] != "12:15" || !strings.HasPrefix(f.T[0].String(), "2022/10/02 * Lunch\n") {
+		t.Errorf("Incorrect output:\n%v", f.T[0].String())
+	}
+
+	// A time after the date wins over the KV, they are never both added.
+	input = "2022/10/02 12:00 * Lunch\n    ; time: 12:15\n    Expenses:Food  $12.00\n    Assets:Cash\n"
+	f, err = parse.ParseLedgerWith(parse.NewCharReader(input, 1), parse.Options{MergeTime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.T[0].Date != time.Date(2022, 10, 2, 12, 0, 0, 0, time.UTC) {
+		t.Errorf("Incorrect date: %v", f.T[0].Date)
+	}
+}
+
+var TestCostSpacingInput = `
+2022/10/03 * Broker
+    Assets:Broker  10 AAPL @ $150.00
+    Assets:Broker  2 MSFT @@ $500.00
+    Assets:Cash
+`
+
+func TestCostSpacing(t *testing.T) {
+	canonical, err := parse.ParseLedgerString(TestCostSpacingInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	irregular := strings.NewReplacer(
+		"Broker  10 AAPL @ ", "Broker     10    AAPL\t@   ",
+		"Broker  2 MSFT @@ ", "Broker\t 2 \tMSFT  @@\t",
+	).Replace(TestCostSpacingInput)
+	f, err := parse.ParseLedgerString(irregular)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(f.T[0].Postings, canonical.T[0].Postings) {
+		t.Errorf("Irregular spacing parsed differently:\n%#v\n%#v", f.T[0].Postings, canonical.T[0].Postings)
+	}
+
+	p := canonical.T[0].Postings[0]
+	if p.Account != "Assets:Broker" || p.Value != 100000 || p.Commodity != "AAPL" || !p.HasCost || p.TotalCost ||
+		p.Cost != 1500000 || p.CostCommodity != "$" {
+		t.Errorf("Incorrect posting: %#v", p)
+	}
+	if p := canonical.T[0].Postings[1]; !p.HasCost || !p.TotalCost || p.Cost != 5000000 {
+		t.Errorf("Incorrect posting: %#v", p)
+	}
+
+	// The cash posting balances in the cost commodity.
+	tr := canonical.T[0].CleanCopy()
+	if err := tr.Canonicalize(); err != nil {
+		t.Fatal(err)
+	}
+	if p := tr.Postings[2]; p.Value != -20000000 || p.Commodity != "$" {
+		t.Errorf("Incorrect balance: %v", p.Amount())
+	}
+
+	// And it all survives being written back out.
+	f, err = parse.ParseLedgerString(canonical.T[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.T[0].Postings, canonical.T[0].Postings) {
+		t.Errorf("Incorrect round trip:\n%v", canonical.T[0].String())
+	}
+}
+
+var TestDefaultPrecisionInput = `
+D $1,000.00
+
+2022/10/04 * Coffee
+    Expenses:Food  $5
+    Assets:Cash  $-5.125
+
+commodity EUR
+    format 1.000,000 EUR
+D 1,000 EUR
+
+2022/10/05 * Lunch
+    Expenses:Food  12 EUR
+    Assets:Cash
+`
+
+func TestDefaultPrecision(t *testing.T) {
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(TestDefaultPrecisionInput, 1), parse.Options{DefaultPrecision: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The declared precision is a minimum, and the commodity directive wins over the later D directive.
+	for i, e := range []string{"$5.00", "$-5.125", "12.000 EUR"} {
+		p := f.T[i/2].Postings[i%2]
+		if s := p.Amount().String(); s != e {
+			t.Errorf("Posting %v: expected %q, got %q", i, e, s)
+		}
+	}
+
+	// Without the option amounts are written as they were.
+	f, err = parse.ParseLedgerString(TestDefaultPrecisionInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := f.T[0].Postings[0].Amount().String(); s != "$5" {
+		t.Errorf("Expected %q, got %q", "$5", s)
+	}
+}
+
+var TestShortDateTimeInput = `
+Y 2023
+
+01/15 14:30 * (42) Coffee Shop
+    Expenses:Food  $4.50
+    Assets:Cash
+
+01/16=01/18 7-Eleven
+    Expenses:Food  $2.00
+    Assets:Cash
+
+2022/12/31 23:59:30 ! Party
+    Expenses:Fun  $20.00
+    Assets:Cash
+
+2023/01/02 12:30
+    Expenses:Fun  $5.00
+    Assets:Cash
+
+2023/01/03 12:30 Lunch
+    Expenses:Food  $8.00
+    Assets:Cash
+`
+
+func TestShortDateTime(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestShortDateTimeInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		date, clear time.Time
+		short, tod  bool
+		desc, code  string
+	}{
+		{time.Date(2023, 1, 15, 14, 30, 0, 0, time.UTC), time.Time{}, true, true, "Coffee Shop", "42"},
+		{time.Date(2023, 1, 16, 0, 0, 0, 0, time.UTC), time.Date(2023, 1, 18, 0, 0, 0, 0, time.UTC), true, false, "7-Eleven", ""},
+		{time.Date(2022, 12, 31, 23, 59, 30, 0, time.UTC), time.Time{}, false, true, "Party", ""},
+		// A time needs a status or code after it, otherwise it is part of the payee.
+		{time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), time.Time{}, false, false, "12:30", ""},
+		{time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC), time.Time{}, false, false, "12:30 Lunch", ""},
+	}
+	for i, e := range expected {
+		tr := f.T[i]
+		if tr.Date != e.date || tr.ClearDate != e.clear || tr.ShortDate != e.short || tr.HasTime != e.tod ||
+			tr.Description != e.desc || tr.Code != e.code {
+			t.Errorf("Incorrect transaction %v: %v %v %v %v %q %q", i, tr.Date, tr.ClearDate, tr.ShortDate, tr.HasTime,
+				tr.Description, tr.Code)
+		}
+	}
+
+	// The dates are written back out the way they came in.
+	for i, e := range []string{"01/15 14:30 * (42) Coffee Shop\n", "01/16=01/18   7-Eleven\n", "2022/12/31 23:59:30 ! Party\n"} {
+		if s := f.T[i].String(); !strings.HasPrefix(s, e) {
+			t.Errorf("Incorrect output %v:\n%v", i, s)
+		}
+	}
+
+	// A payee that starts with a time is read back as a payee.
+	f2, err := parse.ParseLedgerString(f.T[4].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr := f2.T[0]; tr.HasTime || tr.Description != "12:30 Lunch" || !tr.Date.Equal(f.T[4].Date) {
+		t.Errorf("Incorrect round trip: %v %v %q", tr.Date, tr.HasTime, tr.Description)
+	}
+
+	// A short date without a Y directive is an error.
+	_, err = parse.ParseLedgerString("01/15 Coffee Shop\n    Expenses:Food  $4.50\n    Assets:Cash\n")
+	if _, ok := err.(parse.ErrBadDate); !ok {
+		t.Errorf("Expected ErrBadDate, got %v", err)
+	}
+}
+
+var TestDirectiveCommentInput = `P 2023/01/01 AAPL $185.00  ; source: yahoo
+commodity "Gold Bars ;1kg"	; precious
+    note Shiny
+account Assets:Cash ; wallet
+D $1,000.00 ; dollars
+Y 2023 ; this year
+include other.ledger;not a comment
+# hash ;x
+comment ; not split
+    ; nor this
+end comment
+
+01/02 Coffee
+    Assets:Cash  $-4.00
+    Expenses:Food
+`
+
+func TestDirectiveComment(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestDirectiveCommentInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		typ, arg, comment string
+	}{
+		{"P", "2023/01/01 AAPL $185.00", "source: yahoo"},
+		{"commodity", `"Gold Bars ;1kg"`, "precious"},
+		{"account", "Assets:Cash", "wallet"},
+		{"D", "$1,000.00", "dollars"},
+		{"Y", "2023", "this year"},
+		{"include", "other.ledger;not a comment", ""},
+		{"#", "hash ;x", ""},
+		{"comment", "; not split", ""},
+		{"end", "comment", ""},
+	}
+	if len(f.D) != len(expected) {
+		t.Fatalf("Incorrect number of directives: %v", len(f.D))
+	}
+	for i, e := range expected {
+		d := f.D[i]
+		if d.Type != e.typ || d.Argument != e.arg || d.Comment != e.comment {
+			t.Errorf("Incorrect directive %v: %q %q %q", i, d.Type, d.Argument, d.Comment)
+		}
+	}
+
+	// The comments survive being written back out.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range f.D {
+		if !f.D[i].Compare(f2.D[i]) {
+			t.Errorf("Incorrect round trip %v: %q", i, f2.D[i].String())
+		}
+	}
+	if !strings.Contains(buf.String(), "\n# hash ;x\n") {
+		t.Errorf("Comment line was changed:\n%v", buf.String())
+	}
+}
+
+func TestTightHeader(t *testing.T) {
+	cases := []struct {
+		header, code, desc, out string
+	}{
+		{"2023/01/01 *Payee", "", "Payee", "2023/01/01 * Payee\n"},
+		{"2023/01/01 !Payee", "", "Payee", "2023/01/01 ! Payee\n"},
+		{"2023/01/01 * (42)Payee", "42", "Payee", "2023/01/01 * (42) Payee\n"},
+		{"2023/01/01 *(42)Payee", "42", "Payee", "2023/01/01 * (42) Payee\n"},
+		{"2023/01/01 (42)Payee", "42", "Payee", "2023/01/01   (42) Payee\n"},
+	}
+	for i, c := range cases {
+		f, err := parse.ParseLedgerString(c.header + "\n    Expenses:Food  $4.00\n    Assets:Cash\n")
+		if err != nil {
+			t.Errorf("Case %v: %v", i, err)
+			continue
+		}
+		tr := f.T[0]
+		if tr.Code != c.code || tr.Description != c.desc {
+			t.Errorf("Case %v: incorrect header: %q %q", i, tr.Code, tr.Description)
+		}
+		if s := tr.String(); !strings.HasPrefix(s, c.out) {
+			t.Errorf("Case %v: incorrect output:\n%v", i, s)
+		}
+	}
+}
+
+func TestAccountTrailingSpace(t *testing.T) {
+	cases := []string{
+		"    Assets:Cash   $5.00\n",
+		"    Assets:Cash \t$5.00\n",
+		"    Assets:Cash\t $5.00\n",
+		"    Assets:Cash  \t  $5.00\n",
+	}
+	for i, c := range cases {
+		f, err := parse.ParseLedgerString("2023/01/01 * Test\n" + c + "    Equity:Opening Balances \n")
+		if err != nil {
+			t.Errorf("Case %v: %v", i, err)
+			continue
+		}
+		ps := f.T[0].Postings
+		if ps[0].Account != "Assets:Cash" || ps[0].Value != 50000 {
+			t.Errorf("Case %v: incorrect posting: %q %v", i, ps[0].Account, ps[0].Value)
+		}
+		if ps[1].Account != "Equity:Opening Balances" || !ps[1].Null {
+			t.Errorf("Case %v: incorrect posting: %q", i, ps[1].Account)
+		}
+	}
+}
+
+var TestPostingDatesInput = `
+2023/01/05 * Credit card payment
+    Liabilities:Card    $100.00 ; [=2023/02/01]
+    Liabilities:Other   $50.00
+        ; Cleared late [01/06=02/03]
+    Expenses:Misc       $1.00 ; [not a date] [2023/13/01]
+    Assets:Checking
+`
+
+func TestPostingDates(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestPostingDatesInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(2023, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	expected := []struct {
+		date, clear time.Time
+	}{
+		{time.Time{}, day(2, 1)},
+		{day(1, 6), day(2, 3)},
+		{time.Time{}, time.Time{}},
+		{time.Time{}, time.Time{}},
+	}
+	tr := &f.T[0]
+	for i, e := range expected {
+		p := tr.Postings[i]
+		if p.Date != e.date || p.ClearDate != e.clear {
+			t.Errorf("Incorrect dates for posting %v: %v %v", i, p.Date, p.ClearDate)
+		}
+	}
+
+	// The effective date only applies to the posting, not the transaction.
+	if p := &tr.Postings[0]; p.DateIn(tr, ledger.EffectiveDate) != day(2, 1) || p.DateIn(tr, ledger.PrimaryDate) != day(1, 5) {
+		t.Errorf("Incorrect posting dates.")
+	}
+	if p := &tr.Postings[3]; p.DateIn(tr, ledger.EffectiveDate) != day(1, 5) {
+		t.Errorf("Incorrect posting dates.")
+	}
+	if b := ledger.BalanceAtIn(f.T, "Liabilities", day(1, 31), ledger.EffectiveDate, true); b["$"].Value != 0 {
+		t.Errorf("Incorrect balance: %v", b)
+	}
+
+	// The exact form is kept.
+	s := tr.String()
+	if !strings.Contains(s, "$100.00 ; [=2023/02/01]\n") || !strings.Contains(s, "; Cleared late [01/06=02/03]\n") {
+		t.Errorf("Incorrect output:\n%v", s)
+	}
+}
+
+var TestStrayPostingInput = `    Expenses:Food    $5.00
+    Assets:Cash
+
+2023/01/01 * Lunch
+    Expenses:Food    $10.00
+    Assets:Cash
+
+; Postings can't follow a comment either.
+    Expenses:Food    $3.00
+
+2023/01/02 * Dinner
+    Expenses:Food    $20.00
+    Assets:Cash
+`
+
+func TestStrayPosting(t *testing.T) {
+	_, err := parse.ParseLedgerString(TestStrayPostingInput)
+	if _, ok := err.(parse.ErrStrayPosting); !ok {
+		t.Fatalf("Incorrect error: %v", err)
+	}
+	if err.Error() != "Posting without a transaction on line: 1:5" {
+		t.Errorf("Incorrect error message: %v", err)
+	}
+
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(TestStrayPostingInput, 1), parse.Options{CollectErrors: true})
+	errs, ok := err.(parse.Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Incorrect errors: %v", err)
+	}
+	if lex.Location(errs[0].(parse.ErrStrayPosting)).Line() != 1 || lex.Location(errs[1].(parse.ErrStrayPosting)).Line() != 9 {
+		t.Errorf("Incorrect errors: %v", err)
+	}
+	if len(f.T) != 2 || f.T[0].Description != "Lunch" || f.T[1].Description != "Dinner" {
+		t.Errorf("Incorrect transactions: %v", f.T)
+	}
+
+	// Other indented lines are read as usual.
+	f, err = parse.ParseLedgerString("    account Assets:Cash\n\n    # A comment\n\n    * Another\n\n    % And another\n\n" +
+		"    2023/01/01 * Lunch\n    Expenses:Food    $10.00\n    Assets:Cash\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.D) != 4 || f.D[0].Type != "account" || len(f.T) != 1 {
+		t.Errorf("Incorrect file: %v %v", f.D, f.T)
+	}
+}
+
+var TestMissingAccountInput = `2023/01/01 * Lunch
+    Expenses:Food    $5.00
+    $-5.00
+
+2023/01/02 * Dinner
+    Expenses:Food    $12.00
+    Assets:Cash
+
+2023/01/03 * Shares
+    Assets:Broker    10 AAPL
+    * 20,00 €  ; a note
+    Equity:Transfers
+
+2023/01/04 * 2023 is not an amount here
+    Expenses:2023 Taxes    $100.00
+    Assets:Cash
+
+2023/01/05 * Numbered accounts
+    1200 Receivables    $5.00
+    4000 Revenue
+    1300    $-2.00
+    -10 AAPL
+`
+
+func TestMissingAccount(t *testing.T) {
+	_, err := parse.ParseLedgerString(TestMissingAccountInput)
+	if _, ok := err.(parse.ErrMissingAccount); !ok {
+		t.Fatalf("Incorrect error: %v", err)
+	}
+	if err.Error() != "Posting missing account name on line: 3:5" {
+		t.Errorf("Incorrect error message: %v", err)
+	}
+
+	// The broken transactions are dropped, and everything else is read as usual.
+	f, err := parse.ParseLedgerWith(parse.NewCharReader(TestMissingAccountInput, 1), parse.Options{CollectErrors: true})
+	errs, ok := err.(parse.Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Incorrect errors: %v", err)
+	}
+	if lex.Location(errs[0].(parse.ErrMissingAccount)).Line() != 3 || lex.Location(errs[1].(parse.ErrMissingAccount)).Line() != 11 {
+		t.Errorf("Incorrect errors: %v", err)
+	}
+	if len(f.T) != 3 || f.T[0].Description != "Dinner" || f.T[1].Postings[0].Account != "Expenses:2023 Taxes" {
+		t.Fatalf("Incorrect transactions: %v", f.T)
+	}
+
+	// Account names that start with a number are fine, as long as they are not just an amount.
+	ps := f.T[2].Postings
+	if len(ps) != 4 || ps[0].Account != "1200 Receivables" || ps[1].Account != "4000 Revenue" || ps[2].Account != "1300" || ps[3].Account != "-10 AAPL" {
+		t.Errorf("Incorrect postings: %v", ps)
+	}
+
+	// A bare number is a numbered account when it can be the null posting.
+	f, err = parse.ParseLedgerString("2023/01/06 * Numbered null\n    1200    $5.00\n    4000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := f.T[0].Postings[1]; p.Account != "4000" || !p.Null {
+		t.Errorf("Incorrect posting: %v", p)
+	}
+	_, err = parse.ParseLedgerString("2023/01/06 * Numbered null\n    1200\n    4000\n")
+	if _, ok := err.(parse.ErrMissingAccount); !ok {
+		t.Errorf("Incorrect error for a second null posting: %v", err)
+	}
+}
+
+var TestBlankLinesInput = "\n\n\n" + `2023/01/01 * Lunch
+    Expenses:Food    $5.00
+    Assets:Cash
+
+
+
+  ` + "\t" + `
+
+2023/01/02 * Dinner
+    Expenses:Food    $12.00
+    Assets:Cash
+` + "\n\n\n\n"
+
+func TestBlankLines(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestBlankLinesInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.T) != 2 || len(f.D) != 0 {
+		t.Fatalf("Incorrect file: %v transactions, %v directives", len(f.T), len(f.D))
+	}
+	if l := f.T[0].Location.Line(); l != 4 {
+		t.Errorf("Incorrect line for the first transaction: %v", l)
+	}
+	if l := f.T[1].Location.Line(); l != 12 {
+		t.Errorf("Incorrect line for the second transaction: %v", l)
+	}
+	if len(f.T[0].Postings) != 2 || len(f.T[1].Postings) != 2 {
+		t.Errorf("Incorrect postings: %v", f.T)
+	}
+	if TestBlankLinesInput[f.T[1].Start:f.T[1].End] != "2023/01/02 * Dinner\n    Expenses:Food    $12.00\n    Assets:Cash\n" {
+		t.Errorf("Incorrect range for the second transaction: %q", TestBlankLinesInput[f.T[1].Start:f.T[1].End])
+	}
+
+	// The blank lines are counted (the line with only white space is blank too), and can be written back out.
+	if f.T[0].BlankLines != 3 || f.T[1].BlankLines != 5 {
+		t.Errorf("Incorrect blank lines: %v %v", f.T[0].BlankLines, f.T[1].BlankLines)
+	}
+	buf := new(strings.Builder)
+	err = f.FormatWith(buf, ledger.WriteOptions{PreserveBlankLines: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\n\n\n" + f.T[0].String() + "\n\n\n\n\n" + f.T[1].String(); buf.String() != expected {
+		t.Errorf("Incorrect output:\n%q\nExpected:\n%q", buf.String(), expected)
+	}
+
+	// Directives too.
+	f, err = parse.ParseLedgerString("account Assets:Cash\n\n\naccount Expenses:Food\n" + TestBlankLinesInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.D[0].BlankLines != 0 || f.D[1].BlankLines != 2 || f.T[0].BlankLines != 3 {
+		t.Errorf("Incorrect blank lines: %v %v %v", f.D[0].BlankLines, f.D[1].BlankLines, f.T[0].BlankLines)
+	}
+}
+
+var TestLeadingCommentInput = `
+2023/01/01 * Lunch
+        ; Deeply indented
+    ; :work:
+    Expenses:Food    $5.00
+    ; On the posting
+    Assets:Cash
+`
+
+func TestLeadingComment(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestLeadingCommentInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &f.T[0]
+	if !reflect.DeepEqual(tr.Comments, []string{"Deeply indented"}) || !tr.Tags["work"] || len(tr.Postings) != 2 {
+		t.Fatalf("Incorrect transaction: %#v", tr)
+	}
+	if !reflect.DeepEqual(tr.Postings[0].Comments, []string{"On the posting"}) {
+		t.Errorf("Incorrect posting comments: %#v", tr.Postings[0].Comments)
+	}
+
+	// The comments stay before the postings.
+	s := tr.String()
+	expected := "2023/01/01 * Lunch\n\t; Deeply indented\n\t; :work:\n\tExpenses:Food"
+	if !strings.HasPrefix(s, expected) {
+		t.Errorf("Incorrect output:\n%v", s)
+	}
+	f2, err := parse.ParseLedgerString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2 := f2.T[0].String(); s2 != s {
+		t.Errorf("Output did not reparse the same:\n%v\nExpected:\n%v", s2, s)
+	}
+}
+
+func TestParseLedgerBytes(t *testing.T) {
+	f1, err := parse.ParseLedgerString(TestPostingDatesInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := parse.ParseLedgerBytes([]byte(TestPostingDatesInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f1, f2) {
+		t.Errorf("Byte slice parsed differently:\n%#v\nExpected:\n%#v", f2, f1)
+	}
+
+	// Line numbers are the same as well.
+	_, err = parse.ParseLedgerBytes([]byte("\n\n    Assets:Cash    $5.00\n"))
+	if l, ok := err.(parse.ErrStrayPosting); !ok || lex.Location(l).Line() != 3 {
+		t.Errorf("Incorrect error: %v", err)
+	}
+}
+
+var TestLazyAmountsInput = `
+2023/06/01 * Lazy
+    Expenses:Food       $1,234.5
+    Expenses:Travel     12,50 €
+    Expenses:Misc       -3 EUR
+    Assets:Cash
+
+2023/06/02 * Asserted
+    Expenses:Food       $5 = $1,239.5
+    Assets:Cash         $-5 @ 1.1 EUR
+`
+
+func TestLazyAmounts(t *testing.T) {
+	eager, err := parse.ParseLedgerString(TestLazyAmountsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := parse.ParseLedgerWith(parse.NewCharReader(TestLazyAmountsInput, 1), parse.Options{LazyAmounts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raws := []string{"1,234.5", "12,50", "-3", ""}
+	for i, raw := range raws {
+		p := lazy.T[0].Postings[i]
+		if p.Raw != raw || p.Value != 0 || p.Commodity != eager.T[0].Postings[i].Commodity {
+			t.Errorf("Incorrect lazy posting %v: %#v", i, p)
+		}
+	}
+
+	// An amount with an assertion is always converted, but the others in the transaction don't have to be.
+	if ps := lazy.T[1].Postings; ps[0].Raw != "" || ps[0].Value != 50000 || ps[1].Raw != "-5" || ps[1].Cost != 11000 {
+		t.Errorf("Incorrect lazy postings: %#v", ps)
+	}
+
+	// Anything that needs the values converts them as it goes.
+	for i, p := range lazy.T[0].Postings[:3] {
+		if a := p.Amount(); a != eager.T[0].Postings[i].Amount() {
+			t.Errorf("Incorrect lazy amount %v: %#v", i, a)
+		}
+	}
+	if ok, _ := lazy.T[0].Balance(); !ok {
+		t.Error("Lazy transaction does not balance.")
+	}
+	tr := lazy.T[0].CleanCopy()
+	want := eager.T[0].CleanCopy()
+	if err := tr.Canonicalize(); err != nil || want.Canonicalize() != nil || !reflect.DeepEqual(tr.Postings, want.Postings) {
+		t.Errorf("Incorrect canonicalized postings: %#v %v", tr.Postings, err)
+	}
+	if totals := lazy.T[0].CommodityTotals(); totals["$"].Value != 12345000 || totals["€"].Value != 125000 {
+		t.Errorf("Incorrect lazy totals: %v", totals)
+	}
+
+	// The sign of a total cost comes from the raw number.
+	sold, err := parse.ParseLedgerWith(parse.NewCharReader("2023/06/03 * Sold\n    Assets:Broker    -5 AAPL @@ $10\n    Assets:Cash    $10\n", 1), parse.Options{LazyAmounts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := sold.T[0].Balance(); !ok {
+		t.Error("Lazy total cost does not balance.")
+	}
+
+	// Raw numbers are never merged, as they can't be added without converting them.
+	double, err := parse.ParseLedgerWith(parse.NewCharReader("2023/06/04 * Twice\n    Expenses:Food    $1\n    Expenses:Food    $2\n    Assets:Cash\n", 1), parse.Options{LazyAmounts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	double.T[0].CoalescePostings()
+	if len(double.T[0].Postings) != 3 {
+		t.Errorf("Raw postings merged: %#v", double.T[0].Postings)
+	}
+
+	// Written out the same, and the same once converted.
+	for i := range eager.T {
+		s := lazy.T[i].String()
+		if s != eager.T[i].String() {
+			t.Errorf("Incorrect lazy output:\n%v\nExpected:\n%v", s, eager.T[i].String())
+		}
+		err := lazy.T[i].ParseRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lazy.T[i], eager.T[i]) {
+			t.Errorf("Incorrect converted transaction:\n%#v\nExpected:\n%#v", lazy.T[i], eager.T[i])
+		}
+	}
+
+	// Bad numbers are only found when converted.
+	lazy, err = parse.ParseLedgerWith(parse.NewCharReader(strings.Replace(TestLazyAmountsInput, "-3", "1.2.3,4,5", 1), 1), parse.Options{LazyAmounts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lazy.T[0].ParseRaw(); err == nil || lazy.T[0].Postings[2].Raw != "1.2.3,4,5" {
+		t.Errorf("Incorrect result for a bad amount: %v", err)
+	}
+	if ok, _ := lazy.T[0].Balance(); ok {
+		t.Error("Transaction with a bad amount balances.")
+	}
+	if lines := ledger.TrialBalance(lazy.T[:1], time.Now()); len(lines) != 0 {
+		t.Errorf("Transaction with a bad amount in a report: %v", lines)
+	}
+}
+
+var TestSignFirstInput = `
+2023/07/01 * Refund
+    Assets:Cash         -$5.00
+    Assets:Card         $-5.00
+    Income:Refunds      $10.00
+`
+
+func TestSignFirst(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestSignFirstInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := f.T[0].Postings
+	if !ps[0].Amount().Equal(ps[1].Amount()) || ps[0].Value != -50000 {
+		t.Errorf("Amounts are not the same: %v %v", ps[0].Amount(), ps[1].Amount())
+	}
+	if !ps[0].Style.SignFirst || ps[1].Style.SignFirst {
+		t.Errorf("Incorrect styles: %+v %+v", ps[0].Style, ps[1].Style)
+	}
+
+	cases := []struct {
+		sign     ledger.SignStyle
+		expected [2]string
+	}{
+		{ledger.SignAfterCommodity, [2]string{"$-5.00", "$-5.00"}},
+		{ledger.SignBeforeCommodity, [2]string{"-$5.00", "-$5.00"}},
+		{ledger.SignPreserve, [2]string{"-$5.00", "$-5.00"}},
+	}
+	for i, c := range cases {
+		lines := strings.Split(f.T[0].StringWith(ledger.WriteOptions{Sign: c.sign}), "\n")
+		for j, e := range c.expected {
+			if !strings.HasSuffix(lines[j+1], " "+e) {
+				t.Errorf("Case %v: incorrect posting %v: %q", i, j, lines[j+1])
+			}
+		}
+		if !strings.HasSuffix(lines[3], " $10.00") {
+			t.Errorf("Case %v: incorrect positive posting: %q", i, lines[3])
+		}
+	}
+
+	// Only one sign is allowed.
+	_, err = parse.ParseLedgerString(strings.Replace(TestSignFirstInput, "-$5.00", "-$-5.00", 1))
+	if _, ok := err.(parse.ErrBadAmount); !ok {
+		t.Errorf("Incorrect error for two signs: %v", err)
+	}
+}
+
+var TestTagDirectiveInput = `account Expenses:Food
+account Assets:Cash
+commodity $
+
+tag Receipt
+    check value =~ /^[0-9]+$/
+    assert value != "none"
+    check len(value) > 2
+tag reimbursable
+
+2023/08/01 * Lunch
+    ; :reimbursable:
+    ; Receipt: 1234
+    Expenses:Food    $10.00
+    Assets:Cash
+`
+
+func TestTagDirective(t *testing.T) {
+	pedantic := func(input string) (*ledger.File, error) {
+		return parse.ParseLedgerWith(parse.NewCharReader(input, 1), parse.Options{Pedantic: true})
+	}
+
+	f, err := pedantic(TestTagDirectiveInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := f.Tags()
+	expected := []string{`value =~ /^[0-9]+$/`, `value != "none"`, `len(value) > 2`}
+	if len(tags) != 2 || tags[0].Name != "Receipt" || !reflect.DeepEqual(tags[0].Checks, expected) || tags[1].DirectiveIndex != 4 {
+		t.Fatalf("Incorrect tags: %#v", tags)
+	}
+
+	// The directive is written back out as it was.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\ntag Receipt\n\tcheck value =~ /^[0-9]+$/\n\tassert value != \"none\"\n\tcheck len(value) > 2\n") {
+		t.Errorf("Incorrect output:\n%v", buf.String())
+	}
+
+	// Undeclared tags and keys.
+	_, err = pedantic(strings.Replace(TestTagDirectiveInput, ":reimbursable:", ":personal:", 1))
+	if uerr, ok := err.(parse.ErrUndeclared); !ok || uerr.Kind != "tag" || uerr.Name != "personal" {
+		t.Errorf("Incorrect error for an undeclared tag: %v", err)
+	}
+	_, err = pedantic(strings.Replace(TestTagDirectiveInput, "Receipt: 1234", "Note: 1234", 1))
+	if uerr, ok := err.(parse.ErrUndeclared); !ok || uerr.Name != "Note" {
+		t.Errorf("Incorrect error for an undeclared key: %v", err)
+	}
+
+	// The keys the library writes itself don't need to be declared.
+	_, err = pedantic(strings.Replace(TestTagDirectiveInput, "; Receipt: 1234", "; Receipt: 1234\n    ; ID: abc\n    ; RID: def\n    ; time: 12:30", 1))
+	if err != nil {
+		t.Errorf("Error for the library's own keys: %v", err)
+	}
+
+	// Values that fail a constraint.
+	for _, value := range []string{"12a", "none"} {
+		_, err = pedantic(strings.Replace(TestTagDirectiveInput, "Receipt: 1234", "Receipt: "+value, 1))
+		if verr, ok := err.(parse.ErrTagValue); !ok || verr.Tag != "Receipt" || verr.Value != value {
+			t.Errorf("Incorrect error for %q: %v", value, err)
+		}
+	}
+
+	// An earlier value of a key given twice is checked as well.
+	_, err = pedantic(strings.Replace(TestTagDirectiveInput, "; Receipt: 1234", "; Receipt: none\n    ; Receipt: 1234", 1))
+	if verr, ok := err.(parse.ErrTagValue); !ok || verr.Value != "none" {
+		t.Errorf("Incorrect error for a duplicate value: %v", err)
+	}
+
+	// Only pedantic mode cares.
+	_, err = parse.ParseLedgerString(strings.Replace(TestTagDirectiveInput, "Receipt: 1234", "Other: none", 1))
+	if err != nil {
+		t.Errorf("Error outside pedantic mode: %v", err)
+	}
+}
+
+var TestSectionsInput = "2023/01/01 * A\n" +
+	"    Expenses:Food    $5.00\n" +
+	"    Assets:Cash\n" +
+	"\f\n" +
+	"--- Q1 ---\n" +
+	"\f2023/02/01 * B\n" +
+	"    Expenses:Food    $5.00\n" +
+	"    Assets:Cash\n" +
+	"------\n" +
+	"2023/03/01 * C\n" +
+	"    Expenses:Food    $5.00\n" +
+	"    Assets:Cash\n"
+
+func TestSections(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestSectionsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.T) != 3 || len(f.D) != 0 || f.T[1].Description != "B" || len(f.T[0].Postings) != 2 {
+		t.Fatalf("Incorrect file: %v %v", f.T, f.D)
+	}
+
+	f, err = parse.ParseLedgerWith(parse.NewCharReader(TestSectionsInput, 1), parse.Options{KeepSections: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		typ, arg string
+		before   int
+	}{
+		{"\f", "", 1},
+		{"---", "Q1 ---", 1},
+		{"\f", "", 1},
+		{"---", "", 2},
+	}
+	if len(f.T) != 3 || len(f.D) != len(expected) {
+		t.Fatalf("Incorrect file: %v %v", f.T, f.D)
+	}
+	for i, e := range expected {
+		d := f.D[i]
+		if d.Type != e.typ || d.Argument != e.arg || d.FoundBefore != e.before || d.Kind() != ledger.DirectiveSection {
+			t.Errorf("Incorrect directive %v: %#v", i, d)
+		}
+	}
+
+	// The markers survive a round trip.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n\f\n\n--- Q1 ---\n\n\f\n\n2023/02/01 * B\n") {
+		t.Errorf("Incorrect output:\n%q", buf.String())
+	}
+	f2, err := parse.ParseLedgerWith(parse.NewCharReader(buf.String(), 1), parse.Options{KeepSections: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f2.D) != len(f.D) || len(f2.T) != 3 {
+		t.Errorf("Incorrect reparse: %v %v", f2.T, f2.D)
+	}
+
+	// Two dashes are not enough.
+	_, err = parse.ParseLedgerString(strings.Replace(TestSectionsInput, "------", "--", 1))
+	if _, ok := err.(parse.ErrMalformed); !ok {
+		t.Errorf("Incorrect error: %v", err)
+	}
+}
+
+var TestCodeOrderInput = `
+2023/11/01 * (123) Spaced
+    Expenses:Food    $5.00
+    Assets:Cash
+
+2023/11/01 *(123) Tight
+    Expenses:Food    $5.00
+    Assets:Cash
+
+2023/11/01 (123) * Code first
+    Expenses:Food    $5.00
+    Assets:Cash
+
+2023/11/01 (123) !Not a status
+    Expenses:Food    $5.00
+    Assets:Cash
+`
+
+func TestCodeOrder(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCodeOrderInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, desc := range []string{"Spaced", "Tight", "Code first"} {
+		tr := &f.T[i]
+		if tr.Status != ledger.StatusClear || tr.Code != "123" || tr.Description != desc || tr.CodeFirst != (i == 2) {
+			t.Errorf("Incorrect transaction %v: %#v", i, tr)
+		}
+		if s := tr.String(); !strings.HasPrefix(s, "2023/11/01 * (123) "+desc+"\n") {
+			t.Errorf("Incorrect output for transaction %v:\n%v", i, s)
+		}
+	}
+	if tr := &f.T[3]; tr.Status != ledger.StatusUndefined || tr.Description != "!Not a status" {
+		t.Errorf("Incorrect transaction 3: %#v", tr)
+	}
+
+	// The original order can be kept.
+	s := f.T[2].StringWith(ledger.WriteOptions{PreserveCodeOrder: true})
+	if !strings.HasPrefix(s, "2023/11/01 (123) * Code first\n") {
+		t.Errorf("Incorrect preserved output:\n%v", s)
+	}
+	s = f.T[0].StringWith(ledger.WriteOptions{PreserveCodeOrder: true})
+	if !strings.HasPrefix(s, "2023/11/01 * (123) Spaced\n") {
+		t.Errorf("Incorrect preserved output:\n%v", s)
+	}
+}
+
+func TestNoTrailingNewline(t *testing.T) {
+	inputs := []string{
+		"2023/12/01 * Last\n    Expenses:Food    $5.00\n    Assets:Cash",
+		"2023/12/01 * Last\n    Expenses:Food    $5.00\n    Assets:Cash    $-5.00 ; note",
+		"2023/12/01 * Last\n    Expenses:Food    $5.00\n    Assets:Cash\n    ; ID: abc",
+		"account Assets:Cash\n2023/12/01 * Last\n    Expenses:Food    $5.00\n    Assets:Cash    = $-5.00",
+	}
+	for i, input := range inputs {
+		f, err := parse.ParseLedgerString(input)
+		if err != nil {
+			t.Errorf("Case %v: %v", i, err)
+			continue
+		}
+		f2, err := parse.ParseLedgerString(input + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tr, tr2 := f.T[0], f2.T[0]
+		if tr.End != int64(len(input)) {
+			t.Errorf("Case %v: incorrect end offset: %v", i, tr.End)
+		}
+		tr.End, tr2.End = 0, 0
+		if !reflect.DeepEqual(tr, tr2) {
+			t.Errorf("Case %v: incorrect transaction:\n%#v\nExpected:\n%#v", i, tr, tr2)
+		}
+	}
+
+	// A directive at the very end works as well.
+	f, err := parse.ParseLedgerString("2023/12/01 * Last\n    Expenses:Food    $5.00\n    Assets:Cash\nP 2023/12/01 EUR $1.10")
+	if err != nil || len(f.D) != 1 || f.D[0].Argument != "2023/12/01 EUR $1.10" {
+		t.Errorf("Incorrect result for a final directive: %v", err)
+	}
+}
+
+var TestScanIndexInput = `account Assets:Checking
+    note Where the money is
+
+comment
+    2023/01/01 old entry
+    10 reasons
+
+2023/01/01 * Paycheck
+    ; ID: a1
+    ; RID: 0001
+    Assets:Checking    $1,000.00
+    ; FITID: not this one
+    Income:Salary
+  ; FITID: 2023010101
+
+; A comment with a date: 2023/01/02
+Y 2022
+
+  12/31 Groceries
+    ; ID: a2
+    ; ID: a3
+    Expenses:Food    $20.00
+    Assets:Checking
+
+2023/01/03=2023/01/05 (10) Rent
+    ; Note: ID: not this one either
+    Expenses:Rent    $500.00
+    Assets:Checking`
+
+func TestScanIndex(t *testing.T) {
+	idx, err := parse.ScanIndex(parse.NewCharReader(TestScanIndexInput, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parse.ParseLedgerString(TestScanIndexInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything must match a full parse.
+	if len(idx) != len(f.T) {
+		t.Fatalf("Incorrect transaction count: %v", len(idx))
+	}
+	for i, tr := range f.T {
+		expected := parse.TxnIndex{
+			Date:     tr.Date,
+			ID:       tr.KVPairs["ID"],
+			RID:      tr.KVPairs["RID"],
+			FITID:    tr.KVPairs["FITID"],
+			Location: tr.Location,
+			Start:    tr.Start,
+			End:      tr.End,
+		}
+		if idx[i] != expected {
+			t.Errorf("Incorrect index %v: %+v, expected %+v", i, idx[i], expected)
+		}
+	}
+	if idx[0].FITID != "2023010101" || idx[1].ID != "a3" || idx[1].Date.Year() != 2022 || idx[2].ID != "" {
+		t.Errorf("Incorrect index: %+v", idx)
+	}
+
+	_, err = parse.ScanIndex(parse.NewCharReader("2023/13/01 Bad\n", 1))
+	if err == nil {
+		t.Error("Expected an error for a bad date.")
+	}
+}
+
+// scanBenchInput returns a journal of n made up transactions.
+func scanBenchInput(n int) string {
+	buf := new(strings.Builder)
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buf, "%v * Groceries %v\n", date.AddDate(0, 0, i).Format("2006/01/02"), i)
+		fmt.Fprintf(buf, "    ; ID: %v\n", i)
+		fmt.Fprintf(buf, "    ; FITID: %v\n", i*7)
+		fmt.Fprintf(buf, "    Expenses:Food       $%v.%02d\n", i, i%100)
+		fmt.Fprintf(buf, "    Expenses:Travel     %v,%02d €\n", i, i%100)
+		fmt.Fprintf(buf, "    Assets:Cash         $-%v.%02d\n", i, i%100)
+		fmt.Fprintf(buf, "    Liabilities:Card\n\n")
+	}
+	return buf.String()
+}
+
+func BenchmarkScanIndex(b *testing.B) {
+	input := scanBenchInput(10000)
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		_, err := parse.ScanIndex(parse.NewCharReader(input, 1))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanIndexFullParse(b *testing.B) {
+	input := scanBenchInput(10000)
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		_, err := parse.ParseLedgerString(input)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestResolveInclude(t *testing.T) {
+	root, other := t.TempDir(), t.TempDir()
+	for _, path := range []string{
+		filepath.Join(root, "accounts.ledger"),
+		filepath.Join(root, "years", "2023.ledger"),
+		filepath.Join(other, "prices.ledger"),
+		filepath.Join(other, "accounts.ledger"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := parse.ParseLedgerString("include years/2023.ledger\ninclude accounts.ledger\ninclude prices.ledger\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := ledger.DirectivesOfKind(f.D, ledger.DirectiveInclude)
+	if len(ds) != 3 {
+		t.Fatalf("Incorrect directives: %v", ds)
+	}
+
+	// The base directory comes first, then the search path.
+	expected := []string{
+		filepath.Join(root, "years", "2023.ledger"),
+		filepath.Join(root, "accounts.ledger"),
+		filepath.Join(other, "prices.ledger"),
+	}
+	for i, d := range ds {
+		path, err := parse.ResolveInclude(d.Argument, root, other)
+		if err != nil || path != expected[i] {
+			t.Errorf("Incorrect path for %v: %v %v", d.Argument, path, err)
+		}
+	}
+
+	// Without the search path.
+	if _, err := parse.ResolveInclude("prices.ledger", root); err != parse.ErrIncludeNotFound("prices.ledger") {
+		t.Errorf("Incorrect error: %v", err)
+	}
+	if _, err := parse.ResolveInclude("years", root); err == nil {
+		t.Error("Expected an error for a directory.")
+	}
+
+	// Absolute names skip the search.
+	abs := filepath.Join(other, "accounts.ledger")
+	if path, err := parse.ResolveInclude(abs, root); err != nil || path != abs {
+		t.Errorf("Incorrect path for an absolute name: %v %v", path, err)
+	}
+
+	// Quoted names and the home directory.
+	if path, err := parse.ResolveInclude(`"years/2023.ledger"`, root); err != nil || path != expected[0] {
+		t.Errorf("Incorrect path for a quoted name: %v %v", path, err)
+	}
+	t.Setenv("HOME", other)
+	if path, err := parse.ResolveInclude("~/prices.ledger", root); err != nil || path != expected[2] {
+		t.Errorf("Incorrect path for a name in the home directory: %v %v", path, err)
+	}
+}
+
+var TestApplyTagInput = `
+apply tag trip
+
+2023/05/01 * Hotel
+	; :work:
+	Expenses:Travel                                             $200.00
+	Assets:Checking
+
+apply tag Project: Alpha
+
+2023/05/02 * Lunch
+	; Project: Beta
+	Expenses:Food                                                $15.00
+	Assets:Checking
+
+apply tag :meal:
+
+2023/05/03 * Dinner
+	Expenses:Food                                                $30.00
+	Assets:Checking
+
+end apply tag
+
+end apply tag
+
+end apply tag
+
+2023/05/04 * Groceries
+	Expenses:Food                                                $50.00
+	Assets:Checking
+`
+
+func TestApplyTag(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestApplyTagInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.T) != 4 {
+		t.Fatalf("Incorrect transaction count: %v", len(f.T))
+	}
+
+	// Nested blocks accumulate, and tags written on the transaction win.
+	cases := []struct {
+		tags    []string
+		kvs     map[string]string
+		applied []string
+	}{
+		{[]string{"trip", "work"}, map[string]string{}, []string{"trip"}},
+		{[]string{"trip"}, map[string]string{"Project": "Beta"}, []string{"trip"}},
+		{[]string{"meal", "trip"}, map[string]string{"Project": "Alpha"}, []string{"trip", "meal"}},
+		{[]string{}, map[string]string{}, nil},
+	}
+	for i, c := range cases {
+		tr := f.T[i]
+		tags := []string{}
+		for tag := range tr.Tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, c.tags) || !reflect.DeepEqual(tr.KVPairs, c.kvs) || !reflect.DeepEqual(tr.AppliedTags, c.applied) {
+			t.Errorf("Incorrect transaction %v: %v %v %v", i, tags, tr.KVPairs, tr.AppliedTags)
+		}
+	}
+	if f.T[1].AppliedKV != nil || !reflect.DeepEqual(f.T[2].AppliedKV, []string{"Project"}) {
+		t.Errorf("Incorrect applied keys: %v %v", f.T[1].AppliedKV, f.T[2].AppliedKV)
+	}
+
+	// By default the tags are written inline and the blocks go away.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "apply") {
+		t.Errorf("Apply blocks were written:\n%v", buf.String())
+	}
+	out, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range f.T {
+		if !reflect.DeepEqual(out.T[i].Tags, f.T[i].Tags) || !reflect.DeepEqual(out.T[i].KVPairs, f.T[i].KVPairs) {
+			t.Errorf("Incorrect transaction %v after a write: %v %v", i, out.T[i].Tags, out.T[i].KVPairs)
+		}
+	}
+
+	// Or the block form is kept.
+	buf.Reset()
+	err = f.FormatWith(buf, ledger.WriteOptions{KeepApplyBlocks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != TestApplyTagInput {
+		t.Errorf("Incorrect output:\n%v", buf.String())
+	}
+}
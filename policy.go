@@ -0,0 +1,34 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package ledger
+
+// RoundingMode selects how exact results are rounded to the nearest ten-thousandth of a unit. Functions that round
+// without being given a mode (ConvertTo, ExchangeRate, NormalizePrecision, and BalanceOptions left at its zero
+// value) always use the default, RoundHalfEven, each of them has a variant or option that takes a mode instead.
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // Ties go to the even neighbor (banker's rounding). This is the default.
+	RoundHalfUp                       // Ties go away from zero.
+	RoundDown                         // Everything goes towards zero (truncation).
+)
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package ledger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestPolicyInput = `
+2022/10/06 * Split bill
+    Expenses:Food       $3.3333
+    Expenses:Food       $3.3333
+    Assets:Cash         $-6.67
+`
+
+func TestPolicy(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestPolicyInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := f.T[0].Balance(); ok {
+		t.Fatal("Transaction balanced without a tolerance.")
+	}
+	if _, err := ledger.RunChecks(f.T); err == nil {
+		t.Error("No error without a tolerance.")
+	}
+
+	// A tolerance flows through every function that is given it.
+	opts := ledger.BalanceOptions{Tolerance: 50}
+	if ok, _ := f.T[0].BalanceWith(opts); !ok {
+		t.Error("Transaction did not balance with a tolerance.")
+	}
+	if _, errs := ledger.RunChecksSeq(ledger.SliceSeq(f.T), ledger.CheckOptions{Balance: opts}); len(errs) != 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	// A rounding account flows through to the reports.
+	opts.RoundingAccount = "Expenses:Rounding"
+	lines := ledger.TrialBalanceWith(f.T, time.Now(), ledger.ReportOptions{Balance: opts, IncludeGenerated: true})
+	if len(lines) != 3 || lines[2].Account != "Expenses:Rounding" || lines[2].Debit != 34 {
+		t.Errorf("Incorrect trial balance: %v", lines)
+	}
+	totals := ledger.CommodityTotalsByAccountWith(f.T, ledger.ReportOptions{Balance: opts, IncludeGenerated: true})
+	if totals["Expenses:Rounding"]["$"].Value != 34 {
+		t.Errorf("Incorrect totals: %v", totals)
+	}
+
+	// Rounding modes.
+	a, neg := ledger.Amount{Value: 5, Commodity: "EUR"}, ledger.Amount{Value: -5, Commodity: "EUR"}
+	rate := ledger.Amount{Value: 5000, Commodity: "$"} // 0.5
+	if v := a.ConvertTo("$", rate).Value; v != 2 {
+		t.Errorf("Incorrect default rounding: %v", v)
+	}
+	for _, c := range []struct {
+		mode     ledger.RoundingMode
+		expected int64
+	}{
+		{ledger.RoundHalfEven, 2},
+		{ledger.RoundHalfUp, 3},
+		{ledger.RoundDown, 2},
+	} {
+		if v := a.ConvertToWith("$", rate, c.mode).Value; v != c.expected {
+			t.Errorf("Mode %v: expected %v, got %v", c.mode, c.expected, v)
+		}
+		if v := neg.ConvertToWith("$", rate, c.mode).Value; v != -c.expected {
+			t.Errorf("Mode %v: expected %v, got %v", c.mode, -c.expected, v)
+		}
+
+		// The same mode is used for per unit costs when balancing.
+		tr := ledger.Transaction{Postings: []ledger.Posting{
+			{Account: "Assets:Broker", Value: 5, Commodity: "EUR", Cost: 5000, HasCost: true, CostCommodity: "$"},
+			{Account: "Assets:Cash", Null: true},
+		}}
+		if err := tr.CanonicalizeWith(ledger.BalanceOptions{Rounding: c.mode}); err != nil || tr.Postings[1].Value != -c.expected {
+			t.Errorf("Mode %v: incorrect balance %v %v", c.mode, tr.Postings[1].Value, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package ledger
+
+// CommodityFormat is the canonical number of decimal places for each commodity, keyed by commodity name. An
+// empty name means DefaultCommodity, the same as everywhere else.
+type CommodityFormat map[string]int
+
+// places returns the canonical number of decimal places for the commodity, if there is one.
+func (f CommodityFormat) places(c string) (int, bool) {
+	if places, ok := f[commodityName(c)]; ok {
+		return places, true
+	}
+	if commodityName(c) == DefaultCommodity {
+		places, ok := f[""]
+		return places, ok
+	}
+	return 0, false
+}
+
+// NormalizePrecision rounds every amount in a commodity with a canonical format to that many decimal places (to
+// even, see NormalizePrecisionWith) and sets the amount's style to match, for cleaning up imported data before it is
+// committed. Commodities without a format are left alone, as are postings with a cost or a balance assertion
+// (changing those would change their meaning).
+//
+// The total of each commodity in a transaction never changes. If the transaction has a null posting it takes up
+// any difference on its own, otherwise the difference goes to the posting with the RoundingNote (if any) or the
+// posting that was changed the most by rounding (the first one if there is a tie). If that leaves the posting with
+// more places than the format allows, it keeps all of them so the transaction still balances when written out.
+func NormalizePrecision(trs []Transaction, formats CommodityFormat) {
+	NormalizePrecisionWith(trs, formats, RoundHalfEven)
+}
+
+// NormalizePrecisionWith is exactly like NormalizePrecision, but with the given rounding mode.
+func NormalizePrecisionWith(trs []Transaction, formats CommodityFormat, mode RoundingMode) {
+	for i := range trs {
+		normalizePrecision(&trs[i], formats, mode)
+	}
+}
+
+func normalizePrecision(t *Transaction, formats CommodityFormat, mode RoundingMode) {
+	null := false
+	diffs := map[string]int64{}
+	targets := map[string]int{}
+	changes := map[int]int64{}
+	for i := range t.Postings {
+		p := &t.Postings[i]
+		if p.Null {
+			null = true
+			continue
+		}
+		places, ok := formats.places(p.Commodity)
+		if !ok || p.HasCost || p.HasAssert {
+			continue
+		}
+
+		v := roundValue(p.Value, places, mode)
+		c := commodityName(p.Commodity)
+		diffs[c] += v - p.Value
+		changes[i] = abs(v - p.Value)
+		p.Value = v
+		p.Style.Precision = places
+		if places == 0 {
+			p.Style.Precision = -1
+		}
+
+		// The posting that takes up the difference, a rounding posting wins over the one changed the most.
+		j, ok := targets[c]
+		if !ok || t.Postings[j].Note != RoundingNote && (p.Note == RoundingNote || changes[i] > changes[j]) {
+			targets[c] = i
+		}
+	}
+	if null {
+		return
+	}
+
+	for c, diff := range diffs {
+		if diff == 0 {
+			continue
+		}
+		p := &t.Postings[targets[c]]
+		p.Value -= diff
+
+		places, _ := formats.places(c)
+		if roundValue(p.Value, places, RoundDown) != p.Value {
+			p.Style.Precision = 4
+		}
+	}
+}
+
+// roundValue rounds a value (in ten-thousandths of a unit) to the given number of decimal places.
+func roundValue(v int64, places int, mode RoundingMode) int64 {
+	if places >= 4 {
+		return v
+	}
+	if places < 0 {
+		places = 0
+	}
+
+	div := int64(1)
+	for i := places; i < 4; i++ {
+		div *= 10
+	}
+	q, r := v/div, abs(v%div)
+
+	up := false
+	switch mode {
+	case RoundHalfEven:
+		up = r*2 > div || r*2 == div && q%2 != 0
+	case RoundHalfUp:
+		up = r*2 >= div
+	}
+	if up {
+		if v < 0 {
+			q--
+		} else {
+			q++
+		}
+	}
+	return q * div
+}
+
+// abs returns the absolute value of v.
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
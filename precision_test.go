@@ -0,0 +1,96 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package ledger_test
+
+import (
+	"testing"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestNormalizePrecisionInput = `
+2022/10/11 * Split three ways
+    Expenses:Food       $3.3333
+    Expenses:Food       $3.3333
+    Expenses:Food       $3.3334
+    Assets:Cash         $-10.00
+
+2022/10/12 * Imported
+    Expenses:Travel     EUR 10.125
+    Expenses:Fees       $0.015
+    Assets:Checking
+
+2022/10/13 * With rounding
+    Expenses:Food       $1.005
+    Expenses:Food       $1.005
+    Equity:Rounding     $0.00 ; Rounding adjustment
+    Assets:Cash         $-2.01
+`
+
+func TestNormalizePrecision(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestNormalizePrecisionInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger.NormalizePrecision(f.T, ledger.CommodityFormat{"$": 2, "EUR": 2})
+
+	expected := [][]string{
+		{"$3.33", "$3.33", "$3.34", "$-10.00"},
+		{"EUR 10.12", "$0.02", ""},
+		{"$1.00", "$1.00", "$0.01", "$-2.01"},
+	}
+	for i, e := range expected {
+		for j, out := range e {
+			p := f.T[i].Postings[j]
+			if p.Null {
+				continue
+			}
+			if s := p.Amount().String(); s != out {
+				t.Errorf("Transaction %v, posting %v: expected %q, got %q", i, j, out, s)
+			}
+		}
+	}
+
+	// Everything still balances, and the totals are unchanged.
+	for i := range f.T {
+		if ok, _ := f.T[i].Balance(); !ok {
+			t.Errorf("Transaction %v does not balance.", i)
+		}
+	}
+
+	// Without a rounding posting the one changed the most takes up the difference.
+	f, err = parse.ParseLedgerString(TestNormalizePrecisionInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.T[2].Postings[2].Note = ""
+	ledger.NormalizePrecision(f.T[2:], ledger.CommodityFormat{"": 2})
+	if s := f.T[2].Postings[0].Amount().String(); s != "$1.01" {
+		t.Errorf("Incorrect adjustment: %v", s)
+	}
+	if ok, _ := f.T[2].Balance(); !ok {
+		t.Error("Transaction does not balance.")
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// BareAccount strips the brackets or parenthesis from a virtual account name, so "[Assets:Savings]" and
+// "(Assets:Savings)" both become "Assets:Savings". Other names are returned unchanged.
+func BareAccount(name string) string {
+	if len(name) < 2 {
+		return name
+	}
+	if (name[0] == '[' && name[len(name)-1] == ']') || (name[0] == '(' && name[len(name)-1] == ')') {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+// AccountDepth returns the number of segments in an account name, so "Expenses:Food" is 2 and "Expenses" is 1. An
+// empty name is 0. Virtual account names are measured by their bare names.
+func AccountDepth(name string) int {
+	name = BareAccount(name)
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ":") + 1
+}
+
+// AccountParent returns the parent of an account, so "Expenses:Food:Dining" gives "Expenses:Food". A top level
+// account (or an empty name) has no parent and gives an empty string. Virtual account names give the bare name of
+// the parent.
+func AccountParent(name string) string {
+	name = BareAccount(name)
+	i := strings.LastIndex(name, ":")
+	if i == -1 {
+		return ""
+	}
+	return name[:i]
+}
+
+// AccountLeaf returns the last segment of an account name, so "Expenses:Food:Dining" gives "Dining". A top level
+// account is its own leaf. Virtual account names give the leaf of the bare name.
+func AccountLeaf(name string) string {
+	name = BareAccount(name)
+	return name[strings.LastIndex(name, ":")+1:]
+}
+
+// accountMatches returns true if name is account, or if prefix is set, one of account's children. Virtual
+// account names are compared by their bare names.
+func accountMatches(name, account string, prefix bool) bool {
+	name, account = BareAccount(name), BareAccount(account)
+	if name == account {
+		return true
+	}
+	return prefix && strings.HasPrefix(name, account+":")
+}
+
+// HasPosting returns true if the transaction has a posting to exactly the given account. Virtual account names are
+// compared by their bare names, so "[Assets:Savings]" matches "Assets:Savings".
+func (t *Transaction) HasPosting(account string) bool {
+	for _, p := range t.Postings {
+		if accountMatches(p.Account, account, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPostingUnder is like HasPosting, but postings to children of the account count as well ("Expenses" matches
+// "Expenses:Food", but not "ExpensesOther").
+func (t *Transaction) HasPostingUnder(account string) bool {
+	for _, p := range t.Postings {
+		if accountMatches(p.Account, account, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransactionsForAccount returns all the transactions with at least one posting to the given account. If prefix
+// is true postings to any child of the account also count ("Expenses" matches "Expenses:Food", but not
+// "ExpensesOther"). The transactions are returned in the same order they are found in trs.
+func TransactionsForAccount(trs []Transaction, account string, prefix bool) []Transaction {
+	rtrs := []Transaction{}
+	for _, tr := range trs {
+		for _, p := range tr.Postings {
+			if accountMatches(p.Account, account, prefix) {
+				rtrs = append(rtrs, tr)
+				break
+			}
+		}
+	}
+	return rtrs
+}
+
+// PendingCategorization returns the transactions that still have a posting to the placeholder account used while
+// importing (Expenses:Unknown, for example), so they can be categorized by hand or with Transaction.Match. The
+// account is matched the same way as TransactionsForAccount, so with prefix set a placeholder like
+// "Expenses:Unknown" also catches "Expenses:Unknown:Card".
+func PendingCategorization(trs []Transaction, unknownAccount string, prefix bool) []Transaction {
+	return TransactionsForAccount(trs, unknownAccount, prefix)
+}
+
+// FilterPostings returns copies of the transactions with only the postings that match pred, for reports that only
+// care about some accounts. Unlike TransactionsForAccount this trims the transactions themselves, and any
+// transaction left without postings is dropped. The copies are made with CleanCopy, so trs is not changed.
+//
+// Note that the filtered transactions will usually no longer balance, so they should not be written back to a
+// journal or passed to anything that expects balanced transactions (RunChecks, for example). Null postings are kept
+// as is if they match, but their value is no longer implied by the other postings.
+func FilterPostings(trs []Transaction, pred func(Posting) bool) []Transaction {
+	rtrs := []Transaction{}
+	for i := range trs {
+		tr := trs[i].CleanCopy()
+		ps := tr.Postings[:0]
+		for _, p := range tr.Postings {
+			if pred(p) {
+				ps = append(ps, p)
+			}
+		}
+		if len(ps) == 0 {
+			continue
+		}
+		tr.Postings = ps
+		rtrs = append(rtrs, *tr)
+	}
+	return rtrs
+}
+
+// FutureTransactions returns the transactions dated after now, in the same order they are found in trs. These are
+// either scheduled on purpose or typos (the wrong year, usually), so import tools can warn about them.
+func FutureTransactions(trs []Transaction, now time.Time) []Transaction {
+	return FutureTransactionsIn(trs, now, PrimaryDate)
+}
+
+// FutureTransactionsIn is like FutureTransactions, but it uses the given date mode.
+func FutureTransactionsIn(trs []Transaction, now time.Time, mode DateMode) []Transaction {
+	rtrs := []Transaction{}
+	for i := range trs {
+		if trs[i].DateIn(mode).After(now) {
+			rtrs = append(rtrs, trs[i])
+		}
+	}
+	return rtrs
+}
+
+// Contains returns true if any of the transactions has a posting to the given account. Accounts are matched
+// the same way as TransactionsForAccount.
+func Contains(trs []Transaction, account string, prefix bool) bool {
+	for _, tr := range trs {
+		for _, p := range tr.Postings {
+			if accountMatches(p.Account, account, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Payees returns the sorted list of unique payees (descriptions) used by the transactions. Matching is exact and
+// case sensitive, so "Coffee Shop" and "coffee shop" are two payees; normalize the descriptions first (with
+// matchers, for example) if that is not what you want. Empty descriptions are left out.
+func Payees(trs []Transaction) []string {
+	seen := map[string]bool{}
+	payees := []string{}
+	for _, tr := range trs {
+		if tr.Description == "" || seen[tr.Description] {
+			continue
+		}
+		seen[tr.Description] = true
+		payees = append(payees, tr.Description)
+	}
+	sort.Strings(payees)
+	return payees
+}
+
+// CheckNumberGaps returns the check numbers missing from the range used by the transactions, in order. Check
+// numbers are taken from the transaction codes, codes that are not plain numbers (like "ATM" or "#12") are ignored.
+// Returns an empty list if there are no gaps or no check numbers at all.
+//
+// A run of more than MaxCheckNumberGap missing numbers is almost always a typo in a code, and listing every number
+// in it could take an enormous amount of memory, so such runs are left out. Use CheckNumberGapRanges to see them.
+func CheckNumberGaps(trs []Transaction) []int {
+	gaps := []int{}
+	for _, r := range CheckNumberGapRanges(trs) {
+		if r.Last-r.First >= MaxCheckNumberGap {
+			continue
+		}
+		for n := r.First; n <= r.Last; n++ {
+			gaps = append(gaps, n)
+		}
+	}
+	return gaps
+}
+
+// MaxCheckNumberGap is the longest run of missing check numbers listed by CheckNumberGaps.
+const MaxCheckNumberGap = 1000
+
+// NumberGap is a run of missing check numbers, from First to Last inclusive.
+type NumberGap struct {
+	First, Last int
+}
+
+// CheckNumberGapRanges is like CheckNumberGaps, but returns each run of missing numbers as a range, no matter how
+// long it is.
+func CheckNumberGapRanges(trs []Transaction) []NumberGap {
+	used := map[int]bool{}
+	for _, tr := range trs {
+		if tr.Code == "" || strings.TrimLeft(tr.Code, "0123456789") != "" {
+			continue
+		}
+		n, err := strconv.Atoi(tr.Code)
+		if err != nil {
+			continue
+		}
+		used[n] = true
+	}
+
+	ns := maps.Keys(used)
+	sort.Ints(ns)
+	gaps := []NumberGap{}
+	for i := 1; i < len(ns); i++ {
+		if ns[i]-ns[i-1] > 1 {
+			gaps = append(gaps, NumberGap{ns[i-1] + 1, ns[i] - 1})
+		}
+	}
+	return gaps
+}
@@ -0,0 +1,309 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestQueryInput = `
+2022/01/01 * Groceries
+    Expenses:Food       $20.00
+    Assets:Cash
+
+2022/01/02 * Rent
+    Expenses:Rent       $500.00
+    Assets:Checking
+
+2022/01/03 * Savings
+    [Assets:Savings]    $50.00
+    Assets:Checking
+
+2022/01/04 * Odd Name
+    ExpensesOther       $5.00
+    Assets:Cash
+`
+
+func loadQueryInput(t *testing.T) []ledger.Transaction {
+	f, err := parse.ParseLedgerString(TestQueryInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.T
+}
+
+func TestTransactionsForAccount(t *testing.T) {
+	trs := loadQueryInput(t)
+
+	cases := []struct {
+		account string
+		prefix  bool
+		found   []string
+	}{
+		{"Expenses:Food", false, []string{"Groceries"}},
+		{"Expenses", false, []string{}},
+		{"Expenses", true, []string{"Groceries", "Rent"}},
+		{"Assets", true, []string{"Groceries", "Rent", "Savings", "Odd Name"}},
+		{"Assets:Savings", false, []string{"Savings"}},
+		{"[Assets:Savings]", false, []string{"Savings"}},
+		{"Assets:Checking:Sub", true, []string{}},
+	}
+
+	for _, c := range cases {
+		rtrs := ledger.TransactionsForAccount(trs, c.account, c.prefix)
+		if len(rtrs) != len(c.found) {
+			t.Errorf("Incorrect number of transactions for %v (prefix: %v): %v", c.account, c.prefix, len(rtrs))
+			continue
+		}
+		for i, tr := range rtrs {
+			if tr.Description != c.found[i] {
+				t.Errorf("Incorrect transaction %v for %v (prefix: %v): %v", i, c.account, c.prefix, tr.Description)
+			}
+		}
+
+		if ledger.Contains(trs, c.account, c.prefix) != (len(c.found) != 0) {
+			t.Errorf("Contains disagrees with TransactionsForAccount for %v (prefix: %v)", c.account, c.prefix)
+		}
+	}
+}
+
+func TestPayees(t *testing.T) {
+	trs := loadQueryInput(t)
+	more := []ledger.Transaction{trs[0], trs[1]}
+	more[0].Description = "groceries"
+	trs = append(trs, more...)
+
+	payees := ledger.Payees(trs)
+	expected := []string{"Groceries", "Odd Name", "Rent", "Savings", "groceries"}
+	if !reflect.DeepEqual(payees, expected) {
+		t.Errorf("Incorrect payees: %q", payees)
+	}
+}
+
+func TestHasPosting(t *testing.T) {
+	trs := loadQueryInput(t)
+
+	cases := []struct {
+		tr      int
+		account string
+		exact   bool
+		prefix  bool
+	}{
+		{0, "Expenses:Food", true, true},
+		{0, "Expenses", false, true},
+		{0, "Expenses:Foo", false, false},
+		{2, "Assets:Savings", true, true},
+		{2, "[Assets:Savings]", true, true},
+		{2, "(Assets:Savings)", true, true},
+		{2, "Assets", false, true},
+		{3, "Expenses", false, false},
+		{3, "ExpensesOther", true, true},
+	}
+	for i, c := range cases {
+		if v := trs[c.tr].HasPosting(c.account); v != c.exact {
+			t.Errorf("Case %v: HasPosting(%q) = %v", i, c.account, v)
+		}
+		if v := trs[c.tr].HasPostingUnder(c.account); v != c.prefix {
+			t.Errorf("Case %v: HasPostingUnder(%q) = %v", i, c.account, v)
+		}
+	}
+}
+
+func TestCheckNumberGaps(t *testing.T) {
+	trs := []ledger.Transaction{}
+	for _, code := range []string{"1003", "", "1001", "ATM", "1006", "#1004", "1002", "1001", "-5"} {
+		trs = append(trs, ledger.Transaction{Code: code})
+	}
+
+	gaps := ledger.CheckNumberGaps(trs)
+	if !reflect.DeepEqual(gaps, []int{1004, 1005}) {
+		t.Errorf("Incorrect gaps: %v", gaps)
+	}
+
+	if gaps := ledger.CheckNumberGaps(nil); len(gaps) != 0 {
+		t.Errorf("Incorrect gaps: %v", gaps)
+	}
+	if gaps := ledger.CheckNumberGaps(trs[3:4]); len(gaps) != 0 {
+		t.Errorf("Incorrect gaps: %v", gaps)
+	}
+
+	// A typo leaves a huge gap, which is only reported as a range.
+	trs = append(trs, ledger.Transaction{Code: "999999999"})
+	gaps = ledger.CheckNumberGaps(trs)
+	if !reflect.DeepEqual(gaps, []int{1004, 1005}) {
+		t.Errorf("Incorrect gaps: %v", gaps)
+	}
+	ranges := ledger.CheckNumberGapRanges(trs)
+	if !reflect.DeepEqual(ranges, []ledger.NumberGap{{1004, 1005}, {1007, 999999998}}) {
+		t.Errorf("Incorrect gap ranges: %v", ranges)
+	}
+}
+
+var TestPendingCategorizationInput = `
+2022/02/01 * Hardware Store
+    Expenses:Unknown    $20.00
+    Assets:Checking
+
+2022/02/02 * Coffee
+    Expenses:Food       $4.00
+    Assets:Checking
+
+2022/02/03 * Card Purchase
+    Expenses:Unknown:Card    $9.00
+    Liabilities:Card
+`
+
+func TestPendingCategorization(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestPendingCategorizationInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := ledger.PendingCategorization(f.T, "Expenses:Unknown", false)
+	if len(pending) != 1 || pending[0].Description != "Hardware Store" {
+		t.Errorf("Incorrect exact matches: %v", pending)
+	}
+
+	pending = ledger.PendingCategorization(f.T, "Expenses:Unknown", true)
+	if len(pending) != 2 || pending[0].Description != "Hardware Store" || pending[1].Description != "Card Purchase" {
+		t.Errorf("Incorrect prefix matches: %v", pending)
+	}
+
+	// Once categorized, a transaction is no longer pending.
+	f.T[0].Postings[0].Account = "Expenses:Tools"
+	if pending := ledger.PendingCategorization(f.T, "Expenses:Unknown", false); len(pending) != 0 {
+		t.Errorf("Incorrect matches after categorizing: %v", pending)
+	}
+}
+
+func TestFilterPostings(t *testing.T) {
+	trs := loadQueryInput(t)
+
+	// Partial matches keep only the matching postings.
+	cash := ledger.FilterPostings(trs, func(p ledger.Posting) bool {
+		return p.Account == "Assets:Cash"
+	})
+	if len(cash) != 2 || cash[0].Description != "Groceries" || cash[1].Description != "Odd Name" {
+		t.Fatalf("Incorrect transactions: %v", cash)
+	}
+	for _, tr := range cash {
+		if len(tr.Postings) != 1 || tr.Postings[0].Account != "Assets:Cash" {
+			t.Errorf("Incorrect postings: %v", tr.Postings)
+		}
+	}
+
+	// The originals are left alone.
+	if len(trs[0].Postings) != 2 {
+		t.Errorf("Original transaction changed: %v", trs[0].Postings)
+	}
+	cash[0].Postings[0].Account = "Assets:Wallet"
+	if trs[0].Postings[1].Account != "Assets:Cash" {
+		t.Errorf("Original posting changed: %v", trs[0].Postings[1])
+	}
+
+	// Full matches keep everything.
+	all := ledger.FilterPostings(trs, func(p ledger.Posting) bool { return true })
+	if !reflect.DeepEqual(all, trs) {
+		t.Errorf("Incorrect transactions: %v", all)
+	}
+
+	if none := ledger.FilterPostings(trs, func(p ledger.Posting) bool { return false }); len(none) != 0 {
+		t.Errorf("Incorrect transactions: %v", none)
+	}
+}
+
+func TestAccountSegments(t *testing.T) {
+	cases := []struct {
+		name         string
+		depth        int
+		parent, leaf string
+	}{
+		{"", 0, "", ""},
+		{"Expenses", 1, "", "Expenses"},
+		{"Expenses:Food", 2, "Expenses", "Food"},
+		{"Expenses:Food:Dining Out", 3, "Expenses:Food", "Dining Out"},
+		{"[Assets:Savings]", 2, "Assets", "Savings"},
+		{"(Budget)", 1, "", "Budget"},
+	}
+	for i, c := range cases {
+		depth, parent, leaf := ledger.AccountDepth(c.name), ledger.AccountParent(c.name), ledger.AccountLeaf(c.name)
+		if depth != c.depth || parent != c.parent || leaf != c.leaf {
+			t.Errorf("Case %v: incorrect result for %q: %v %q %q", i, c.name, depth, parent, leaf)
+		}
+	}
+}
+
+var TestFutureTransactionsInput = `
+2023/05/01 * Rent
+    Expenses:Rent       $500.00
+    Assets:Checking
+
+2023/05/20=2023/06/02 * Card payment
+    Liabilities:Card    $120.00
+    Assets:Checking
+
+2203/05/21 * Groceries
+    Expenses:Food       $30.00
+    Assets:Checking
+
+2023/05/31 * Scheduled rent
+    Expenses:Rent       $500.00
+    Assets:Checking
+`
+
+func TestFutureTransactions(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestFutureTransactionsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 5, 25, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		mode     ledger.DateMode
+		expected []string
+	}{
+		{ledger.PrimaryDate, []string{"Groceries", "Scheduled rent"}},
+		{ledger.EffectiveDate, []string{"Card payment", "Groceries", "Scheduled rent"}},
+	}
+	for _, c := range cases {
+		trs := ledger.FutureTransactionsIn(f.T, now, c.mode)
+		descs := []string{}
+		for _, tr := range trs {
+			descs = append(descs, tr.Description)
+		}
+		if !reflect.DeepEqual(descs, c.expected) {
+			t.Errorf("Incorrect transactions for mode %v: %v", c.mode, descs)
+		}
+	}
+
+	// Nothing is in the future of the last transaction.
+	if trs := ledger.FutureTransactions(f.T, time.Date(2203, 5, 21, 0, 0, 0, 0, time.UTC)); len(trs) != 0 {
+		t.Errorf("Incorrect transactions: %v", trs)
+	}
+}
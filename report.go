@@ -0,0 +1,516 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// TrialLine is a single row in a trial balance. Only one of Debit or Credit will be non-zero.
+type TrialLine struct {
+	Account   string
+	Commodity string
+	Debit     int64 // The balance of the account if it is positive.
+	Credit    int64 // The balance of the account if it is negative, as a positive number.
+}
+
+// ReportOptions controls the optional behavior of the report functions. Every report that adds up postings has a
+// "With" variant that takes these, the plain versions use the zero value.
+type ReportOptions struct {
+	// Options used when balancing each transaction. If a rounding account is set the rounding postings are
+	// Generated, and so are only included if IncludeGenerated is set. Commodities are totaled with the aliases
+	// resolved, under the name they are an alias of.
+	Balance BalanceOptions
+
+	// Include generated postings. These are left out by default so that things like budget templates are not
+	// counted as actuals.
+	IncludeGenerated bool
+
+	// Add the balance of every account to each of its parents as well, so "Expenses" holds everything spent. Only
+	// used by reports without a tree of their own (CommodityTotalsByAccountWith).
+	RollUp bool
+}
+
+// postings returns the postings of the transaction as the reports see them: resolved with the balance options, and
+// without generated postings unless they are asked for. A transaction that does not balance is included as well as
+// possible.
+func (opts ReportOptions) postings(tr *Transaction) []Posting {
+	ps, _ := tr.resolve(opts.Balance)
+	if opts.IncludeGenerated {
+		return ps
+	}
+	kept := ps[:0]
+	for _, p := range ps {
+		if !p.Generated {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// TrialBalance returns the balance of every account as of the given time (inclusive), with debit balances and
+// credit balances in separate columns. Accounts holding more than one commodity get one line per commodity and
+// accounts with a zero balance are left out. Lines are sorted by account and then commodity.
+//
+// The totals of the debit and credit columns will be equal for each commodity so long as every transaction
+// balances. Transactions that do not balance are included as well as possible, use SumTransactions first if you
+// need to know about them.
+func TrialBalance(trs []Transaction, at time.Time) []TrialLine {
+	return TrialBalanceWith(trs, at, ReportOptions{})
+}
+
+// TrialBalanceWith is exactly like TrialBalance, but with options. Leaving out generated postings may make the
+// report unbalanced.
+func TrialBalanceWith(trs []Transaction, at time.Time, opts ReportOptions) []TrialLine {
+	type key struct {
+		account   string
+		commodity string
+	}
+
+	sums := map[key]int64{}
+	for _, tr := range trs {
+		if tr.Date.After(at) {
+			continue
+		}
+
+		for _, p := range opts.postings(&tr) {
+			sums[key{p.Account, opts.Balance.commodity(p.Commodity)}] += p.Value
+		}
+	}
+
+	lines := []TrialLine{}
+	for k, v := range sums {
+		switch {
+		case v > 0:
+			lines = append(lines, TrialLine{Account: k.account, Commodity: k.commodity, Debit: v})
+		case v < 0:
+			lines = append(lines, TrialLine{Account: k.account, Commodity: k.commodity, Credit: -v})
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Account != lines[j].Account {
+			return lines[i].Account < lines[j].Account
+		}
+		return lines[i].Commodity < lines[j].Commodity
+	})
+	return lines
+}
+
+// CommodityTotalsByAccount returns the balance of every account in each commodity it holds, as a map of account names
+// to commodity names to amounts. Each account only holds its own postings, there is no tree (see
+// CommodityTotalsByAccountWith and ReportOptions.RollUp for that). Accounts are keyed by the name in the postings,
+// so a virtual account is separate from the real account of the same name, and a balance that comes to zero is kept.
+// The amounts are in the style of the first posting in each commodity.
+//
+// Transactions that do not balance are included as well as possible.
+func CommodityTotalsByAccount(trs []Transaction) map[string]map[string]Amount {
+	return CommodityTotalsByAccountWith(trs, ReportOptions{})
+}
+
+// CommodityTotalsByAccountWith is exactly like CommodityTotalsByAccount, but with options. If RollUp is set every
+// parent of an account gets its balance too, parents are keyed by their bare names (see AccountParent).
+func CommodityTotalsByAccountWith(trs []Transaction, opts ReportOptions) map[string]map[string]Amount {
+	totals := map[string]map[string]Amount{}
+	add := func(account string, p *Posting) {
+		if totals[account] == nil {
+			totals[account] = map[string]Amount{}
+		}
+		c := opts.Balance.commodity(p.Commodity)
+		a, ok := totals[account][c]
+		if !ok {
+			a = p.Amount()
+			a.Value = 0
+		}
+		a.Value += p.Value
+		totals[account][c] = a
+	}
+
+	for i := range trs {
+		ps := opts.postings(&trs[i])
+		for j := range ps {
+			p := &ps[j]
+			add(p.Account, p)
+			if !opts.RollUp {
+				continue
+			}
+			for parent := AccountParent(p.Account); parent != ""; parent = AccountParent(parent) {
+				add(parent, p)
+			}
+		}
+	}
+	return totals
+}
+
+// TopTransactions returns the n largest transactions in the given commodity, largest first, for reviewing
+// expenses. The size of a transaction is the total of its positive postings in the commodity (after filling in any
+// null posting), which for a balanced transaction is the amount that changed hands. Transactions without any
+// postings in the commodity are left out, ties are ordered by CompareTransactions (date, then ID).
+func TopTransactions(trs []Transaction, n int, commodity string) []Transaction {
+	return TopTransactionsWith(trs, n, commodity, ReportOptions{})
+}
+
+// TopTransactionsWith is exactly like TopTransactions, but with options.
+func TopTransactionsWith(trs []Transaction, n int, commodity string, opts ReportOptions) []Transaction {
+	type sized struct {
+		tr   *Transaction
+		size int64
+	}
+
+	commodity = opts.Balance.commodity(commodity)
+	all := []sized{}
+	for i := range trs {
+		found, size := false, int64(0)
+		for _, p := range opts.postings(&trs[i]) {
+			if opts.Balance.commodity(p.Commodity) != commodity {
+				continue
+			}
+			found = true
+			if p.Value > 0 {
+				size += p.Value
+			}
+		}
+		if found {
+			all = append(all, sized{&trs[i], size})
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].size != all[j].size {
+			return all[i].size > all[j].size
+		}
+		return CompareTransactions(all[i].tr, all[j].tr) < 0
+	})
+
+	top := []Transaction{}
+	for i := 0; i < n && i < len(all); i++ {
+		top = append(top, *all[i].tr)
+	}
+	return top
+}
+
+// BalanceAt returns the balance of the account (including its children) in each commodity as of the given time
+// (inclusive), keyed by commodity. Commodities the account has never held are left out, but a balance that went
+// back to zero is included. This only needs a single pass over the transactions, which do not need to be sorted.
+func BalanceAt(trs []Transaction, account string, at time.Time) map[string]Amount {
+	return BalanceAtIn(trs, account, at, PrimaryDate, true)
+}
+
+// BalanceAtIn is like BalanceAt, but it uses the given date mode and only includes the children of the account if
+// prefix is set. Postings with their own dates are counted as of those dates (see Posting.DateIn).
+func BalanceAtIn(trs []Transaction, account string, at time.Time, mode DateMode, prefix bool) map[string]Amount {
+	return BalanceAtInWith(trs, account, at, mode, prefix, ReportOptions{})
+}
+
+// BalanceAtInWith is exactly like BalanceAtIn, but with options.
+func BalanceAtInWith(trs []Transaction, account string, at time.Time, mode DateMode, prefix bool, opts ReportOptions) map[string]Amount {
+	sums := map[string]Amount{}
+	for i := range trs {
+		tr := &trs[i]
+		for _, p := range opts.postings(tr) {
+			if !accountMatches(p.Account, account, prefix) || p.DateIn(tr, mode).After(at) {
+				continue
+			}
+			c := opts.Balance.commodity(p.Commodity)
+			a, ok := sums[c]
+			if !ok {
+				a = p.Amount()
+				a.Value = 0
+			}
+			a.Value += p.Value
+			sums[c] = a
+		}
+	}
+	return sums
+}
+
+// RunningBalance lazily produces each transaction touching the given account (or one of its children) along with
+// the balance of the account after that transaction. Nothing is kept aside from the balance of each commodity,
+// so this is suitable for enormous inputs.
+//
+// The balance is for the commodity of the first posting to the account in the transaction. If the account holds
+// more than one commodity use RunningBalances instead.
+func RunningBalance(trs Seq[Transaction], account string) Seq2[Transaction, Amount] {
+	return RunningBalanceWith(trs, account, ReportOptions{})
+}
+
+// RunningBalanceWith is exactly like RunningBalance, but with options.
+func RunningBalanceWith(trs Seq[Transaction], account string, opts ReportOptions) Seq2[Transaction, Amount] {
+	return func(yield func(Transaction, Amount) bool) {
+		sums := map[string]int64{}
+		trs(func(tr Transaction) bool {
+			ps := opts.postings(&tr)
+
+			var first *Posting
+			for i, p := range ps {
+				if accountMatches(p.Account, account, true) {
+					sums[opts.Balance.commodity(p.Commodity)] += p.Value
+					if first == nil {
+						first = &ps[i]
+					}
+				}
+			}
+			if first == nil {
+				return true
+			}
+
+			return yield(tr, Amount{
+				Value:     sums[opts.Balance.commodity(first.Commodity)],
+				Commodity: first.Commodity,
+				Style:     first.Style,
+			})
+		})
+	}
+}
+
+// RunningBalances is like RunningBalance, but it produces the balance of every commodity the account (and its
+// children) has held so far, keyed by commodity. Each map is a fresh copy that may be kept or modified.
+func RunningBalances(trs Seq[Transaction], account string) Seq2[Transaction, map[string]Amount] {
+	return RunningBalancesWith(trs, account, ReportOptions{})
+}
+
+// RunningBalancesWith is exactly like RunningBalances, but with options.
+func RunningBalancesWith(trs Seq[Transaction], account string, opts ReportOptions) Seq2[Transaction, map[string]Amount] {
+	return func(yield func(Transaction, map[string]Amount) bool) {
+		sums := map[string]Amount{}
+		trs(func(tr Transaction) bool {
+			found := false
+			for _, p := range opts.postings(&tr) {
+				if accountMatches(p.Account, account, true) {
+					c := opts.Balance.commodity(p.Commodity)
+					a, ok := sums[c]
+					if !ok {
+						a = p.Amount()
+						a.Value = 0
+					}
+					a.Value += p.Value
+					sums[c] = a
+					found = true
+				}
+			}
+			if !found {
+				return true
+			}
+
+			return yield(tr, maps.Clone(sums))
+		})
+	}
+}
+
+// AccountActivity returns the date of the most recent transaction touching each account. Accounts that have not
+// been used in a long time are probably candidates for closing or archiving.
+func AccountActivity(trs []Transaction) map[string]time.Time {
+	_, last := AccountActivityIn(trs, PrimaryDate)
+	return last
+}
+
+// AccountFirstActivity returns the date of the earliest transaction touching each account.
+func AccountFirstActivity(trs []Transaction) map[string]time.Time {
+	first, _ := AccountActivityIn(trs, PrimaryDate)
+	return first
+}
+
+// AccountActivityIn returns the dates of the earliest and latest transactions touching each account, using the
+// given date mode. Postings with their own dates count as of those dates. The transactions do not need to be sorted.
+func AccountActivityIn(trs []Transaction, mode DateMode) (first, last map[string]time.Time) {
+	first, last = map[string]time.Time{}, map[string]time.Time{}
+	for i := range trs {
+		tr := &trs[i]
+		for _, p := range tr.Postings {
+			date := p.DateIn(tr, mode)
+			if d, ok := first[p.Account]; !ok || date.Before(d) {
+				first[p.Account] = date
+			}
+			if d, ok := last[p.Account]; !ok || date.After(d) {
+				last[p.Account] = date
+			}
+		}
+	}
+	return first, last
+}
+
+// OpeningNote is the note put on the postings of the transaction created by Compact.
+const OpeningNote = "Opening balance"
+
+// Compact replaces every transaction dated before the given time with a single opening balances transaction, dated at
+// that time and placed first in the result, and keeps the rest unchanged. The opening transaction has one posting per
+// account and commodity holding the balance of that account at the cutoff, plus postings to equityAccount to balance
+// it (conversions between commodities mean that the balances do not net to zero in each commodity on their own).
+//
+// Balances from the cutoff on are the same as before, with the exception of the equity account itself, which absorbs
+// the history. The transactions do not need to be sorted. An error is returned if a compacted transaction does not
+// balance, as then there is no correct opening balance to give.
+func Compact(trs []Transaction, at time.Time, equityAccount string) ([]Transaction, error) {
+	type key struct {
+		account   string
+		commodity string
+	}
+
+	sums := map[key]int64{}
+	totals := map[string]int64{}
+	written := map[string]string{}
+	styles := map[string]AmountStyle{}
+	kept := []Transaction{}
+	compacted := false
+	for i := range trs {
+		tr := &trs[i]
+		if !tr.Date.Before(at) {
+			kept = append(kept, *tr)
+			continue
+		}
+		compacted = true
+
+		ps, err := tr.resolve(BalanceOptions{})
+		if err != nil {
+			switch err.(type) {
+			case BalanceError:
+				return nil, BalanceError{i, tr.Location}
+			case MultipleNullError:
+				return nil, MultipleNullError{i, tr.Location}
+			}
+			return nil, err
+		}
+		// Each commodity is written the way it was first seen, but with the most decimal places it was seen with, so
+		// that a balance made up of $1000 and $0.50 keeps its cents.
+		for _, p := range ps {
+			c := commodityName(p.Commodity)
+			if style, ok := styles[c]; !ok {
+				written[c] = p.Commodity
+				styles[c] = p.Style
+			} else if p.Style.Places() > style.Places() {
+				style.Precision = p.Style.Precision
+				styles[c] = style
+			}
+			sums[key{p.Account, c}] += p.Value
+		}
+	}
+	if !compacted {
+		return kept, nil
+	}
+
+	keys := maps.Keys(sums)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].account != keys[j].account {
+			return keys[i].account < keys[j].account
+		}
+		return keys[i].commodity < keys[j].commodity
+	})
+
+	opening := Transaction{
+		Date:        at,
+		Status:      StatusClear,
+		Description: "Opening Balances",
+		KVPairs: map[string]string{
+			"ID":  <-IDService,
+			"RID": <-IDService,
+		},
+	}
+	for _, k := range keys {
+		if sums[k] == 0 || k.account == equityAccount {
+			continue
+		}
+		opening.Postings = append(opening.Postings, Posting{
+			Account:   k.account,
+			Value:     sums[k],
+			Commodity: written[k.commodity],
+			Style:     styles[k.commodity],
+			Note:      OpeningNote,
+		})
+		totals[k.commodity] += sums[k]
+	}
+	commodities := maps.Keys(totals)
+	sort.Strings(commodities)
+	for _, c := range commodities {
+		if totals[c] == 0 {
+			continue
+		}
+		opening.Postings = append(opening.Postings, Posting{
+			Account:   equityAccount,
+			Value:     -totals[c],
+			Commodity: written[c],
+			Style:     styles[c],
+		})
+	}
+
+	return append([]Transaction{opening}, kept...), nil
+}
+
+// BudgetBreach is an account that spent more than its budget, see CheckBudget. All of the amounts are in the
+// commodity of the budget.
+type BudgetBreach struct {
+	Account string
+	Budget  Amount
+	Spent   Amount
+	Over    Amount // How much more than the budget was spent.
+}
+
+// CheckBudget returns the accounts that spent more than their monthly budget in the given month, sorted by account.
+// The spending of an account includes all of its children, so a budget for "Expenses:Food" covers
+// "Expenses:Food:Groceries" as well. Only postings in the commodity of the budget are counted, and postings with
+// their own dates count in the month of that date.
+//
+// Generated postings are left out, the same as every other report does by default. Transactions that do not balance
+// are counted as well as possible.
+func CheckBudget(trs []Transaction, budgets map[string]Amount, month time.Month, year int) []BudgetBreach {
+	return CheckBudgetWith(trs, budgets, month, year, ReportOptions{})
+}
+
+// CheckBudgetWith is exactly like CheckBudget, but with options.
+func CheckBudgetWith(trs []Transaction, budgets map[string]Amount, month time.Month, year int, opts ReportOptions) []BudgetBreach {
+	spent := map[string]int64{}
+	for i := range trs {
+		tr := &trs[i]
+		for _, p := range opts.postings(tr) {
+			date := p.DateIn(tr, PrimaryDate)
+			if date.Month() != month || date.Year() != year {
+				continue
+			}
+
+			for account, budget := range budgets {
+				if accountMatches(p.Account, account, true) && opts.Balance.commodity(p.Commodity) == opts.Balance.commodity(budget.Commodity) {
+					spent[account] += p.Value
+				}
+			}
+		}
+	}
+
+	breaches := []BudgetBreach{}
+	for account, budget := range budgets {
+		if spent[account] <= budget.Value {
+			continue
+		}
+
+		s, over := budget, budget
+		s.Value = spent[account]
+		over.Value = spent[account] - budget.Value
+		breaches = append(breaches, BudgetBreach{Account: account, Budget: budget, Spent: s, Over: over})
+	}
+	sort.Slice(breaches, func(i, j int) bool {
+		return breaches[i].Account < breaches[j].Account
+	})
+	return breaches
+}
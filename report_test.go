@@ -0,0 +1,676 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestTrialBalanceInput = `
+2022/01/01 * Paycheck
+    Assets:Checking     $1,000.00
+    Income:Salary
+
+2022/01/02 * Groceries
+    Expenses:Food       $25.50
+    Assets:Checking
+
+2022/01/03 * Vacation
+    Expenses:Travel     €100.00
+    Assets:Checking     $-110.00
+    Liabilities:Travel Card
+
+2022/02/01 * Rent
+    Expenses:Rent       $500.00
+    Assets:Checking
+`
+
+func TestTrialBalance(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestTrialBalanceInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := ledger.TrialBalance(f.T, time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC))
+
+	expected := []ledger.TrialLine{
+		{Account: "Assets:Checking", Commodity: "$", Debit: 8645000},
+		{Account: "Expenses:Food", Commodity: "$", Debit: 255000},
+		{Account: "Expenses:Travel", Commodity: "€", Debit: 1000000},
+		{Account: "Income:Salary", Commodity: "$", Credit: 10000000},
+		{Account: "Liabilities:Travel Card", Commodity: "$", Debit: 1100000},
+		{Account: "Liabilities:Travel Card", Commodity: "€", Credit: 1000000},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Incorrect number of lines: %#v", lines)
+	}
+	for i, l := range lines {
+		if l != expected[i] {
+			t.Errorf("Incorrect line %v: %#v", i, l)
+		}
+	}
+
+	debits, credits := map[string]int64{}, map[string]int64{}
+	for _, l := range lines {
+		debits[l.Commodity] += l.Debit
+		credits[l.Commodity] += l.Credit
+	}
+	for c := range debits {
+		if debits[c] != credits[c] {
+			t.Errorf("Debits and credits do not match for %v: %v != %v", c, debits[c], credits[c])
+		}
+	}
+}
+
+func TestTrialBalanceGenerated(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestTrialBalanceInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A budget template, as an automated transaction would produce.
+	budget := ledger.Transaction{
+		Date:        time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Description: "Budget",
+		Postings: []ledger.Posting{
+			{Account: "Expenses:Food", Value: 2000000, Generated: true},
+			{Account: "Assets:Budget", Value: -2000000, Generated: true},
+		},
+	}
+	trs := append(f.T, budget)
+	at := time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	find := func(lines []ledger.TrialLine, account string) (ledger.TrialLine, bool) {
+		for _, l := range lines {
+			if l.Account == account {
+				return l, true
+			}
+		}
+		return ledger.TrialLine{}, false
+	}
+
+	lines := ledger.TrialBalanceWith(trs, at, ledger.ReportOptions{})
+	if l, _ := find(lines, "Expenses:Food"); l.Debit != 255000 {
+		t.Errorf("Generated postings were counted: %#v", l)
+	}
+	if _, ok := find(lines, "Assets:Budget"); ok {
+		t.Errorf("Generated account was included: %#v", lines)
+	}
+
+	lines = ledger.TrialBalanceWith(trs, at, ledger.ReportOptions{IncludeGenerated: true})
+	if l, _ := find(lines, "Expenses:Food"); l.Debit != 2255000 {
+		t.Errorf("Generated postings were not counted: %#v", l)
+	}
+	if l, _ := find(lines, "Assets:Budget"); l.Credit != 2000000 {
+		t.Errorf("Generated account was not included: %#v", l)
+	}
+
+	// Rounding postings are generated too.
+	odd := ledger.Transaction{
+		Date: time.Date(2022, 1, 5, 0, 0, 0, 0, time.UTC),
+		Postings: []ledger.Posting{
+			{Account: "Expenses:Food", Value: 100001},
+			{Account: "Assets:Checking", Value: -100000},
+		},
+	}
+	opts := ledger.ReportOptions{Balance: ledger.BalanceOptions{Tolerance: 1, RoundingAccount: "Expenses:Rounding"}}
+	if _, ok := find(ledger.TrialBalanceWith([]ledger.Transaction{odd}, at, opts), "Expenses:Rounding"); ok {
+		t.Errorf("Rounding posting was included without IncludeGenerated")
+	}
+	opts.IncludeGenerated = true
+	if l, _ := find(ledger.TrialBalanceWith([]ledger.Transaction{odd}, at, opts), "Expenses:Rounding"); l.Credit != 1 {
+		t.Errorf("Rounding posting was not included: %#v", l)
+	}
+
+	// The other reports follow the same rule.
+	if b := ledger.BalanceAtIn(trs, "Assets:Budget", at, ledger.DateMode(0), false); len(b) != 0 {
+		t.Errorf("BalanceAtIn counted generated postings: %#v", b)
+	}
+	all := ledger.ReportOptions{IncludeGenerated: true}
+	if b := ledger.BalanceAtInWith(trs, "Assets:Budget", at, ledger.DateMode(0), false, all); b["$"].Value != -2000000 {
+		t.Errorf("BalanceAtInWith left out generated postings: %#v", b)
+	}
+	if top := ledger.TopTransactions(trs, len(trs), "$"); len(top) != len(trs)-1 {
+		t.Errorf("TopTransactions counted generated postings: %#v", top)
+	}
+	if top := ledger.TopTransactionsWith(trs, len(trs), "$", all); len(top) != len(trs) {
+		t.Errorf("TopTransactionsWith left out generated postings: %#v", top)
+	}
+	n := 0
+	ledger.RunningBalance(ledger.SliceSeq(trs), "Assets:Budget")(func(ledger.Transaction, ledger.Amount) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Errorf("RunningBalance counted generated postings")
+	}
+	ledger.RunningBalanceWith(ledger.SliceSeq(trs), "Assets:Budget", all)(func(ledger.Transaction, ledger.Amount) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Errorf("RunningBalanceWith left out generated postings")
+	}
+}
+
+func TestRunningBalance(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestTrialBalanceInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int64{10000000, 9745000, 8645000, 3645000}
+	i := 0
+	ledger.RunningBalance(ledger.SliceSeq(f.T), "Assets:Checking")(func(tr ledger.Transaction, a ledger.Amount) bool {
+		if i >= len(expected) {
+			t.Fatalf("Too many results.")
+		}
+		if a.Value != expected[i] || a.Commodity != "$" {
+			t.Errorf("Incorrect running balance %v: %v", i, a)
+		}
+		i++
+		return true
+	})
+	if i != len(expected) {
+		t.Errorf("Incorrect number of results: %v", i)
+	}
+
+	// Stopping early must work.
+	i = 0
+	ledger.RunningBalance(ledger.SliceSeq(f.T), "Assets")(func(tr ledger.Transaction, a ledger.Amount) bool {
+		i++
+		return false
+	})
+	if i != 1 {
+		t.Errorf("Iteration did not stop when asked: %v", i)
+	}
+
+	// The liability account holds two commodities.
+	var last map[string]ledger.Amount
+	ledger.RunningBalances(ledger.SliceSeq(f.T), "Liabilities")(func(tr ledger.Transaction, a map[string]ledger.Amount) bool {
+		last = a
+		return true
+	})
+	if len(last) != 2 || last["$"].Value != 1100000 || last["€"].Value != -1000000 {
+		t.Errorf("Incorrect multi-commodity running balance: %v", last)
+	}
+}
+
+// Generates transactions on demand so the benchmark measures the report alone, not a huge input slice.
+func generatedTransactions(n int) ledger.Seq[ledger.Transaction] {
+	return func(yield func(ledger.Transaction) bool) {
+		date := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < n; i++ {
+			tr := ledger.Transaction{
+				Date:        date.AddDate(0, 0, i/10),
+				Description: "Generated",
+				Postings: []ledger.Posting{
+					{Account: "Expenses:Food", Value: int64(i%1000) * 100},
+					{Account: "Assets:Checking", Null: true},
+				},
+			}
+			if !yield(tr) {
+				return
+			}
+		}
+	}
+}
+
+func BenchmarkRunningBalance(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		total := int64(0)
+		ledger.RunningBalance(generatedTransactions(100000), "Assets:Checking")(func(tr ledger.Transaction, a ledger.Amount) bool {
+			total = a.Value
+			return true
+		})
+		if total == 0 {
+			b.Fatal("No balance.")
+		}
+	}
+}
+
+func TestFlipSign(t *testing.T) {
+	accounts := map[string]int64{
+		"Expenses:Food":      200000,
+		"Expenses:Refunds":   -50000,
+		"Income:Salary":      -1000000,
+		"Assets:Checking":    850000,
+		"Liabilities:Credit": 0,
+	}
+
+	opts := &ledger.RenderOptions{FlipSign: map[string]bool{
+		"Expenses":         true,
+		"Expenses:Refunds": false,
+	}}
+
+	expected := [][]string{
+		{"Assets:Checking", "$85.00"},
+		{"Expenses", "$-15.00"},
+		{"  Food", "$-20.00"},
+		{"  Refunds", "$-5.00"},
+		{"Income:Salary", "$-100.00"},
+		{"Liabilities:Credit", "$0.00"},
+	}
+
+	rows := ledger.FormatSumsWith(accounts, "  ", opts)
+	if len(rows) != len(expected) {
+		t.Fatalf("Incorrect number of rows: %v", rows)
+	}
+	for i, row := range rows {
+		if row[0] != expected[i][0] || row[1] != expected[i][1] {
+			t.Errorf("Incorrect row %v: %v", i, row)
+		}
+	}
+
+	// The stored values must not change.
+	if accounts["Expenses:Food"] != 200000 {
+		t.Errorf("Rendering modified the input.")
+	}
+
+	// And without options nothing is flipped.
+	rows = ledger.FormatSums(accounts, "  ")
+	if rows[1][1] != "$15.00" || rows[2][1] != "$20.00" {
+		t.Errorf("Values flipped without options: %v", rows)
+	}
+}
+
+func TestHideZero(t *testing.T) {
+	accounts := map[string]int64{
+		"Assets:Checking":      850000,
+		"Assets:Savings":       0,
+		"Expenses:Food":        200000,
+		"Liabilities:Credit":   0,
+		"Income:Salary":        -1000000,
+		"Equity:Transfers:In":  50000,
+		"Equity:Transfers:Out": -50000,
+	}
+
+	expected := [][]string{
+		{"Assets:Checking", "$85.00"},
+		{"Expenses:Food", "$20.00"},
+		{"Income:Salary", "$-100.00"},
+	}
+
+	rows := ledger.FormatSumsWith(accounts, "  ", &ledger.RenderOptions{HideZero: true})
+	if len(rows) != len(expected) {
+		t.Fatalf("Incorrect number of rows: %v", rows)
+	}
+	for i, row := range rows {
+		if row[0] != expected[i][0] || row[1] != expected[i][1] {
+			t.Errorf("Incorrect row %v: %v", i, row)
+		}
+	}
+
+	// Without the option everything is shown.
+	rows = ledger.FormatSums(accounts, "  ")
+	if len(rows) != 9 {
+		t.Errorf("Incorrect number of rows without HideZero: %v", rows)
+	}
+}
+
+var TestAccountActivityInput = `
+2022/01/01 * Opening
+    Assets:Checking     $1,000.00
+    Equity:Opening
+
+2022/03/15=2022/03/20 * Paycheck
+    Assets:Checking     $500.00
+    Income:Salary
+
+2022/02/01 * Old Card
+    Liabilities:Old Card  $10.00
+    Assets:Checking
+`
+
+func TestAccountActivity(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestAccountActivityInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(2022, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	last := ledger.AccountActivity(f.T)
+	expected := map[string]time.Time{
+		"Assets:Checking":      date(3, 15),
+		"Equity:Opening":       date(1, 1),
+		"Income:Salary":        date(3, 15),
+		"Liabilities:Old Card": date(2, 1),
+	}
+	if len(last) != len(expected) {
+		t.Errorf("Incorrect number of accounts: %v", last)
+	}
+	for a, d := range expected {
+		if !last[a].Equal(d) {
+			t.Errorf("Incorrect last activity for %v: %v", a, last[a])
+		}
+	}
+
+	first := ledger.AccountFirstActivity(f.T)
+	if !first["Assets:Checking"].Equal(date(1, 1)) || !first["Income:Salary"].Equal(date(3, 15)) {
+		t.Errorf("Incorrect first activity: %v", first)
+	}
+
+	_, last = ledger.AccountActivityIn(f.T, ledger.EffectiveDate)
+	if !last["Income:Salary"].Equal(date(3, 20)) || !last["Liabilities:Old Card"].Equal(date(2, 1)) {
+		t.Errorf("Incorrect last activity by effective date: %v", last)
+	}
+}
+
+var TestTopTransactionsInput = `
+2022/03/01 * Rent
+    Expenses:Rent       $500.00
+    Assets:Checking
+
+2022/03/02 * Trip
+    Expenses:Travel     EUR 900.00
+    Assets:Euros
+
+2022/03/03 * Split
+    Expenses:Food       $30.00
+    Expenses:Tools      $20.00
+    Assets:Cash
+
+2022/03/04 * Hardware
+    ; ID: b
+    Expenses:Tools      $50.00
+    Assets:Cash
+
+2022/03/04 * Groceries
+    ; ID: a
+    Expenses:Food       $50.00
+    Assets:Cash
+
+2022/03/05 * Coffee
+    Expenses:Food       $4.00
+    Assets:Cash
+`
+
+func TestTopTransactions(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestTopTransactionsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ties go by date, then ID.
+	top := ledger.TopTransactions(f.T, 4, "$")
+	expected := []string{"Rent", "Split", "Groceries", "Hardware"}
+	if len(top) != len(expected) {
+		t.Fatalf("Incorrect number of transactions: %v", len(top))
+	}
+	for i, e := range expected {
+		if top[i].Description != e {
+			t.Errorf("Incorrect transaction %v: %v", i, top[i].Description)
+		}
+	}
+
+	if top := ledger.TopTransactions(f.T, 10, "$"); len(top) != 5 {
+		t.Errorf("Incorrect number of transactions: %v", len(top))
+	}
+	if top := ledger.TopTransactions(f.T, 10, "EUR"); len(top) != 1 || top[0].Description != "Trip" {
+		t.Errorf("Incorrect transactions: %v", top)
+	}
+	if top := ledger.TopTransactions(f.T, 0, "$"); len(top) != 0 {
+		t.Errorf("Incorrect transactions: %v", top)
+	}
+}
+
+var TestBalanceAtInput = `
+2022/04/01 * Paycheck
+    Assets:Checking         $1,000.00
+    Income:Salary
+
+2022/04/15=2022/04/17 * Transfer
+    Assets:Checking:Savings $200.00
+    Assets:Checking         $-200.00
+
+2022/04/30 * Trip
+    Assets:Checking         EUR 50.00
+    Assets:Checking         $-55.00
+`
+
+func TestBalanceAt(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestBalanceAtInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d int) time.Time {
+		return time.Date(2022, 4, d, 0, 0, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		at     time.Time
+		mode   ledger.DateMode
+		prefix bool
+		out    map[string]string
+	}{
+		{day(1).Add(-time.Second), ledger.PrimaryDate, true, map[string]string{}},
+		{day(1), ledger.PrimaryDate, true, map[string]string{"$": "$1,000.00"}},
+		{day(15), ledger.PrimaryDate, true, map[string]string{"$": "$1,000.00"}},
+		{day(15), ledger.PrimaryDate, false, map[string]string{"$": "$800.00"}},
+		{day(15), ledger.EffectiveDate, false, map[string]string{"$": "$1,000.00"}},
+		{day(17), ledger.EffectiveDate, false, map[string]string{"$": "$800.00"}},
+		{day(30), ledger.PrimaryDate, true, map[string]string{"$": "$945.00", "EUR": "EUR 50.00"}},
+	}
+	for i, c := range cases {
+		out := ledger.BalanceAtIn(f.T, "Assets:Checking", c.at, c.mode, c.prefix)
+		if len(out) != len(c.out) {
+			t.Errorf("Case %v: incorrect balances: %v", i, out)
+			continue
+		}
+		for k, v := range c.out {
+			if out[k].String() != v {
+				t.Errorf("Case %v: incorrect balance for %v: %v", i, k, out[k])
+			}
+		}
+	}
+
+	if out := ledger.BalanceAt(f.T, "Assets:Checking", day(15)); out["$"].Value != 10000000 {
+		t.Errorf("Incorrect balance: %v", out)
+	}
+}
+
+var TestCompactInput = `
+2022/01/01 * Paycheck
+    Assets:Checking     $1,000.00
+    Income:Salary
+
+2022/01/05 * Buy stock
+    Assets:Broker       10 AAPL @ $50.00
+    Assets:Checking
+
+2022/01/10 * Groceries
+    Expenses:Food       $25.50
+    Assets:Checking
+
+2022/02/01 * Travel
+    Expenses:Travel     20,00 €
+    Assets:Checking     $-21.00
+
+2022/02/02 * Sell stock
+    Assets:Checking     $300.00
+    Assets:Broker       -5 AAPL @ $60.00
+
+2022/02/03 * Groceries
+    Expenses:Food       $10.00
+    Assets:Checking
+`
+
+func TestCompact(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCompactInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+	trs, err := ledger.Compact(f.T, at, "Equity:Opening Balances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trs) != 4 {
+		t.Fatalf("Incorrect transaction count: %v", len(trs))
+	}
+	if ok, _ := trs[0].Balance(); !ok {
+		t.Errorf("Opening transaction does not balance:\n%v", trs[0].String())
+	}
+
+	// Every account other than the equity account must have the same balance from the cutoff on.
+	for _, end := range []time.Time{at, at.AddDate(0, 0, 1), at.AddDate(0, 0, 2)} {
+		before := map[string]ledger.TrialLine{}
+		for _, l := range ledger.TrialBalance(f.T, end) {
+			before[l.Account+" "+l.Commodity] = l
+		}
+		after := map[string]ledger.TrialLine{}
+		for _, l := range ledger.TrialBalance(trs, end) {
+			if l.Account != "Equity:Opening Balances" {
+				after[l.Account+" "+l.Commodity] = l
+			}
+		}
+		if len(before) != len(after) {
+			t.Errorf("Incorrect account count at %v: %v, expected %v", end, len(after), len(before))
+		}
+		for k, l := range before {
+			if after[k] != l {
+				t.Errorf("Incorrect balance for %v at %v: %+v, expected %+v", k, end, after[k], l)
+			}
+		}
+	}
+
+	// Nothing to compact.
+	trs, err = ledger.Compact(f.T, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), "Equity:Opening Balances")
+	if err != nil || len(trs) != len(f.T) {
+		t.Errorf("Incorrect result with nothing to compact: %v, %v", len(trs), err)
+	}
+
+	// The balance keeps its cents even if the commodity was first written without them.
+	f, err = parse.ParseLedgerString("2022/01/01 * Deposit\n    Assets:Checking    $1000\n    Income:Gift\n\n" +
+		"2022/01/02 * Coffee\n    Expenses:Food    $2.50\n    Assets:Checking\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trs, err = ledger.Compact(f.T, at, "Equity:Opening Balances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := trs[0].String(); !strings.Contains(s, "$997.50") {
+		t.Errorf("Incorrect opening balance:\n%v", s)
+	}
+}
+
+var TestCheckBudgetInput = `
+2022/02/28 * Groceries
+    Expenses:Food:Groceries    $90.00
+    Assets:Checking
+
+2022/03/02 * Groceries
+    Expenses:Food:Groceries    $120.00
+    Assets:Checking
+
+2022/03/05 * Restaurant
+    Expenses:Food:Dining       $45.50
+    Assets:Checking
+
+2022/03/10 * Books
+    Expenses:Books             $30.00
+    Expenses:Food              20,00 €
+    Assets:Checking            $-30.00
+    Assets:Cash
+
+2022/03/15 * Refund
+    Assets:Checking            $10.00
+    Expenses:Books
+
+2022/04/01 * Books
+    Expenses:Books             $100.00
+    Assets:Checking
+`
+
+func TestCheckBudget(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCheckBudgetInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	budgets := map[string]ledger.Amount{
+		"Expenses:Food":  {Value: 1500000},
+		"Expenses:Books": {Value: 500000},
+	}
+	breaches := ledger.CheckBudget(f.T, budgets, time.March, 2022)
+	if len(breaches) != 1 {
+		t.Fatalf("Incorrect breaches: %+v", breaches)
+	}
+	b := breaches[0]
+	if b.Account != "Expenses:Food" || b.Spent.Value != 1655000 || b.Over.Value != 155000 || b.Budget.Value != 1500000 {
+		t.Errorf("Incorrect breach: %+v", b)
+	}
+	if b.Over.String() != "$15.50" {
+		t.Errorf("Incorrect overage: %v", b.Over)
+	}
+
+	// The April spending on books goes over its budget.
+	breaches = ledger.CheckBudget(f.T, budgets, time.April, 2022)
+	if len(breaches) != 1 || breaches[0].Account != "Expenses:Books" || breaches[0].Over.Value != 500000 {
+		t.Errorf("Incorrect breaches for April: %+v", breaches)
+	}
+}
+
+func TestCommodityTotalsByAccount(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCheckBudgetInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totals := ledger.CommodityTotalsByAccount(f.T)
+	if a := totals["Expenses:Food:Groceries"]["$"]; a.String() != "$210.00" {
+		t.Errorf("Incorrect groceries total: %v", a)
+	}
+	if a := totals["Assets:Cash"]["€"]; a.String() != "-20,00 €" {
+		t.Errorf("Incorrect cash total: %v", a)
+	}
+	if a := totals["Expenses:Books"]["$"]; len(totals["Expenses:Books"]) != 1 || a.Value != 1200000 {
+		t.Errorf("Incorrect books total: %v", totals["Expenses:Books"])
+	}
+	if _, ok := totals["Expenses"]; ok || len(totals["Expenses:Food"]) != 1 {
+		t.Errorf("Incorrect totals without roll up: %v", totals)
+	}
+
+	totals = ledger.CommodityTotalsByAccountWith(f.T, ledger.ReportOptions{RollUp: true})
+	if a := totals["Expenses:Food"]["$"]; a.Value != 2555000 {
+		t.Errorf("Incorrect rolled up food total: %v", a)
+	}
+	if a := totals["Expenses"]["€"]; a.String() != "20,00 €" {
+		t.Errorf("Incorrect rolled up euro total: %v", a)
+	}
+	if a := totals["Assets"]["$"]; a.Value != -3755000 {
+		t.Errorf("Incorrect rolled up assets total: %v", a)
+	}
+}
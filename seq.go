@@ -0,0 +1,42 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+// Seq is a sequence of values, produced by calling yield for each value until there are no more values or
+// yield returns false. This is the same shape as iter.Seq (Go 1.23), so it can be converted directly.
+type Seq[V any] func(yield func(V) bool)
+
+// Seq2 is a sequence of pairs of values, see Seq.
+type Seq2[K, V any] func(yield func(K, V) bool)
+
+// SliceSeq returns a sequence of the transactions in a slice.
+func SliceSeq(trs []Transaction) Seq[Transaction] {
+	return func(yield func(Transaction) bool) {
+		for _, tr := range trs {
+			if !yield(tr) {
+				return
+			}
+		}
+	}
+}
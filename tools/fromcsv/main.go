@@ -23,14 +23,9 @@ misrepresented as being the original software.
 package main
 
 import (
-	"encoding/csv"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"strconv"
-	"strings"
-	"time"
 
 	"github.com/milochristiansen/ledger"
 )
@@ -71,16 +66,12 @@ var noHeader bool
 
 var dateFmt string
 var dateField string
-var descField map[string]bool = map[string]bool{}
+var descField []string
 var amountField string
 
 var accountFrom string
 var accountTo string
 
-var dateFieldIx int = -1
-var descFieldIx map[int]bool = map[int]bool{}
-var amountFieldIx int = -1
-
 var help bool
 
 func main() {
@@ -95,7 +86,7 @@ func main() {
 	flag.BoolVar(&help, "help", false, "show this help")
 	flag.BoolVar(&help, "h", false, "show this help")
 	flag.Func("desc", "name of description field", func(arg string) error {
-		descField[arg] = true
+		descField = append(descField, arg)
 		return nil
 	})
 	flag.Parse()
@@ -128,170 +119,23 @@ func main() {
 		}
 	}
 
-	reader := csv.NewReader(inFile)
-
-	if !noHeader {
-		header, err := reader.Read()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to read header: %v\n", err)
-			os.Exit(1)
-		}
-
-		for i, field := range header {
-			if field == dateField {
-				dateFieldIx = i
-			}
-
-			if field == amountField {
-				amountFieldIx = i
-			}
-
-			if descField[field] {
-				descFieldIx[i] = true
-			}
-		}
-	} else {
-		dateFieldIx, err = strconv.Atoi(dateField)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "-date argument is not a number")
-			os.Exit(2)
-		}
-
-		amountFieldIx, err = strconv.Atoi(amountField)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "-amount argument is not a number")
-			os.Exit(2)
-		}
-
-		for desc, has := range descField {
-			if !has {
-				continue
-			}
-
-			descIx, err := strconv.Atoi(desc)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "-desc argument is not a number")
-				os.Exit(2)
-			}
-
-			descFieldIx[descIx] = true
-		}
-
-	}
-
-	if dateFieldIx == -1 {
-		fmt.Fprintln(os.Stderr, "date field not found or specified")
-		os.Exit(2)
-	}
-
-	if amountFieldIx == -1 {
-		fmt.Fprintln(os.Stderr, "amount field not found or specified")
-		os.Exit(2)
-	}
-
-	hasDesc := false
-	for _, has := range descFieldIx {
-		hasDesc = hasDesc || has
-	}
-
-	if !hasDesc {
-		fmt.Fprintln(os.Stderr, "desc field not found or specified")
-		os.Exit(2)
-	}
-
-	minLen := dateFieldIx
-	if amountFieldIx > minLen {
-		minLen = amountFieldIx
-	}
-	for desc, has := range descFieldIx {
-		if !has {
-			continue
-		}
-
-		if desc > minLen {
-			minLen = desc
-		}
-	}
-	minLen++
-
-	trs := []ledger.Transaction{}
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to read input record: %v\n", err)
-			os.Exit(1)
-		}
-
-		if len(record) < minLen {
-			fmt.Fprintln(os.Stderr, "found input record with too few fields")
-			os.Exit(3)
-		}
-
-		date, err := time.Parse(dateFmt, record[dateFieldIx])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to parse date: %s\n", record[dateFieldIx])
-			os.Exit(3)
-		}
-
-		amountStr := record[amountFieldIx]
-		amountClean := strings.Builder{}
-		negate := false
-		for _, chr := range amountStr {
-			switch chr {
-			case '$':
-				// eat all $
-			case '(':
-				negate = true
-			case ')':
-				// eat all )
-			case ',':
-				// eat all ,
-			default:
-				amountClean.WriteRune(chr)
-			}
-		}
-		amount, err := ledger.ParseValueNumber(amountClean.String())
-		if negate {
-			amount = -amount
-		}
-
-		desc := make([]string, 0, len(descFieldIx))
-		for descIx, has := range descFieldIx {
-			if !has {
-				continue
-			}
-
-			desc = append(desc, record[descIx])
-		}
-
-		tr := ledger.Transaction{
-			Description: strings.Join(desc, " "),
-			Date:        date,
-			Status:      ledger.StatusClear,
-			KVPairs: map[string]string{
-				"ID":  <-ledger.IDService,
-				"RID": <-ledger.IDService,
-			},
-			Postings: []ledger.Posting{
-				{
-					Account: accountTo,
-					Value:   amount,
-				},
-				{
-					Account: accountFrom,
-					Null:    true,
-				},
-			},
-		}
-		trs = append(trs, tr)
+	mapping := ledger.CSVMapping{
+		Header:      !noHeader,
+		Date:        dateField,
+		DateFormat:  dateFmt,
+		Amount:      amountField,
+		Description: descField,
+		To:          accountTo,
+		From:        accountFrom,
 	}
 
-	err = (&ledger.File{T: trs, D: nil}).Format(outFile)
+	// Transactions are written as they are read, so there is no limit to the size of the input.
+	err = ledger.StreamCSV(inFile, mapping, func(tr ledger.Transaction) error {
+		_, err := fmt.Fprintf(outFile, "\n%v", tr.String())
+		return err
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to write ledger data: %v\n", err)
+		fmt.Fprintf(os.Stderr, "failed to convert csv: %v\n", err)
 		os.Exit(1)
 	}
 }
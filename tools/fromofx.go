@@ -37,6 +37,19 @@ var defaultAccount string = "Unknown:Account"
 // This function makes a lot of assumptions about the structure of the input OFX file, and will error out if
 // they are not met.
 func FromOFX(file io.Reader, mainAccount string, matchers []ledger.Matcher) *ledger.File {
+	return FromOFXWith(file, mainAccount, matchers, OFXOptions{})
+}
+
+// OFXOptions controls the optional behavior of FromOFXWith.
+type OFXOptions struct {
+	// Normally the date the transaction was posted (DTPOSTED) is the primary date and the date the user initiated
+	// it (DTUSER, or DTAVAIL if there is no DTUSER) is the effective date. Setting this swaps them. Transactions
+	// that only have a posted date always use it as the primary date.
+	SwapDates bool
+}
+
+// FromOFXWith is exactly like FromOFX, but with options.
+func FromOFXWith(file io.Reader, mainAccount string, matchers []ledger.Matcher, opts OFXOptions) *ledger.File {
 	// Load OFX file
 	ofxd := HandleErrV(ofxgo.ParseResponse(file))
 
@@ -75,6 +88,18 @@ func FromOFX(file io.Reader, mainAccount string, matchers []ledger.Matcher) *led
 			},
 		}
 
+		// Keep the bank's distinction between when the transaction happened and when it was settled.
+		other := str.DtUser
+		if other == nil {
+			other = str.DtAvail
+		}
+		if other != nil && !other.Equal(str.DtPosted) {
+			tr.ClearDate = other.Time
+			if opts.SwapDates {
+				tr.Date, tr.ClearDate = tr.ClearDate, tr.Date
+			}
+		}
+
 		tr.Match(defaultAccount, matchers)
 
 		trs = append(trs, tr)
@@ -31,6 +31,8 @@ import (
 
 func main() {
 	fs := tools.CommonFlagSet(tools.FlagDestFile|tools.FlagSourceFile|tools.FlagAccountName|tools.FlagMatchFile, usage)
+	swap := false
+	fs.Flags.BoolVar(&swap, "swap-dates", swap, "Use the user (trade) date as the primary date and the posted date as the effective date.")
 	fs.Parse()
 
 	fr := tools.HandleErrV(os.Open(fs.SourceFile))
@@ -41,7 +43,7 @@ func main() {
 	}
 
 	// Load OFX file
-	f := tools.FromOFX(fr, fs.AccountName, matchers)
+	f := tools.FromOFXWith(fr, fs.AccountName, matchers, tools.OFXOptions{SwapDates: swap})
 
 	tools.WriteLedgerFile(fs.DestFile, f)
 }
@@ -49,4 +51,8 @@ func main() {
 var usage = `Usage:
 
 This program takes an OFX file and converts it to a ledger file.
+
+The date the bank posted each transaction is used as the primary date, and the
+date the transaction was made (if the bank provides it) is used as the
+effective date. Use -swap-dates to get it the other way around.
 `
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package tools_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger/tools"
+)
+
+var TestFromOFXInput = `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="203" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <SIGNONMSGSRSV1><SONRS>
+    <STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+    <DTSERVER>20220407001504.765[0:GMT]</DTSERVER>
+    <LANGUAGE>ENG</LANGUAGE>
+  </SONRS></SIGNONMSGSRSV1>
+  <BANKMSGSRSV1><STMTTRNRS>
+    <TRNUID>1</TRNUID>
+    <STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+    <STMTRS>
+      <CURDEF>USD</CURDEF>
+      <BANKACCTFROM><BANKID>1</BANKID><ACCTID>2</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+      <BANKTRANLIST>
+        <DTSTART>20220101000000.000[0:GMT]</DTSTART>
+        <DTEND>20220201000000.000[0:GMT]</DTEND>
+        <STMTTRN>
+          <TRNTYPE>DEBIT</TRNTYPE>
+          <DTPOSTED>20220105120000.000[0:GMT]</DTPOSTED>
+          <DTUSER>20220103120000.000[0:GMT]</DTUSER>
+          <TRNAMT>-12.50</TRNAMT>
+          <FITID>1</FITID>
+          <NAME>Coffee Shop</NAME>
+        </STMTTRN>
+        <STMTTRN>
+          <TRNTYPE>CREDIT</TRNTYPE>
+          <DTPOSTED>20220110120000.000[0:GMT]</DTPOSTED>
+          <TRNAMT>100.00</TRNAMT>
+          <FITID>2</FITID>
+          <NAME>Deposit</NAME>
+        </STMTTRN>
+      </BANKTRANLIST>
+      <LEDGERBAL><BALAMT>87.50</BALAMT><DTASOF>20220201000000.000[0:GMT]</DTASOF></LEDGERBAL>
+    </STMTRS>
+  </STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+
+func TestFromOFXDates(t *testing.T) {
+	posted := time.Date(2022, 1, 5, 12, 0, 0, 0, time.UTC)
+	user := time.Date(2022, 1, 3, 12, 0, 0, 0, time.UTC)
+
+	f := tools.FromOFX(strings.NewReader(TestFromOFXInput), "Assets:Checking", nil)
+	if len(f.T) != 2 {
+		t.Fatalf("Incorrect transaction count: %v", len(f.T))
+	}
+	if !f.T[0].Date.Equal(posted) || !f.T[0].ClearDate.Equal(user) {
+		t.Errorf("Incorrect dates: %v %v", f.T[0].Date, f.T[0].ClearDate)
+	}
+	if !f.T[1].ClearDate.IsZero() {
+		t.Errorf("Effective date set without a user date: %v", f.T[1].ClearDate)
+	}
+
+	f = tools.FromOFXWith(strings.NewReader(TestFromOFXInput), "Assets:Checking", nil, tools.OFXOptions{SwapDates: true})
+	if !f.T[0].Date.Equal(user) || !f.T[0].ClearDate.Equal(posted) {
+		t.Errorf("Incorrect swapped dates: %v %v", f.T[0].Date, f.T[0].ClearDate)
+	}
+	if !f.T[1].Date.Equal(time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)) || !f.T[1].ClearDate.IsZero() {
+		t.Errorf("Incorrect swapped dates without a user date: %v %v", f.T[1].Date, f.T[1].ClearDate)
+	}
+}
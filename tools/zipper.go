@@ -24,8 +24,10 @@ package tools
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse/lex"
 )
 
 // Zipper takes two ledger flies and zips them together in a deterministic manner. On error os.Exit is called and
@@ -38,24 +40,103 @@ func Zipper(a *ledger.File, b *ledger.File) *ledger.File {
 // ZipperHTTP is like Zipper, but intended for use in HTTPhandlers and the like where the standard command
 // error handling is not desirable.
 func ZipperHTTP(a *ledger.File, b *ledger.File) (*ledger.File, error) {
+	f, _, err := Zip(a, b)
+	return f, err
+}
+
+// ZipStats is a summary of the work done by Zip, mostly useful for reporting what a merge did (or would do).
+type ZipStats struct {
+	FromA  int // Transactions only found in a.
+	FromB  int // Transactions only found in b.
+	Shared int // Transactions common to both files (these are taken from a).
+
+	DirectivesA      int // Directives taken from a.
+	DirectivesB      int // Directives taken from b.
+	DirectivesMerged int // Directives in b that were dropped as duplicates of a directive in a.
+}
+
+// ZipOrderError is returned by Zip when two transactions cannot be ordered deterministically.
+type ZipOrderError struct {
+	A, B lex.Location // Where the offending transactions are defined in their respective files.
+}
+
+func (err ZipOrderError) Error() string {
+	return fmt.Sprintf("Error: Could not order transactions (defined on line %v and line %v). Ensure all transactions have ID and RID keys as appropriate.", err.A, err.B)
+}
+
+// ZipOptions controls the optional behavior of ZipWith. The zero value gives the behavior of Zip.
+type ZipOptions struct {
+	// All directives are moved to the top of the file, with the directives from a first (in order) followed by the
+	// new directives from b (in order). If this is set, each new directive from b is instead placed right after the
+	// directive that came before it in b (or at the very top if there is none), so that the order of the directives
+	// in b is kept as well.
+	MergeDirectiveOrder bool
+
+	// Normally the first transaction in b must also be in a (matched by code), as that is where the two files are
+	// synced. If it isn't, b can't be a later copy of a and Zip fails. If this is set b is instead taken to be
+	// entirely new transactions (a fresh import, for example), and they are merged into a by date just like any
+	// other new transactions. Nothing is ever dropped from either file. An empty a never needs a sync point.
+	AllowNoSyncPoint bool
+
+	// If set, this decides the order of transactions that are only in one of the files. Normally this is
+	// ledger.CompareTransactions: the earlier date goes first, and transactions on the same date are ordered by their
+	// time KV, then their ID, RID, or FITID KVs (in that order). If the comparator returns 0 the transactions can't
+	// be ordered and Zip fails with a ZipOrderError.
+	Compare ledger.Comparator
+}
+
+// Zip does the actual work for Zipper and ZipperHTTP. In addition to the resulting file it returns a summary of
+// where the contents of the file came from. The stats are valid (up to the point of failure) even if there is an error.
+func Zip(a *ledger.File, b *ledger.File) (*ledger.File, *ZipStats, error) {
+	return ZipWith(a, b, ZipOptions{})
+}
+
+// ZipWith is exactly like Zip, but with options.
+func ZipWith(a *ledger.File, b *ledger.File, opts ZipOptions) (*ledger.File, *ZipStats, error) {
+	stats := &ZipStats{DirectivesA: len(a.D)}
+
 	drs := []ledger.Directive{}
 	drs = append(drs, a.D...)
+	fromA := make([]bool, len(drs))
+	for i := range fromA {
+		fromA[i] = true
+	}
+	at := 0 // Where the next new directive from b goes when keeping b's order.
 outer:
 	for _, d2 := range b.D {
-		for _, d1 := range a.D {
-			if d2.Compare(d1) {
+		for i, d1 := range drs {
+			if fromA[i] && d2.Compare(d1) {
+				stats.DirectivesMerged++
+				at = i + 1
 				continue outer
 			}
 		}
-		drs = append(drs, d2)
+		stats.DirectivesB++
+		if !opts.MergeDirectiveOrder {
+			at = len(drs)
+		}
+		drs = append(drs, ledger.Directive{})
+		copy(drs[at+1:], drs[at:])
+		drs[at] = d2
+		fromA = append(fromA, false)
+		copy(fromA[at+1:], fromA[at:])
+		fromA[at] = false
+		at++
 	}
-	for _, d := range drs {
-		d.FoundBefore = 0
+	for i := range drs {
+		drs[i].FoundBefore = 0
 	}
 
 	// Merge transactions.
 	trs := []ledger.Transaction{}
 
+	// Nothing to merge in, so the result is just the master.
+	if len(b.T) == 0 {
+		trs = append(trs, a.T...)
+		stats.FromA = len(a.T)
+		return &ledger.File{T: trs, D: drs}, stats, nil
+	}
+
 	// First, zoom through the master file until we find the sync point.
 	syncPoint := len(a.T) - 1
 	for ; syncPoint >= 0; syncPoint-- {
@@ -63,121 +144,69 @@ outer:
 			break
 		}
 	}
-	if syncPoint == len(a.T) {
-		return nil, errors.New("No sync point found!")
+	if syncPoint < 0 && len(a.T) > 0 && !opts.AllowNoSyncPoint {
+		return nil, stats, errors.New("No sync point found!")
 	}
 
 	// Add transactions from the master up to the sync point
 	for i := 0; i <= syncPoint; i++ {
 		trs = append(trs, a.T[i])
 	}
+	if syncPoint >= 0 {
+		stats.FromA += syncPoint
+		stats.Shared++
+	}
 
 	// Now continue adding files from the master up until the last transaction that matches.
 	i1, i2 := syncPoint+1, 1
-	for i1 < len(a.T) || i2 < len(b.T) {
+	if syncPoint < 0 {
+		// Nothing in common, so everything in b is new.
+		i2 = 0
+	}
+	for i1 < len(a.T) && i2 < len(b.T) {
 		if a.T[i1].Code != b.T[i2].Code {
 			break
 		}
 		trs = append(trs, a.T[i1])
+		stats.Shared++
 		i1++
 		i2++
 	}
 
 	// Now zipper the differences together from the last sync point
+	cmp := opts.Compare
+	if cmp == nil {
+		cmp = ledger.CompareTransactions
+	}
 	for i1 < len(a.T) || i2 < len(b.T) {
 		// If only one side is left, just append it and bail.
 		if i1 >= len(a.T) {
 			trs = append(trs, b.T[i2])
+			stats.FromB++
 			i2++
 			continue
 		}
 		if i2 >= len(b.T) {
 			trs = append(trs, a.T[i1])
+			stats.FromA++
 			i1++
 			continue
 		}
 
-		// If there is a clear difference between the times, the earlier one goes first.
-		if a.T[i1].Date.Before(b.T[i2].Date) {
-			trs = append(trs, a.T[i1])
-			i1++
-			continue
-		}
-		if a.T[i1].Date.After(b.T[i2].Date) {
-			trs = append(trs, b.T[i2])
-			i2++
-			continue
-		}
-
-		// if the times are the same, try to order lexically by ID to preserve determinism.
-		dir := chooseAB(a.T[i1].KVPairs, b.T[i2].KVPairs, "ID")
-		if dir < 0 {
-			trs = append(trs, a.T[i1])
-			i1++
-			continue
-		}
-		if dir > 0 {
-			trs = append(trs, b.T[i2])
-			i2++
-			continue
-		}
-
-		// Well, we can't order by ID for some reason. Try to order by the revision ID (only present in edits)
-		dir = chooseAB(a.T[i1].KVPairs, b.T[i2].KVPairs, "RID")
-		if dir < 0 {
-			trs = append(trs, a.T[i1])
-			i1++
-			continue
-		}
-		if dir > 0 {
-			trs = append(trs, b.T[i2])
-			i2++
-			continue
-		}
-
-		// If all else fails, try to use a financial institution ID (only present in imported data)
-		dir = chooseAB(a.T[i1].KVPairs, b.T[i2].KVPairs, "FITID")
+		dir := cmp(&a.T[i1], &b.T[i2])
 		if dir < 0 {
 			trs = append(trs, a.T[i1])
+			stats.FromA++
 			i1++
 			continue
 		}
 		if dir > 0 {
 			trs = append(trs, b.T[i2])
+			stats.FromB++
 			i2++
 			continue
 		}
-		return nil, errors.New("Error: Could not order some transactions. Ensure all transactions have ID and RID keys as appropriate.")
-	}
-	return &ledger.File{T: trs, D: drs}, nil
-}
-
-// -1 == a, 0 == neither, 1 == b
-func chooseAB(a, b map[string]string, key string) int {
-	id1, ok1 := a[key]
-	id2, ok2 := b[key]
-
-	// If only one has an ID, the ID goes first.
-	if ok1 && !ok2 {
-		return -1
-	}
-	if !ok1 && ok2 {
-		return 1
-	}
-
-	// If neither has an ID
-	if !ok1 && !ok2 {
-		return 0
-	}
-
-	// If both have identical IDs
-	if id1 == id2 {
-		return 0
-	}
-
-	// If both have an ID then order by ID lexically.
-	if id1 < id2 {
-		return -1
+		return nil, stats, ZipOrderError{a.T[i1].Location, b.T[i2].Location}
 	}
-	return 1
+	return &ledger.File{T: trs, D: drs}, stats, nil
 }
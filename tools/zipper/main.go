@@ -22,16 +22,40 @@ misrepresented as being the original software.
 
 package main
 
-import "github.com/milochristiansen/ledger/tools"
+import (
+	"fmt"
+
+	"github.com/milochristiansen/ledger/tools"
+)
 
 func main() {
 	fs := tools.CommonFlagSet(tools.FlagDestFile | tools.FlagMasterFile | tools.FlagSourceFile, usage)
+	dryRun := false
+	fs.Flags.BoolVar(&dryRun, "dry-run", dryRun, "Report what the merge would do without writing the output file.")
+	opts := tools.ZipOptions{}
+	fs.Flags.BoolVar(&opts.AllowNoSyncPoint, "append", opts.AllowNoSyncPoint, "If the source shares nothing with the master, merge it in as new transactions instead of failing.")
 	fs.Parse()
 
 	a := tools.LoadLedgerFile(fs.MasterFile)
 	b := tools.LoadLedgerFile(fs.SourceFile)
 
-	f := tools.Zipper(a, b)
+	if dryRun {
+		f, stats, err := tools.ZipWith(a, b, opts)
+
+		fmt.Printf("Transactions from %v: %v\n", fs.MasterFile, stats.FromA)
+		fmt.Printf("Transactions from %v: %v\n", fs.SourceFile, stats.FromB)
+		fmt.Printf("Transactions in both: %v\n", stats.Shared)
+		fmt.Printf("Directives from %v: %v\n", fs.MasterFile, stats.DirectivesA)
+		fmt.Printf("Directives from %v: %v\n", fs.SourceFile, stats.DirectivesB)
+		fmt.Printf("Duplicate directives merged: %v\n", stats.DirectivesMerged)
+		tools.HandleErr(err)
+
+		fmt.Printf("Merge OK, %v would contain %v transactions.\n", fs.DestFile, len(f.T))
+		return
+	}
+
+	f, _, err := tools.ZipWith(a, b, opts)
+	tools.HandleErr(err)
 
 	tools.WriteLedgerFile(fs.DestFile, f)
 }
@@ -45,4 +69,12 @@ For this to work properly, each transaction needs an "ID" K/V to be set to a
 unique transaction ID, otherwise it is not possible to sync partial files
 and syncing full files is not deterministic. Any non-deterministic result is
 an error.
+
+The first transaction in the source file must also be in the master file, that
+is where the two are synced. If the source file is a fresh batch of
+transactions (nothing in common with the master) use -append, they are then
+merged into the master by date.
+
+With -dry-run the merge is done in memory and a summary is printed instead of
+writing the output file. The exit code is non-zero if the merge would fail.
 `
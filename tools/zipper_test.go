@@ -0,0 +1,279 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package tools_test
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+	"github.com/milochristiansen/ledger/tools"
+)
+
+var TestZipDirectivesA = `account Assets:Cash
+
+2022/06/01 * Groceries
+  ; ID: a
+  Expenses:Food    $20.00
+  Assets:Cash
+
+account Expenses:Food
+
+account Expenses:Rent
+`
+
+var TestZipDirectivesB = `account Assets:Checking
+
+account Expenses:Food
+
+2022/06/02 * Rent
+  ; ID: b
+  Expenses:Rent    $500.00
+  Assets:Checking
+
+account Expenses:Misc
+`
+
+func TestZipDirectiveOrder(t *testing.T) {
+	a, err := parse.ParseLedgerString(TestZipDirectivesA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parse.ParseLedgerString(TestZipDirectivesB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		opts     tools.ZipOptions
+		expected []string
+	}{
+		{tools.ZipOptions{}, []string{"Assets:Cash", "Expenses:Food", "Expenses:Rent", "Assets:Checking", "Expenses:Misc"}},
+		{tools.ZipOptions{MergeDirectiveOrder: true}, []string{"Assets:Checking", "Assets:Cash", "Expenses:Food", "Expenses:Misc", "Expenses:Rent"}},
+	}
+	for _, c := range cases {
+		f, stats, err := tools.ZipWith(a, b, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.DirectivesMerged != 1 || stats.DirectivesB != 2 {
+			t.Errorf("Incorrect directive stats: %+v", stats)
+		}
+
+		// The directives must all be at the top, and must survive a write in the same order.
+		buf := new(strings.Builder)
+		err = f.Format(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Index(buf.String(), "account") > strings.Index(buf.String(), "2022/") ||
+			strings.LastIndex(buf.String(), "account") > strings.Index(buf.String(), "2022/") {
+			t.Errorf("Directives are not at the top:\n%v", buf.String())
+		}
+		out, err := parse.ParseLedgerString(buf.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.D) != len(c.expected) {
+			t.Fatalf("Incorrect directive count: %v", len(out.D))
+		}
+		for i := range out.D {
+			if out.D[i].Argument != c.expected[i] {
+				t.Errorf("Incorrect directive %v: %q, expected %q", i, out.D[i].Argument, c.expected[i])
+			}
+		}
+	}
+}
+
+var TestZipNoSyncA = `2022/07/01 * (1) Groceries
+  ; ID: a1
+  Expenses:Food    $20.00
+  Assets:Cash
+
+2022/07/03 * (2) Rent
+  ; ID: a2
+  Expenses:Rent    $500.00
+  Assets:Checking
+`
+
+var TestZipNoSyncB = `2022/07/02 * (10) Coffee
+  ; ID: b1
+  Expenses:Food    $4.00
+  Assets:Cash
+
+2022/07/04 * (11) Books
+  ; ID: b2
+  Expenses:Books    $30.00
+  Assets:Checking
+`
+
+func TestZipNoSyncPoint(t *testing.T) {
+	a, err := parse.ParseLedgerString(TestZipNoSyncA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parse.ParseLedgerString(TestZipNoSyncB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = tools.Zip(a, b)
+	if err == nil {
+		t.Error("Expected an error without a sync point.")
+	}
+
+	f, stats, err := tools.ZipWith(a, b, tools.ZipOptions{AllowNoSyncPoint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FromA != 2 || stats.FromB != 2 || stats.Shared != 0 {
+		t.Errorf("Incorrect stats: %+v", stats)
+	}
+
+	// Everything is kept, in date order, and survives a write.
+	buf := new(strings.Builder)
+	err = f.Format(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := parse.ParseLedgerString(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a1", "b1", "a2", "b2"}
+	if len(out.T) != len(expected) {
+		t.Fatalf("Incorrect transaction count: %v", len(out.T))
+	}
+	for i, id := range expected {
+		if out.T[i].KVPairs["ID"] != id {
+			t.Errorf("Incorrect transaction %v: %v", i, out.T[i].KVPairs["ID"])
+		}
+	}
+
+	// An empty master never needs a sync point.
+	f, _, err = tools.Zip(&ledger.File{}, b)
+	if err != nil || len(f.T) != 2 {
+		t.Errorf("Incorrect result for an empty master: %v", err)
+	}
+}
+
+func TestZipCompare(t *testing.T) {
+	a, err := parse.ParseLedgerString(TestZipNoSyncA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parse.ParseLedgerString(TestZipNoSyncB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Order by the number in the ID, then b before a, ignoring the dates.
+	opts := tools.ZipOptions{
+		AllowNoSyncPoint: true,
+		Compare: func(a, b *ledger.Transaction) int {
+			ida, idb := a.KVPairs["ID"], b.KVPairs["ID"]
+			if c := strings.Compare(ida[1:], idb[1:]); c != 0 {
+				return c
+			}
+			return -strings.Compare(ida, idb)
+		},
+	}
+	f, _, err := tools.ZipWith(a, b, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"b1", "a1", "b2", "a2"} {
+		if f.T[i].KVPairs["ID"] != id {
+			t.Errorf("Incorrect transaction %v: %v", i, f.T[i].KVPairs["ID"])
+		}
+	}
+
+	// By default the time KV orders transactions on the same date, before the IDs do.
+	a.T[0].KVPairs["time"], b.T[0].KVPairs["time"] = "14:00", "09:00"
+	b.T[0].Date = a.T[0].Date
+	f, _, err = tools.ZipWith(a, b, tools.ZipOptions{AllowNoSyncPoint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.T[0].KVPairs["ID"] != "b1" || f.T[1].KVPairs["ID"] != "a1" {
+		t.Errorf("Incorrect order by time: %v %v", f.T[0].KVPairs["ID"], f.T[1].KVPairs["ID"])
+	}
+
+	// Anything the comparator can't order is an error.
+	opts.Compare = func(a, b *ledger.Transaction) int { return 0 }
+	_, _, err = tools.ZipWith(a, b, opts)
+	if _, ok := err.(tools.ZipOrderError); !ok {
+		t.Errorf("Expected a ZipOrderError, got %v", err)
+	}
+}
+
+// zipBenchInput returns a journal of n transactions with made up IDs, starting on the given day.
+func zipBenchInput(n, start int, id string) string {
+	buf := new(strings.Builder)
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buf, "%v * Groceries %v\n", date.AddDate(0, 0, start+i).Format("2006/01/02"), i)
+		fmt.Fprintf(buf, "    ; ID: %v%v\n", id, i)
+		fmt.Fprintf(buf, "    Expenses:Food       $%v.%02d\n", i, i%100)
+		fmt.Fprintf(buf, "    Expenses:Travel     %v,%02d €\n", i, i%100)
+		fmt.Fprintf(buf, "    Assets:Cash         $-%v.%02d\n", i, i%100)
+		fmt.Fprintf(buf, "    Liabilities:Card\n\n")
+	}
+	return buf.String()
+}
+
+// benchmarkZip parses, zips, and writes two journals, which is all the zipper command does.
+func benchmarkZip(b *testing.B, opts parse.Options) {
+	a, c := zipBenchInput(2000, 0, "a"), zipBenchInput(2000, 2000, "b")
+	for i := 0; i < b.N; i++ {
+		fa, err := parse.ParseLedgerWith(parse.NewCharReader(a, 1), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fb, err := parse.ParseLedgerWith(parse.NewCharReader(c, 1), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f, _, err := tools.ZipWith(fa, fb, tools.ZipOptions{AllowNoSyncPoint: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = f.Format(io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkZip(b *testing.B) {
+	benchmarkZip(b, parse.Options{})
+}
+
+func BenchmarkZipLazyAmounts(b *testing.B) {
+	benchmarkZip(b, parse.Options{LazyAmounts: true})
+}
@@ -37,12 +37,15 @@ package ledger
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math/big"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/milochristiansen/ledger/parse/lex"
 	"golang.org/x/exp/maps"
@@ -66,102 +69,654 @@ type Transaction struct {
 	Code        string    // ( Stuff ) (optional)
 	Description string    // Spent monie on stuf
 
+	// How the dates were written, so they can be written back out the same way. ShortDate is set if the year was
+	// left off (it comes from a Y directive), HasTime if a time of day followed the date (10/10 14:30 * Payee). The
+	// time is included in Date. A time is only read if a status or code comes after it, so without one the time is
+	// not read back (use the "time" KV for those).
+	ShortDate bool
+	HasTime   bool
+
+	// Set if the code was written before the status ((123) * Payee). This is only written back out with the
+	// PreserveCodeOrder write option, normally the status always comes first.
+	CodeFirst bool
+
 	Postings []Posting
 
 	Comments []string // ; Stuff...
 
+	// The white space before each of the Comments as it was written, see WriteOptions.PreserveCommentIndent. This
+	// is only used if there is exactly one for each comment, so it is safe to ignore when changing Comments.
+	CommentIndent []string
+
 	Tags    map[string]bool   // ; :tag:tag:tag:
 	KVPairs map[string]string // ; Key: Value
 
+	// Earlier values of keys that were given more than once, in the order they were written. KVPairs always holds
+	// the last value given for a key, so most code never needs to look here, use GetAll to get every value of a key.
+	// These are written out before the value in KVPairs, but only if the key is still in KVPairs. Use SetKV to change
+	// a value, assigning to KVPairs directly keeps the earlier values, which then come before the new one.
+	DuplicateKV []KV
+
+	// The tags and KV keys that came from enclosing `apply tag` blocks instead of being written on the transaction.
+	// They are in Tags and KVPairs like any other, these only matter for writing with WriteOptions.KeepApplyBlocks.
+	AppliedTags []string
+	AppliedKV   []string
+
 	Location lex.Location // The line number where the transaction starts.
+
+	// The number of blank lines before the transaction (since the last transaction or directive) as it was parsed,
+	// see WriteOptions.PreserveBlankLines.
+	BlankLines int
+
+	// The byte range [Start, End) the transaction was parsed from, including the newline at the end.
+	// Both are zero if the transaction was not parsed from a file.
+	Start, End int64
+
+	// Meta is free for programs to stash whatever they have worked out about the transaction (a parsed category,
+	// a match from an import, etc) without having to turn it into a string for KVPairs. It is never read or written
+	// by this package: the parser leaves it nil, the writer and JSON ignore it, and CleanCopy copies it as is, so
+	// a pointer is shared between the copies. Treat it as scratch space that only lives as long as the program.
+	Meta any `json:"-"`
+}
+
+// DateMode selects which of the dates on a transaction is used by reports and the like.
+type DateMode int
+
+// Date modes for Transaction.DateIn
+const (
+	PrimaryDate   DateMode = iota // Transaction.Date
+	EffectiveDate                 // Transaction.ClearDate, or Transaction.Date if there isn't one.
+)
+
+// DateIn returns the date of the transaction as seen in the given mode.
+func (t *Transaction) DateIn(mode DateMode) time.Time {
+	if mode == EffectiveDate && !t.ClearDate.IsZero() {
+		return t.ClearDate
+	}
+	return t.Date
 }
 
 // Posting is a single line item in a Transaction.
 type Posting struct {
 	Status    status //   | ! | *  (optional)
-	Account   string // Account:Name
-	Value     int64  // $20.00 (currently only supporting USD, in thousandths of a cent)
+	Account   string // Account:Name (may contain single spaces, but never tabs)
+	Value     int64  // $20.00 (in ten-thousandths of a unit of Commodity)
 	Null      bool   // True if the Value is implied. Value may or may not contain a valid amount.
-	Assert    int64  // = $20.00
+	Assert    int64  // = $20.00 (in the same commodity as Value)
 	HasAssert bool
 	Note      string // ; Stuff
+
+	// ; Stuff (on the lines following the posting, indented at least as far as the posting). These are kept exactly
+	// as written, including `; Key: Value` lines, see OrderedKV.
+	Comments []string
+
+	// The white space before each of the Comments as it was written, the same as Transaction.CommentIndent.
+	CommentIndent []string
+
+	Commodity string      // $, €, AAPL, etc. Empty if the amount was written without one, in which case DefaultCommodity is used.
+	Style     AmountStyle // How the amount was written, so it can be written back out the same way.
+
+	// @ $150.00 or @@ $1,500.00 (optional). The cost of the posting in CostCommodity, either per unit or (if
+	// TotalCost is set) for the whole posting. A posting with a cost balances in the cost commodity, not its own.
+	Cost          int64
+	HasCost       bool
+	TotalCost     bool
+	CostCommodity string
+	CostStyle     AmountStyle
+
+	// [2023/01/05=2023/02/01] (optional, in the note or a comment). The posting's own date and effective date, zero
+	// if not given. These are read from the note and comments, so change those to change the dates. See DateIn.
+	Date      time.Time
+	ClearDate time.Time
+
+	// The number of the amount exactly as it was written (with its sign), if it was parsed with the
+	// parse.Options.LazyAmounts option. While this is set Value is zero and the number related parts of Style
+	// (DecimalComma, Thousands, and Precision) are not filled in, but the posting is written back out with the
+	// number as it was. Amount converts the number when it is called, and everything that balances transactions
+	// (Balance, Canonicalize, the reports, etc) converts it as well, returning an error (or leaving the transaction
+	// out, for the reports) if it isn't valid. Code that reads Value directly must call ParseRaw first.
+	Raw string
+
+	// True if the posting was generated (by a rounding adjustment, an automated transaction, etc.) rather than
+	// written by hand. This is not written out. The reports (everything that takes ReportOptions, and the plain
+	// versions of those) leave these out unless ReportOptions.IncludeGenerated is set, everything else (Balance,
+	// SumTransactions, Compact, the exports, etc) counts them like any other posting.
+	Generated bool
+}
+
+// KV is a single `; Key: Value` pair.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// OrderedKV returns the KV pairs in the comments of the posting, in the order they were written. Unlike a
+// transaction, a posting keeps its comment lines as is, so these are always written back out in the same order, and
+// a key used more than once shows up more than once. A comment line is read as a KV pair the same way the parser
+// reads one on a transaction: a key without white space in it, then a colon and white space, then the value.
+func (p *Posting) OrderedKV() []KV {
+	kvs := []KV{}
+	for _, line := range p.Comments {
+		if kv, ok := commentKV(line); ok {
+			kvs = append(kvs, kv)
+		}
+	}
+	return kvs
+}
+
+// withoutApplied removes the names in applied from names, in place.
+func withoutApplied(names, applied []string) []string {
+	kept := names[:0]
+	for _, name := range names {
+		if !slices.Contains(applied, name) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// commentKV reads a comment line as a KV pair, returning false if it isn't one.
+func commentKV(line string) (KV, bool) {
+	if strings.HasPrefix(line, ":") || !looksLikeKV(line) {
+		return KV{}, false
+	}
+	key, value, _ := strings.Cut(line, ":")
+	return KV{key, strings.TrimSpace(value)}, true
+}
+
+// ParseRaw converts the raw number of the posting (see Raw) into its value, filling in the rest of its style. Does
+// nothing if the posting does not have a raw number. The posting is not changed if the number is not valid.
+func (p *Posting) ParseRaw() error {
+	v, style, err := p.number()
+	if err != nil {
+		return err
+	}
+	p.Value, p.Style, p.Raw = v, style, ""
+	return nil
+}
+
+// number returns the value and style of the posting, converting the raw number (see Raw) if there is one.
+func (p *Posting) number() (int64, AmountStyle, error) {
+	if p.Raw == "" {
+		return p.Value, p.Style, nil
+	}
+	style := p.Style
+	v, ok := ParseNumber(strings.TrimPrefix(p.Raw, "-"), &style)
+	if !ok {
+		return 0, p.Style, fmt.Errorf("Invalid amount: %q", p.Raw)
+	}
+	if strings.HasPrefix(p.Raw, "-") {
+		v = -v
+	}
+	return v, style, nil
+}
+
+// ParseRaw calls Posting.ParseRaw for each posting, stopping at the first error.
+func (t *Transaction) ParseRaw() error {
+	for i := range t.Postings {
+		err := t.Postings[i].ParseRaw()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DateIn returns the date of the posting as seen in the given mode. A posting without its own dates has the dates
+// of its transaction, and one with only its own (primary) date uses it for both modes unless the transaction has an
+// effective date.
+func (p *Posting) DateIn(t *Transaction, mode DateMode) time.Time {
+	if mode == EffectiveDate && !p.ClearDate.IsZero() {
+		return p.ClearDate
+	}
+	if mode == EffectiveDate && !t.ClearDate.IsZero() {
+		return t.ClearDate
+	}
+	if !p.Date.IsZero() {
+		return p.Date
+	}
+	return t.Date
 }
 
 // CleanCopy takes a perfect copy of the transaction object, safe for editing without making any changes to the parent.
 func (t *Transaction) CleanCopy() *Transaction {
 	nt := *t
 	nt.Postings = slices.Clone(t.Postings)
+	for i := range nt.Postings {
+		nt.Postings[i].Comments = slices.Clone(nt.Postings[i].Comments)
+		nt.Postings[i].CommentIndent = slices.Clone(nt.Postings[i].CommentIndent)
+	}
 	nt.Comments = slices.Clone(t.Comments)
+	nt.CommentIndent = slices.Clone(t.CommentIndent)
 	nt.Tags = maps.Clone(t.Tags)
 	nt.KVPairs = maps.Clone(t.KVPairs)
+	nt.DuplicateKV = slices.Clone(t.DuplicateKV)
+	nt.AppliedTags = slices.Clone(t.AppliedTags)
+	nt.AppliedKV = slices.Clone(t.AppliedKV)
 	return &nt
 }
 
-// Balance ensures that all postings in the transaction add up to 0 or there is a single null posting.
+// GetAll returns every value given for a KV key, in the order they were written. The last one is the value in
+// KVPairs. Returns nil if the transaction doesn't have the key.
+func (t *Transaction) GetAll(key string) []string {
+	last, ok := t.KVPairs[key]
+	if !ok {
+		return nil
+	}
+
+	values := []string{}
+	for _, kv := range t.DuplicateKV {
+		if kv.Key == key {
+			values = append(values, kv.Value)
+		}
+	}
+	return append(values, last)
+}
+
+// SetKV sets the value of a KV key, replacing every value it had before (including any in DuplicateKV).
+func (t *Transaction) SetKV(key, value string) {
+	if t.KVPairs == nil {
+		t.KVPairs = map[string]string{}
+	}
+	t.KVPairs[key] = value
+
+	var kept []KV
+	for _, kv := range t.DuplicateKV {
+		if kv.Key != key {
+			kept = append(kept, kv)
+		}
+	}
+	t.DuplicateKV = kept
+}
+
+// ConversionAccount is the account Deannotate books currency conversions to.
+const ConversionAccount = "Equity:Conversion"
+
+// Deannotate returns a copy of the transaction in a plain form for tools that do not understand costs or balance
+// assertions. Every posting keeps its amount, but costs and assertions are removed. For each posting that had a
+// cost, a pair of postings to ConversionAccount is added to undo the posting's amount and book its cost, so a
+// transaction that balanced before still does. These new postings are marked as Generated.
+//
+// What is lost is the link between the amounts: the exchange rate is no longer stated anywhere, so it can't be used
+// for prices or capital gains, and the assertions are no longer checked at all.
+func (t *Transaction) Deannotate() *Transaction {
+	nt := t.CleanCopy()
+	conversions := []Posting{}
+	for i := range nt.Postings {
+		p := &nt.Postings[i]
+		p.Assert, p.HasAssert = 0, false
+		if !p.HasCost {
+			continue
+		}
+
+		v, commodity, style := p.weight(RoundHalfEven)
+		conversions = append(conversions, Posting{
+			Account:   ConversionAccount,
+			Value:     -p.Value,
+			Commodity: p.Commodity,
+			Style:     p.Style,
+			Generated: true,
+		}, Posting{
+			Account:   ConversionAccount,
+			Value:     v,
+			Commodity: commodity,
+			Style:     style,
+			Generated: true,
+		})
+		p.Cost, p.HasCost, p.TotalCost, p.CostCommodity, p.CostStyle = 0, false, false, "", AmountStyle{}
+	}
+	nt.Postings = append(nt.Postings, conversions...)
+	return nt
+}
+
+// Balance ensures that all postings in the transaction add up to 0 or there is a single null posting, with the
+// default (zero value) BalanceOptions.
 // Returns false, nil if there is more than one null posting, otherwise returns the ending balances of
 // all accounts with postings and true if the transaction balances to 0 or there was a null posting.
+// Each commodity must balance separately. The account balances do not say what commodity they are in, so if an
+// account has postings in more than one commodity no balances are returned at all, only whether the transaction
+// balances (use CommodityTotalsByAccount for those). Postings to virtual accounts in parenthesis do not have to balance (see CommodityTotals).
 func (t *Transaction) Balance() (bool, map[string]int64) {
-	bal := int64(0)
-	null := -1
-	accounts := map[string]int64{}
+	return t.BalanceWith(BalanceOptions{})
+}
 
-	for i, p := range t.Postings {
-		if p.Null && null != -1 {
-			return false, nil // Multiple null postings
-		}
-		if p.Null {
-			null = i
-			continue
+// BalanceOptions controls how strictly a transaction must balance. The zero value is the default, used by every
+// function that balances transactions without being given options (Balance, Canonicalize, SumTransactions, the
+// reports, etc). There is no package wide setting, pass the options to the "With" variant of a function instead.
+type BalanceOptions struct {
+	// If a commodity is off by no more than this amount (in ten-thousandths of a unit) the transaction is considered
+	// balanced. This is meant for rounding errors introduced by splitting or converting amounts.
+	Tolerance int64
+
+	// If set, any residual within Tolerance is booked to this account with a new posting instead of being ignored.
+	// The new posting has its note set to RoundingNote and is marked as Generated.
+	RoundingAccount string
+
+	// How the amount of a posting with a per unit cost (@) is rounded when it is converted to the cost commodity.
+	Rounding RoundingMode
+
+	// Commodity aliases, as returned by CommodityAliases. An amount in an alias is treated as being in the commodity
+	// it is an alias of, so with the aliases from `commodity € ; alias EUR` a transaction with €12.00 and -12.00 EUR
+	// balances. Reports given these in their ReportOptions total the two together as well.
+	Aliases map[string]string
+}
+
+// commodity returns the name of a commodity (see commodityName) with any alias resolved.
+func (opts BalanceOptions) commodity(c string) string {
+	c = commodityName(c)
+	if name, ok := opts.Aliases[c]; ok {
+		return name
+	}
+	return c
+}
+
+// RoundingNote is the note attached to postings added to balance out rounding errors.
+const RoundingNote = "Rounding adjustment"
+
+// BalanceWith is exactly like Balance, but it allows small rounding errors as specified by the options.
+// Any rounding postings are included in the returned account balances.
+func (t *Transaction) BalanceWith(opts BalanceOptions) (bool, map[string]int64) {
+	ps, err := t.resolve(opts)
+	if _, ok := err.(MultipleNullError); ok {
+		return false, nil // Multiple null postings
+	}
+
+	accounts, commodities := map[string]int64{}, map[string]string{}
+	for _, p := range ps {
+		if !addToAccount(accounts, commodities, &p, opts) {
+			return err == nil, nil
 		}
-		bal += p.Value
-		accounts[p.Account] += p.Value
 	}
-	if null != -1 {
-		accounts[t.Postings[null].Account] += -bal
-		return true, accounts
+	return err == nil, accounts
+}
+
+// addToAccount adds the value of the posting to its account's balance, returning false if the account already has
+// a balance in some other commodity (as recorded in commodities). Zero values don't count as being in a commodity.
+func addToAccount(accounts map[string]int64, commodities map[string]string, p *Posting, opts BalanceOptions) bool {
+	if p.Value != 0 {
+		c := opts.commodity(p.Commodity)
+		if seen, ok := commodities[p.Account]; ok && seen != c {
+			return false
+		}
+		commodities[p.Account] = c
 	}
-	return bal == 0, accounts
+	accounts[p.Account] += p.Value
+	return true
 }
 
 // Canonicalize takes a transaction and sets the value of any null postings that may exist to
 // the required value to make it balance. Returns an error if there are multiple null postings or
 // if there are no null postings and the transaction does not balance.
+// If the null posting needs to balance more than one commodity, it is replaced with one posting for each.
 func (t *Transaction) Canonicalize() error {
-	bal := int64(0)
-	null := -1
+	return t.CanonicalizeWith(BalanceOptions{})
+}
 
+// CanonicalizeWith is exactly like Canonicalize, but it allows small rounding errors as specified by the options.
+// If a rounding account is set, any rounding postings needed are added to the end of the transaction.
+func (t *Transaction) CanonicalizeWith(opts BalanceOptions) error {
+	ps, err := t.resolve(opts)
+	if err != nil {
+		return err
+	}
+	t.Postings = ps
+	return nil
+}
+
+// SplitByCommodity makes sure that every posting in the transaction is in a single commodity, which is what the
+// rest of this package assumes. A posting with an amount always is, so this only affects a null posting that
+// balances more than one commodity: it is replaced with one posting for each commodity, with the values filled in.
+// A null posting that only balances a single commodity is left alone.
+//
+// Returns a MixedCommodityError if the null posting has a balance assertion, as the assertion can only be in one
+// commodity, or any error from balancing the transaction. The transaction is not changed if there is an error.
+func (t *Transaction) SplitByCommodity() error {
+	ps, err := t.resolve(BalanceOptions{})
+	if err != nil {
+		return err
+	}
+	if len(ps) == len(t.Postings) {
+		return nil
+	}
+
+	for i, p := range t.Postings {
+		if p.Null && p.HasAssert {
+			return MixedCommodityError{i, t.Location}
+		}
+	}
+	split := []Posting{}
+	for i := range t.Postings {
+		split = append(split, t.Postings[i].SplitByCommodity(t)...)
+	}
+	t.Postings = split
+	return nil
+}
+
+// SplitByCommodity returns the posting as one posting for each commodity it is in. Only a null posting can be in
+// more than one commodity, when it balances several at once, and it depends on the rest of the transaction, so the
+// posting must be one of t's postings. Anything else (including a null posting that balances a single commodity, or
+// one in a transaction that cannot be balanced) is returned as is.
+func (p *Posting) SplitByCommodity(t *Transaction) []Posting {
+	if !p.Null {
+		return []Posting{*p}
+	}
+	at := -1
+	for i := range t.Postings {
+		if &t.Postings[i] == p {
+			at = i
+		}
+	}
+	ps, err := t.resolve(BalanceOptions{})
+	if at == -1 || err != nil || len(ps) == len(t.Postings) {
+		return []Posting{*p}
+	}
+	return ps[at : at+len(ps)-len(t.Postings)+1]
+}
+
+// resolve returns a copy of the postings with the value of the null posting (if any) filled in so that every
+// commodity balances (see totals for what must balance). If more than one commodity needs balancing the null posting
+// is replaced with a posting for each. Without a null posting, residuals within the tolerance are allowed and booked
+// to the rounding account if there is one. Raw numbers (see Posting.Raw) are converted. If there is an error the
+// postings are still returned (as far as they could be resolved) unless the error was due to multiple null postings
+// or a raw number that isn't valid.
+func (t *Transaction) resolve(opts BalanceOptions) ([]Posting, error) {
+	null := -1
 	for i, p := range t.Postings {
 		if p.Null && null != -1 {
-			return MultipleNullError{-1, t.Location}
+			return nil, MultipleNullError{-1, t.Location}
 		}
 		if p.Null {
 			null = i
+		}
+	}
+
+	// Raw numbers are converted in the copy, so the totals and the result both have the real values.
+	ps := slices.Clone(t.Postings)
+	for i := range ps {
+		if err := ps[i].ParseRaw(); err != nil {
+			return nil, err
+		}
+	}
+	order, sums := (&Transaction{Postings: ps}).totals(true, opts)
+
+	unbalanced := []string{}
+	for _, c := range order {
+		if sums[c].Value != 0 {
+			unbalanced = append(unbalanced, c)
+		}
+	}
+
+	if null == -1 {
+		for _, c := range unbalanced {
+			if sums[c].Value > opts.Tolerance || -sums[c].Value > opts.Tolerance {
+				return ps, BalanceError{-1, t.Location}
+			}
+		}
+		if opts.RoundingAccount != "" {
+			for _, c := range unbalanced {
+				ps = append(ps, Posting{
+					Account:   opts.RoundingAccount,
+					Value:     -sums[c].Value,
+					Commodity: sums[c].Commodity,
+					Style:     sums[c].Style,
+					Note:      RoundingNote,
+					Generated: true,
+				})
+			}
+		}
+		return ps, nil
+	}
+
+	switch len(unbalanced) {
+	case 0:
+		ps[null].Value = 0
+	case 1:
+		// The common case, the null posting takes up the slack and keeps the format of what it is balancing.
+		c := unbalanced[0]
+		ps[null].Value = -sums[c].Value
+		if ps[null].Commodity == "" || opts.commodity(ps[null].Commodity) != c {
+			ps[null].Commodity = sums[c].Commodity
+			ps[null].Style = sums[c].Style
+		}
+	default:
+		extra := []Posting{}
+		for _, c := range unbalanced {
+			p := ps[null]
+			p.Null = false
+			p.Value = -sums[c].Value
+			p.Commodity = sums[c].Commodity
+			p.Style = sums[c].Style
+			extra = append(extra, p)
+		}
+		ps = append(ps[:null], append(extra, ps[null+1:]...)...)
+	}
+	return ps, nil
+}
+
+// totals sums the postings that must balance in each commodity, keyed by commodity name (with the aliases from opts
+// resolved) and in the order the commodities are first used. Each total is in the commodity and style of the first
+// posting that uses it, as it was written. Postings with a cost count in the cost commodity if costs is set.
+//
+// This decides what has to balance for all of the package: null postings are left out, as are postings to virtual
+// accounts in parenthesis, which ledger-cli does not require to balance.
+func (t *Transaction) totals(costs bool, opts BalanceOptions) ([]string, map[string]Amount) {
+	order := []string{}
+	totals := map[string]Amount{}
+	for i := range t.Postings {
+		p := &t.Postings[i]
+		if p.Null || (strings.HasPrefix(p.Account, "(") && strings.HasSuffix(p.Account, ")")) {
 			continue
 		}
-		bal += p.Value
+
+		a := p.Amount()
+		v, commodity, style := a.Value, a.Commodity, a.Style
+		if costs {
+			v, commodity, style = p.weight(opts.Rounding)
+		}
+		c := opts.commodity(commodity)
+		a, ok := totals[c]
+		if !ok {
+			order = append(order, c)
+			a = Amount{Commodity: commodity, Style: style}
+		}
+		a.Value += v
+		totals[c] = a
 	}
-	if null != -1 {
-		t.Postings[null].Value = -bal
-		return nil
+	return order, totals
+}
+
+// weight returns the value a posting contributes when balancing, along with the commodity and style it is in. This
+// is the cost of the posting if it has one, otherwise it is simply the amount. A per unit cost is rounded with the
+// given mode.
+func (p *Posting) weight(mode RoundingMode) (int64, string, AmountStyle) {
+	a := p.Amount()
+	if !p.HasCost {
+		return a.Value, a.Commodity, a.Style
 	}
-	if bal != 0 {
-		return BalanceError{-1, t.Location}
+	if p.TotalCost {
+		if a.Value < 0 {
+			return -p.Cost, p.CostCommodity, p.CostStyle
+		}
+		return p.Cost, p.CostCommodity, p.CostStyle
 	}
-	return nil
+	a = a.ConvertToWith(p.CostCommodity, Amount{Value: p.Cost, Commodity: p.CostCommodity, Style: p.CostStyle}, mode)
+	return a.Value, a.Commodity, a.Style
+}
+
+// CommodityTotals sums the postings of the transaction in each commodity, keyed by commodity name (amounts with no
+// commodity are under DefaultCommodity). Postings with a cost count in the cost commodity, the same as when
+// balancing the transaction, so a balanced transaction gives all zeros. Only postings that must balance are counted,
+// so null postings are left out, as are postings to virtual accounts in parenthesis (which ledger-cli does not
+// require to balance, and neither does Balance).
+func (t *Transaction) CommodityTotals() map[string]Amount {
+	_, totals := t.totals(true, BalanceOptions{})
+	return totals
 }
 
-// SumTransactions balances a list of transactions, and returns a map of accounts to their ending values.
+// UnitTotals is like CommodityTotals, but ignores costs, summing each posting in the commodity it is written in.
+// A transaction that converts between commodities will not total to zero this way.
+func (t *Transaction) UnitTotals() map[string]Amount {
+	_, totals := t.totals(false, BalanceOptions{})
+	return totals
+}
+
+// ExchangeRate returns the cost of one unit of the posting's commodity in its cost commodity, as implied by the
+// posting's cost. For a per unit cost (@) this is just the cost, for a total cost (@@) it is the cost divided by
+// the amount, rounded to even. The rate is written in the style of the cost, with four decimal places if it needs
+// them. Returns false if the posting has no cost, or its amount is zero (either way there is nothing to exchange).
+func (p *Posting) ExchangeRate() (Amount, bool) {
+	return p.ExchangeRateWith(RoundHalfEven)
+}
+
+// ExchangeRateWith is exactly like ExchangeRate, but a rate worked out from a total cost is rounded with the given
+// mode.
+func (p *Posting) ExchangeRateWith(mode RoundingMode) (Amount, bool) {
+	if !p.HasCost || p.Null {
+		return Amount{}, false
+	}
+	if p.Value == 0 {
+		return Amount{}, false
+	}
+	rate := Amount{Value: p.Cost, Commodity: p.CostCommodity, Style: p.CostStyle}
+	if !p.TotalCost {
+		return rate, true
+	}
+
+	v := p.Value
+	if v < 0 {
+		v = -v
+	}
+	rate.Value = roundRat(big.NewRat(p.Cost, v), mode)
+	if roundValue(rate.Value, rate.Style.Places(), RoundDown) != rate.Value {
+		rate.Style.Precision = 4
+	}
+	return rate, true
+}
+
+// commodityName returns the name of a commodity, substituting DefaultCommodity for an empty commodity.
+func commodityName(c string) string {
+	if c == "" {
+		return DefaultCommodity
+	}
+	return c
+}
+
+// SumTransactions balances a list of transactions, and returns a map of accounts to their ending values. The values
+// do not say what commodity they are in, so every account must only ever have postings in one commodity, otherwise
+// this returns a MixedAccountError (use CommodityTotalsByAccount for journals like that).
 func SumTransactions(ts []Transaction) (map[string]int64, error) {
-	accounts := map[string]int64{}
+	accounts, commodities := map[string]int64{}, map[string]string{}
 
 	for i, t := range ts {
-		ok, ac := t.Balance()
-		if !ok {
+		ps, err := t.resolve(BalanceOptions{})
+		if err != nil {
 			return nil, BalanceError{i, t.Location}
 		}
 
-		for k, v := range ac {
-			accounts[k] += v
+		for _, p := range ps {
+			if !addToAccount(accounts, commodities, &p, BalanceOptions{}) {
+				return nil, MixedAccountError{i, t.Location, p.Account}
+			}
 		}
 	}
 
@@ -173,35 +728,83 @@ type sumTree struct {
 	value    int64
 }
 
-func (st *sumTree) render(name, lvl, pad string, res [][]string) [][]string {
-	if len(st.children) == 1 {
-		// Maybe I'm being an idiot, but there isn't a way to get an unknown key from a map that isn't a loop.
-		for key, child := range st.children {
-			return child.render(name+":"+key, lvl, pad, res)
+func (st *sumTree) render(name, path, lvl, pad string, opts *RenderOptions, res [][]string) [][]string {
+	keys := make([]string, 0, len(st.children))
+	for key, child := range st.children {
+		if child.value == 0 && opts != nil && opts.HideZero {
+			continue
 		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 1 {
+		key := keys[0]
+		if name == "" {
+			return st.children[key].render(key, key, lvl, pad, opts, res)
+		}
+		return st.children[key].render(name+":"+key, path+":"+key, lvl, pad, opts, res)
 	}
 
 	padding := ""
 	if name != "" {
 		padding = pad
-		res = append(res, []string{lvl + name, FormatValue(st.value)})
-	}
-
-	keys := make([]string, 0, len(st.children))
-	for key := range st.children {
-		keys = append(keys, key)
+		res = append(res, []string{lvl + name, FormatValue(st.value * opts.Sign(path))})
 	}
-	sort.Strings(keys)
 
 	for _, key := range keys {
-		res = st.children[key].render(key, lvl+padding, pad, res)
+		cpath := key
+		if path != "" {
+			cpath = path + ":" + key
+		}
+		res = st.children[key].render(key, cpath, lvl+padding, pad, opts, res)
 	}
 	return res
 }
 
+// RenderOptions controls how reports are rendered for display. None of these options change the underlying data.
+type RenderOptions struct {
+	// FlipSign maps account names to whether the sign of their balances should be flipped for display. Each entry
+	// applies to the account and all of its children, with the most specific entry winning. For example
+	// {"Income": true, "Liabilities": true} shows income and debts as positive numbers, and adding
+	// "Income:Refunds": false would keep that one child as stored.
+	FlipSign map[string]bool
+
+	// Leave out accounts with a zero balance, along with all of their children. The balance of an account includes
+	// its children, so this also hides a parent whose children net out to zero, children and all.
+	HideZero bool
+}
+
+// Sign returns -1 if the sign of the given account should be flipped for display, otherwise 1.
+func (opts *RenderOptions) Sign(account string) int64 {
+	if opts == nil || len(opts.FlipSign) == 0 {
+		return 1
+	}
+
+	account = BareAccount(account)
+	for {
+		if flip, ok := opts.FlipSign[account]; ok {
+			if flip {
+				return -1
+			}
+			return 1
+		}
+
+		account = AccountParent(account)
+		if account == "" {
+			return 1
+		}
+	}
+}
+
 // FormatSums takes a map of accounts to sums and turns it into a list of name/value pairs
 // with indentation applied to the names.
 func FormatSums(accounts map[string]int64, pad string) [][]string {
+	return FormatSumsWith(accounts, pad, nil)
+}
+
+// FormatSumsWith is exactly like FormatSums, but with control over the rendering. opts may be nil.
+func FormatSumsWith(accounts map[string]int64, pad string, opts *RenderOptions) [][]string {
 	// Generate an accounts tree
 	root := &sumTree{children: map[string]*sumTree{}}
 
@@ -221,7 +824,70 @@ func FormatSums(accounts map[string]int64, pad string) [][]string {
 		}
 	}
 
-	return root.render("", "", pad, nil)
+	return root.render("", "", "", pad, opts, nil)
+}
+
+// CoalescePostings merges postings to the same account into a single posting (at the position of the first one),
+// summing their values. Notes are joined with "; " and comment lines are concatenated, except that a KV pair (see
+// Posting.OrderedKV) the merged posting already has is not repeated.
+//
+// Postings are only merged if they are compatible: same account, commodity, and status, and no KV key with a
+// different value on each. Null postings and postings carrying a balance assertion are never merged, since there is
+// no correct way to combine them, and neither are postings with a raw number (see Posting.Raw), call ParseRaw first to
+// merge those.
+func (t *Transaction) CoalescePostings() {
+	ps := []Posting{}
+outer:
+	for _, p := range t.Postings {
+		for i := range ps {
+			if ps[i].coalescible(&p) {
+				ps[i].Value += p.Value
+				if p.Note != "" {
+					if ps[i].Note != "" {
+						ps[i].Note += "; "
+					}
+					ps[i].Note += p.Note
+				}
+				kvs := ps[i].OrderedKV()
+				comments, indents := slices.Clone(ps[i].Comments), slices.Clone(ps[i].CommentIndent)
+				for j, line := range p.Comments {
+					if kv, ok := commentKV(line); ok && slices.Contains(kvs, kv) {
+						continue
+					}
+					comments = append(comments, line)
+					if j < len(p.CommentIndent) {
+						indents = append(indents, p.CommentIndent[j])
+					}
+				}
+				ps[i].Comments, ps[i].CommentIndent = comments, indents
+				continue outer
+			}
+		}
+		ps = append(ps, p)
+	}
+	t.Postings = ps
+}
+
+// coalescible returns true if the two postings may be merged by CoalescePostings.
+func (p *Posting) coalescible(p2 *Posting) bool {
+	if p.Null || p2.Null || p.HasAssert || p2.HasAssert || p.HasCost || p2.HasCost || p.Raw != "" || p2.Raw != "" {
+		return false
+	}
+	if !(p.Account == p2.Account && commodityName(p.Commodity) == commodityName(p2.Commodity) && p.Status == p2.Status &&
+		p.Generated == p2.Generated && p.Date.Equal(p2.Date) && p.ClearDate.Equal(p2.ClearDate)) {
+		return false
+	}
+
+	// The metadata must not conflict.
+	kvs := p2.OrderedKV()
+	for _, kv := range p.OrderedKV() {
+		for _, kv2 := range kvs {
+			if kv.Key == kv2.Key && kv.Value != kv2.Value {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // Match replaces the given account in the postings with the first matcher that succeeds.
@@ -263,54 +929,397 @@ type Matcher struct {
 	Payee   string
 }
 
+// RenamePayee replaces the description of every transaction whose description is exactly from with to, for
+// cleaning up after a vendor changes names. Returns the number of transactions changed.
+//
+// If regex is set, from is a regexp and the parts of each description it matches are replaced with to, which may
+// refer to capture groups ($1, ${name}) the same as regexp.Regexp.Expand. Anchor the regexp with ^ and $ to replace
+// the whole description. Returns an error if the regexp is invalid, in which case nothing is changed.
+func RenamePayee(trs []Transaction, from, to string, regex bool) (int, error) {
+	return RenamePayeeWith(trs, from, to, regex, RenameOptions{})
+}
+
+// RenameOptions controls the optional behavior of RenamePayeeWith.
+type RenameOptions struct {
+	// If not empty, the original description is kept in a KV with this key. An existing KV is never overwritten,
+	// so after several renames it still holds the description as it was first written.
+	OriginalKV string
+}
+
+// RenamePayeeWith is exactly like RenamePayee, but with options.
+func RenamePayeeWith(trs []Transaction, from, to string, regex bool, opts RenameOptions) (int, error) {
+	rename := func(desc string) string {
+		if desc == from {
+			return to
+		}
+		return desc
+	}
+	if regex {
+		r, err := regexp.Compile(from)
+		if err != nil {
+			return 0, err
+		}
+		rename = func(desc string) string {
+			return r.ReplaceAllString(desc, to)
+		}
+	}
+
+	count := 0
+	for i := range trs {
+		t := &trs[i]
+		desc := rename(t.Description)
+		if desc == t.Description {
+			continue
+		}
+
+		if opts.OriginalKV != "" {
+			if _, ok := t.KVPairs[opts.OriginalKV]; !ok {
+				t.SetKV(opts.OriginalKV, t.Description)
+			}
+		}
+		t.Description = desc
+		count++
+	}
+	return count, nil
+}
+
+// String formats the transaction the way ledger-cli writes it: the date (and effective date), the status, the code,
+// and then the payee. Posting statuses come right before the account. hledger uses the same layout, so there is no
+// option for anything else.
 func (t *Transaction) String() string {
+	return t.StringWith(WriteOptions{})
+}
+
+// WriteOptions controls the optional behavior of the functions that write ledger files. The zero value gives the
+// default output.
+type WriteOptions struct {
+	// If greater than zero, comment lines longer than this many columns are wrapped onto more comment lines (tabs
+	// count as 8 columns). Lines are only broken at single spaces, and never in a way that would make the
+	// continuation look like a tag or KV line, so a single word that is too long is left alone.
+	//
+	// Only free form comments are wrapped. A KV value or a posting note has no way to continue onto another line (the
+	// next line would be read back as a free form comment), so KV lines, tag lines, and postings with notes are
+	// written out at whatever length they are, even if that is past this width.
+	WrapComments int
+
+	// If greater than zero, amounts start at this column (counting from zero, including the indent of the posting)
+	// instead of being aligned on their decimal marks. If the account name runs past the column, the amount follows
+	// it after two spaces instead.
+	AmountColumn int
+
+	// The indent used for postings and comments (and the lines of directives). Zero is a tab, which is the default,
+	// and a positive number is that many spaces. Amounts end up in the same columns either way, with a tab counting
+	// as 8 columns.
+	IndentStyle int
+
+	// If not empty, amounts in this commodity are written as bare numbers (5.00 instead of $5.00). This only makes
+	// sense for a file with a D directive for the commodity, and such a file only reads back the same if it is
+	// parsed with the parse.Options.DefaultCommodity option. Amounts written without a commodity in the first place
+	// are always written with DefaultCommodity unless it is the commodity given here.
+	BareCommodity string
+
+	// The order directives are written in, see DirectiveSort. The default keeps them where they are.
+	DirectiveSort DirectiveSort
+
+	// Where the minus sign of a negative amount goes when the commodity comes first. The default is after the
+	// commodity ($-5.00), no matter how the amount was written.
+	Sign SignStyle
+
+	// If set, everything is written as close to the way it was parsed as possible. This is the same as setting Sign
+	// to SignPreserve along with PreserveCodeOrder, PreserveCommentIndent, PreserveBlankLines, and KeepApplyBlocks,
+	// the options below only matter when this is not set. Section markers are only kept if the file was parsed with
+	// the parse.Options.KeepSections option.
+	Preserve bool
+
+	// If set, transactions with their code written before their status ((123) * Payee, see
+	// Transaction.CodeFirst) are written that way. Otherwise the status always comes first (* (123) Payee).
+	PreserveCodeOrder bool
+
+	// If set, the decimal marks of the amounts are aligned on the column just far enough out to fit the longest
+	// posting, instead of on a fixed column that long account names run past. File.FormatWith looks at every
+	// posting in the file first, so the amounts line up across the whole file, Transaction.StringWith only at the
+	// postings of the one transaction. This is ignored if AmountColumn is set.
+	GlobalAlign bool
+
+	// If set, comments are written with the indent they were parsed with (see Transaction.CommentIndent) instead of
+	// the usual indent. A comment on a posting is only written as it was if that keeps it indented at least as far
+	// as the posting, otherwise it would belong to the transaction when read back.
+	PreserveCommentIndent bool
+
+	// If set, File.FormatWith writes each transaction and directive with the number of blank lines before it that
+	// it was parsed with (see Transaction.BlankLines) instead of exactly one. Anything that was not parsed (or was
+	// parsed right after the last thing, with no blank line) gets none, so set BlankLines on new transactions.
+	PreserveBlankLines bool
+
+	// If set, tags and KV pairs that came from `apply tag` blocks (see Transaction.AppliedTags) are left off the
+	// transactions and the blocks are written as they were parsed. Otherwise they are written on each transaction
+	// like any other, and File.FormatWith leaves out the apply tag directives and the ends of their blocks.
+	KeepApplyBlocks bool
+
+	// The column decimal marks are aligned on by GlobalAlign, counting from the end of the indent. Zero if it has
+	// not been worked out yet.
+	decimalColumn int
+}
+
+// preserved returns the options with everything the Preserve option stands for turned on, if it is set.
+func (opts WriteOptions) preserved() WriteOptions {
+	if opts.Preserve {
+		opts.Sign = SignPreserve
+		opts.PreserveCodeOrder = true
+		opts.PreserveCommentIndent = true
+		opts.PreserveBlankLines = true
+		opts.KeepApplyBlocks = true
+	}
+	return opts
+}
+
+// SignStyle selects where the minus sign of a negative amount with a leading commodity is written.
+type SignStyle int
+
+const (
+	SignAfterCommodity  SignStyle = iota // $-5.00
+	SignBeforeCommodity                  // -$5.00
+	SignPreserve                         // However the amount was written (see AmountStyle.SignFirst).
+)
+
+// sign sets the style's SignFirst as set by the Sign option.
+func (opts WriteOptions) sign(style AmountStyle) AmountStyle {
+	switch opts.Sign {
+	case SignAfterCommodity:
+		style.SignFirst = false
+	case SignBeforeCommodity:
+		style.SignFirst = true
+	}
+	return style
+}
+
+// amount formats an amount as FormatAmount does, leaving off the commodity as set by BareCommodity.
+func (opts WriteOptions) amount(v int64, commodity string, style AmountStyle) string {
+	s, _ := opts.formatAmount(v, commodity, style)
+	return s
+}
+
+// formatAmount is like the package level formatAmount, but leaves off the commodity as set by BareCommodity.
+func (opts WriteOptions) formatAmount(v int64, commodity string, style AmountStyle) (string, int) {
+	if opts.BareCommodity == "" || commodityName(commodity) != opts.BareCommodity {
+		return formatAmount(v, commodity, opts.sign(style))
+	}
+	whole, frac := formatNumber(v, style)
+	return whole + frac, utf8.RuneCountInString(whole)
+}
+
+// postingAmount is like formatAmount, but for the amount of a posting, which may be a raw number (see Posting.Raw).
+func (opts WriteOptions) postingAmount(p *Posting) (string, int) {
+	if p.Raw == "" {
+		return opts.formatAmount(p.Value, p.Commodity, p.Style)
+	}
+	whole, frac := splitRaw(p.Raw)
+	if opts.BareCommodity != "" && commodityName(p.Commodity) == opts.BareCommodity {
+		return whole + frac, utf8.RuneCountInString(whole)
+	}
+	return withCommodity(whole, frac, p.Commodity, opts.sign(p.Style))
+}
+
+// withDecimalColumn returns the options with the column for GlobalAlign worked out from the given transactions, if
+// it is needed and not done already.
+func (opts WriteOptions) withDecimalColumn(trs []Transaction) WriteOptions {
+	if !opts.GlobalAlign || opts.AmountColumn > 0 || opts.decimalColumn > 0 {
+		return opts
+	}
+
+	// Two spaces between the account and the amount, the same as the fixed alignment.
+	for i := range trs {
+		for j := range trs[i].Postings {
+			p := &trs[i].Postings[j]
+			if p.Null {
+				continue
+			}
+			_, prefixlen := opts.postingAmount(p)
+			column := utf8.RuneCountInString(p.Account) + 2 + prefixlen
+			if p.Status != StatusUndefined {
+				column += 2
+			}
+			if column > opts.decimalColumn {
+				opts.decimalColumn = column
+			}
+		}
+	}
+	return opts
+}
+
+// commentIndent returns the indent to write comment i with, and its width in columns. This is the given indent,
+// unless the PreserveCommentIndent option is set and the comment has its own indent at least min columns wide.
+func (opts WriteOptions) commentIndent(comments, indents []string, i int, indent string, width, min int) (string, int) {
+	if !opts.PreserveCommentIndent || len(indents) != len(comments) {
+		return indent, width
+	}
+
+	w := 0
+	for _, r := range indents[i] {
+		if r == '\t' {
+			w += 8 - w%8
+		} else {
+			w++
+		}
+	}
+	if w < min {
+		return indent, width
+	}
+	return indents[i], w
+}
+
+// indent returns the indent string for the options and its width in columns.
+func (opts WriteOptions) indent() (string, int) {
+	if opts.IndentStyle > 0 {
+		return strings.Repeat(" ", opts.IndentStyle), opts.IndentStyle
+	}
+	return "\t", 8
+}
+
+// StringWith is exactly like String, but with options.
+func (t *Transaction) StringWith(opts WriteOptions) string {
 	buf := new(bytes.Buffer)
+	opts = opts.preserved()
+	opts = opts.withDecimalColumn([]Transaction{*t})
 
-	buf.WriteString(t.Date.Format("2006/01/02"))
+	layout := "2006/01/02"
+	if t.ShortDate {
+		layout = "01/02"
+	}
+	buf.WriteString(t.Date.Format(layout))
 	if !t.ClearDate.IsZero() {
-		fmt.Fprintf(buf, "=%v", t.ClearDate.Format("2006/01/02"))
+		fmt.Fprintf(buf, "=%v", t.ClearDate.Format(layout))
 	}
-
-	switch t.Status {
-	case StatusClear:
-		buf.WriteString(" * ")
-	case StatusPending:
-		buf.WriteString(" ! ")
-	default:
-		buf.WriteString("   ")
+	if t.HasTime {
+		if t.Date.Second() != 0 {
+			buf.WriteString(t.Date.Format(" 15:04:05"))
+		} else {
+			buf.WriteString(t.Date.Format(" 15:04"))
+		}
 	}
 
-	if t.Code != "" {
-		fmt.Fprintf(buf, "(%v) ", t.Code)
+	if t.Code != "" && t.Status != StatusUndefined && t.CodeFirst && opts.PreserveCodeOrder {
+		fmt.Fprintf(buf, " (%v)", t.Code)
+		if t.Status == StatusClear {
+			buf.WriteString(" * ")
+		} else {
+			buf.WriteString(" ! ")
+		}
+	} else {
+		switch t.Status {
+		case StatusClear:
+			buf.WriteString(" * ")
+		case StatusPending:
+			buf.WriteString(" ! ")
+		default:
+			buf.WriteString("   ")
+		}
+
+		if t.Code != "" {
+			fmt.Fprintf(buf, "(%v) ", t.Code)
+		}
 	}
 
 	fmt.Fprintf(buf, "%v\n", t.Description)
 
+	indent, width := opts.indent()
+
 	// We don't know if the comments and postings were interleaved in any way,
 	// so canonically we will just do the comments and metadata first.
-	for _, line := range t.Comments {
-		fmt.Fprintf(buf, "\t; %v\n", line)
+	for i, line := range t.Comments {
+		cindent, cwidth := opts.commentIndent(t.Comments, t.CommentIndent, i, indent, width, 1)
+		for _, line := range wrapComment(line, cwidth+2, opts.WrapComments) {
+			fmt.Fprintf(buf, "%v; %v\n", cindent, line)
+		}
+	}
+	// Map order is random, so sort tags and keys to get the same output every time.
+	tags := maps.Keys(t.Tags)
+	keys := maps.Keys(t.KVPairs)
+	if opts.KeepApplyBlocks {
+		tags = withoutApplied(tags, t.AppliedTags)
+		keys = withoutApplied(keys, t.AppliedKV)
 	}
-	if len(t.Tags) != 0 {
-		fmt.Fprint(buf, "\t; ")
-		for tag := range t.Tags {
+	if len(tags) != 0 {
+		sort.Strings(tags)
+
+		fmt.Fprintf(buf, "%v; ", indent)
+		for _, tag := range tags {
 			fmt.Fprintf(buf, ":%v", tag)
 		}
 		fmt.Fprint(buf, ":\n")
 	}
-	for k, v := range t.KVPairs {
-		fmt.Fprintf(buf, "\t; %v: %v\n", k, v)
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, kv := range t.DuplicateKV {
+			if kv.Key == k {
+				fmt.Fprintf(buf, "%v; %v: %v\n", indent, k, kv.Value)
+			}
+		}
+		fmt.Fprintf(buf, "%v; %v: %v\n", indent, k, t.KVPairs[k])
 	}
 
+	// Posting comment lines are indented further than the posting so there is no doubt who they belong to.
 	for _, p := range t.Postings {
-		fmt.Fprintf(buf, "\t%v\n", p.String())
+		fmt.Fprintf(buf, "%v%v\n", indent, p.StringWith(opts))
+		for i, line := range p.Comments {
+			cindent, cwidth := opts.commentIndent(p.Comments, p.CommentIndent, i, indent+"    ", width+4, width)
+			for _, line := range wrapComment(line, cwidth+2, opts.WrapComments) {
+				fmt.Fprintf(buf, "%v; %v\n", cindent, line)
+			}
+		}
 	}
 
 	return buf.String()
 }
 
+// wrapComment splits a comment line that will be written starting at the given column so that it fits in width
+// columns, as described for WriteOptions.WrapComments.
+func wrapComment(line string, column, width int) []string {
+	if width <= 0 {
+		return []string{line}
+	}
+
+	lines := []string{}
+	for utf8.RuneCountInString(line)+column > width {
+		at := -1
+		for i, r := range line {
+			if i > 0 && utf8.RuneCountInString(line[:i])+column > width && at != -1 {
+				break
+			}
+			if r != ' ' || i == 0 || line[i-1] == ' ' || i+1 >= len(line) || line[i+1] == ' ' {
+				continue
+			}
+			if rest := line[i+1:]; strings.HasPrefix(rest, ":") || looksLikeKV(rest) {
+				continue
+			}
+			at = i
+		}
+		if at == -1 {
+			break
+		}
+		lines = append(lines, line[:at])
+		line = line[at+1:]
+	}
+	return append(lines, line)
+}
+
+// looksLikeKV returns true if the parser would read a comment line starting with s as a KV pair.
+func looksLikeKV(s string) bool {
+	word := s
+	if i := strings.IndexAny(s, " \t"); i != -1 {
+		word = s[:i]
+	}
+	return strings.HasSuffix(word, ":") && len(word) < len(s)
+}
+
 func (p *Posting) String() string {
+	return p.StringWith(WriteOptions{})
+}
+
+// StringWith is exactly like String, but with options.
+func (p *Posting) StringWith(opts WriteOptions) string {
 	buf := new(bytes.Buffer)
+	opts = opts.preserved()
 
 	switch p.Status {
 	case StatusClear:
@@ -323,19 +1332,44 @@ func (p *Posting) String() string {
 		//buf.WriteString("  ")
 	}
 
-	if !p.Null {
-		// In order to align on the decimal point instead of the first digit, we need to figure out how much value is
-		// before the decimal point so we can reduce the account padding to match.
-		value := FormatValue(p.Value)
+	// The amount columns assume the posting is indented by a tab, so adjust to match the real indent.
+	_, width := opts.indent()
+	align := 62 + 8 - width
+	if opts.decimalColumn > 0 {
+		align = opts.decimalColumn - 2 - utf8.RuneCountInString(buf.String())
+	}
 
-		// Measure forward offset
-		prefixlen := strings.Index(value, ".")
-		if prefixlen == -1 {
-			prefixlen = len(value)
+	// In absolute mode all that matters is where the account name ends.
+	if opts.AmountColumn > 0 {
+		pad := opts.AmountColumn - width - utf8.RuneCountInString(buf.String()) - utf8.RuneCountInString(p.Account)
+		if pad < 2 {
+			pad = 2
 		}
 
+		buf.WriteString(p.Account)
+		if !p.Null || p.HasAssert {
+			buf.WriteString(strings.Repeat(" ", pad))
+		}
+		if !p.Null {
+			value, _ := opts.postingAmount(p)
+			buf.WriteString(value)
+			buf.WriteString(p.costString(opts))
+			if p.HasAssert {
+				buf.WriteString(" ")
+			}
+		}
+		if p.HasAssert {
+			buf.WriteString("= ")
+			buf.WriteString(opts.amount(p.Assert, p.Commodity, p.Style))
+		}
+	} else if !p.Null {
+		// In order to align on the decimal point instead of the first digit, we need to figure out how much value is
+		// before the decimal point so we can reduce the account padding to match. This is measured in runes, not
+		// bytes, so multi-byte commodities like € don't throw things off.
+		value, prefixlen := opts.postingAmount(p)
+
 		// Calculate padding
-		pad := 62 - prefixlen
+		pad := align - prefixlen
 		if pad < 0 {
 			pad = 0
 		}
@@ -344,14 +1378,15 @@ func (p *Posting) String() string {
 		// point), add an extra two spaces so we don't need to write a bunch of logic for pathologically long account
 		// names, and then write the value.
 		fmt.Fprintf(buf, "%-*s  %s", pad, p.Account, value)
+		buf.WriteString(p.costString(opts))
 
 		if p.HasAssert {
 			buf.WriteString(" = ")
-			buf.WriteString(FormatValue(p.Assert))
+			buf.WriteString(opts.amount(p.Assert, p.Commodity, p.Style))
 		}
 	} else {
 		if p.HasAssert {
-			fmt.Fprintf(buf, "%-62s      = %s", p.Account, FormatValue(p.Assert))
+			fmt.Fprintf(buf, "%-*s      = %s", align, p.Account, opts.amount(p.Assert, p.Commodity, p.Style))
 		} else {
 			buf.WriteString(p.Account)
 		}
@@ -364,6 +1399,18 @@ func (p *Posting) String() string {
 	return buf.String()
 }
 
+// costString returns the cost of the posting as it should be written after the amount, or nothing if it has no cost.
+func (p *Posting) costString(opts WriteOptions) string {
+	switch {
+	case !p.HasCost:
+		return ""
+	case p.TotalCost:
+		return " @@ " + opts.amount(p.Cost, p.CostCommodity, p.CostStyle)
+	default:
+		return " @ " + opts.amount(p.Cost, p.CostCommodity, p.CostStyle)
+	}
+}
+
 // ParseValueNumber takes a decimal number and converts it to a integer with a precision of .
 // Rounding is done via the round to even method.
 func ParseValueNumber(v string) (int64, error) {
@@ -423,6 +1470,149 @@ func roundToEven(ms, ls int64) int64 {
 	return ms
 }
 
+// TimeOfDay returns the time of day from the "time" KV (written as HH:MM or HH:MM:SS) as an offset from midnight.
+// Returns false if there is no such KV or it is not a valid time.
+func (t *Transaction) TimeOfDay() (time.Duration, bool) {
+	v, ok := t.KVPairs["time"]
+	if !ok {
+		return 0, false
+	}
+	return ParseTimeOfDay(strings.TrimSpace(v))
+}
+
+// ParseTimeOfDay parses a time of day written as HH:MM or HH:MM:SS, returning it as an offset from midnight.
+func ParseTimeOfDay(v string) (time.Duration, bool) {
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		tm, err := time.Parse(layout, v)
+		if err == nil {
+			return time.Duration(tm.Hour())*time.Hour + time.Duration(tm.Minute())*time.Minute +
+				time.Duration(tm.Second())*time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// ErrBadDate is returned by ParseDate for anything that isn't a date.
+var ErrBadDate = errors.New("Malformed date.")
+
+// ParseDate parses a date written the same way as the date of a transaction in a ledger file: yyyy/mm/dd, with a
+// dash or a period allowed in place of either slash, optionally followed by white space and a time of day (see
+// ParseTimeOfDay), which is added to the date. A short date (mm/dd) is in the current year. White space around the
+// date is ignored.
+//
+// Returns ErrBadDate if the date isn't written correctly, or an error from the time package if it is but the date
+// doesn't exist (2023/02/30).
+func ParseDate(s string) (time.Time, error) {
+	return ParseDateIn(s, time.Now().Year())
+}
+
+// ParseDateIn is like ParseDate, but a short date is in the given year. If year is zero short dates are not
+// allowed, the same as a ledger file without a year directive.
+func ParseDateIn(s string, year int) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	tod := time.Duration(0)
+	if i := strings.IndexAny(s, " \t"); i != -1 {
+		d, ok := ParseTimeOfDay(strings.TrimSpace(s[i:]))
+		if !ok {
+			return time.Time{}, ErrBadDate
+		}
+		s, tod = s[:i], d
+	}
+
+	parts := []string{}
+	for {
+		i := strings.IndexAny(s, "/-.")
+		if i == -1 {
+			parts = append(parts, s)
+			break
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+	if len(parts) == 2 && year != 0 {
+		parts = append([]string{fmt.Sprintf("%04d", year)}, parts...)
+	}
+	if len(parts) != 3 || len(parts[0]) != 4 || len(parts[1]) != 2 || len(parts[2]) != 2 {
+		return time.Time{}, ErrBadDate
+	}
+	for _, part := range parts {
+		if strings.Trim(part, "0123456789") != "" {
+			return time.Time{}, ErrBadDate
+		}
+	}
+
+	t, err := time.Parse("2006/01/02", strings.Join(parts, "/"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(tod), nil
+}
+
+// CompareTransactions returns -1 if a sorts before b, 1 if b sorts before a, and 0 if there is no way to tell.
+// The order is decided by, in order of precedence:
+//
+//  1. The date.
+//  2. The "time" KV (see TimeOfDay), transactions without a time come first.
+//  3. The "ID" KV, then the "RID" KV, then the "FITID" KV. If only one of the two has the key it comes first,
+//     otherwise the keys are compared lexically.
+func CompareTransactions(a, b *Transaction) int {
+	switch {
+	case a.Date.Before(b.Date):
+		return -1
+	case a.Date.After(b.Date):
+		return 1
+	}
+
+	ta, oka := a.TimeOfDay()
+	tb, okb := b.TimeOfDay()
+	switch {
+	case oka && !okb:
+		return 1
+	case !oka && okb:
+		return -1
+	case ta < tb:
+		return -1
+	case ta > tb:
+		return 1
+	}
+
+	for _, key := range []string{"ID", "RID", "FITID"} {
+		ka, oka := a.KVPairs[key]
+		kb, okb := b.KVPairs[key]
+		switch {
+		case oka && !okb:
+			return -1
+		case !oka && okb:
+			return 1
+		case ka < kb:
+			return -1
+		case ka > kb:
+			return 1
+		}
+	}
+	return 0
+}
+
+// Comparator orders two transactions the same way as CompareTransactions, which is the default everywhere one is
+// accepted. It must be a strict weak ordering: a transaction never sorts before itself, the order is transitive,
+// and transactions that compare equal (0) to each other must compare the same way to everything else. Otherwise the
+// results are undefined.
+type Comparator func(a, b *Transaction) int
+
+// SortTransactions sorts the transactions in place using CompareTransactions. The sort is stable, so transactions
+// that compare equal keep their order.
+func SortTransactions(trs []Transaction) {
+	SortTransactionsFunc(trs, CompareTransactions)
+}
+
+// SortTransactionsFunc is exactly like SortTransactions, but with a custom order.
+func SortTransactionsFunc(trs []Transaction, cmp Comparator) {
+	sort.SliceStable(trs, func(i, j int) bool {
+		return cmp(&trs[i], &trs[j]) < 0
+	})
+}
+
 // TransactionDateSorter is a helper for sorting a list of transactions by date.
 type TransactionDateSorter []Transaction
 
@@ -466,3 +1656,26 @@ func (err MultipleNullError) Error() string {
 	}
 	return fmt.Sprintf("Transaction %v (defined on line %v) has multiple null postings.", err.T, err.L)
 }
+
+// MixedAccountError is returned by SumTransactions if an account has postings in more than one commodity. T is the
+// transaction where the second commodity was found.
+type MixedAccountError struct {
+	T       int
+	L       lex.Location
+	Account string
+}
+
+func (err MixedAccountError) Error() string {
+	return fmt.Sprintf("Account %v has more than one commodity, found in transaction %v (defined on line %v).", err.Account, err.T, err.L)
+}
+
+// MixedCommodityError is returned by Transaction.SplitByCommodity if a posting must be in more than one commodity at
+// once. P is the index of the posting.
+type MixedCommodityError struct {
+	P int
+	L lex.Location
+}
+
+func (err MixedCommodityError) Error() string {
+	return fmt.Sprintf("Posting %v of transaction (defined on line %v) has more than one commodity.", err.P, err.L)
+}
@@ -0,0 +1,953 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestRoundingInput = `
+2022/03/01 * Split Bill
+    Expenses:Food       $3.34
+    Expenses:Food       $3.33
+    Expenses:Food       $3.34
+    Assets:Checking     $-10.00
+`
+
+func TestRoundingPosting(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRoundingInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.T[0]
+
+	if ok, _ := tr.Balance(); ok {
+		t.Fatalf("Transaction with a one cent residual balances without a tolerance.")
+	}
+
+	opts := ledger.BalanceOptions{Tolerance: 100, RoundingAccount: "Expenses:Rounding"}
+	ok, ac := tr.BalanceWith(opts)
+	if !ok {
+		t.Fatalf("Transaction with a one cent residual does not balance with a one cent tolerance.")
+	}
+	if ac["Expenses:Rounding"] != -100 {
+		t.Errorf("Incorrect balance for rounding account: %v", ac["Expenses:Rounding"])
+	}
+
+	if ok, _ := tr.BalanceWith(ledger.BalanceOptions{Tolerance: 99}); ok {
+		t.Errorf("Transaction balances with a residual larger than the tolerance.")
+	}
+
+	err = tr.CanonicalizeWith(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Postings) != 5 {
+		t.Fatalf("Incorrect number of postings: %v", len(tr.Postings))
+	}
+	p := tr.Postings[4]
+	if p.Account != "Expenses:Rounding" || p.Value != -100 || p.Note != ledger.RoundingNote {
+		t.Errorf("Incorrect rounding posting: %#v", p)
+	}
+
+	// Once the rounding posting is there, it balances normally.
+	if ok, _ := tr.Balance(); !ok {
+		t.Errorf("Transaction does not balance after adding a rounding posting.")
+	}
+}
+
+var TestCoalescePostingsInput = `
+2022/03/02 * Import
+    Expenses:Food       $3.00 ; Bread
+    Expenses:Food       $4.00 ; Milk
+        ; From the second line
+    Expenses:Food       €5.00
+    Expenses:Food       $1.00 = $100.00
+    * Expenses:Food     $2.00
+    Expenses:Food       $6.00
+    Assets:Checking
+`
+
+func TestCoalescePostings(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCoalescePostingsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.T[0]
+	tr.CoalescePostings()
+
+	// Only the plain dollar postings may be merged, the euro posting, asserted posting, cleared posting, and
+	// null posting all have to stay as they are.
+	if len(tr.Postings) != 5 {
+		t.Fatalf("Incorrect number of postings: %v", len(tr.Postings))
+	}
+	p := tr.Postings[0]
+	if p.Value != 130000 {
+		t.Errorf("Incorrect merged value: %v", p.Value)
+	}
+	if p.Note != "Bread; Milk" {
+		t.Errorf("Incorrect merged note: %v", p.Note)
+	}
+	if len(p.Comments) != 1 || p.Comments[0] != "From the second line" {
+		t.Errorf("Incorrect merged comments: %#v", p.Comments)
+	}
+
+	expected := []int64{130000, 50000, 10000, 20000}
+	for i, v := range expected {
+		if tr.Postings[i].Value != v {
+			t.Errorf("Incorrect posting %v value: %v", i, tr.Postings[i].Value)
+		}
+	}
+	if !tr.Postings[4].Null {
+		t.Errorf("Null posting was not preserved.")
+	}
+
+	if ok, _ := tr.Balance(); !ok {
+		t.Errorf("Coalesced transaction does not balance.")
+	}
+}
+
+var TestCoalesceMetadataInput = `
+2022/03/03 * Import
+    Expenses:Food       $3.00
+        ; FITID: 1001
+        ; Project: Kitchen
+    Expenses:Food       $4.00
+        ; Project: Kitchen
+        ; Receipt: 42
+        ; Two bags
+    Expenses:Food       $5.00
+        ; Project: Garage
+    Assets:Checking
+`
+
+func TestCoalesceMetadata(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCoalesceMetadataInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.T[0]
+	tr.CoalescePostings()
+
+	// The first two agree on the project, the third doesn't so it is left alone.
+	if len(tr.Postings) != 3 {
+		t.Fatalf("Incorrect number of postings: %v", len(tr.Postings))
+	}
+	p := tr.Postings[0]
+	if p.Value != 70000 || !reflect.DeepEqual(p.Comments, []string{"FITID: 1001", "Project: Kitchen", "Receipt: 42", "Two bags"}) {
+		t.Errorf("Incorrect merged posting: %v %#v", p.Value, p.Comments)
+	}
+	p = tr.Postings[1]
+	if p.Value != 50000 || !reflect.DeepEqual(p.OrderedKV(), []ledger.KV{{Key: "Project", Value: "Garage"}}) {
+		t.Errorf("Incorrect conflicting posting: %v %#v", p.Value, p.Comments)
+	}
+}
+
+var TestWrapCommentsInput = `
+2022/03/02 * Hardware Store
+    ; This comment is far too long to fit in a narrow editor window, so it should be wrapped. Note: this bit must not become a KV.
+    ; Receipt: A very long value that must be left exactly as it is no matter how long it gets.
+    ; :home:repair:
+    Expenses:Home       $42.00
+        ; Paid for the hinges and a whole bunch of :screws: which were on sale this week only.
+    Assets:Checking
+`
+
+func TestWrapComments(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestWrapCommentsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.T[0]
+
+	out := tr.StringWith(ledger.WriteOptions{WrapComments: 40})
+	for _, line := range strings.Split(out, "\n") {
+		// KV values can't be wrapped, so they are left as long as they are.
+		if !strings.Contains(line, ";") || strings.Contains(line, "Receipt:") {
+			continue
+		}
+		if n := utf8.RuneCountInString(strings.Replace(line, "\t", "        ", -1)); n > 40 {
+			t.Errorf("Line is too long (%v): %q", n, line)
+		}
+	}
+
+	f2, err := parse.ParseLedgerString(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2 := f2.T[0]
+
+	if len(tr2.Comments) < 2 || strings.Join(tr2.Comments, " ") != strings.Join(tr.Comments, " ") {
+		t.Errorf("Comments changed:\n%q\n%q", tr2.Comments, tr.Comments)
+	}
+	if !reflect.DeepEqual(tr2.KVPairs, tr.KVPairs) || !reflect.DeepEqual(tr2.Tags, tr.Tags) {
+		t.Errorf("Metadata changed:\n%v %v\n%v %v", tr2.KVPairs, tr2.Tags, tr.KVPairs, tr.Tags)
+	}
+	p, p2 := tr.Postings[0], tr2.Postings[0]
+	if len(p2.Comments) < 2 || strings.Join(p2.Comments, " ") != strings.Join(p.Comments, " ") {
+		t.Errorf("Posting comments changed:\n%q\n%q", p2.Comments, p.Comments)
+	}
+
+	// Off by default.
+	if tr.String() != tr.StringWith(ledger.WriteOptions{}) || strings.Count(tr.String(), ";") != 4 {
+		t.Errorf("Comments wrapped by default:\n%v", tr.String())
+	}
+}
+
+func TestAmountColumn(t *testing.T) {
+	tr := ledger.Transaction{
+		Date:        time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Description: "Column Test",
+		Postings: []ledger.Posting{
+			{Account: "Expenses:Food", Value: 200000},
+			{Account: "Expenses:Café", Value: 1234567, Commodity: "€", Style: ledger.AmountStyle{Suffix: true, Spaced: true, Precision: 4}},
+			{Status: ledger.StatusClear, Account: "Expenses:Food", Value: 10000},
+			{Account: "Expenses:An Account Name That Is Far Too Long To Fit Before The Column", Value: 10000},
+			{Account: "Assets:Cash", Null: true, HasAssert: true, Assert: 50000},
+		},
+	}
+
+	out := tr.StringWith(ledger.WriteOptions{AmountColumn: 40})
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")[1:]
+	expected := []string{"$20.00", "123.4567 €", "$1.00", "", "= $5.00"}
+	for i, line := range lines {
+		line = strings.Replace(line, "\t", "        ", -1)
+		if i == 3 {
+			if !strings.HasSuffix(line, "Column  $1.00") {
+				t.Errorf("Incorrect overflow line: %q", line)
+			}
+			continue
+		}
+
+		rs := []rune(line)
+		if len(rs) < 40 || string(rs[40:]) != expected[i] || rs[39] != ' ' || rs[38] != ' ' {
+			t.Errorf("Incorrect line %v: %q", i, line)
+		}
+	}
+
+	f, err := parse.ParseLedgerString(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range f.T[0].Postings {
+		p2 := tr.Postings[i]
+		if p.Account != p2.Account || p.Value != p2.Value || p.Amount().String() != p2.Amount().String() || p.Assert != p2.Assert {
+			t.Errorf("Posting %v changed in round trip: %#v", i, p)
+		}
+	}
+}
+
+var TestSortTransactionsInput = `
+2022/10/02 * Dinner
+	; time: 19:30
+	; ID: a
+    Expenses:Food       $30.00
+    Assets:Cash
+
+2022/10/02 * Lunch
+	; time: 12:15
+	; ID: b
+    Expenses:Food       $12.00
+    Assets:Cash
+
+2022/10/02 * Breakfast
+	; time: 7:05:30
+	; ID: z
+    Expenses:Food       $6.00
+    Assets:Cash
+
+2022/10/02 * Some time
+	; ID: y
+    Expenses:Food       $1.00
+    Assets:Cash
+
+2022/10/02 * Second Lunch
+	; time: 12:15
+	; ID: a
+    Expenses:Food       $2.00
+    Assets:Cash
+
+2022/10/01 * Yesterday
+	; time: 23:00
+    Expenses:Food       $3.00
+    Assets:Cash
+`
+
+func TestSortTransactions(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestSortTransactionsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger.SortTransactions(f.T)
+	order := []string{"Yesterday", "Some time", "Breakfast", "Second Lunch", "Lunch", "Dinner"}
+	for i, tr := range f.T {
+		if tr.Description != order[i] {
+			t.Errorf("Incorrect transaction %v: %v", i, tr.Description)
+		}
+	}
+
+	// The time does not change the date.
+	if f.T[5].Date != time.Date(2022, 10, 2, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("Date was changed: %v", f.T[5].Date)
+	}
+	if tod, ok := f.T[2].TimeOfDay(); !ok || tod != 7*time.Hour+5*time.Minute+30*time.Second {
+		t.Errorf("Incorrect time of day: %v", tod)
+	}
+
+	// A custom order, by description alone. Ties keep their order.
+	ledger.SortTransactionsFunc(f.T, func(a, b *ledger.Transaction) int {
+		return strings.Compare(a.Description[:1], b.Description[:1])
+	})
+	order = []string{"Breakfast", "Dinner", "Lunch", "Some time", "Second Lunch", "Yesterday"}
+	for i, tr := range f.T {
+		if tr.Description != order[i] {
+			t.Errorf("Incorrect transaction %v: %v", i, tr.Description)
+		}
+	}
+}
+
+var TestSplitByCommodityInput = `
+2022/11/01 * Trip
+    Expenses:Travel     €100.00
+    Expenses:Food       $20.00
+    Assets:Cash         $-5.00
+    Liabilities:Card
+
+2022/11/02 * Simple
+    Expenses:Food       $20.00
+    Liabilities:Card
+`
+
+func TestSplitByCommodity(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestSplitByCommodityInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := f.T[0].CleanCopy()
+	err = tr.SplitByCommodity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Postings) != 5 {
+		t.Fatalf("Incorrect postings: %#v", tr.Postings)
+	}
+	for i, e := range []ledger.Amount{{Value: -1000000, Commodity: "€"}, {Value: -150000, Commodity: "$"}} {
+		p := tr.Postings[3+i]
+		if p.Null || p.Account != "Liabilities:Card" || p.Value != e.Value || p.Commodity != e.Commodity {
+			t.Errorf("Incorrect split posting %v: %#v", i, p)
+		}
+	}
+	if ok, _ := tr.Balance(); !ok {
+		t.Errorf("Split transaction does not balance.")
+	}
+
+	// Liabilities:Card is in two commodities, so there is no single balance for it.
+	if ok, accounts := tr.Balance(); !ok || accounts != nil {
+		t.Errorf("Incorrect balances for a mixed account: %v", accounts)
+	}
+	if ok, accounts := f.T[1].Balance(); !ok || accounts["Liabilities:Card"] != -200000 {
+		t.Errorf("Incorrect balances: %v", accounts)
+	}
+	if _, err := ledger.SumTransactions(f.T); err == nil {
+		t.Error("No error summing a mixed account.")
+	} else if merr, ok := err.(ledger.MixedAccountError); !ok || merr.Account != "Liabilities:Card" || merr.T != 0 {
+		t.Errorf("Incorrect error: %v", err)
+	}
+	if sums, err := ledger.SumTransactions(f.T[1:]); err != nil || sums["Expenses:Food"] != 200000 {
+		t.Errorf("Incorrect sums: %v %v", sums, err)
+	}
+
+	// The same for a single posting.
+	tr = f.T[0].CleanCopy()
+	if ps := tr.Postings[3].SplitByCommodity(tr); len(ps) != 2 || ps[0].Value != -1000000 || ps[1].Value != -150000 {
+		t.Errorf("Incorrect postings for null posting: %#v", ps)
+	}
+	if ps := tr.Postings[0].SplitByCommodity(tr); len(ps) != 1 || ps[0].Value != 1000000 {
+		t.Errorf("Incorrect postings for posting with an amount: %#v", ps)
+	}
+
+	// A single commodity null posting is fine as it is.
+	tr = f.T[1].CleanCopy()
+	if err := tr.SplitByCommodity(); err != nil || len(tr.Postings) != 2 || !tr.Postings[1].Null {
+		t.Errorf("Simple transaction was changed: %v %#v", err, tr.Postings)
+	}
+
+	// An assertion can't be in two commodities.
+	tr = f.T[0].CleanCopy()
+	tr.Postings[3].HasAssert = true
+	tr.Postings[3].Commodity = "$"
+	err = tr.SplitByCommodity()
+	if merr, ok := err.(ledger.MixedCommodityError); !ok || merr.P != 3 || len(tr.Postings) != 4 {
+		t.Errorf("Incorrect error for mixed assertion: %v", err)
+	}
+}
+
+var TestStatusInput = `
+2022/12/01 * (101) Cleared
+    * Expenses:Food     $1.00
+    ! Expenses:Tea      $2.00
+    Assets:Cash
+
+2022/12/02=2022/12/04 ! (102) Pending
+    Expenses:Food       $1.00
+    * Assets:Cash
+
+2022/12/03 Uncleared
+    ! Expenses:Food     $1.00
+    Assets:Cash
+`
+
+func TestStatusRoundTrip(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestStatusInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		status   string
+		first    string
+		postings []string
+	}{
+		{"*", "2022/12/01 * (101) Cleared\n", []string{"*", "!", ""}},
+		{"!", "2022/12/02=2022/12/04 ! (102) Pending\n", []string{"", "*"}},
+		{"", "2022/12/03   Uncleared\n", []string{"!", ""}},
+	}
+	statuses := map[string]interface{}{"*": ledger.StatusClear, "!": ledger.StatusPending, "": ledger.StatusUndefined}
+
+	for i, e := range expected {
+		tr := f.T[i]
+		if tr.Status != statuses[e.status] {
+			t.Errorf("Transaction %v: incorrect status: %v", i, tr.Status)
+		}
+		out := tr.String()
+		if !strings.HasPrefix(out, e.first) {
+			t.Errorf("Transaction %v: incorrect first line: %q", i, out)
+		}
+
+		lines := strings.Split(out, "\n")[1:]
+		for j, s := range e.postings {
+			p := tr.Postings[j]
+			if p.Status != statuses[s] {
+				t.Errorf("Transaction %v posting %v: incorrect status: %v", i, j, p.Status)
+			}
+			if s != "" && !strings.HasPrefix(lines[j], "\t"+s+" "+p.Account) {
+				t.Errorf("Transaction %v posting %v: incorrect output: %q", i, j, lines[j])
+			}
+			if s == "" && !strings.HasPrefix(lines[j], "\t"+p.Account) {
+				t.Errorf("Transaction %v posting %v: incorrect output: %q", i, j, lines[j])
+			}
+		}
+
+		f2, err := parse.ParseLedgerString(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f2.T[0].String() != out {
+			t.Errorf("Transaction %v changed in round trip:\n%v", i, f2.T[0].String())
+		}
+	}
+}
+
+var TestRenamePayeeInput = `
+2022/10/01 * Acme Corp
+    Expenses:Tools  $5.00
+    Assets:Cash
+
+2022/10/02 * Acme Corp Store #12
+    Expenses:Tools  $5.00
+    Assets:Cash
+
+2022/10/03 * AMZN Mktp US*2K4
+    Expenses:Books  $5.00
+    Assets:Cash
+`
+
+func TestRenamePayee(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRenamePayeeInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Literal mode only matches whole descriptions.
+	n, err := ledger.RenamePayeeWith(f.T, "Acme Corp", "Acme Inc", false, ledger.RenameOptions{OriginalKV: "Payee"})
+	if err != nil || n != 1 {
+		t.Fatalf("Incorrect result: %v %v", n, err)
+	}
+	if f.T[0].Description != "Acme Inc" || f.T[0].KVPairs["Payee"] != "Acme Corp" || f.T[1].Description != "Acme Corp Store #12" {
+		t.Errorf("Incorrect descriptions: %q %q %q", f.T[0].Description, f.T[0].KVPairs["Payee"], f.T[1].Description)
+	}
+
+	// Regexp mode, with capture groups. The original KV is left alone.
+	n, err = ledger.RenamePayeeWith(f.T, `^Acme (Corp|Inc)( Store #(\d+))?$`, "Acme Inc$2", true, ledger.RenameOptions{OriginalKV: "Payee"})
+	if err != nil || n != 1 {
+		t.Fatalf("Incorrect result: %v %v", n, err)
+	}
+	if f.T[0].KVPairs["Payee"] != "Acme Corp" || f.T[1].Description != "Acme Inc Store #12" || f.T[1].KVPairs["Payee"] != "Acme Corp Store #12" {
+		t.Errorf("Incorrect descriptions: %q %q %q", f.T[0].KVPairs["Payee"], f.T[1].Description, f.T[1].KVPairs["Payee"])
+	}
+
+	n, err = ledger.RenamePayee(f.T, `^AMZN Mktp (\w+).*$`, "Amazon ($1)", true)
+	if err != nil || n != 1 || f.T[2].Description != "Amazon (US)" || len(f.T[2].KVPairs) != 0 {
+		t.Errorf("Incorrect result: %v %v %q", n, err, f.T[2].Description)
+	}
+
+	if _, err := ledger.RenamePayee(f.T, `(`, "", true); err == nil {
+		t.Error("Expected an error for an invalid regexp.")
+	}
+}
+
+var TestCommodityTotalsInput = `
+2023/03/01 * Exchange
+    Assets:Euro         €100.00 @ $1.10
+    (Budget:Travel)     $500.00
+    Assets:Checking     $-110.00
+
+2023/03/02 * Typo
+    Expenses:Food       $20.00
+    Assets:Cash         $-2.00
+`
+
+func TestCommodityTotals(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCommodityTotalsInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Balanced, with the cost counted and the virtual posting left out.
+	totals := f.T[0].CommodityTotals()
+	if len(totals) != 1 || totals["$"].Value != 0 {
+		t.Errorf("Incorrect totals: %v", totals)
+	}
+
+	// Balance agrees, the null posting doesn't pick up the virtual posting either.
+	if ok, _ := f.T[0].Balance(); !ok {
+		t.Error("Transaction with a virtual posting does not balance.")
+	}
+	tr := f.T[0].CleanCopy()
+	tr.Postings[2].Null = true
+	if err := tr.Canonicalize(); err != nil || len(tr.Postings) != 3 || tr.Postings[2].Value != -1100000 {
+		t.Errorf("Incorrect null posting: %v %v", tr.Postings, err)
+	}
+
+	// Without costs the commodities are separate.
+	totals = f.T[0].UnitTotals()
+	if len(totals) != 2 || totals["€"].Value != 1000000 || totals["$"].Value != -1100000 {
+		t.Errorf("Incorrect unit totals: %v", totals)
+	}
+
+	// Unbalanced.
+	totals = f.T[1].CommodityTotals()
+	if a := totals["$"]; len(totals) != 1 || a.Value != 180000 || a.String() != "$18.00" {
+		t.Errorf("Incorrect totals: %v", totals)
+	}
+}
+
+var TestDeannotateInput = `
+2023/05/01 * Exchange
+    Assets:Euro         €100.00 @ $1.10
+    Assets:Checking     $-110.00
+
+2023/05/02 * Shares
+    Assets:Broker       10 AAPL @@ $1,850.00
+    Assets:Checking                = $-1,960.00
+
+2023/05/03 * Unbalanced
+    Expenses:Food       €5.00 @ $1.10
+    Assets:Checking     $-6.00
+`
+
+func TestDeannotate(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestDeannotateInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range f.T {
+		tr := &f.T[i]
+		before, _ := tr.Balance()
+		plain := tr.Deannotate()
+		if after, _ := plain.Balance(); after != before {
+			t.Errorf("Transaction %v: balanced %v before and %v after", i, before, after)
+		}
+
+		s := plain.String()
+		if strings.ContainsAny(s, "@=") {
+			t.Errorf("Transaction %v still has annotations:\n%v", i, s)
+		}
+		if len(plain.Postings) != len(tr.Postings)+2 || plain.Postings[0].Value != tr.Postings[0].Value {
+			t.Errorf("Transaction %v has incorrect postings:\n%v", i, s)
+		}
+		if !tr.Postings[0].HasCost {
+			t.Errorf("Transaction %v was changed.", i)
+		}
+	}
+
+	plain := f.T[1].Deannotate()
+	expected := []ledger.Amount{{Value: -100000, Commodity: "AAPL"}, {Value: 18500000, Commodity: "$"}}
+	for i, e := range expected {
+		p := plain.Postings[2+i]
+		if p.Account != ledger.ConversionAccount || !p.Amount().Equal(e) || !p.Generated {
+			t.Errorf("Incorrect conversion posting %v: %#v", i, p)
+		}
+	}
+}
+
+var TestExchangeRateInput = `
+2023/09/01 * Rates
+    Assets:Euro         €100.00 @ $1.10
+    Assets:Broker       10 AAPL @@ $1,850.00
+    Assets:Broker       -3 AAPL @@ $100.00
+    Assets:Checking     $-1,920.00
+    Assets:Cash         $0.00 @@ €1.00
+    Assets:Broker       0 AAPL @ $150.00
+`
+
+func TestExchangeRate(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestExchangeRateInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"$1.10", "$185.00", "$33.3333", "", "", ""}
+	for i, e := range expected {
+		rate, ok := f.T[0].Postings[i].ExchangeRate()
+		if ok != (e != "") || ok && rate.String() != e {
+			t.Errorf("Incorrect rate for posting %v: %v %v", i, rate, ok)
+		}
+	}
+}
+
+type testCategory struct {
+	Name string
+}
+
+func (c *testCategory) String() string {
+	return "; category: " + c.Name
+}
+
+func TestMeta(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestRoundingInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &f.T[0]
+	if tr.Meta != nil {
+		t.Errorf("Meta set by the parser: %v", tr.Meta)
+	}
+	before := tr.String()
+	jbefore, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat := &testCategory{"Food"}
+	tr.Meta = cat
+	if s := tr.String(); s != before {
+		t.Errorf("Meta changed the output:\n%v\nexpected:\n%v", s, before)
+	}
+	jafter, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(jafter) != string(jbefore) {
+		t.Errorf("Meta changed the JSON:\n%s", jafter)
+	}
+
+	// Copies share the same value.
+	if tr.CleanCopy().Meta != cat {
+		t.Error("Meta not copied.")
+	}
+}
+
+var TestPostingKVInput = `2023/01/05 * Transfer
+    Assets:Checking    $-50.00
+    ; FITID: 2023010501
+    ; Project: Kitchen
+    ; Note: see: receipt
+    ; just a comment
+    ; :tagged:
+    ; Project: Bathroom
+    ; date: [2023/01/07]
+    Assets:Savings
+`
+
+func TestPostingOrderedKV(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestPostingKVInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ledger.KV{
+		{"FITID", "2023010501"},
+		{"Project", "Kitchen"},
+		{"Note", "see: receipt"},
+		{"Project", "Bathroom"},
+		{"date", "[2023/01/07]"},
+	}
+	kvs := f.T[0].Postings[0].OrderedKV()
+	if !reflect.DeepEqual(kvs, expected) {
+		t.Errorf("Incorrect KV pairs: %v", kvs)
+	}
+	if len(f.T[0].Postings[1].OrderedKV()) != 0 {
+		t.Errorf("Incorrect KV pairs on the second posting: %v", f.T[0].Postings[1].OrderedKV())
+	}
+
+	// The order survives a round trip.
+	out, err := parse.ParseLedgerString(f.T[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kvs := out.T[0].Postings[0].OrderedKV(); !reflect.DeepEqual(kvs, expected) {
+		t.Errorf("Incorrect KV pairs after a round trip: %v", kvs)
+	}
+}
+
+var TestDuplicateKVInput = `2023/02/01 * Contractor
+    ; Project: Kitchen
+    ; ID: c1
+    ; Project: Bathroom
+    ; Project: Garage
+    Expenses:Repairs    $300.00
+    Assets:Checking
+`
+
+func TestDuplicateKV(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestDuplicateKVInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &f.T[0]
+	if tr.KVPairs["Project"] != "Garage" {
+		t.Errorf("Incorrect value: %v", tr.KVPairs["Project"])
+	}
+	expected := []string{"Kitchen", "Bathroom", "Garage"}
+	if all := tr.GetAll("Project"); !reflect.DeepEqual(all, expected) {
+		t.Errorf("Incorrect values: %v", all)
+	}
+	if all := tr.GetAll("ID"); !reflect.DeepEqual(all, []string{"c1"}) {
+		t.Errorf("Incorrect values for ID: %v", all)
+	}
+	if tr.GetAll("Missing") != nil {
+		t.Errorf("Incorrect values for a missing key: %v", tr.GetAll("Missing"))
+	}
+
+	// Every value survives a round trip, in order.
+	s := tr.String()
+	if !strings.Contains(s, "; Project: Kitchen\n\t; Project: Bathroom\n\t; Project: Garage\n") {
+		t.Errorf("Incorrect output:\n%v", s)
+	}
+	out, err := parse.ParseLedgerString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := out.T[0].GetAll("Project"); !reflect.DeepEqual(all, expected) {
+		t.Errorf("Incorrect values after a round trip: %v", all)
+	}
+
+	// Setting the key replaces every old value.
+	tr.SetKV("Project", "Attic")
+	if all := tr.GetAll("Project"); !reflect.DeepEqual(all, []string{"Attic"}) {
+		t.Errorf("Incorrect values after SetKV: %v", all)
+	}
+	if s := tr.String(); strings.Contains(s, "Kitchen") || !strings.Contains(s, "; Project: Attic\n") {
+		t.Errorf("Incorrect output after SetKV:\n%v", s)
+	}
+
+	// Once the key is gone, so are the old values.
+	delete(tr.KVPairs, "Project")
+	if strings.Contains(tr.String(), "Project") {
+		t.Errorf("Duplicate written without the key:\n%v", tr.String())
+	}
+}
+
+var TestImpliedCostInput = `
+2023/06/01 * Buy shares
+    Assets:Broker       10 AAPL @ $150.00
+    Assets:Checking     $-1,500.00
+
+2023/06/02 * Buy shares
+    Assets:Broker       10 AAPL @ $150.00
+    Assets:Checking
+
+2023/06/03 * Buy shares
+    Assets:Broker       2.5 AAPL @@ $400.00
+    Assets:Checking
+
+2023/06/04 * Buy shares
+    Assets:Broker       10 AAPL @ $150.00
+    Assets:Checking     $-1,400.00
+`
+
+func TestImpliedCost(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestImpliedCostInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fully specified.
+	ok, accounts := f.T[0].Balance()
+	if !ok || accounts["Assets:Broker"] != 100000 || accounts["Assets:Checking"] != -15000000 {
+		t.Errorf("Incorrect balance: %v %v", ok, accounts)
+	}
+
+	// With the cash side left out, it is filled in from the cost, in the style of the cost.
+	cases := []struct {
+		value    int64
+		expected string
+	}{
+		{-15000000, "$-1500.00"},
+		{-4000000, "$-400.00"},
+	}
+	for i, c := range cases {
+		tr := f.T[i+1].CleanCopy()
+		ok, accounts = tr.Balance()
+		if !ok || accounts["Assets:Checking"] != c.value {
+			t.Errorf("Incorrect balance for transaction %v: %v %v", i+1, ok, accounts)
+		}
+
+		err := tr.Canonicalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := tr.Postings[1]
+		if p.Commodity != "$" || p.Amount().String() != c.expected {
+			t.Errorf("Incorrect posting for transaction %v: %+v", i+1, p)
+		}
+	}
+
+	// And a cash side that doesn't match the cost doesn't balance.
+	if ok, _ := f.T[3].Balance(); ok {
+		t.Error("Transaction with the wrong cash amount balances.")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected time.Time
+		ok       bool
+	}{
+		{"2023/01/02", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{"2023-01-02", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{"2023.01-02", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{"  2023/12/31  ", time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC), true},
+		{"2023/01/02 14:30", time.Date(2023, 1, 2, 14, 30, 0, 0, time.UTC), true},
+		{"2023/01/02\t09:15:20", time.Date(2023, 1, 2, 9, 15, 20, 0, time.UTC), true},
+		{"03/04", time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), true},
+		{"03/04 08:00", time.Date(2021, 3, 4, 8, 0, 0, 0, time.UTC), true},
+		{"2023/1/02", time.Time{}, false},
+		{"23/01/02", time.Time{}, false},
+		{"2023/01/02/03", time.Time{}, false},
+		{"2023/02/30", time.Time{}, false},
+		{"2023/01/02 noon", time.Time{}, false},
+		{"2023/0a/02", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, c := range cases {
+		d, err := ledger.ParseDateIn(c.in, 2021)
+		if (err == nil) != c.ok || !d.Equal(c.expected) {
+			t.Errorf("Incorrect result for %q: %v %v", c.in, d, err)
+		}
+
+		// The parser must agree. Some of the bad dates read as a good date followed by the description there, so
+		// only the good ones are checked.
+		if !c.ok {
+			continue
+		}
+		f, err := parse.ParseLedgerString("Y 2021\n" + strings.TrimSpace(c.in) + " * Payee\n    Expenses:Food    $5.00\n    Assets:Cash\n")
+		if err != nil || !f.T[0].Date.Equal(c.expected) {
+			t.Errorf("Parser disagrees for %q: %v", c.in, err)
+		}
+	}
+
+	// Short dates need a year.
+	if _, err := ledger.ParseDateIn("03/04", 0); err != ledger.ErrBadDate {
+		t.Errorf("Incorrect error for a short date without a year: %v", err)
+	}
+	if d, err := ledger.ParseDate("03/04"); err != nil || d.Year() != time.Now().Year() {
+		t.Errorf("Incorrect short date: %v %v", d, err)
+	}
+}
+
+var TestCommentIndentInput = "2023/07/01 * Hardware\n" +
+	"  ; Barely indented\n" +
+	"\t\t; Deeply indented\n" +
+	"    Expenses:Tools    $20.00\n" +
+	"\t; Tabbed under the posting\n" +
+	"      ; Spaced under the posting\n" +
+	"    Assets:Cash\n" +
+	"    ; Level with the posting\n"
+
+func TestPreserveCommentIndent(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestCommentIndentInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &f.T[0]
+
+	// By default everything is tidied up.
+	normal := "2023/07/01 * Hardware\n" +
+		"    ; Barely indented\n" +
+		"    ; Deeply indented\n" +
+		"    Expenses:Tools    $20.00\n" +
+		"        ; Tabbed under the posting\n" +
+		"        ; Spaced under the posting\n" +
+		"    Assets:Cash\n" +
+		"        ; Level with the posting\n"
+	opts := ledger.WriteOptions{IndentStyle: 4, AmountColumn: 22}
+	if s := tr.StringWith(opts); s != normal {
+		t.Errorf("Incorrect output:\n%v", s)
+	}
+
+	opts.PreserveCommentIndent = true
+	if s := tr.StringWith(opts); s != TestCommentIndentInput {
+		t.Errorf("Incorrect preserved output:\n%v", s)
+	}
+
+	// With a tab for the posting indent, six spaces would put a comment on the transaction.
+	opts.IndentStyle = 0
+	s := tr.StringWith(opts)
+	if !strings.Contains(s, "\n\t; Tabbed under the posting\n\t    ; Spaced under the posting\n") ||
+		!strings.Contains(s, "\n\t\t; Deeply indented\n") || !strings.HasSuffix(s, "\tAssets:Cash\n\t    ; Level with the posting\n") {
+		t.Errorf("Incorrect preserved output with tabs:\n%v", s)
+	}
+
+	// Changing the comments without the indents goes back to the usual indent.
+	tr.Postings[0].Comments = append(tr.Postings[0].Comments, "New")
+	if s := tr.StringWith(opts); !strings.Contains(s, "\t    ; Tabbed under the posting\n") {
+		t.Errorf("Incorrect output after a change:\n%v", s)
+	}
+}
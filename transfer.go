@@ -0,0 +1,134 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger
+
+import (
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// MergeTransfers finds pairs of transactions that are really the two sides of a single transfer (as happens when
+// importing the statements of both accounts involved) and merges each pair into one transaction. The result is a
+// new list, trs is not modified.
+//
+// Only simple transactions are considered: two postings, one of which is null (so exactly what the import tools
+// produce). Two such transactions are a pair if their non-null postings are to different accounts, in the same
+// commodity, with opposite values, and their dates are no more than window apart. Matching is conservative, a
+// transaction with more than one possible partner is left alone, as is every transaction that is not part of a pair.
+//
+// The merged transaction takes the place of the earlier of the pair (the first in trs if the dates are the same)
+// and keeps its date, description, and metadata. The postings are the two non-null postings, with the positive one
+// first. Comments and tags from the later transaction are added, and its ID (if any) is kept as "TransferID".
+func MergeTransfers(trs []Transaction, window time.Duration) []Transaction {
+	// The index of the non-null posting of each candidate, or -1.
+	sides := make([]int, len(trs))
+	for i := range trs {
+		sides[i] = transferSide(&trs[i])
+	}
+
+	pairs := func(i, j int) bool {
+		if i == j || sides[i] == -1 || sides[j] == -1 {
+			return false
+		}
+		a, b := &trs[i].Postings[sides[i]], &trs[j].Postings[sides[j]]
+		if a.Account == b.Account || commodityName(a.Commodity) != commodityName(b.Commodity) ||
+			a.Value != -b.Value || a.Value == 0 {
+			return false
+		}
+		d := trs[i].Date.Sub(trs[j].Date)
+		return d <= window && -d <= window
+	}
+	partner := func(i int) int {
+		found := -1
+		for j := range trs {
+			if pairs(i, j) {
+				if found != -1 {
+					return -1
+				}
+				found = j
+			}
+		}
+		return found
+	}
+
+	merged := map[int]int{} // The earlier transaction of each pair to the later.
+	dropped := map[int]bool{}
+	for i := range trs {
+		j := partner(i)
+		if j == -1 || partner(j) != i {
+			continue
+		}
+		if trs[j].Date.Before(trs[i].Date) || (trs[j].Date.Equal(trs[i].Date) && j < i) {
+			continue // Handled from the other side.
+		}
+		merged[i] = j
+		dropped[j] = true
+	}
+
+	out := make([]Transaction, 0, len(trs)-len(dropped))
+	for i := range trs {
+		if dropped[i] {
+			continue
+		}
+		j, ok := merged[i]
+		if !ok {
+			out = append(out, trs[i])
+			continue
+		}
+
+		tr := *trs[i].CleanCopy()
+		a, b := trs[i].Postings[sides[i]], trs[j].Postings[sides[j]]
+		if a.Value < 0 {
+			a, b = b, a
+		}
+		a.Comments, b.Comments = slices.Clone(a.Comments), slices.Clone(b.Comments)
+		tr.Postings = []Posting{a, b}
+
+		tr.Comments = append(tr.Comments, trs[j].Comments...)
+		if tr.Tags == nil {
+			tr.Tags = map[string]bool{}
+		}
+		maps.Copy(tr.Tags, trs[j].Tags)
+		if id, ok := trs[j].KVPairs["ID"]; ok {
+			tr.SetKV("TransferID", id)
+		}
+		tr.Start, tr.End = 0, 0
+		out = append(out, tr)
+	}
+	return out
+}
+
+// transferSide returns the index of the non-null posting if the transaction is a candidate for MergeTransfers,
+// or -1 if it is not.
+func transferSide(t *Transaction) int {
+	if len(t.Postings) != 2 || t.Postings[0].Null == t.Postings[1].Null {
+		return -1
+	}
+	if t.Postings[0].Null {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+
+package ledger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/milochristiansen/ledger"
+	"github.com/milochristiansen/ledger/parse"
+)
+
+var TestMergeTransfersInput = `
+2022/08/01 * Transfer to savings
+	; ID: a
+    Assets:Checking     $-100.00
+    Unknown:Account
+
+2022/08/01 * Groceries
+	; ID: b
+    Assets:Checking     $-100.00
+    Unknown:Account
+
+2022/08/03 * Transfer from checking
+	; ID: c
+	; :transfer:
+    Assets:Savings      $100.00
+    Unknown:Account
+
+2022/08/04 * Refund
+	; ID: d
+    Assets:Card         $50.00
+    Unknown:Account
+
+2022/08/04 * Payment
+	; ID: e
+    Assets:Checking     $-50.00
+    Unknown:Account
+
+2022/08/04 * Other Payment
+	; ID: f
+    Assets:Savings      $-50.00
+    Unknown:Account
+
+2022/08/20 * Late
+	; ID: g
+    Assets:Savings      $-20.00
+    Unknown:Account
+
+2022/08/01 * Early
+	; ID: h
+    Assets:Checking     $20.00
+    Unknown:Account
+`
+
+func TestMergeTransfers(t *testing.T) {
+	f, err := parse.ParseLedgerString(TestMergeTransfersInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a and b both match c, so nothing may be merged.
+	out := ledger.MergeTransfers(f.T, 72*time.Hour)
+	if len(out) != len(f.T) {
+		t.Fatalf("Ambiguous transfers were merged: %v", len(out))
+	}
+
+	// Once b is a different amount a and c are a pair. d matches both e and f, and g and h are too far apart.
+	f.T[1].Postings[0].Value = -200000
+	out = ledger.MergeTransfers(f.T, 72*time.Hour)
+	if len(out) != len(f.T)-1 {
+		t.Fatalf("Incorrect transaction count: %v", len(out))
+	}
+
+	tr := out[0]
+	if tr.KVPairs["ID"] != "a" || tr.KVPairs["TransferID"] != "c" || !tr.Tags["transfer"] {
+		t.Errorf("Incorrect merged metadata: %v %v", tr.KVPairs, tr.Tags)
+	}
+	if len(tr.Postings) != 2 || tr.Postings[0].Account != "Assets:Savings" || tr.Postings[0].Value != 1000000 ||
+		tr.Postings[1].Account != "Assets:Checking" || tr.Postings[1].Value != -1000000 {
+		t.Errorf("Incorrect merged postings: %#v", tr.Postings)
+	}
+	if ok, _ := tr.Balance(); !ok {
+		t.Errorf("Merged transaction does not balance.")
+	}
+	for i, id := range []string{"a", "b", "d", "e", "f", "g", "h"} {
+		if out[i].KVPairs["ID"] != id {
+			t.Errorf("Incorrect transaction %v: %v", i, out[i].KVPairs["ID"])
+		}
+	}
+
+	// The input is left alone.
+	if len(f.T[0].Postings) != 2 || !f.T[0].Postings[1].Null || f.T[0].KVPairs["TransferID"] != "" {
+		t.Errorf("Input was modified: %#v", f.T[0])
+	}
+
+	// A wider window catches g and h, the later of the two in the file goes first since it has the earlier date.
+	out = ledger.MergeTransfers(f.T, 20*24*time.Hour)
+	if len(out) != len(f.T)-2 || out[len(out)-1].KVPairs["ID"] != "h" || out[len(out)-1].KVPairs["TransferID"] != "g" {
+		t.Errorf("Incorrect merge with wide window: %v", len(out))
+	}
+}